@@ -0,0 +1,252 @@
+package acl
+
+import (
+	"bufio"
+	"errors"
+	"go-redis/config"
+	"go-redis/lib/logger"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	访问控制
+	--每个连接以某个用户的身份执行命令，新连接的用户为 default，default 用户 nopass 时无需认证
+	--用户的命令权限由 +cmd -cmd +@category -@category 规则决定，key 必须匹配某个 ~pattern
+	--&pattern 限制可以访问的频道，目前还没有 pub/sub 命令，由将来的 pub/sub 命令调用 CheckChannel
+	--集群内部的连接 (aof 加载、复制流、事务参与者) 不属于任何用户，不做检查
+	--配置了 aclfile 时启动时从文件加载用户，ACL LOAD/SAVE 重新加载和保存
+*/
+
+// DefaultUser 新连接使用的用户，不能被删除
+const DefaultUser = "default"
+
+var errNoAclFile = errors.New("This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration.")
+
+const (
+	logMaxLen     = 128
+	logMergeDelay = 60 * time.Second
+)
+
+var (
+	mu    sync.RWMutex
+	users = make(map[string]*User)
+
+	logMu     sync.Mutex
+	logs      []*LogEntry // 最新的在前
+	logNextID int64
+)
+
+// Setup 根据配置初始化用户，必须在处理连接之前调用
+func Setup() {
+	mu.Lock()
+	users = map[string]*User{DefaultUser: makeDefaultUser()}
+	mu.Unlock()
+	if config.Properties.AclFile == "" {
+		return
+	}
+	if config.Properties.RequirePass != "" {
+		logger.Warn("acl: requirepass is ignored when aclfile is configured")
+	}
+	if _, err := os.Stat(config.Properties.AclFile); os.IsNotExist(err) {
+		return
+	}
+	if err := Load(); err != nil {
+		logger.Fatal("acl: load " + config.Properties.AclFile + " failed: " + err.Error())
+	}
+}
+
+// makeDefaultUser default 用户拥有所有权限，配置了 requirepass 时需要密码
+func makeDefaultUser() *User {
+	u := makeUser(DefaultUser)
+	for _, rule := range []string{"on", "nopass", "~*", "&*", "+@all"} {
+		_ = u.applyRule(rule)
+	}
+	if config.Properties.RequirePass != "" && config.Properties.AclFile == "" {
+		_ = u.applyRule(">" + config.Properties.RequirePass)
+	}
+	return u
+}
+
+// GetUser 返回用户，不存在时返回 nil
+func GetUser(name string) *User {
+	mu.RLock()
+	defer mu.RUnlock()
+	return users[name]
+}
+
+// Users 按名称排序返回所有用户
+func Users() []*User {
+	mu.RLock()
+	defer mu.RUnlock()
+	result := make([]*User, 0, len(users))
+	for _, u := range users {
+		result = append(result, u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// SetUser 创建或修改用户，任意一条规则出错时不做任何修改
+func SetUser(name string, rules []string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	u, ok := users[name]
+	if ok {
+		u = u.clone()
+	} else {
+		u = makeUser(name)
+	}
+	for _, rule := range rules {
+		if err := u.applyRule(rule); err != nil {
+			return errors.New("Error in ACL SETUSER modifier '" + rule + "': " + err.Error())
+		}
+	}
+	users[name] = u
+	return nil
+}
+
+// DelUser 删除用户，返回删除的数量
+func DelUser(names []string) (int, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range names {
+		if name == DefaultUser {
+			return 0, errors.New("The 'default' user cannot be removed")
+		}
+	}
+	deleted := 0
+	for _, name := range names {
+		if _, ok := users[name]; ok {
+			delete(users, name)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// IsNoPass 用户是否存在、启用且不需要密码，default 用户满足时新连接无需认证
+func IsNoPass(name string) bool {
+	u := GetUser(name)
+	return u != nil && u.Enabled && u.NoPass
+}
+
+// Authenticate 检查用户名和密码，失败时记录到 ACL LOG
+func Authenticate(name string, password string, clientInfo string) bool {
+	u := GetUser(name)
+	if u != nil && u.Enabled && u.checkPassword(password) {
+		return true
+	}
+	addLog(reasonAuth, "AUTH", name, clientInfo)
+	return false
+}
+
+// Check 检查用户能否执行命令以及访问命令中的 key，name 为空表示集群内部的连接
+func Check(name string, args [][]byte, clientInfo string) error {
+	if name == "" || len(args) == 0 {
+		return nil
+	}
+	u := GetUser(name)
+	if u == nil || !u.Enabled {
+		return errors.New("NOPERM User " + name + " is disabled or no longer exists")
+	}
+	cmdName := toLower(args[0])
+	fullName := commandName(cmdName, args)
+	if !u.canRun(fullName) {
+		addLog(reasonCommand, fullName, name, clientInfo)
+		return errors.New("NOPERM User " + name + " has no permissions to run the '" + fullName + "' command")
+	}
+	spec, ok := commandSpecs[cmdName]
+	if !ok {
+		return nil
+	}
+	for _, key := range spec.keys(args) {
+		if !u.canAccessKey(string(key)) {
+			addLog(reasonKey, string(key), name, clientInfo)
+			return errors.New("NOPERM No permissions to access a key")
+		}
+	}
+	return nil
+}
+
+// CheckChannel 检查用户能否访问频道
+func CheckChannel(name string, channel string, clientInfo string) error {
+	if name == "" {
+		return nil
+	}
+	u := GetUser(name)
+	if u == nil || !u.Enabled || !u.canAccessChannel(channel) {
+		addLog(reasonChannel, channel, name, clientInfo)
+		return errors.New("NOPERM No permissions to access a channel")
+	}
+	return nil
+}
+
+// Load 从 aclfile 重新加载所有用户，文件有错误时保持原来的用户不变
+func Load() error {
+	filename := config.Properties.AclFile
+	if filename == "" {
+		return errNoAclFile
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	loaded := make(map[string]*User)
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 || fields[0] != "user" {
+			return errors.New(filename + ":" + strconv.Itoa(lineNum) + ": line should start with user keyword")
+		}
+		u := makeUser(fields[1])
+		for _, rule := range fields[2:] {
+			if err := u.applyRule(rule); err != nil {
+				return errors.New(filename + ":" + strconv.Itoa(lineNum) + ": " + rule + ": " + err.Error())
+			}
+		}
+		loaded[u.Name] = u
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if _, ok := loaded[DefaultUser]; !ok {
+		loaded[DefaultUser] = makeDefaultUser()
+	}
+
+	mu.Lock()
+	users = loaded
+	mu.Unlock()
+	return nil
+}
+
+// Save 将所有用户写入 aclfile，先写临时文件再替换
+func Save() error {
+	filename := config.Properties.AclFile
+	if filename == "" {
+		return errNoAclFile
+	}
+	var sb strings.Builder
+	for _, u := range Users() {
+		sb.WriteString(u.Describe())
+		sb.WriteString("\n")
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, []byte(sb.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,238 @@
+package acl
+
+import (
+	"go-redis/config"
+	"go-redis/lib/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// resetUsers 只保留 default 用户，测试结束后恢复 aclfile 配置
+func resetUsers(t *testing.T) {
+	aclFile := config.Properties.AclFile
+	config.Properties.AclFile = ""
+	Setup()
+	t.Cleanup(func() {
+		config.Properties.AclFile = aclFile
+		Setup()
+		ResetLog()
+	})
+}
+
+func TestCheck(t *testing.T) {
+	resetUsers(t)
+	type check struct {
+		cmd     string
+		allowed bool
+	}
+	tests := []struct {
+		name   string
+		rules  []string
+		checks []check
+	}{
+		{
+			name:  "category",
+			rules: []string{"on", "nopass", "~*", "+@read"},
+			checks: []check{
+				{"GET k", true},
+				{"EXISTS a b", true},
+				{"SET k v", false},
+				{"DEL k", false},
+			},
+		},
+		{
+			name:  "category minus command",
+			rules: []string{"on", "nopass", "~*", "+@string", "-set"},
+			checks: []check{
+				{"GET k", true},
+				{"MSET a 1 b 2", true},
+				{"SET k v", false},
+				{"DEL k", false},
+			},
+		},
+		{
+			name:  "all minus category",
+			rules: []string{"on", "nopass", "~*", "+@all", "-@dangerous"},
+			checks: []check{
+				{"SET k v", true},
+				{"FLUSHALL", false},
+				{"KEYS *", false},
+			},
+		},
+		{
+			// 子命令没有单独的规则时使用命令的规则
+			name:  "subcommand",
+			rules: []string{"on", "nopass", "~*", "-@all", "+acl|whoami"},
+			checks: []check{
+				{"ACL WHOAMI", true},
+				{"ACL SETUSER u on", false},
+			},
+		},
+		{
+			name:  "key patterns",
+			rules: []string{"on", "nopass", "+@all", "~cache:*", "~s?ssion"},
+			checks: []check{
+				{"GET cache:1", true},
+				{"GET session", true},
+				{"GET user:1", false},
+				// 所有的 key 都必须匹配
+				{"MSET cache:1 v user:1 v", false},
+				{"MSET cache:1 v cache:2 v", true},
+				// 没有 key 的命令不检查
+				{"DBSIZE", true},
+			},
+		},
+		{
+			name:  "no key patterns",
+			rules: []string{"on", "nopass", "+@all"},
+			checks: []check{
+				{"GET k", false},
+				{"PING", true},
+			},
+		},
+		{
+			name:  "disabled",
+			rules: []string{"off", "nopass", "~*", "+@all"},
+			checks: []check{
+				{"PING", false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetUser("u", append([]string{"reset"}, tt.rules...)); err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range tt.checks {
+				err := Check("u", utils.ToCmdLine(strings.Fields(c.cmd)...), "")
+				if (err == nil) != c.allowed {
+					t.Errorf("%s: err = %v, want allowed = %v", c.cmd, err, c.allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestSetUserErrors(t *testing.T) {
+	resetUsers(t)
+	if err := SetUser("u", []string{"on", "+get"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, rule := range []string{"+nosuchcmd", "+@nosuchcategory", "<unknown", "#abc", "bad", ""} {
+		if err := SetUser("u", []string{"-get", rule}); err == nil {
+			t.Errorf("rule %q accepted", rule)
+		}
+	}
+	// 出错时不做任何修改
+	if rules := GetUser("u").CommandRules(); rules != "-@all +get" {
+		t.Fatalf("command rules = %q", rules)
+	}
+	if err := SetUser("u", []string{"~*", "~k"}); err == nil {
+		t.Fatal("pattern after ~* accepted")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	resetUsers(t)
+	tests := []struct {
+		name     string
+		rules    []string
+		password string
+		ok       bool
+	}{
+		{"nopass accepts any password", []string{"on", "nopass"}, "anything", true},
+		{"password", []string{"on", ">p1", ">p2"}, "p2", true},
+		{"wrong password", []string{"on", ">p1"}, "p2", false},
+		{"no password set", []string{"on"}, "", false},
+		{"password after nopass", []string{"on", "nopass", ">p1"}, "other", false},
+		{"nopass clears passwords", []string{"on", ">p1", "nopass"}, "other", true},
+		{"removed password", []string{"on", ">p1", ">p2", "<p1"}, "p1", false},
+		{"password hash", []string{"on", "#" + hashPassword("p1")}, "p1", true},
+		{"resetpass", []string{"on", ">p1", "resetpass"}, "p1", false},
+		{"disabled", []string{"off", ">p1"}, "p1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := SetUser("u", append([]string{"reset"}, tt.rules...)); err != nil {
+				t.Fatal(err)
+			}
+			if got := Authenticate("u", tt.password, ""); got != tt.ok {
+				t.Fatalf("Authenticate = %v, want %v", got, tt.ok)
+			}
+		})
+	}
+	if Authenticate("nosuchuser", "", "") {
+		t.Fatal("unknown user authenticated")
+	}
+	if entries := Log(1); len(entries) == 0 || entries[0].Reason != reasonAuth {
+		t.Fatalf("failed AUTH not logged: %+v", entries)
+	}
+}
+
+func TestLoadSave(t *testing.T) {
+	resetUsers(t)
+	config.Properties.AclFile = filepath.Join(t.TempDir(), "users.acl")
+	rules := map[string][]string{
+		"app":    {"on", ">secret", "~cache:*", "~session:*", "&news.*", "+@read", "+@write", "-flushdb"},
+		"viewer": {"on", "nopass", "allkeys", "+@read", "-keys"},
+		"locked": {"off", "#" + hashPassword("old")},
+	}
+	for name, r := range rules {
+		if err := SetUser(name, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := make(map[string]string)
+	for _, u := range Users() {
+		want[u.Name] = u.Describe()
+	}
+	if err := Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新加载前修改内存中的用户，加载后恢复为文件中的内容
+	if _, err := DelUser([]string{"app"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUser("extra", []string{"on"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, u := range Users() {
+		got[u.Name] = u.Describe()
+	}
+	if len(got) != len(want) {
+		t.Fatalf("loaded users %v, want %v", got, want)
+	}
+	for name, desc := range want {
+		if got[name] != desc {
+			t.Errorf("%s: loaded %q, want %q", name, got[name], desc)
+		}
+	}
+	if !Authenticate("app", "secret", "") || Check("app", utils.ToCmdLine("GET", "user:1"), "") == nil {
+		t.Fatal("loaded user app has different permissions")
+	}
+}
+
+func TestLoadKeepsUsersOnError(t *testing.T) {
+	resetUsers(t)
+	config.Properties.AclFile = filepath.Join(t.TempDir(), "users.acl")
+	// 文件中有错误的规则时保持原来的用户
+	if err := os.WriteFile(config.Properties.AclFile, []byte("user app on nopass\nuser bad on +nosuchcmd\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUser("kept", []string{"on"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Fatalf("Load = %v, want an error on line 2", err)
+	}
+	if GetUser("kept") == nil {
+		t.Fatal("users replaced by a broken aclfile")
+	}
+}
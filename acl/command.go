@@ -0,0 +1,151 @@
+package acl
+
+import "sort"
+
+// 命令的类别，用于 +@category / -@category 规则
+const (
+	CategoryKeyspace   = "keyspace"
+	CategoryRead       = "read"
+	CategoryWrite      = "write"
+	CategoryString     = "string"
+	CategoryFast       = "fast"
+	CategorySlow       = "slow"
+	CategoryAdmin      = "admin"
+	CategoryDangerous  = "dangerous"
+	CategoryConnection = "connection"
+	CategoryPubSub     = "pubsub"
+)
+
+var categories = []string{
+	CategoryKeyspace, CategoryRead, CategoryWrite, CategoryString, CategoryFast,
+	CategorySlow, CategoryAdmin, CategoryDangerous, CategoryConnection, CategoryPubSub,
+}
+
+// commandSpec 命令所属的类别以及 key 所在的位置
+// key 为 args[firstKey], args[firstKey+step] ... args[lastKey]，lastKey 为负数时从末尾倒数，firstKey 为 0 表示没有 key
+type commandSpec struct {
+	categories []string
+	firstKey   int
+	lastKey    int
+	step       int
+}
+
+// commandSpecs 所有支持 ACL 的命令，子命令的类别与命令不同时以 "命令|子命令" 的形式单独列出
+var commandSpecs = map[string]*commandSpec{
+	"ping":      {categories: []string{CategoryFast, CategoryConnection}},
+	"select":    {categories: []string{CategoryFast, CategoryConnection}},
+	"readonly":  {categories: []string{CategoryFast, CategoryConnection}},
+	"readwrite": {categories: []string{CategoryFast, CategoryConnection}},
+
+	"get":    {categories: []string{CategoryRead, CategoryString, CategoryFast}, firstKey: 1, lastKey: 1, step: 1},
+	"strlen": {categories: []string{CategoryRead, CategoryString, CategoryFast}, firstKey: 1, lastKey: 1, step: 1},
+	"set":    {categories: []string{CategoryWrite, CategoryString, CategorySlow}, firstKey: 1, lastKey: 1, step: 1},
+	"setnx":  {categories: []string{CategoryWrite, CategoryString, CategoryFast}, firstKey: 1, lastKey: 1, step: 1},
+	"getset": {categories: []string{CategoryWrite, CategoryString, CategoryFast}, firstKey: 1, lastKey: 1, step: 1},
+	"mset":   {categories: []string{CategoryWrite, CategoryString, CategorySlow}, firstKey: 1, lastKey: -1, step: 2},
+	"msetnx": {categories: []string{CategoryWrite, CategoryString, CategorySlow}, firstKey: 1, lastKey: -1, step: 2},
+
+	"del":       {categories: []string{CategoryWrite, CategoryKeyspace, CategorySlow}, firstKey: 1, lastKey: -1, step: 1},
+	"exists":    {categories: []string{CategoryRead, CategoryKeyspace, CategoryFast}, firstKey: 1, lastKey: -1, step: 1},
+	"type":      {categories: []string{CategoryRead, CategoryKeyspace, CategoryFast}, firstKey: 1, lastKey: 1, step: 1},
+	"rename":    {categories: []string{CategoryWrite, CategoryKeyspace, CategorySlow}, firstKey: 1, lastKey: 2, step: 1},
+	"renamenx":  {categories: []string{CategoryWrite, CategoryKeyspace, CategoryFast}, firstKey: 1, lastKey: 2, step: 1},
+	"expire":    {categories: []string{CategoryWrite, CategoryKeyspace, CategoryFast}, firstKey: 1, lastKey: 1, step: 1},
+	"pexpire":   {categories: []string{CategoryWrite, CategoryKeyspace, CategoryFast}, firstKey: 1, lastKey: 1, step: 1},
+	"expireat":  {categories: []string{CategoryWrite, CategoryKeyspace, CategoryFast}, firstKey: 1, lastKey: 1, step: 1},
+	"pexpireat": {categories: []string{CategoryWrite, CategoryKeyspace, CategoryFast}, firstKey: 1, lastKey: 1, step: 1},
+	"persist":   {categories: []string{CategoryWrite, CategoryKeyspace, CategoryFast}, firstKey: 1, lastKey: 1, step: 1},
+	"ttl":       {categories: []string{CategoryRead, CategoryKeyspace, CategoryFast}, firstKey: 1, lastKey: 1, step: 1},
+	"pttl":      {categories: []string{CategoryRead, CategoryKeyspace, CategoryFast}, firstKey: 1, lastKey: 1, step: 1},
+	"keys":      {categories: []string{CategoryRead, CategoryKeyspace, CategorySlow, CategoryDangerous}},
+	"scan":      {categories: []string{CategoryRead, CategoryKeyspace, CategorySlow}},
+	"randomkey": {categories: []string{CategoryRead, CategoryKeyspace, CategorySlow}},
+	"dbsize":    {categories: []string{CategoryRead, CategoryKeyspace, CategoryFast}},
+	"flushdb":   {categories: []string{CategoryWrite, CategoryKeyspace, CategorySlow, CategoryDangerous}},
+	"flushall":  {categories: []string{CategoryWrite, CategoryKeyspace, CategorySlow, CategoryDangerous}},
+
+	"acl":        {categories: []string{CategoryAdmin, CategorySlow, CategoryDangerous}},
+	"acl|whoami": {categories: []string{CategorySlow}},
+	"acl|cat":    {categories: []string{CategorySlow}},
+
+	"cluster":        {categories: []string{CategoryAdmin, CategorySlow, CategoryDangerous}},
+	"cluster|info":   {categories: []string{CategorySlow}},
+	"cluster|nodes":  {categories: []string{CategorySlow}},
+	"cluster|slots":  {categories: []string{CategorySlow}},
+	"cluster|shards": {categories: []string{CategorySlow}},
+
+	// 集群结点之间的内部命令
+	"raft":     {categories: []string{CategoryAdmin, CategorySlow, CategoryDangerous}},
+	"prepare":  {categories: []string{CategoryAdmin, CategorySlow, CategoryDangerous}},
+	"commit":   {categories: []string{CategoryAdmin, CategorySlow, CategoryDangerous}},
+	"rollback": {categories: []string{CategoryAdmin, CategorySlow, CategoryDangerous}},
+	"finish":   {categories: []string{CategoryAdmin, CategorySlow, CategoryDangerous}},
+}
+
+// Categories 返回所有的类别
+func Categories() []string {
+	result := make([]string, len(categories))
+	copy(result, categories)
+	return result
+}
+
+// IsCategory 类别是否存在
+func IsCategory(category string) bool {
+	for _, c := range categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// CommandsInCategory 返回类别中的命令，按名称排序
+func CommandsInCategory(category string) []string {
+	result := make([]string, 0)
+	for name, spec := range commandSpecs {
+		if spec.hasCategory(category) {
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+func (spec *commandSpec) hasCategory(category string) bool {
+	for _, c := range spec.categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// commandName 返回 args 对应的命令表中的名称，子命令单独列出时为 "命令|子命令"
+func commandName(name string, args [][]byte) string {
+	if len(args) >= 2 {
+		sub := name + "|" + toLower(args[1])
+		if _, ok := commandSpecs[sub]; ok {
+			return sub
+		}
+	}
+	return name
+}
+
+// keys 返回命令中的 key
+func (spec *commandSpec) keys(args [][]byte) [][]byte {
+	if spec.firstKey <= 0 || spec.firstKey >= len(args) {
+		return nil
+	}
+	last := spec.lastKey
+	if last < 0 {
+		last = len(args) + last
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	keys := make([][]byte, 0)
+	for i := spec.firstKey; i <= last; i += spec.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
@@ -0,0 +1,73 @@
+package acl
+
+import "time"
+
+// 被拒绝的原因
+const (
+	reasonAuth    = "auth"
+	reasonCommand = "command"
+	reasonKey     = "key"
+	reasonChannel = "channel"
+)
+
+// LogEntry ACL LOG 中的一条记录，相同的拒绝在 logMergeDelay 内合并为一条并计数
+type LogEntry struct {
+	Count      int64
+	Reason     string
+	Object     string // 被拒绝的命令、key 或频道
+	Username   string
+	ClientInfo string
+	EntryID    int64
+	Created    time.Time
+	Updated    time.Time
+}
+
+func addLog(reason string, object string, username string, clientInfo string) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	now := time.Now()
+	for _, entry := range logs {
+		if entry.Reason == reason && entry.Object == object && entry.Username == username &&
+			entry.ClientInfo == clientInfo && now.Sub(entry.Updated) < logMergeDelay {
+			entry.Count++
+			entry.Updated = now
+			return
+		}
+	}
+	entry := &LogEntry{
+		Count:      1,
+		Reason:     reason,
+		Object:     object,
+		Username:   username,
+		ClientInfo: clientInfo,
+		EntryID:    logNextID,
+		Created:    now,
+		Updated:    now,
+	}
+	logNextID++
+	logs = append([]*LogEntry{entry}, logs...)
+	if len(logs) > logMaxLen {
+		logs = logs[:logMaxLen]
+	}
+}
+
+// Log 返回最近的 count 条记录，最新的在前，count 为负数时返回全部
+func Log(count int) []LogEntry {
+	logMu.Lock()
+	defer logMu.Unlock()
+	if count < 0 || count > len(logs) {
+		count = len(logs)
+	}
+	result := make([]LogEntry, count)
+	for i := 0; i < count; i++ {
+		result[i] = *logs[i]
+	}
+	return result
+}
+
+// ResetLog 清空 ACL LOG
+func ResetLog() {
+	logMu.Lock()
+	defer logMu.Unlock()
+	logs = nil
+}
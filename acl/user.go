@@ -0,0 +1,329 @@
+package acl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"go-redis/lib/wildcard"
+	"sort"
+	"strings"
+)
+
+// User 一个 ACL 用户，创建后不再修改，SETUSER 修改它的拷贝后整体替换
+type User struct {
+	Name      string
+	Enabled   bool
+	NoPass    bool
+	Passwords map[string]bool // 密码的 sha256
+
+	AllKeys     bool
+	KeyPatterns []string
+	keyMatchers []*wildcard.Pattern
+
+	AllChannels     bool
+	ChannelPatterns []string
+	channelMatchers []*wildcard.Pattern
+
+	// 命令权限: 不在 commands 中的命令由 allCommands 决定
+	allCommands  bool
+	commands     map[string]bool
+	commandRules []string // 生效的规则，用于展示和保存
+}
+
+func makeUser(name string) *User {
+	return &User{
+		Name:         name,
+		Passwords:    make(map[string]bool),
+		commands:     make(map[string]bool),
+		commandRules: []string{"-@all"},
+	}
+}
+
+func (u *User) clone() *User {
+	c := *u
+	c.Passwords = make(map[string]bool, len(u.Passwords))
+	for hash := range u.Passwords {
+		c.Passwords[hash] = true
+	}
+	c.KeyPatterns = append([]string(nil), u.KeyPatterns...)
+	c.keyMatchers = append([]*wildcard.Pattern(nil), u.keyMatchers...)
+	c.ChannelPatterns = append([]string(nil), u.ChannelPatterns...)
+	c.channelMatchers = append([]*wildcard.Pattern(nil), u.channelMatchers...)
+	c.commands = make(map[string]bool, len(u.commands))
+	for name, allowed := range u.commands {
+		c.commands[name] = allowed
+	}
+	c.commandRules = append([]string(nil), u.commandRules...)
+	return &c
+}
+
+func hashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+func isPasswordHash(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// applyRule 应用一条规则，规则的含义与 redis 相同
+func (u *User) applyRule(rule string) error {
+	switch lower := strings.ToLower(rule); lower {
+	case "on":
+		u.Enabled = true
+	case "off":
+		u.Enabled = false
+	case "nopass":
+		u.NoPass = true
+		u.Passwords = make(map[string]bool)
+	case "resetpass":
+		u.NoPass = false
+		u.Passwords = make(map[string]bool)
+	case "allkeys":
+		u.AllKeys = true
+		u.KeyPatterns, u.keyMatchers = nil, nil
+	case "resetkeys":
+		u.AllKeys = false
+		u.KeyPatterns, u.keyMatchers = nil, nil
+	case "allchannels":
+		u.AllChannels = true
+		u.ChannelPatterns, u.channelMatchers = nil, nil
+	case "resetchannels":
+		u.AllChannels = false
+		u.ChannelPatterns, u.channelMatchers = nil, nil
+	case "allcommands":
+		u.setAllCommands(true)
+	case "nocommands":
+		u.setAllCommands(false)
+	case "reset":
+		for _, r := range []string{"resetpass", "resetkeys", "resetchannels", "nocommands", "off"} {
+			_ = u.applyRule(r)
+		}
+	default:
+		if rule == "" {
+			return errors.New("empty rule")
+		}
+		return u.applyPrefixedRule(rule)
+	}
+	return nil
+}
+
+func (u *User) applyPrefixedRule(rule string) error {
+	arg := rule[1:]
+	switch rule[0] {
+	case '>':
+		u.NoPass = false
+		u.Passwords[hashPassword(arg)] = true
+	case '<':
+		hash := hashPassword(arg)
+		if !u.Passwords[hash] {
+			return errors.New("no such password")
+		}
+		delete(u.Passwords, hash)
+	case '#':
+		if !isPasswordHash(arg) {
+			return errors.New("the password hash must be exactly 64 hexadecimal characters")
+		}
+		u.NoPass = false
+		u.Passwords[strings.ToLower(arg)] = true
+	case '!':
+		if !u.Passwords[strings.ToLower(arg)] {
+			return errors.New("no such password")
+		}
+		delete(u.Passwords, strings.ToLower(arg))
+	case '~':
+		if arg == "*" {
+			return u.applyRule("allkeys")
+		}
+		if u.AllKeys {
+			return errors.New("adding a pattern after the * pattern (or the 'allkeys' flag) is not valid")
+		}
+		u.KeyPatterns = append(u.KeyPatterns, arg)
+		u.keyMatchers = append(u.keyMatchers, wildcard.CompilePattern(arg))
+	case '&':
+		if arg == "*" {
+			return u.applyRule("allchannels")
+		}
+		if u.AllChannels {
+			return errors.New("adding a pattern after the * pattern (or the 'allchannels' flag) is not valid")
+		}
+		u.ChannelPatterns = append(u.ChannelPatterns, arg)
+		u.channelMatchers = append(u.channelMatchers, wildcard.CompilePattern(arg))
+	case '+', '-':
+		return u.applyCommandRule(rule[0] == '+', strings.ToLower(arg))
+	default:
+		return errors.New("syntax error")
+	}
+	return nil
+}
+
+func (u *User) setAllCommands(allowed bool) {
+	u.allCommands = allowed
+	u.commands = make(map[string]bool)
+	if allowed {
+		u.commandRules = []string{"+@all"}
+	} else {
+		u.commandRules = []string{"-@all"}
+	}
+}
+
+// applyCommandRule +cmd -cmd +@category -@category
+func (u *User) applyCommandRule(allow bool, name string) error {
+	sign := "-"
+	if allow {
+		sign = "+"
+	}
+	if strings.HasPrefix(name, "@") {
+		category := name[1:]
+		if category == "all" {
+			u.setAllCommands(allow)
+			return nil
+		}
+		if !IsCategory(category) {
+			return errors.New("unknown command category '" + category + "'")
+		}
+		for _, cmd := range CommandsInCategory(category) {
+			u.commands[cmd] = allow
+		}
+	} else {
+		if _, ok := commandSpecs[name]; !ok {
+			return errors.New("unknown command '" + name + "'")
+		}
+		u.commands[name] = allow
+	}
+	u.commandRules = append(u.commandRules, sign+name)
+	return nil
+}
+
+// canRun 是否可以执行命令，name 为 commandName 返回的名称
+func (u *User) canRun(name string) bool {
+	if allowed, ok := u.commands[name]; ok {
+		return allowed
+	}
+	// 子命令没有单独的规则时使用命令的规则
+	if i := strings.IndexByte(name, '|'); i > 0 {
+		if allowed, ok := u.commands[name[:i]]; ok {
+			return allowed
+		}
+	}
+	return u.allCommands
+}
+
+func (u *User) canAccessKey(key string) bool {
+	if u.AllKeys {
+		return true
+	}
+	for _, matcher := range u.keyMatchers {
+		if matcher.IsMatch(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) canAccessChannel(channel string) bool {
+	if u.AllChannels {
+		return true
+	}
+	for _, matcher := range u.channelMatchers {
+		if matcher.IsMatch(channel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) checkPassword(password string) bool {
+	if u.NoPass {
+		return true
+	}
+	return u.Passwords[hashPassword(password)]
+}
+
+// Flags on/off 以及 nopass, allkeys, allchannels
+func (u *User) Flags() []string {
+	flags := []string{"off"}
+	if u.Enabled {
+		flags[0] = "on"
+	}
+	if u.NoPass {
+		flags = append(flags, "nopass")
+	}
+	if u.AllKeys {
+		flags = append(flags, "allkeys")
+	}
+	if u.AllChannels {
+		flags = append(flags, "allchannels")
+	}
+	return flags
+}
+
+// PasswordHashes 按字典序返回密码的 sha256
+func (u *User) PasswordHashes() []string {
+	hashes := make([]string, 0, len(u.Passwords))
+	for hash := range u.Passwords {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// CommandRules 命令规则，例如 "+@all -flushall"
+func (u *User) CommandRules() string {
+	return strings.Join(u.commandRules, " ")
+}
+
+// Keys 形如 "~cache:* ~session:*" 的 key 规则
+func (u *User) Keys() string {
+	if u.AllKeys {
+		return "~*"
+	}
+	return joinPatterns("~", u.KeyPatterns)
+}
+
+// Channels 形如 "&news.*" 的频道规则
+func (u *User) Channels() string {
+	if u.AllChannels {
+		return "&*"
+	}
+	return joinPatterns("&", u.ChannelPatterns)
+}
+
+func joinPatterns(prefix string, patterns []string) string {
+	parts := make([]string, len(patterns))
+	for i, p := range patterns {
+		parts[i] = prefix + p
+	}
+	return strings.Join(parts, " ")
+}
+
+// Describe 用户的完整规则，ACL LIST 和 aclfile 使用相同的格式
+func (u *User) Describe() string {
+	parts := []string{"user", u.Name, u.Flags()[0]}
+	if u.NoPass {
+		parts = append(parts, "nopass")
+	}
+	for _, hash := range u.PasswordHashes() {
+		parts = append(parts, "#"+hash)
+	}
+	if s := u.Keys(); s != "" {
+		parts = append(parts, s)
+	} else {
+		parts = append(parts, "resetkeys")
+	}
+	if s := u.Channels(); s != "" {
+		parts = append(parts, s)
+	} else {
+		parts = append(parts, "resetchannels")
+	}
+	parts = append(parts, u.CommandRules())
+	return strings.Join(parts, " ")
+}
+
+func toLower(b []byte) string {
+	return strings.ToLower(string(b))
+}
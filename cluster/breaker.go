@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"go-redis/config"
+	"sync"
+	"time"
+)
+
+/*
+	熔断器
+	每个兄弟结点一个熔断器，连续失败 cluster-breaker-threshold 次后打开，打开期间请求直接返回 CLUSTERDOWN 而不必等待超时。
+	打开 cluster-breaker-cooldown 毫秒后半开，只放行一个探测请求，成功则关闭，失败则重新打开。
+*/
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 5 * time.Second
+)
+
+type breaker struct {
+	mu        sync.Mutex
+	state     int
+	failures  int
+	openedAt  time.Time
+	probing   bool // 半开状态下已有探测请求在执行
+	threshold int
+	cooldown  time.Duration
+}
+
+func makeBreaker() *breaker {
+	b := &breaker{
+		threshold: defaultBreakerThreshold,
+		cooldown:  defaultBreakerCooldown,
+	}
+	if config.Properties.ClusterBreakerThreshold > 0 {
+		b.threshold = config.Properties.ClusterBreakerThreshold
+	}
+	if config.Properties.ClusterBreakerCooldown > 0 {
+		b.cooldown = time.Duration(config.Properties.ClusterBreakerCooldown) * time.Millisecond
+	}
+	return b
+}
+
+// allow 返回是否可以向该结点发出请求
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+func (b *breaker) onSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *breaker) onFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+	b.probing = false
+}
+
+// getBreaker 返回 peer 的熔断器，不存在时创建
+func (cluster *ClusterDatabase) getBreaker(peer string) *breaker {
+	cluster.mu.RLock()
+	b, ok := cluster.breakers[peer]
+	cluster.mu.RUnlock()
+	if ok {
+		return b
+	}
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	if b, ok = cluster.breakers[peer]; !ok {
+		b = makeBreaker()
+		cluster.breakers[peer] = b
+	}
+	return b
+}
@@ -3,17 +3,47 @@ package cluster
 import (
 	"context"
 	"errors"
+	"go-redis/config"
 	"go-redis/resp/client"
+	"go-redis/resp/reply"
+	"time"
 
 	pool "github.com/jolestar/go-commons-pool"
 )
 
+const (
+	defaultPoolIdleTimeout = 5 * time.Minute
+	// validateIdleTime 空闲超过该时间的连接在借出前用 PING 检查，刚归还的连接不再检查
+	validateIdleTime = time.Second
+	evictionInterval = 30 * time.Second
+)
+
+// makePoolConfig 兄弟结点连接池的配置，借出前和空闲时检查连接，空闲过久的连接被关闭
+func makePoolConfig() *pool.ObjectPoolConfig {
+	poolConfig := pool.NewDefaultPoolConfig()
+	if config.Properties.ClusterPoolMaxTotal > 0 {
+		poolConfig.MaxTotal = config.Properties.ClusterPoolMaxTotal
+	}
+	if config.Properties.ClusterPoolMaxIdle > 0 {
+		poolConfig.MaxIdle = config.Properties.ClusterPoolMaxIdle
+	}
+	poolConfig.MinEvictableIdleTime = defaultPoolIdleTimeout
+	if config.Properties.ClusterPoolIdleTimeout > 0 {
+		poolConfig.MinEvictableIdleTime = time.Duration(config.Properties.ClusterPoolIdleTimeout) * time.Second
+	}
+	poolConfig.TestOnBorrow = true
+	poolConfig.TestWhileIdle = true
+	poolConfig.TimeBetweenEvictionRuns = evictionInterval
+	return poolConfig
+}
+
 type connectionFactory struct {
-	Peer string
+	Peer    string
+	Options client.Options
 }
 
 func (c *connectionFactory) MakeObject(ctx context.Context) (*pool.PooledObject, error) {
-	client, err := client.MakeClient(c.Peer)
+	client, err := client.MakeClientWithOptions(c.Peer, c.Options)
 	if err != nil {
 		return nil, err
 	}
@@ -30,11 +60,24 @@ func (c *connectionFactory) DestroyObject(ctx context.Context, object *pool.Pool
 	return nil
 }
 
+// ValidateObject 用 PING 检查空闲的连接，失效的连接由连接池销毁并重新创建
 func (c *connectionFactory) ValidateObject(ctx context.Context, object *pool.PooledObject) bool {
-	return true
+	peerClient, ok := object.Object.(*client.Client)
+	if !ok {
+		return false
+	}
+	if object.GetIdleTime() < validateIdleTime {
+		return true
+	}
+	status, ok := peerClient.Send([][]byte{[]byte("PING")}).(*reply.StatusReply)
+	return ok && status.Status == "PONG"
 }
 
+// ActivateObject 借出前检查对象的类型，出错时连接池销毁该对象
 func (c *connectionFactory) ActivateObject(ctx context.Context, object *pool.PooledObject) error {
+	if _, ok := object.Object.(*client.Client); !ok {
+		return errors.New("object is not a client")
+	}
 	return nil
 }
 
@@ -0,0 +1,250 @@
+package cluster
+
+import (
+	"crypto/subtle"
+	"go-redis/acl"
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clusterFunc CLUSTER MEET|FORGET|INFO|NODES|SHARDS|PEER|GOSSIP|JOIN|APPLY|LOCAL
+func clusterFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply("cluster")
+	}
+	subCmd := strings.ToLower(string(cmdArgs[1]))
+	switch subCmd {
+	case "meet":
+		return clusterMeet(cluster, cmdArgs[2:])
+	case "forget":
+		return clusterForget(cluster, cmdArgs[2:])
+	case "info":
+		return clusterInfo(cluster)
+	case "nodes":
+		return clusterNodes(cluster)
+	case "shards":
+		return clusterShards(cluster)
+	case "peer":
+		return clusterPeer(conn, cmdArgs[2:])
+	case "gossip":
+		return clusterGossip(cluster, cmdArgs[2:])
+	case "join":
+		return clusterJoin(cluster, cmdArgs[2:])
+	case "apply":
+		return clusterApply(cluster, cmdArgs[2:])
+	case "local":
+		return clusterLocal(cluster, conn, cmdArgs[2:])
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + subCmd + "'")
+}
+
+// CLUSTER PEER [secret]
+// 其它结点的连接在认证之后标记自己，之后可以执行内部命令。普通客户端也知道 requirepass，
+// 因此需要出示 cluster-secret，或者以结点之间专用的 masteruser 认证
+func clusterPeer(conn resp.Connection, args [][]byte) resp.Reply {
+	if len(args) > 1 {
+		return reply.MakeArgNumErrReply("cluster peer")
+	}
+	if !isPeerCredential(conn, args) {
+		return reply.MakeErrReply("ERR CLUSTER PEER requires the cluster-secret or a connection authenticated as masteruser")
+	}
+	conn.SetPeer(true)
+	return reply.MakeOkReply()
+}
+
+func isPeerCredential(conn resp.Connection, args [][]byte) bool {
+	secret := config.Properties.ClusterSecret
+	if secret != "" && len(args) == 1 && subtle.ConstantTimeCompare(args[0], []byte(secret)) == 1 {
+		return true
+	}
+	// 所有客户端默认都是 default 用户，masteruser 为 default 时不能作为凭据
+	user := config.Properties.MasterUser
+	return user != "" && user != acl.DefaultUser && conn.GetUser() == user
+}
+
+// CLUSTER MEET ip port
+func clusterMeet(cluster *ClusterDatabase, args [][]byte) resp.Reply {
+	if len(args) != 2 {
+		return reply.MakeArgNumErrReply("cluster meet")
+	}
+	port, err := strconv.Atoi(string(args[1]))
+	if err != nil || port <= 0 || port > 65535 {
+		return reply.MakeErrReply("ERR Invalid node address specified: " + string(args[0]) + ":" + string(args[1]))
+	}
+	addr := net.JoinHostPort(string(args[0]), strconv.Itoa(port))
+	if err := cluster.meet(addr); err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	return reply.MakeOkReply()
+}
+
+// CLUSTER FORGET ip:port
+func clusterForget(cluster *ClusterDatabase, args [][]byte) resp.Reply {
+	if len(args) != 1 {
+		return reply.MakeArgNumErrReply("cluster forget")
+	}
+	addr := string(args[0])
+	if addr == cluster.self {
+		return reply.MakeErrReply("ERR I tried hard but I can't forget myself...")
+	}
+	isVoter := cluster.raft.IsVoter(addr)
+	cluster.mu.RLock()
+	_, ok := cluster.meta.nodes[addr]
+	cluster.mu.RUnlock()
+	if !ok && !isVoter {
+		return reply.MakeErrReply("ERR Unknown node " + addr)
+	}
+	// 先记为已遗忘再从投票者中删除，否则结点在两次提案之间发现自己不是投票者会重新加入
+	// 删除投票者失败时重试 FORGET 即可，已遗忘的结点仍然可以从投票者中删除
+	if ok {
+		if err := cluster.propose("DELNODE", addr); err != nil {
+			return reply.MakeErrReply("ERR " + err.Error())
+		}
+	}
+	if err := cluster.raft.RemoveVoter(addr); err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	return reply.MakeOkReply()
+}
+
+// CLUSTER INFO
+func clusterInfo(cluster *ClusterDatabase) resp.Reply {
+	raftRole, raftTerm, raftLeader, raftCommit, raftApplied := cluster.raft.Status()
+	raftVoters := cluster.raft.Voters()
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	state := "ok"
+	failed := 0
+	for _, node := range cluster.nodes {
+		if node.flag == flagFail {
+			failed++
+		}
+	}
+	// 元数据为空或任意一个分片没有可用的主结点时集群不可用
+	if len(cluster.shards) == 0 {
+		state = "fail"
+	}
+	for _, master := range cluster.shards {
+		if node, ok := cluster.nodes[master]; !ok || node.flag == flagFail {
+			state = "fail"
+		}
+	}
+	var sb strings.Builder
+	sb.WriteString("cluster_state:" + state + reply.CRLF)
+	sb.WriteString("cluster_known_nodes:" + strconv.Itoa(len(cluster.nodes)) + reply.CRLF)
+	sb.WriteString("cluster_size:" + strconv.Itoa(len(cluster.shards)) + reply.CRLF)
+	sb.WriteString("cluster_failed_nodes:" + strconv.Itoa(failed) + reply.CRLF)
+	sb.WriteString("cluster_current_epoch:" + strconv.FormatUint(cluster.meta.epoch, 10) + reply.CRLF)
+	sb.WriteString("cluster_node_timeout:" + strconv.FormatInt(cluster.nodeTimeout.Milliseconds(), 10) + reply.CRLF)
+	sb.WriteString("cluster_virtual_nodes:" + strconv.Itoa(virtualNodes()) + reply.CRLF)
+	sb.WriteString("raft_role:" + raftRole + reply.CRLF)
+	sb.WriteString("raft_term:" + strconv.FormatUint(raftTerm, 10) + reply.CRLF)
+	sb.WriteString("raft_leader:" + raftLeader + reply.CRLF)
+	sb.WriteString("raft_voters:" + strings.Join(raftVoters, ",") + reply.CRLF)
+	sb.WriteString("raft_commit_index:" + strconv.FormatUint(raftCommit, 10) + reply.CRLF)
+	sb.WriteString("raft_last_applied:" + strconv.FormatUint(raftApplied, 10) + reply.CRLF)
+	return reply.MakeVerbatimReply("txt", []byte(sb.String()))
+}
+
+// CLUSTER NODES 每行: addr flags shard config-epoch last-pong-ms
+func clusterNodes(cluster *ClusterDatabase) resp.Reply {
+	addrs := cluster.nodeAddrs()
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	var sb strings.Builder
+	for _, addr := range addrs {
+		node, ok := cluster.nodes[addr]
+		if !ok {
+			continue
+		}
+		flags := node.Role.String() + "," + node.flag.String()
+		if addr == cluster.self {
+			flags = "myself," + flags
+		}
+		sb.WriteString(addr + " " + flags + " " + node.Shard + " " + strconv.FormatUint(node.ConfigEpoch, 10) + " " +
+			strconv.FormatInt(node.lastPong.UnixNano()/int64(time.Millisecond), 10) + "\n")
+	}
+	return reply.MakeVerbatimReply("txt", []byte(sb.String()))
+}
+
+// CLUSTER SHARDS 每个分片一项: shard master replica...，master 为空表示分片暂时没有主结点
+// 客户端据此和 cluster_virtual_nodes 在本地构建相同的哈希环，直接访问 key 所在的结点
+func clusterShards(cluster *ClusterDatabase) resp.Reply {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	shards := make([]string, 0, len(cluster.shards))
+	for shard := range cluster.shards {
+		shards = append(shards, shard)
+	}
+	sort.Strings(shards)
+	entries := make([]resp.Reply, 0, len(shards))
+	for _, shard := range shards {
+		entry := [][]byte{[]byte(shard), []byte(cluster.shards[shard])}
+		replicas := make([]string, 0)
+		for addr, node := range cluster.nodes {
+			if node.Shard == shard && node.Role == roleReplica {
+				replicas = append(replicas, addr)
+			}
+		}
+		sort.Strings(replicas)
+		for _, replica := range replicas {
+			entry = append(entry, []byte(replica))
+		}
+		entries = append(entries, reply.MakeMultiBulkReply(entry))
+	}
+	return reply.MakeMultiRawReply(entries)
+}
+
+// CLUSTER GOSSIP sender [addr flag]... 仅用于结点之间通信
+func clusterGossip(cluster *ClusterDatabase, args [][]byte) resp.Reply {
+	if len(args) < 1 {
+		return reply.MakeArgNumErrReply("cluster gossip")
+	}
+	cluster.handleGossip(string(args[0]), args[1:])
+	return reply.MakeMultiBulkReply(cluster.gossipMessage())
+}
+
+// CLUSTER JOIN voter... 由 CLUSTER MEET 发送给新结点，告知 raft 的投票者以便其注册
+// 已经属于其它集群的结点拒绝加入，只有自己一个结点的集群会被丢弃
+func clusterJoin(cluster *ClusterDatabase, args [][]byte) resp.Reply {
+	if len(args) == 0 {
+		return reply.MakeArgNumErrReply("cluster join")
+	}
+	voters := make([]string, len(args))
+	for i, arg := range args {
+		voters[i] = string(arg)
+	}
+	if err := cluster.raft.Join(voters); err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	return reply.MakeOkReply()
+}
+
+// CLUSTER APPLY dbIndex cmd args... 主结点推送给副本的写命令，直接在本地执行
+func clusterApply(cluster *ClusterDatabase, args [][]byte) resp.Reply {
+	if len(args) < 2 {
+		return reply.MakeArgNumErrReply("cluster apply")
+	}
+	dbIndex, err := strconv.Atoi(string(args[0]))
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid DB index")
+	}
+	conn := &connection.Connection{}
+	conn.SelectDB(dbIndex)
+	return cluster.db.Exec(conn, args[1:])
+}
+
+// CLUSTER LOCAL cmd args... 广播时发给各结点的命令，只在收到的结点上执行，不再转发
+func clusterLocal(cluster *ClusterDatabase, conn resp.Connection, args [][]byte) resp.Reply {
+	if len(args) == 0 {
+		return reply.MakeArgNumErrReply("cluster local")
+	}
+	return cluster.db.Exec(conn, args)
+}
@@ -0,0 +1,60 @@
+package cluster
+
+import (
+	"go-redis/acl"
+	"go-redis/config"
+	"go-redis/lib/utils"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"strings"
+	"testing"
+)
+
+func TestClusterPeerRequiresCredential(t *testing.T) {
+	if err := acl.SetUser("repl", []string{"on", ">repl-pass", "~*", "+@all"}); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_, _ = acl.DelUser([]string{"repl"})
+		config.Properties.ClusterSecret, config.Properties.MasterUser = "", ""
+	}()
+	cluster := makeTestCluster("a")
+
+	cases := []struct {
+		name       string
+		secret     string
+		masterUser string
+		user       string
+		args       []string
+		want       bool
+	}{
+		{"nothing configured", "", "", acl.DefaultUser, []string{"CLUSTER", "PEER"}, false},
+		{"no secret given", "s3cret", "", acl.DefaultUser, []string{"CLUSTER", "PEER"}, false},
+		{"wrong secret", "s3cret", "", acl.DefaultUser, []string{"CLUSTER", "PEER", "guess"}, false},
+		{"cluster-secret", "s3cret", "", acl.DefaultUser, []string{"CLUSTER", "PEER", "s3cret"}, true},
+		{"not masteruser", "", "repl", acl.DefaultUser, []string{"CLUSTER", "PEER"}, false},
+		{"masteruser", "", "repl", "repl", []string{"CLUSTER", "PEER"}, true},
+		// 所有客户端都是 default 用户
+		{"masteruser default", "", acl.DefaultUser, acl.DefaultUser, []string{"CLUSTER", "PEER"}, false},
+	}
+	for _, c := range cases {
+		config.Properties.ClusterSecret, config.Properties.MasterUser = c.secret, c.masterUser
+		conn := &connection.Connection{}
+		conn.SetUser(c.user)
+
+		result := cluster.Exec(conn, utils.ToCmdLine(c.args...))
+		if reply.IsErrReply(result) == c.want || conn.IsPeer() != c.want {
+			t.Errorf("%s: CLUSTER PEER = %q, peer = %v", c.name, result.ToBytes(), conn.IsPeer())
+			continue
+		}
+		// 只有结点之间的连接可以执行内部命令
+		result = cluster.Exec(conn, utils.ToCmdLine("CLUSTER", "APPLY", "0", "SET", "k", "v"))
+		if c.want {
+			if got := string(result.ToBytes()); got != "+OK\r\n" {
+				t.Errorf("%s: CLUSTER APPLY from peer = %q", c.name, got)
+			}
+		} else if got := string(result.ToBytes()); !strings.Contains(got, "internal command") {
+			t.Errorf("%s: CLUSTER APPLY from client = %q", c.name, got)
+		}
+	}
+}
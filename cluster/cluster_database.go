@@ -2,14 +2,23 @@ package cluster
 
 import (
 	"context"
+	"crypto/tls"
+	"go-redis/acl"
 	"go-redis/config"
 	database2 "go-redis/database"
+	"go-redis/datastruct/lock"
 	"go-redis/interface/database"
 	"go-redis/interface/resp"
 	"go-redis/lib/consistenthash"
 	"go-redis/lib/logger"
+	"go-redis/raft"
+	"go-redis/resp/client"
 	"go-redis/resp/reply"
+	"net"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	pool "github.com/jolestar/go-commons-pool"
 )
@@ -17,33 +26,251 @@ import (
 type ClusterDatabase struct {
 	self string
 
-	nodes              []string
+	// mu 保护集群拓扑: meta, nodes, shards, peerPicker, peerConnectionPool, breakers 以及故障转移状态
+	mu                 sync.RWMutex
+	meta               *clusterMeta      // raft 已提交的元数据，拓扑以它为准
+	nodes              map[string]*Node  // 元数据中的结点以及自己
+	shards             map[string]string // 分片 -> 当前主结点，哈希环上放置的是分片
 	peerPicker         *consistenthash.NodeMap
 	peerConnectionPool map[string]*pool.ObjectPool
-	db                 database.Database
+	poolConfig         *pool.ObjectPoolConfig
+	breakers           map[string]*breaker // 兄弟结点 -> 熔断器
+	db                 *database2.StandaloneDatabase
+	raft               *raft.Raft
+
+	electing     bool
+	lastElection time.Time
+	registering  bool
+
+	replMu      sync.Mutex
+	replicators map[string]*replicator // 副本地址 -> 复制流
+
+	keyLocks     *lock.Locks // 两阶段提交期间锁定的 key
+	txMu         sync.Mutex
+	transactions map[string]*Transaction // 本结点参与的事务
+
+	nodeTimeout time.Duration
+	peerTLS     *tls.Config // tls-cluster yes 时连接其它结点使用的 TLS 配置
+	stopChan    chan struct{}
 }
 
 func MakeClusterDatabase() *ClusterDatabase {
 	cluster := &ClusterDatabase{
 		self:               config.Properties.Self,
 		db:                 database2.NewStandaloneDatabase(),
-		peerPicker:         consistenthash.NewNodeMap(nil),
+		meta:               makeClusterMeta(),
+		nodes:              make(map[string]*Node),
+		shards:             make(map[string]string),
+		peerPicker:         consistenthash.NewNodeMapWithReplicas(virtualNodes(), nil),
 		peerConnectionPool: make(map[string]*pool.ObjectPool),
+		poolConfig:         makePoolConfig(),
+		breakers:           make(map[string]*breaker),
+		replicators:        make(map[string]*replicator),
+		keyLocks:           lock.Make(1024),
+		transactions:       make(map[string]*Transaction),
+		nodeTimeout:        nodeTimeout(),
+		stopChan:           make(chan struct{}),
+	}
+	peerTLS, err := config.Properties.ClientTLSConfig()
+	if err != nil {
+		logger.Fatal("cluster: load tls config failed: " + err.Error())
+	}
+	cluster.peerTLS = peerTLS
+	if config.Properties.AclFile != "" && config.Properties.RequirePass != "" && config.Properties.MasterAuth == "" {
+		logger.Warn("cluster: requirepass is ignored when aclfile is configured, set masteruser and masterauth for connections between nodes")
+	}
+	if config.Properties.ClusterSecret == "" && (config.Properties.MasterUser == "" || config.Properties.MasterUser == acl.DefaultUser) {
+		logger.Warn("cluster: neither cluster-secret nor masteruser is configured, other nodes can not run internal commands on this node")
+	}
+
+	// 注册到元数据之前使用配置中的角色
+	self := makeNode(cluster.self)
+	if master := replicaOf(); master != "" {
+		self.Role = roleReplica
+		self.Shard = master
 	}
+	cluster.nodes[cluster.self] = self
 
-	ctx := context.Background()
-	nodes := make([]string, 0, len(config.Properties.Peers)+1)
-	nodes = append(nodes, config.Properties.Self)
-	for _, peer := range config.Properties.Peers {
-		nodes = append(nodes, peer)
-		cluster.peerConnectionPool[peer] = pool.NewObjectPoolWithDefaultConfig(ctx, &connectionFactory{Peer: peer})
+	cluster.raft, err = raft.MakeRaft(&raft.Config{
+		Self:      cluster.self,
+		Voters:    voters(),
+		StateFile: config.Properties.ClusterConfigFile,
+		Learners:  cluster.metaAddrs,
+		FSM:       &clusterFSM{cluster: cluster},
+		Transport: &raftTransport{cluster: cluster},
+	})
+	if err != nil {
+		logger.Fatal("cluster: load raft state failed: " + err.Error())
 	}
-	cluster.nodes = nodes
-	cluster.peerPicker.AddNode(cluster.nodes...)
+	cluster.db.AddWriteListener(cluster.onWrite)
+	cluster.raft.Start()
+	go cluster.heartbeat()
 
 	return cluster
 }
 
+// virtualNodes 每个结点在哈希环上的虚拟结点数量
+func virtualNodes() int {
+	if config.Properties.VirtualNodes > 0 {
+		return config.Properties.VirtualNodes
+	}
+	return consistenthash.DefaultReplicas
+}
+
+// nodeTimeout 超过该时间没有收到心跳回复的结点会被标记为 PFAIL
+func nodeTimeout() time.Duration {
+	if config.Properties.ClusterNodeTimeout > 0 {
+		return time.Duration(config.Properties.ClusterNodeTimeout) * time.Millisecond
+	}
+	return defaultNodeTimeout
+}
+
+// peerOptions 连接其它结点 (连接池和复制流) 的参数
+func (cluster *ClusterDatabase) peerOptions() client.Options {
+	return client.Options{
+		User:       config.Properties.MasterUser,
+		Password:   peerPassword(),
+		TLSConfig:  cluster.peerTLS,
+		Peer:       true,
+		PeerSecret: config.Properties.ClusterSecret,
+	}
+}
+
+// peerPassword 连接其它结点 (连接池和复制流) 时使用的密码，集群中的结点通常使用相同的 requirepass
+// 配置了 aclfile 时 requirepass 不生效，只使用 masterauth
+func peerPassword() string {
+	if config.Properties.MasterAuth != "" || config.Properties.AclFile != "" {
+		return config.Properties.MasterAuth
+	}
+	return config.Properties.RequirePass
+}
+
+// replicaOf 本结点作为副本时所属分片的主结点，支持 "host port" 和 "host:port" 两种写法
+func replicaOf() string {
+	fields := strings.Fields(config.Properties.ReplicaOf)
+	if len(fields) == 2 {
+		return net.JoinHostPort(fields[0], fields[1])
+	}
+	return config.Properties.ReplicaOf
+}
+
+// voters raft 初始的投票者: 配置中的 peers 以及作为主结点启动的自己，所有结点上应当一致
+// 只在第一次启动时使用，之后以 cluster-config-file 中保存的为准，加入已有的集群需要 CLUSTER MEET
+func voters() []string {
+	seen := make(map[string]bool)
+	result := make([]string, 0, len(config.Properties.Peers)+1)
+	candidates := config.Properties.Peers
+	if replicaOf() == "" {
+		candidates = append([]string{config.Properties.Self}, candidates...)
+	}
+	for _, addr := range candidates {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			result = append(result, addr)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// addNodeLocked adds a node to the local view, caller must hold cluster.mu
+func (cluster *ClusterDatabase) addNodeLocked(addr string) *Node {
+	if node, ok := cluster.nodes[addr]; ok {
+		return node
+	}
+	node := makeNode(addr)
+	cluster.nodes[addr] = node
+	logger.Info("cluster: add node ", addr)
+	return node
+}
+
+// removeNodeLocked removes a node from the local view, caller must hold cluster.mu
+func (cluster *ClusterDatabase) removeNodeLocked(addr string) {
+	if _, ok := cluster.nodes[addr]; !ok {
+		return
+	}
+	delete(cluster.nodes, addr)
+	if p, ok := cluster.peerConnectionPool[addr]; ok {
+		delete(cluster.peerConnectionPool, addr)
+		go p.Close(context.Background())
+	}
+	delete(cluster.breakers, addr)
+	logger.Info("cluster: remove node ", addr)
+}
+
+// syncTopologyLocked 根据已提交的元数据更新本地的结点、分片和哈希环，caller must hold cluster.mu
+func (cluster *ClusterDatabase) syncTopologyLocked() {
+	for addr, mn := range cluster.meta.nodes {
+		node := cluster.addNodeLocked(addr)
+		node.Shard = mn.Shard
+		node.Role = mn.Role
+		node.ConfigEpoch = mn.ConfigEpoch
+	}
+	for addr := range cluster.nodes {
+		if _, ok := cluster.meta.nodes[addr]; !ok && addr != cluster.self {
+			cluster.removeNodeLocked(addr)
+		}
+	}
+
+	shards := make(map[string]string)
+	for addr, mn := range cluster.meta.nodes {
+		if _, ok := shards[mn.Shard]; !ok {
+			shards[mn.Shard] = ""
+		}
+		if mn.Role == roleMaster {
+			shards[mn.Shard] = addr
+		}
+	}
+	for shard := range cluster.shards {
+		if _, ok := shards[shard]; !ok {
+			cluster.peerPicker.RemoveNode(shard)
+		}
+	}
+	for shard, master := range shards {
+		old, ok := cluster.shards[shard]
+		if !ok {
+			cluster.peerPicker.AddNode(shard)
+		}
+		if old != master {
+			logger.Info("cluster: shard ", shard, " is served by ", master)
+		}
+	}
+	cluster.shards = shards
+}
+
+// pickNode returns the master node which owns the key
+func (cluster *ClusterDatabase) pickNode(key string) string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return cluster.shards[cluster.peerPicker.PickNode(key)]
+}
+
+// masterAddrs returns a sorted snapshot of the masters of all shards
+func (cluster *ClusterDatabase) masterAddrs() []string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	addrs := make([]string, 0, len(cluster.shards))
+	for _, master := range cluster.shards {
+		if master != "" {
+			addrs = append(addrs, master)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// nodeAddrs returns a sorted snapshot of all known nodes, including self
+func (cluster *ClusterDatabase) nodeAddrs() []string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	addrs := make([]string, 0, len(cluster.nodes))
+	for addr := range cluster.nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
 var router = makeRouter()
 
 func (cluster *ClusterDatabase) Exec(client resp.Connection, args database.CmdLine) (result resp.Reply) {
@@ -54,16 +281,31 @@ func (cluster *ClusterDatabase) Exec(client resp.Connection, args database.CmdLi
 		}
 	}()
 
+	if errReply := database2.CheckPermission(client, args); errReply != nil {
+		return errReply
+	}
 	cmdName := strings.ToLower(string(args[0]))
+	if isInternalCommand(args) && !client.IsPeer() {
+		return reply.MakeErrReply("ERR '" + internalCommandName(args) + "' is an internal command between cluster nodes")
+	}
 	cmdFunc, ok := router[cmdName]
 	if !ok {
-		result = reply.MakeErrReply("not support command")
+		return reply.MakeErrReply("ERR unknown command '" + cmdName + "', or not supported in cluster mode")
 	}
 	result = cmdFunc(cluster, client, args)
 	return
 }
 
 func (cluster *ClusterDatabase) Close() {
+	close(cluster.stopChan)
+	cluster.raft.Stop()
+	cluster.stopReplicators()
+	cluster.mu.Lock()
+	for addr, p := range cluster.peerConnectionPool {
+		p.Close(context.Background())
+		delete(cluster.peerConnectionPool, addr)
+	}
+	cluster.mu.Unlock()
 	cluster.db.Close()
 }
 
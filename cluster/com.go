@@ -7,28 +7,84 @@ import (
 	"go-redis/lib/utils"
 	"go-redis/resp/client"
 	"go-redis/resp/reply"
-	"strconv"
+	"sort"
+	"strings"
+	"time"
+
+	pool "github.com/jolestar/go-commons-pool"
 )
 
-func (cluster *ClusterDatabase) getPeerClient(peer string) (*client.Client, error) {
-	pool, ok := cluster.peerConnectionPool[peer]
+func (cluster *ClusterDatabase) getPeerPool(peer string) (*pool.ObjectPool, bool) {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	p, ok := cluster.peerConnectionPool[peer]
+	return p, ok
+}
+
+// getOrCreatePeerPool 连接池在第一次使用时创建，raft 需要在结点加入元数据之前与其通信
+func (cluster *ClusterDatabase) getOrCreatePeerPool(peer string) *pool.ObjectPool {
+	if p, ok := cluster.getPeerPool(peer); ok {
+		return p
+	}
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	p, ok := cluster.peerConnectionPool[peer]
 	if !ok {
+		p = pool.NewObjectPool(context.Background(), &connectionFactory{Peer: peer, Options: cluster.peerOptions()}, cluster.poolConfig)
+		cluster.peerConnectionPool[peer] = p
+	}
+	return p
+}
+
+// getPeerClient 从连接池借出连接，熔断器打开时直接失败，用完后必须调用 releasePeerClient
+func (cluster *ClusterDatabase) getPeerClient(peer string) (*client.Client, error) {
+	if peer == "" || peer == cluster.self {
 		return nil, errors.New("connection not found")
 	}
-	object, err := pool.BorrowObject(context.Background())
+	b := cluster.getBreaker(peer)
+	if !b.allow() {
+		return nil, errors.New("CLUSTERDOWN node " + peer + " is unreachable")
+	}
+	pool := cluster.getOrCreatePeerPool(peer)
+	ctx, cancel := context.WithTimeout(context.Background(), borrowTimeout)
+	defer cancel()
+	object, err := pool.BorrowObject(ctx)
 	if err != nil {
-		return nil, err
+		b.onFailure()
+		return nil, errors.New("CLUSTERDOWN node " + peer + " is unreachable: " + err.Error())
 	}
 	client2, ok := object.(*client.Client)
 	if !ok {
+		// 半开状态下这次借出就是探测请求，必须记录结果，否则熔断器一直等待探测结束
+		b.onFailure()
+		_ = pool.InvalidateObject(context.Background(), object)
 		return nil, errors.New("wrong object type")
 	}
 	return client2, nil
 }
 
+// releasePeerClient 根据请求结果更新熔断器，连接出错时销毁连接，否则归还给连接池
+func (cluster *ClusterDatabase) releasePeerClient(peer string, peerClient *client.Client, result resp.Reply) {
+	b := cluster.getBreaker(peer)
+	if !client.IsConnectionError(result) {
+		b.onSuccess()
+		_ = cluster.returnPeerClient(peer, peerClient)
+		return
+	}
+	b.onFailure()
+	pool, ok := cluster.getPeerPool(peer)
+	if !ok {
+		peerClient.Close()
+		return
+	}
+	_ = pool.InvalidateObject(context.Background(), peerClient)
+}
+
 func (cluster *ClusterDatabase) returnPeerClient(peer string, peerClient *client.Client) error {
-	pool, ok := cluster.peerConnectionPool[peer]
+	pool, ok := cluster.getPeerPool(peer)
 	if !ok {
+		// 结点已被移出集群，连接池已关闭
+		peerClient.Close()
 		return errors.New("connection not found")
 	}
 	err := pool.ReturnObject(context.Background(), peerClient)
@@ -40,24 +96,106 @@ func (cluster *ClusterDatabase) relay(peer string, conn resp.Connection, args []
 	if peer == cluster.self {
 		return cluster.db.Exec(conn, args)
 	}
+	if peer == "" {
+		return reply.MakeErrReply("CLUSTERDOWN The cluster is down")
+	}
 
 	peerClient, err := cluster.getPeerClient(peer)
 	if err != nil {
-		return reply.MakeErrReply("获取兄弟结点失败")
+		return reply.MakeErrReply(err.Error())
+	}
+	result := peerClient.SendWithDB(conn.GetDBIndex(), args)
+	cluster.releasePeerClient(peer, peerClient, result)
+	return result
+}
+
+// borrowTimeout 连接池耗尽时等待空闲连接的时间
+const borrowTimeout = time.Second
+
+// scatterTimeout 并发请求多个结点时默认的整体等待时间，慢结点不会拖住调用方
+const scatterTimeout = 3 * time.Second
+
+// withScatterTimeout 调用方没有截止时间时使用 scatterTimeout
+func withScatterTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
 	}
-	defer func(cluster *ClusterDatabase, peer string, peerClient *client.Client) {
-		cluster.returnPeerClient(peer, peerClient)
-	}(cluster, peer, peerClient)
+	return context.WithTimeout(ctx, scatterTimeout)
+}
+
+// gatherResult 并发请求多个结点的结果，失败和超时的结点记录在 errors 中，由调用方决定能否接受部分成功
+type gatherResult struct {
+	replies map[string]resp.Reply
+	errors  map[string]error
+}
 
-	peerClient.Send(utils.ToCmdLine("SELECT", strconv.Itoa(conn.GetDBIndex())))
-	return peerClient.Send(args)
+// errReply 汇总失败的结点，全部成功时返回 nil
+func (result *gatherResult) errReply(cmdName string) resp.Reply {
+	if len(result.errors) == 0 {
+		return nil
+	}
+	peers := make([]string, 0, len(result.errors))
+	for peer := range result.errors {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	msgs := make([]string, len(peers))
+	for i, peer := range peers {
+		msgs[i] = peer + ": " + result.errors[peer].Error()
+	}
+	return reply.MakeErrReply("ERR " + cmdName + " failed on " + strings.Join(msgs, "; "))
 }
 
-func (cluster *ClusterDatabase) broadcast(conn resp.Connection, args [][]byte) map[string]resp.Reply {
-	results := make(map[string]resp.Reply)
-	for _, node := range cluster.nodes {
-		resp := cluster.relay(node, conn, args)
-		results[node] = resp
+// scatter 并发地对每个结点调用 fn，ctx 结束时仍未返回的结点记为超时，ctx 没有截止时间时最多等待 scatterTimeout
+func scatter(ctx context.Context, peers []string, fn func(peer string) resp.Reply) *gatherResult {
+	ctx, cancel := withScatterTimeout(ctx)
+	defer cancel()
+	type item struct {
+		peer  string
+		reply resp.Reply
 	}
-	return results
+	ch := make(chan item, len(peers)) // 带缓冲，超时后返回的请求不会阻塞
+	for _, peer := range peers {
+		go func(peer string) {
+			ch <- item{peer: peer, reply: fn(peer)}
+		}(peer)
+	}
+
+	result := &gatherResult{
+		replies: make(map[string]resp.Reply, len(peers)),
+		errors:  make(map[string]error),
+	}
+	for pending := len(peers); pending > 0; pending-- {
+		select {
+		case it := <-ch:
+			if errReply, ok := it.reply.(reply.ErrorReply); ok {
+				result.errors[it.peer] = errors.New(errReply.Error())
+			} else {
+				result.replies[it.peer] = it.reply
+			}
+		case <-ctx.Done():
+			for _, peer := range peers {
+				if _, ok := result.replies[peer]; !ok && result.errors[peer] == nil {
+					result.errors[peer] = errors.New("timeout")
+				}
+			}
+			return result
+		}
+	}
+	return result
+}
+
+// relayLocal 让 peer 只在本地执行命令，避免对方再次广播
+func (cluster *ClusterDatabase) relayLocal(peer string, conn resp.Connection, args [][]byte) resp.Reply {
+	if peer == cluster.self {
+		return cluster.db.Exec(conn, args)
+	}
+	return cluster.relay(peer, conn, utils.ToCmdLine2("CLUSTER", append([][]byte{[]byte("LOCAL")}, args...)...))
+}
+
+// broadcast 并发地在所有分片的主结点上执行命令，等待到 ctx 结束
+func (cluster *ClusterDatabase) broadcast(ctx context.Context, conn resp.Connection, args [][]byte) *gatherResult {
+	return scatter(ctx, cluster.masterAddrs(), func(peer string) resp.Reply {
+		return cluster.relayLocal(peer, conn, args)
+	})
 }
@@ -0,0 +1,116 @@
+package cluster
+
+import (
+	"context"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	两阶段提交的协调者
+	跨结点的多 key 写命令在每个参与者上 PREPARE，全部成功后 COMMIT，全部提交成功后 FINISH 释放锁，
+	任意一步失败时 ROLLBACK 所有参与者，已提交的参与者仍然持有锁，可以安全地恢复原值。
+	协调者失联时参与者在 txTimeout 之后自动回滚未提交的事务，已提交未结束的事务保留提交的结果。
+*/
+
+// txSeq 以启动时间为初值，避免重启后生成与参与者上残留事务相同的 ID
+var txSeq = uint64(time.Now().UnixNano())
+
+type coordinator struct {
+	cluster *ClusterDatabase
+	conn    resp.Connection
+	id      string
+	peers   []string // 已经准备好的参与者
+}
+
+func (cluster *ClusterDatabase) beginTx(conn resp.Connection) *coordinator {
+	return &coordinator{
+		cluster: cluster,
+		conn:    conn,
+		id:      cluster.self + "-" + strconv.FormatUint(atomic.AddUint64(&txSeq, 1), 10),
+	}
+}
+
+func (c *coordinator) send(peer string, args [][]byte) resp.Reply {
+	if peer == c.cluster.self {
+		return execTxCommand(c.cluster, c.conn, args)
+	}
+	return c.cluster.relay(peer, c.conn, args)
+}
+
+// prepare 失败时回滚整个事务并返回错误
+func (c *coordinator) prepare(peer string, cmdLine [][]byte) resp.Reply {
+	// 超时的参与者可能在之后准备成功，回滚时也要包括它
+	c.peers = append(c.peers, peer)
+	result := c.send(peer, utils.ToCmdLine2("PREPARE", append([][]byte{[]byte(c.id)}, cmdLine...)...))
+	if reply.IsErrReply(result) {
+		c.rollback()
+		return result
+	}
+	return result
+}
+
+// commit 并发地提交所有参与者，返回每个参与者的执行结果，任意一个参与者提交失败时回滚整个事务并返回错误
+func (c *coordinator) commit() (map[string]resp.Reply, resp.Reply) {
+	result := scatter(context.Background(), c.peers, func(peer string) resp.Reply {
+		return c.send(peer, utils.ToCmdLine("COMMIT", c.id))
+	})
+	if errReply := result.errReply("commit"); errReply != nil {
+		c.rollback()
+		return nil, errReply
+	}
+	c.finish()
+	return result.replies, nil
+}
+
+// finish 通知参与者事务已经提交，释放锁，没有收到的参与者在 txTimeout 之后自行释放
+func (c *coordinator) finish() {
+	result := scatter(context.Background(), c.peers, func(peer string) resp.Reply {
+		return c.send(peer, utils.ToCmdLine("FINISH", c.id))
+	})
+	if errReply := result.errReply("finish"); errReply != nil {
+		logger.Warn("cluster: transaction ", c.id, ": ", errReply.(reply.ErrorReply).Error())
+	}
+	c.peers = nil
+}
+
+func (c *coordinator) rollback() {
+	scatter(context.Background(), c.peers, func(peer string) resp.Reply {
+		return c.send(peer, utils.ToCmdLine("ROLLBACK", c.id))
+	})
+	c.peers = nil
+}
+
+// execTx 在多个结点上原子地执行命令，cmdLines 为结点 -> 在该结点上执行的命令
+// 按结点地址的顺序依次准备，所有事务以相同的顺序在各结点上加锁，互相等待时不会形成环，然后并发地提交
+func (cluster *ClusterDatabase) execTx(conn resp.Connection, cmdLines map[string][][]byte) (map[string]resp.Reply, resp.Reply) {
+	peers := make([]string, 0, len(cmdLines))
+	for peer := range cmdLines {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+
+	tx := cluster.beginTx(conn)
+	for _, peer := range peers {
+		if result := tx.prepare(peer, cmdLines[peer]); reply.IsErrReply(result) {
+			// NX 条件不满足时原样返回，调用方据此返回 0
+			if isPreconditionFailed(result) {
+				return nil, result
+			}
+			return nil, reply.MakeErrReply("ERR prepare failed on " + peer + ": " + result.(reply.ErrorReply).Error())
+		}
+	}
+	return tx.commit()
+}
+
+// isPreconditionFailed 参与者因为 NX 条件不满足而拒绝准备
+func isPreconditionFailed(result resp.Reply) bool {
+	errReply, ok := result.(reply.ErrorReply)
+	return ok && errReply.Error() == errPrecondition
+}
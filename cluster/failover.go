@@ -0,0 +1,45 @@
+package cluster
+
+import (
+	"go-redis/lib/logger"
+	"time"
+)
+
+/*
+	自动故障转移
+	--副本发现所属分片的主结点被标记为 FAIL (已经过多数结点确认) 后，通过 raft 提交 FAILOVER
+	--FAILOVER 只有在分片的主结点仍是故障结点时才生效，多个副本同时发起时只有最先提交的生效
+	--生效后纪元加一，新主结点的配置纪元为该纪元，旧主结点恢复后以副本的身份接收新主结点的复制流
+*/
+
+// tryFailover proposes to take over the shard if self is a replica whose master has failed
+func (cluster *ClusterDatabase) tryFailover() {
+	cluster.mu.Lock()
+	self := cluster.nodes[cluster.self]
+	if _, registered := cluster.meta.nodes[cluster.self]; !registered || self.Role != roleReplica ||
+		cluster.electing || time.Since(cluster.lastElection) < 2*cluster.nodeTimeout {
+		cluster.mu.Unlock()
+		return
+	}
+	shard := self.Shard
+	oldMaster := cluster.shards[shard]
+	if master, ok := cluster.nodes[oldMaster]; ok && master.flag != flagFail {
+		cluster.mu.Unlock()
+		return
+	}
+	cluster.electing = true
+	cluster.lastElection = time.Now()
+	cluster.mu.Unlock()
+
+	logger.Info("cluster: try to take over shard ", shard, " from ", oldMaster)
+	go func() {
+		defer func() {
+			cluster.mu.Lock()
+			cluster.electing = false
+			cluster.mu.Unlock()
+		}()
+		if err := cluster.propose("FAILOVER", shard, cluster.self, oldMaster); err != nil {
+			logger.Warn("cluster: failover of shard ", shard, " failed: ", err)
+		}
+	}()
+}
@@ -0,0 +1,237 @@
+package cluster
+
+import (
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"time"
+)
+
+/*
+	集群总线
+	每个结点周期性地向元数据中的所有结点发送 CLUSTER GOSSIP，消息中携带发送方视角下所有结点的状态，
+	对方回复自己视角下所有结点的状态，双方据此收集故障报告。结点列表和角色以 raft 提交的元数据为准，不通过 gossip 传播。
+	--长时间没有收到回复的结点标记为 PFAIL (疑似下线)
+	--超过半数结点都认为其 PFAIL 时标记为 FAIL (确认下线)，FAIL 状态随 gossip 传播
+	--重新收到回复后恢复为 online
+	请求: CLUSTER GOSSIP sender [addr flag]...
+	回复: [addr flag]...
+*/
+
+const (
+	heartbeatInterval  = time.Second
+	defaultNodeTimeout = 5 * time.Second
+	gossipEntrySize    = 2
+)
+
+type nodeFlag uint8
+
+const (
+	flagOnline nodeFlag = iota
+	flagPFail
+	flagFail
+)
+
+func (f nodeFlag) String() string {
+	switch f {
+	case flagPFail:
+		return "pfail"
+	case flagFail:
+		return "fail"
+	}
+	return "online"
+}
+
+func parseNodeFlag(s string) nodeFlag {
+	switch s {
+	case "pfail":
+		return flagPFail
+	case "fail":
+		return flagFail
+	}
+	return flagOnline
+}
+
+type nodeRole uint8
+
+const (
+	roleMaster nodeRole = iota
+	roleReplica
+)
+
+func (r nodeRole) String() string {
+	if r == roleReplica {
+		return "replica"
+	}
+	return "master"
+}
+
+func parseNodeRole(s string) nodeRole {
+	if s == "replica" {
+		return roleReplica
+	}
+	return roleMaster
+}
+
+// Node is a member of the cluster seen by this node
+type Node struct {
+	Addr        string
+	Shard       string // 所属分片，以分片最初的主结点地址命名，决定其在哈希环上的位置
+	Role        nodeRole
+	ConfigEpoch uint64 // 成为分片主结点时的纪元
+
+	flag        nodeFlag
+	lastPong    time.Time
+	latency     time.Duration // 心跳往返时间的滑动平均
+	pinging     bool
+	failReports map[string]time.Time // 报告者 -> 报告时间
+}
+
+func makeNode(addr string) *Node {
+	return &Node{
+		Addr:        addr,
+		Shard:       addr,
+		Role:        roleMaster,
+		lastPong:    time.Now(), // 新加入的结点有一个超时周期的宽限
+		failReports: make(map[string]time.Time),
+	}
+}
+
+func (cluster *ClusterDatabase) heartbeat() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cluster.stopChan:
+			return
+		case <-ticker.C:
+			for _, peer := range cluster.nodeAddrs() {
+				if peer != cluster.self {
+					go cluster.ping(peer)
+				}
+			}
+			cluster.detectFailures()
+			cluster.ensureRegistered()
+			cluster.tryFailover()
+			cluster.syncReplicators()
+		}
+	}
+}
+
+// gossipMessage 本结点视角下所有结点的状态
+func (cluster *ClusterDatabase) gossipMessage() [][]byte {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	msg := make([][]byte, 0, gossipEntrySize*len(cluster.nodes))
+	for addr, node := range cluster.nodes {
+		msg = append(msg, []byte(addr), []byte(node.flag.String()))
+	}
+	return msg
+}
+
+// ping sends CLUSTER GOSSIP to peer and merges its reply
+func (cluster *ClusterDatabase) ping(peer string) {
+	cluster.mu.Lock()
+	node, ok := cluster.nodes[peer]
+	if !ok || node.pinging {
+		cluster.mu.Unlock()
+		return
+	}
+	node.pinging = true
+	cluster.mu.Unlock()
+	defer func() {
+		cluster.mu.Lock()
+		node.pinging = false
+		cluster.mu.Unlock()
+	}()
+
+	peerClient, err := cluster.getPeerClient(peer)
+	if err != nil {
+		return
+	}
+
+	args := utils.ToCmdLine2("CLUSTER", append([][]byte{[]byte("GOSSIP"), []byte(cluster.self)}, cluster.gossipMessage()...)...)
+	start := time.Now()
+	result := peerClient.Send(args)
+	cluster.releasePeerClient(peer, peerClient, result)
+	multiBulk, ok := result.(*reply.MultiBulkReply)
+	if !ok {
+		return
+	}
+	rtt := time.Since(start)
+	cluster.mu.Lock()
+	if node.latency == 0 {
+		node.latency = rtt
+	} else {
+		node.latency = (node.latency*4 + rtt) / 5
+	}
+	cluster.mu.Unlock()
+	cluster.handleGossip(peer, multiBulk.Args)
+}
+
+// handleGossip merges the view of sender, called for both requests and replies
+func (cluster *ClusterDatabase) handleGossip(sender string, msg [][]byte) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	now := time.Now()
+	senderNode, ok := cluster.nodes[sender]
+	if !ok || sender == cluster.self {
+		return
+	}
+	senderNode.lastPong = now
+	if senderNode.flag != flagOnline {
+		logger.Info("cluster: node ", sender, " is online again")
+		senderNode.flag = flagOnline
+		senderNode.failReports = make(map[string]time.Time)
+	}
+
+	for i := 0; i+gossipEntrySize <= len(msg); i += gossipEntrySize {
+		addr := string(msg[i])
+		node, ok := cluster.nodes[addr]
+		if !ok || addr == cluster.self || addr == sender {
+			continue
+		}
+		flag := parseNodeFlag(string(msg[i+1]))
+		if flag == flagOnline {
+			delete(node.failReports, sender)
+			continue
+		}
+		node.failReports[sender] = now
+		// 自己最近还能联系上的结点不接受其他结点传播的 FAIL
+		if flag == flagFail && node.flag != flagFail && now.Sub(node.lastPong) > cluster.nodeTimeout {
+			logger.Warn("cluster: node ", addr, " is marked as fail by ", sender)
+			node.flag = flagFail
+		}
+	}
+}
+
+// detectFailures marks timeout nodes as PFAIL and promotes PFAIL to FAIL once a majority agrees
+func (cluster *ClusterDatabase) detectFailures() {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	now := time.Now()
+	quorum := len(cluster.nodes)/2 + 1
+	for addr, node := range cluster.nodes {
+		if addr == cluster.self {
+			continue
+		}
+		if node.flag == flagOnline && now.Sub(node.lastPong) > cluster.nodeTimeout {
+			logger.Warn("cluster: node ", addr, " is possibly failed")
+			node.flag = flagPFail
+		}
+		if node.flag != flagPFail {
+			continue
+		}
+		for reporter, reportTime := range node.failReports {
+			if now.Sub(reportTime) > 2*cluster.nodeTimeout {
+				delete(node.failReports, reporter)
+			}
+		}
+		if len(node.failReports)+1 >= quorum {
+			logger.Warn("cluster: node ", addr, " is failed")
+			node.flag = flagFail
+		}
+	}
+}
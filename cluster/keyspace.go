@@ -0,0 +1,162 @@
+package cluster
+
+import (
+	"context"
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"math/rand"
+	"strconv"
+)
+
+/*
+	需要遍历整个集群的命令，由收到命令的结点在所有主结点上执行后汇总
+	--KEYS      合并所有结点的结果
+	--SCAN      游标的低 16 位为结点在主结点列表中的下标，其余位为该结点上的游标，拓扑变化时游标可能失效
+	--DBSIZE    各结点求和
+	--RANDOMKEY 按各结点 key 的数量加权随机选择结点
+	--FLUSHALL  广播
+*/
+
+const scanNodeBits = 16
+
+// keysFunc KEYS pattern
+func keysFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 2 {
+		return reply.MakeArgNumErrReply("keys")
+	}
+	result := cluster.broadcast(context.Background(), conn, cmdArgs)
+	if errReply := result.errReply("keys"); errReply != nil {
+		return errReply
+	}
+	keys := make([][]byte, 0)
+	for _, r := range result.replies {
+		if multiBulk, ok := r.(*reply.MultiBulkReply); ok {
+			keys = append(keys, multiBulk.Args...)
+		}
+	}
+	return reply.MakeMultiBulkReply(keys)
+}
+
+// dbsizeFunc DBSIZE
+func dbsizeFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 1 {
+		return reply.MakeArgNumErrReply("dbsize")
+	}
+	sizes, errReply := cluster.dbSizes(conn)
+	if errReply != nil {
+		return errReply
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return reply.MakeIntReply(total)
+}
+
+// dbSizes 每个主结点上 key 的数量
+func (cluster *ClusterDatabase) dbSizes(conn resp.Connection) (map[string]int64, resp.Reply) {
+	result := cluster.broadcast(context.Background(), conn, [][]byte{[]byte("DBSIZE")})
+	if errReply := result.errReply("dbsize"); errReply != nil {
+		return nil, errReply
+	}
+	sizes := make(map[string]int64, len(result.replies))
+	for peer, r := range result.replies {
+		intReply, ok := r.(*reply.IntReply)
+		if !ok {
+			return nil, reply.MakeErrReply("ERR illegal dbsize reply from " + peer)
+		}
+		sizes[peer] = intReply.Code
+	}
+	return sizes, nil
+}
+
+// randomkeyFunc RANDOMKEY
+func randomkeyFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 1 {
+		return reply.MakeArgNumErrReply("randomkey")
+	}
+	sizes, errReply := cluster.dbSizes(conn)
+	if errReply != nil {
+		return errReply
+	}
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	if total == 0 {
+		return reply.MakeNullBulkReply()
+	}
+	n := rand.Int63n(total)
+	for _, peer := range cluster.masterAddrs() {
+		if n < sizes[peer] {
+			return cluster.relayLocal(peer, conn, cmdArgs)
+		}
+		n -= sizes[peer]
+	}
+	return reply.MakeNullBulkReply()
+}
+
+// flushallFunc FLUSHALL
+func flushallFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if errReply := cluster.broadcast(context.Background(), conn, cmdArgs).errReply("flushall"); errReply != nil {
+		return errReply
+	}
+	return reply.MakeOkReply()
+}
+
+// scanFunc SCAN cursor [MATCH pattern] [COUNT count]
+// 依次遍历每个主结点，一个结点遍历完后游标移到下一个结点
+func scanFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply("scan")
+	}
+	cursor, err := strconv.ParseUint(string(cmdArgs[1]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid cursor")
+	}
+	nodeIndex := int(cursor & (1<<scanNodeBits - 1))
+	nodeCursor := cursor >> scanNodeBits
+
+	peers := cluster.masterAddrs()
+	if nodeIndex >= len(peers) {
+		return makeScanReply(0, nil)
+	}
+	args := make([][]byte, len(cmdArgs))
+	copy(args, cmdArgs)
+	args[1] = []byte(strconv.FormatUint(nodeCursor, 10))
+	result := cluster.relayLocal(peers[nodeIndex], conn, args)
+	if reply.IsErrReply(result) {
+		return result
+	}
+	multiRaw, ok := result.(*reply.MultiRawReply)
+	if !ok || len(multiRaw.Replies) != 2 {
+		return reply.MakeErrReply("ERR illegal scan reply from " + peers[nodeIndex])
+	}
+	nextBulk, ok1 := multiRaw.Replies[0].(*reply.BulkReply)
+	keys, ok2 := multiRaw.Replies[1].(*reply.MultiBulkReply)
+	if !ok1 || !ok2 {
+		if _, empty := multiRaw.Replies[1].(*reply.EmptyMultiBulkReply); !ok1 || !empty {
+			return reply.MakeErrReply("ERR illegal scan reply from " + peers[nodeIndex])
+		}
+		keys = reply.MakeMultiBulkReply(nil)
+	}
+	next, err := strconv.ParseUint(string(nextBulk.Arg), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR illegal scan reply from " + peers[nodeIndex])
+	}
+
+	if next == 0 {
+		nodeIndex++
+		if nodeIndex >= len(peers) {
+			return makeScanReply(0, keys.Args)
+		}
+	}
+	return makeScanReply(next<<scanNodeBits|uint64(nodeIndex), keys.Args)
+}
+
+func makeScanReply(cursor uint64, keys [][]byte) resp.Reply {
+	return reply.MakeMultiRawReply([]resp.Reply{
+		reply.MakeBulkReply([]byte(strconv.FormatUint(cursor, 10))),
+		reply.MakeMultiBulkReply(keys),
+	})
+}
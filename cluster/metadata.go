@@ -0,0 +1,271 @@
+package cluster
+
+import (
+	"bytes"
+	"errors"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/parser"
+	"go-redis/resp/reply"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+	集群元数据
+	结点列表、分片归属和纪元保存在 raft 复制的日志中，所有结点按相同的顺序应用相同的命令，拓扑变更因此是线性一致的。
+	日志中的命令:
+	--BOOTSTRAP addr...                          首次启动时将投票者加入为各自分片的主结点，只生效一次
+	--ADDNODE addr shard role                    结点注册，结点已存在或已被遗忘时忽略
+	--DELNODE addr                               CLUSTER FORGET，删除结点并记为已遗忘
+	--MEET addr                                  CLUSTER MEET，清除遗忘记录
+	--FAILOVER shard newMaster oldMaster         分片的主结点仍是 oldMaster 时由副本 newMaster 接管，纪元加一
+	快照由以下命令组成: BOOTSTRAPPED, EPOCH n, NODE addr shard role configEpoch, FORGOTTEN addr
+*/
+
+type metaNode struct {
+	Shard       string
+	Role        nodeRole
+	ConfigEpoch uint64
+}
+
+type clusterMeta struct {
+	bootstrapped bool
+	epoch        uint64
+	nodes        map[string]*metaNode
+	forgotten    map[string]bool
+}
+
+func makeClusterMeta() *clusterMeta {
+	return &clusterMeta{
+		nodes:     make(map[string]*metaNode),
+		forgotten: make(map[string]bool),
+	}
+}
+
+// masterOf returns the master of shard
+func (meta *clusterMeta) masterOf(shard string) string {
+	for addr, node := range meta.nodes {
+		if node.Shard == shard && node.Role == roleMaster {
+			return addr
+		}
+	}
+	return ""
+}
+
+func (meta *clusterMeta) apply(cmd [][]byte) {
+	args := make([]string, len(cmd))
+	for i, arg := range cmd {
+		args[i] = string(arg)
+	}
+	switch strings.ToUpper(args[0]) {
+	case "BOOTSTRAP":
+		if meta.bootstrapped {
+			return
+		}
+		meta.bootstrapped = true
+		for _, addr := range args[1:] {
+			if _, ok := meta.nodes[addr]; !ok {
+				meta.nodes[addr] = &metaNode{Shard: addr, Role: roleMaster}
+			}
+		}
+	case "ADDNODE":
+		if len(args) != 4 || meta.forgotten[args[1]] {
+			return
+		}
+		if _, ok := meta.nodes[args[1]]; !ok {
+			meta.nodes[args[1]] = &metaNode{Shard: args[2], Role: parseNodeRole(args[3])}
+		}
+	case "DELNODE":
+		if len(args) != 2 {
+			return
+		}
+		delete(meta.nodes, args[1])
+		meta.forgotten[args[1]] = true
+	case "MEET":
+		if len(args) != 2 {
+			return
+		}
+		delete(meta.forgotten, args[1])
+	case "FAILOVER":
+		if len(args) != 4 {
+			return
+		}
+		shard, newMaster, oldMaster := args[1], args[2], args[3]
+		node, ok := meta.nodes[newMaster]
+		if !ok || node.Shard != shard || node.Role != roleReplica || meta.masterOf(shard) != oldMaster {
+			return
+		}
+		meta.epoch++
+		for _, n := range meta.nodes {
+			if n.Shard == shard {
+				n.Role = roleReplica
+			}
+		}
+		node.Role = roleMaster
+		node.ConfigEpoch = meta.epoch
+		logger.Info("cluster: ", newMaster, " takes over shard ", shard, " at epoch ", meta.epoch)
+	// 以下命令只出现在快照中
+	case "BOOTSTRAPPED":
+		meta.bootstrapped = true
+	case "EPOCH":
+		if len(args) == 2 {
+			meta.epoch, _ = strconv.ParseUint(args[1], 10, 64)
+		}
+	case "NODE":
+		if len(args) == 5 {
+			configEpoch, _ := strconv.ParseUint(args[4], 10, 64)
+			meta.nodes[args[1]] = &metaNode{Shard: args[2], Role: parseNodeRole(args[3]), ConfigEpoch: configEpoch}
+		}
+	case "FORGOTTEN":
+		if len(args) == 2 {
+			meta.forgotten[args[1]] = true
+		}
+	}
+}
+
+func (meta *clusterMeta) snapshot() []byte {
+	var buf bytes.Buffer
+	if meta.bootstrapped {
+		buf.Write(reply.MakeMultiBulkReply(utils.ToCmdLine("BOOTSTRAPPED")).ToBytes())
+	}
+	buf.Write(reply.MakeMultiBulkReply(utils.ToCmdLine("EPOCH", strconv.FormatUint(meta.epoch, 10))).ToBytes())
+	for addr, node := range meta.nodes {
+		cmdLine := utils.ToCmdLine("NODE", addr, node.Shard, node.Role.String(), strconv.FormatUint(node.ConfigEpoch, 10))
+		buf.Write(reply.MakeMultiBulkReply(cmdLine).ToBytes())
+	}
+	for addr := range meta.forgotten {
+		buf.Write(reply.MakeMultiBulkReply(utils.ToCmdLine("FORGOTTEN", addr)).ToBytes())
+	}
+	return buf.Bytes()
+}
+
+// clusterFSM applies the committed metadata commands to the cluster
+type clusterFSM struct {
+	cluster *ClusterDatabase
+}
+
+func (f *clusterFSM) Apply(cmd [][]byte) {
+	cluster := f.cluster
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	cluster.meta.apply(cmd)
+	cluster.syncTopologyLocked()
+}
+
+func (f *clusterFSM) Snapshot() []byte {
+	cluster := f.cluster
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	return cluster.meta.snapshot()
+}
+
+func (f *clusterFSM) Restore(data []byte) {
+	meta := makeClusterMeta()
+	for payload := range parser.ParseStream(bytes.NewReader(data)) {
+		if payload.Err != nil {
+			break
+		}
+		if cmdLine, ok := payload.Data.(*reply.MultiBulkReply); ok {
+			meta.apply(cmdLine.Args)
+		}
+	}
+	cluster := f.cluster
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+	cluster.meta = meta
+	cluster.syncTopologyLocked()
+}
+
+// raftTransport sends raft RPC through the peer connection pools
+type raftTransport struct {
+	cluster *ClusterDatabase
+}
+
+func (t *raftTransport) Send(peer string, args [][]byte) resp.Reply {
+	peerClient, err := t.cluster.getPeerClient(peer)
+	if err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	result := peerClient.Send(args)
+	t.cluster.releasePeerClient(peer, peerClient, result)
+	return result
+}
+
+// metaAddrs returns all nodes in the metadata, they are the learners of raft
+func (cluster *ClusterDatabase) metaAddrs() []string {
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	addrs := make([]string, 0, len(cluster.meta.nodes))
+	for addr := range cluster.meta.nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// propose commits a metadata command, must not be called with cluster.mu held
+func (cluster *ClusterDatabase) propose(cmd ...string) error {
+	return cluster.raft.Propose(utils.ToCmdLine(cmd...))
+}
+
+// ensureRegistered bootstraps the metadata, registers self and makes a master a raft voter if needed
+func (cluster *ClusterDatabase) ensureRegistered() {
+	// raft.mu 需要在 cluster.mu 之前获取
+	isVoter := cluster.raft.IsVoter(cluster.self)
+	cluster.mu.Lock()
+	metaSelf, registered := cluster.meta.nodes[cluster.self]
+	// 通过 CLUSTER MEET 加入的主结点注册后还需要成为投票者
+	needVoter := registered && metaSelf.Role == roleMaster && !isVoter
+	if (registered && !needVoter) || cluster.meta.forgotten[cluster.self] || cluster.registering {
+		cluster.mu.Unlock()
+		return
+	}
+	cluster.registering = true
+	bootstrapped := cluster.meta.bootstrapped
+	self := cluster.nodes[cluster.self]
+	shard, role := self.Shard, self.Role
+	cluster.mu.Unlock()
+
+	go func() {
+		defer func() {
+			cluster.mu.Lock()
+			cluster.registering = false
+			cluster.mu.Unlock()
+		}()
+		if !registered {
+			// 只有投票者发起 BOOTSTRAP，其余结点在注册之前收不到日志，无法等待提案在本地应用
+			if !bootstrapped && isVoter {
+				if err := cluster.propose(append([]string{"BOOTSTRAP"}, cluster.raft.Voters()...)...); err != nil {
+					logger.Warn("cluster: bootstrap failed: ", err)
+					return
+				}
+			}
+			if err := cluster.propose("ADDNODE", cluster.self, shard, role.String()); err != nil {
+				logger.Warn("cluster: register failed: ", err)
+				return
+			}
+			if role != roleMaster || isVoter {
+				return
+			}
+		}
+		if err := cluster.raft.AddVoter(cluster.self); err != nil {
+			logger.Warn("cluster: add self to raft voters failed: ", err)
+		}
+	}()
+}
+
+// meet clears the forgotten record of addr and tells it the voters, then it will register itself
+func (cluster *ClusterDatabase) meet(addr string) error {
+	if err := cluster.propose("MEET", addr); err != nil {
+		return err
+	}
+	args := utils.ToCmdLine2("CLUSTER", append([][]byte{[]byte("JOIN")}, utils.ToCmdLine(cluster.raft.Voters()...)...)...)
+	result := (&raftTransport{cluster: cluster}).Send(addr, args)
+	if errReply, ok := result.(reply.ErrorReply); ok {
+		return errors.New(errReply.Error())
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package cluster
+
+import (
+	"go-redis/acl"
+	"go-redis/config"
+	database2 "go-redis/database"
+	"go-redis/datastruct/lock"
+	"go-redis/lib/consistenthash"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	pool "github.com/jolestar/go-commons-pool"
+)
+
+func TestMain(m *testing.M) {
+	config.Properties.Databases = 16
+	logger.SetOutput(io.Discard)
+	acl.Setup()
+	os.Exit(m.Run())
+}
+
+// makeTestCluster 创建不启动 raft 和心跳的集群结点，拓扑只通过 clusterFSM 修改
+func makeTestCluster(self string) *ClusterDatabase {
+	cluster := &ClusterDatabase{
+		self:               self,
+		db:                 database2.NewStandaloneDatabase(),
+		meta:               makeClusterMeta(),
+		nodes:              map[string]*Node{self: makeNode(self)},
+		shards:             make(map[string]string),
+		peerPicker:         consistenthash.NewNodeMapWithReplicas(virtualNodes(), nil),
+		peerConnectionPool: make(map[string]*pool.ObjectPool),
+		poolConfig:         makePoolConfig(),
+		breakers:           make(map[string]*breaker),
+		replicators:        make(map[string]*replicator),
+		keyLocks:           lock.Make(1024),
+		transactions:       make(map[string]*Transaction),
+		nodeTimeout:        nodeTimeout(),
+		stopChan:           make(chan struct{}),
+	}
+	return cluster
+}
+
+// describeMeta 按地址排序输出 addr:shard:role:configEpoch，以及遗忘的结点
+func describeMeta(meta *clusterMeta) string {
+	var parts []string
+	for addr, node := range meta.nodes {
+		parts = append(parts, addr+":"+node.Shard+":"+node.Role.String()+":"+strconv.FormatUint(node.ConfigEpoch, 10))
+	}
+	for addr := range meta.forgotten {
+		parts = append(parts, "forgotten:"+addr)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+func TestClusterMetaApply(t *testing.T) {
+	meta := makeClusterMeta()
+	steps := []struct {
+		cmd  []string
+		want string
+	}{
+		{[]string{"BOOTSTRAP", "a", "b"}, "a:a:master:0 b:b:master:0"},
+		// 只生效一次
+		{[]string{"BOOTSTRAP", "c"}, "a:a:master:0 b:b:master:0"},
+		{[]string{"ADDNODE", "a2", "a", "replica"}, "a2:a:replica:0 a:a:master:0 b:b:master:0"},
+		// 已存在的结点不会被覆盖
+		{[]string{"ADDNODE", "a2", "b", "master"}, "a2:a:replica:0 a:a:master:0 b:b:master:0"},
+		{[]string{"ADDNODE", "c"}, "a2:a:replica:0 a:a:master:0 b:b:master:0"},
+		// 主结点不是 oldMaster 或者新主结点不是该分片的副本时忽略
+		{[]string{"FAILOVER", "a", "a2", "b"}, "a2:a:replica:0 a:a:master:0 b:b:master:0"},
+		{[]string{"FAILOVER", "b", "a2", "b"}, "a2:a:replica:0 a:a:master:0 b:b:master:0"},
+		{[]string{"FAILOVER", "a", "a2", "a"}, "a2:a:master:1 a:a:replica:0 b:b:master:0"},
+		{[]string{"FAILOVER", "a", "a2", "a"}, "a2:a:master:1 a:a:replica:0 b:b:master:0"},
+		{[]string{"DELNODE", "b"}, "a2:a:master:1 a:a:replica:0 forgotten:b"},
+		// 遗忘的结点不能重新注册，直到 MEET
+		{[]string{"ADDNODE", "b", "b", "master"}, "a2:a:master:1 a:a:replica:0 forgotten:b"},
+		{[]string{"MEET", "b"}, "a2:a:master:1 a:a:replica:0"},
+		{[]string{"ADDNODE", "b", "b", "master"}, "a2:a:master:1 a:a:replica:0 b:b:master:0"},
+	}
+	for _, step := range steps {
+		meta.apply(utils.ToCmdLine(step.cmd...))
+		if got := describeMeta(meta); got != step.want {
+			t.Fatalf("after %v: got %q, want %q", step.cmd, got, step.want)
+		}
+	}
+	if !meta.bootstrapped || meta.epoch != 1 {
+		t.Fatalf("bootstrapped = %v, epoch = %d", meta.bootstrapped, meta.epoch)
+	}
+	if master := meta.masterOf("a"); master != "a2" {
+		t.Fatalf("master of a = %q", master)
+	}
+}
+
+func TestClusterFSMSnapshotRestore(t *testing.T) {
+	src := makeTestCluster("a")
+	srcFSM := &clusterFSM{cluster: src}
+	for _, cmd := range [][]string{
+		{"BOOTSTRAP", "a", "b"},
+		{"ADDNODE", "a2", "a", "replica"},
+		{"ADDNODE", "c", "c", "master"},
+		{"FAILOVER", "a", "a2", "a"},
+		{"DELNODE", "c"},
+	} {
+		srcFSM.Apply(utils.ToCmdLine(cmd...))
+	}
+	if got := strings.Join(src.masterAddrs(), ","); got != "a2,b" {
+		t.Fatalf("masters after apply = %q", got)
+	}
+
+	// 快照在另一个结点上恢复，旧的拓扑被替换
+	dst := makeTestCluster("b")
+	dstFSM := &clusterFSM{cluster: dst}
+	dstFSM.Apply(utils.ToCmdLine("ADDNODE", "stale", "stale", "master"))
+	dstFSM.Restore(srcFSM.Snapshot())
+
+	if got, want := describeMeta(dst.meta), describeMeta(src.meta); got != want {
+		t.Fatalf("restored meta = %q, want %q", got, want)
+	}
+	if !dst.meta.bootstrapped || dst.meta.epoch != src.meta.epoch {
+		t.Fatalf("restored bootstrapped = %v, epoch = %d", dst.meta.bootstrapped, dst.meta.epoch)
+	}
+	if got := strings.Join(dst.masterAddrs(), ","); got != "a2,b" {
+		t.Fatalf("masters after restore = %q", got)
+	}
+	if got := strings.Join(dst.nodeAddrs(), ","); got != "a,a2,b" {
+		t.Fatalf("nodes after restore = %q", got)
+	}
+	// 两个结点的哈希环一致，同一个 key 路由到同一个主结点
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		if src.pickNode(key) != dst.pickNode(key) {
+			t.Fatalf("key %s: %s on source, %s on restored", key, src.pickNode(key), dst.pickNode(key))
+		}
+	}
+	// 恢复后继续应用日志
+	dstFSM.Apply(utils.ToCmdLine("MEET", "c"))
+	dstFSM.Apply(utils.ToCmdLine("ADDNODE", "c", "c", "master"))
+	if got := strings.Join(dst.masterAddrs(), ","); got != "a2,b,c" {
+		t.Fatalf("masters after rejoin = %q", got)
+	}
+}
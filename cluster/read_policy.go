@@ -0,0 +1,125 @@
+package cluster
+
+import (
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	从副本读取
+	副本接收主结点的复制流，执行过 READONLY 的连接发出的读命令可以按 replica-read-policy 交给副本执行:
+	--master          只读主结点，相当于关闭从副本读取
+	--prefer-replica  随机选择一个在线的副本，没有时读主结点 (默认)
+	--round-robin     在主结点和在线的副本之间轮流
+	--lowest-latency  选择心跳延迟最低的结点
+	副本上的数据可能稍微落后于主结点
+*/
+
+const (
+	readPolicyMaster        = "master"
+	readPolicyPreferReplica = "prefer-replica"
+	readPolicyRoundRobin    = "round-robin"
+	readPolicyLowestLatency = "lowest-latency"
+)
+
+// readOnlyCommands 只读的单 key 命令
+var readOnlyCommands = map[string]bool{
+	"get":    true,
+	"exists": true,
+	"type":   true,
+	"strlen": true,
+	"ttl":    true,
+	"pttl":   true,
+}
+
+var readCounter uint64
+
+func readPolicy() string {
+	switch policy := strings.ToLower(config.Properties.ReplicaReadPolicy); policy {
+	case readPolicyMaster, readPolicyRoundRobin, readPolicyLowestLatency:
+		return policy
+	}
+	return readPolicyPreferReplica
+}
+
+func isReadOnlyCommand(cmdArgs [][]byte) bool {
+	return readOnlyCommands[strings.ToLower(string(cmdArgs[0]))]
+}
+
+// pickReadNode returns the node to read the key from according to the read policy, and whether it is a replica
+func (cluster *ClusterDatabase) pickReadNode(key string) (string, bool) {
+	policy := readPolicy()
+	cluster.mu.RLock()
+	defer cluster.mu.RUnlock()
+	shard := cluster.peerPicker.PickNode(key)
+	master := cluster.shards[shard]
+	if policy == readPolicyMaster {
+		return master, false
+	}
+
+	replicas := make([]string, 0)
+	for addr, node := range cluster.nodes {
+		if node.Shard == shard && node.Role == roleReplica && (addr == cluster.self || node.flag == flagOnline) {
+			replicas = append(replicas, addr)
+		}
+	}
+	if len(replicas) == 0 {
+		return master, false
+	}
+	sort.Strings(replicas)
+
+	switch policy {
+	case readPolicyRoundRobin:
+		candidates := replicas
+		if master != "" {
+			candidates = append(candidates, master)
+		}
+		addr := candidates[atomic.AddUint64(&readCounter, 1)%uint64(len(candidates))]
+		return addr, addr != master
+	case readPolicyLowestLatency:
+		best, bestLatency := master, cluster.latencyLocked(master)
+		for _, addr := range replicas {
+			if latency := cluster.latencyLocked(addr); best == "" || latency < bestLatency {
+				best, bestLatency = addr, latency
+			}
+		}
+		return best, best != master
+	}
+	return replicas[rand.Intn(len(replicas))], true
+}
+
+// latencyLocked 心跳测得的延迟，自己为 0，caller must hold cluster.mu
+func (cluster *ClusterDatabase) latencyLocked(addr string) time.Duration {
+	if addr == cluster.self {
+		return 0
+	}
+	node, ok := cluster.nodes[addr]
+	if !ok || node.flag != flagOnline || node.latency == 0 {
+		return time.Hour
+	}
+	return node.latency
+}
+
+// readonlyFunc READONLY 允许本连接从副本读取
+func readonlyFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 1 {
+		return reply.MakeArgNumErrReply("readonly")
+	}
+	conn.SetReadOnly(true)
+	return reply.MakeOkReply()
+}
+
+// readwriteFunc READWRITE 恢复为只读主结点
+func readwriteFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) != 1 {
+		return reply.MakeArgNumErrReply("readwrite")
+	}
+	conn.SetReadOnly(false)
+	return reply.MakeOkReply()
+}
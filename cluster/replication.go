@@ -0,0 +1,259 @@
+package cluster
+
+import (
+	"errors"
+	"go-redis/config"
+	"go-redis/interface/database"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/client"
+	"go-redis/resp/reply"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	database2 "go-redis/database"
+)
+
+/*
+	主从复制
+	分片的主结点为每个副本维护一条复制流:
+	--建立连接后先全量同步: 每个数据库 FLUSHDB 后逐个 SET
+	--之后将本地执行的每条写命令以 CLUSTER APPLY dbIndex cmd... 的形式推送给副本
+	--副本跟不上 (缓冲区满或超过 client-output-buffer-limit replica) 或执行失败时重新全量同步
+*/
+
+const replBufferSize = 1 << 16
+
+var errResync = errors.New("replica needs full resync")
+
+type replPayload struct {
+	dbIndex int
+	cmdLine database.CmdLine
+	size    int64 // 命令的字节数，计入缓冲区的大小
+}
+
+type replicator struct {
+	addr     string
+	ch       chan *replPayload
+	resync   atomic.Bool
+	kick     chan struct{} // 通知复制流立即开始全量同步
+	stopChan chan struct{}
+
+	limit     config.OutputBufferLimit
+	pending   atomic.Int64 // 缓冲区中命令的字节数
+	softSince time.Time    // 缓冲区开始超过软限制的时间，只在 push 中访问
+}
+
+func makeReplicator(addr string) *replicator {
+	return &replicator{
+		addr:     addr,
+		ch:       make(chan *replPayload, replBufferSize),
+		kick:     make(chan struct{}, 1),
+		stopChan: make(chan struct{}),
+		limit:    config.Properties.GetOutputBufferLimit(config.ClientClassReplica),
+	}
+}
+
+// push 由 onWrite 在 replMu 的保护下调用
+func (r *replicator) push(p *replPayload) {
+	pending := r.pending.Add(p.size)
+	if r.overLimit(pending) {
+		r.pending.Add(-p.size)
+		if !r.resync.Load() {
+			logger.Warn("cluster: replication buffer of ", r.addr, " exceeds client-output-buffer-limit, resync")
+		}
+		r.requestResync()
+		return
+	}
+	select {
+	case r.ch <- p:
+	default:
+		r.pending.Add(-p.size)
+		r.requestResync()
+	}
+}
+
+// requestResync 丢弃了命令之后副本必须重新全量同步
+func (r *replicator) requestResync() {
+	r.resync.Store(true)
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// overLimit 缓冲区超过硬限制，或者持续超过软限制达到 SoftSeconds 秒
+func (r *replicator) overLimit(pending int64) bool {
+	if r.limit.Hard > 0 && pending > r.limit.Hard {
+		return true
+	}
+	if r.limit.Soft <= 0 || pending <= r.limit.Soft {
+		r.softSince = time.Time{}
+		return false
+	}
+	now := time.Now()
+	if r.softSince.IsZero() {
+		r.softSince = now
+		return false
+	}
+	return now.Sub(r.softSince) >= time.Duration(r.limit.SoftSeconds)*time.Second
+}
+
+// take 从缓冲区中取出一条命令之后调用
+func (r *replicator) take(p *replPayload) {
+	r.pending.Add(-p.size)
+}
+
+func cmdLineSize(cmdLine database.CmdLine) int64 {
+	size := int64(16)
+	for _, arg := range cmdLine {
+		size += int64(len(arg)) + 16
+	}
+	return size
+}
+
+// onWrite is the write listener of the local database
+func (cluster *ClusterDatabase) onWrite(dbIndex int, cmdLine database2.CmdLine) {
+	cluster.replMu.Lock()
+	defer cluster.replMu.Unlock()
+	if len(cluster.replicators) == 0 {
+		return
+	}
+	p := &replPayload{dbIndex: dbIndex, cmdLine: cmdLine, size: cmdLineSize(cmdLine)}
+	for _, r := range cluster.replicators {
+		r.push(p)
+	}
+}
+
+// syncReplicators keeps a replication stream for each replica while self is the master of its shard
+func (cluster *ClusterDatabase) syncReplicators() {
+	desired := make(map[string]bool)
+	cluster.mu.RLock()
+	self := cluster.nodes[cluster.self]
+	if self.Role == roleMaster && cluster.shards[self.Shard] == cluster.self {
+		for addr, node := range cluster.nodes {
+			if addr != cluster.self && node.Role == roleReplica && node.Shard == self.Shard && node.flag != flagFail {
+				desired[addr] = true
+			}
+		}
+	}
+	cluster.mu.RUnlock()
+
+	cluster.replMu.Lock()
+	defer cluster.replMu.Unlock()
+	for addr, r := range cluster.replicators {
+		if !desired[addr] {
+			close(r.stopChan)
+			delete(cluster.replicators, addr)
+		}
+	}
+	for addr := range desired {
+		if _, ok := cluster.replicators[addr]; !ok {
+			r := makeReplicator(addr)
+			cluster.replicators[addr] = r
+			go cluster.replicate(r)
+		}
+	}
+}
+
+func (cluster *ClusterDatabase) stopReplicators() {
+	cluster.replMu.Lock()
+	defer cluster.replMu.Unlock()
+	for addr, r := range cluster.replicators {
+		close(r.stopChan)
+		delete(cluster.replicators, addr)
+	}
+}
+
+func (cluster *ClusterDatabase) replicate(r *replicator) {
+	for {
+		err := cluster.doReplicate(r)
+		if err == nil {
+			return
+		}
+		logger.Warn("cluster: replicate to ", r.addr, " failed: ", err)
+		select {
+		case <-r.stopChan:
+			return
+		case <-time.After(heartbeatInterval):
+		}
+	}
+}
+
+// doReplicate returns nil when the replicator is stopped
+func (cluster *ClusterDatabase) doReplicate(r *replicator) error {
+	c, err := client.MakeClientWithOptions(r.addr, cluster.peerOptions())
+	if err != nil {
+		return err
+	}
+	c.Start()
+	defer c.Close()
+
+	for {
+		if err := cluster.fullSync(r, c); err != nil {
+			return err
+		}
+		logger.Info("cluster: full sync to replica ", r.addr, " finished")
+		err := cluster.stream(r, c)
+		if err != errResync {
+			return err
+		}
+	}
+}
+
+func (cluster *ClusterDatabase) fullSync(r *replicator, c *client.Client) error {
+	// 先清空缓冲区，快照之后的写命令会继续进入缓冲区
+	r.resync.Store(false)
+	for len(r.ch) > 0 {
+		r.take(<-r.ch)
+	}
+	var err error
+	for i := 0; i < cluster.db.DBCount() && err == nil; i++ {
+		err = sendApply(c, i, utils.ToCmdLine("FLUSHDB"))
+		cluster.db.ForEach(i, func(key string, entity *database.DataEntity, expiration *time.Time) bool {
+			if err != nil {
+				return false
+			}
+			var cmdLine database2.CmdLine
+			if cmdLine, err = database2.EntityToCmdLine(key, entity); err != nil {
+				return false
+			}
+			if err = sendApply(c, i, cmdLine); err == nil && expiration != nil {
+				err = sendApply(c, i, database2.MakeExpireCmd(key, *expiration))
+			}
+			return err == nil
+		})
+	}
+	return err
+}
+
+func (cluster *ClusterDatabase) stream(r *replicator, c *client.Client) error {
+	for {
+		select {
+		case <-r.stopChan:
+			return nil
+		case <-r.kick:
+			if r.resync.Load() {
+				return errResync
+			}
+		case p := <-r.ch:
+			r.take(p)
+			if r.resync.Load() {
+				return errResync
+			}
+			if err := sendApply(c, p.dbIndex, p.cmdLine); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func sendApply(c *client.Client, dbIndex int, cmdLine database.CmdLine) error {
+	args := utils.ToCmdLine2("CLUSTER", append([][]byte{[]byte("APPLY"), []byte(strconv.Itoa(dbIndex))}, cmdLine...)...)
+	result := c.Send(args)
+	if errReply, ok := result.(reply.ErrorReply); ok {
+		return errors.New(errReply.Error())
+	}
+	return nil
+}
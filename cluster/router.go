@@ -2,8 +2,11 @@ package cluster
 
 import (
 	"bytes"
+	"context"
 	"go-redis/interface/resp"
+	"go-redis/lib/utils"
 	"go-redis/resp/reply"
+	"strings"
 )
 
 type CmdFunc func(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply
@@ -18,31 +21,103 @@ func makeRouter() map[string]CmdFunc {
 	router["getset"] = defaultFunc
 	router["ping"] = selfFunc
 	router["select"] = selfFunc
+	router["acl"] = selfFunc
 	router["rename"] = renameFunc
 	router["renamenx"] = renamenxFunc
 	router["flushdb"] = flushdbFunc
+	router["flushall"] = flushallFunc
+	router["keys"] = keysFunc
+	router["scan"] = scanFunc
+	router["dbsize"] = dbsizeFunc
+	router["randomkey"] = randomkeyFunc
 	router["del"] = delFunc
+	router["mset"] = msetFunc
+	router["msetnx"] = msetnxFunc
+	router["prepare"] = execTxCommand
+	router["commit"] = execTxCommand
+	router["rollback"] = execTxCommand
+	router["finish"] = execTxCommand
+	router["strlen"] = defaultFunc
+	router["expire"] = defaultFunc
+	router["pexpire"] = defaultFunc
+	router["expireat"] = defaultFunc
+	router["pexpireat"] = defaultFunc
+	router["persist"] = defaultFunc
+	router["ttl"] = defaultFunc
+	router["pttl"] = defaultFunc
+	router["readonly"] = readonlyFunc
+	router["readwrite"] = readwriteFunc
+	router["cluster"] = clusterFunc
+	router["raft"] = raftFunc
 
 	return router
 }
 
+// internalCommands 结点之间的内部命令，只有 CLUSTER PEER 标记过的连接可以执行
+var internalCommands = map[string]bool{
+	"raft":     true,
+	"prepare":  true,
+	"commit":   true,
+	"finish":   true,
+	"rollback": true,
+}
+
+// internalClusterCommands 内部使用的 CLUSTER 子命令
+var internalClusterCommands = map[string]bool{
+	"gossip": true,
+	"join":   true,
+	"apply":  true,
+	"local":  true,
+}
+
+func isInternalCommand(args [][]byte) bool {
+	cmdName := strings.ToLower(string(args[0]))
+	if cmdName == "cluster" {
+		return len(args) >= 2 && internalClusterCommands[strings.ToLower(string(args[1]))]
+	}
+	return internalCommands[cmdName]
+}
+
+// internalCommandName CLUSTER 子命令的名称包括子命令
+func internalCommandName(args [][]byte) string {
+	if len(args) >= 2 && strings.EqualFold(string(args[0]), "cluster") {
+		return "cluster " + strings.ToLower(string(args[1]))
+	}
+	return strings.ToLower(string(args[0]))
+}
+
 // GET Key // Set K1 V1
 func defaultFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
 	key := string(cmdArgs[1])
-	peer := cluster.peerPicker.PickNode(key)
+	if conn.IsReadOnly() && isReadOnlyCommand(cmdArgs) {
+		if peer, isReplica := cluster.pickReadNode(key); isReplica {
+			// 副本不拥有 key，需要让它在本地执行而不是再转发给主结点
+			return cluster.relayLocal(peer, conn, cmdArgs)
+		}
+	}
+	peer := cluster.pickNode(key)
+	return cluster.execOn(peer, conn, []string{key}, cmdArgs)
+}
+
+// execOn 在 peer 上执行命令，本结点执行时需要持有 keys 的锁
+func (cluster *ClusterDatabase) execOn(peer string, conn resp.Connection, keys []string, cmdArgs [][]byte) resp.Reply {
+	if peer == cluster.self {
+		return cluster.execLocked(conn, keys, cmdArgs)
+	}
 	return cluster.relay(peer, conn, cmdArgs)
 }
 
+// raftFunc 结点之间的 raft RPC
+func raftFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
+	return cluster.raft.HandleCommand(cmdArgs)
+}
+
 func selfFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
 	return cluster.db.Exec(conn, cmdArgs)
 }
 
 // renameFunc rename k1 k2
-/*
-GET k1 v1
-DEL k1
-SET k2 v1
-*/
+// 两个 key 在同一个结点上时直接转发，否则通过两阶段提交从源结点删除并写入目标结点
 func renameFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
 	// 参数校验
 	if len(cmdArgs) != 3 {
@@ -57,29 +132,14 @@ func renameFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte
 		return reply.MakeErrReply("ERR source and destination objects are the same")
 	}
 
-	// 1. 获取原key的值
-	getCmd := [][]byte{[]byte("GET"), oldKey}
-	result1 := defaultFunc(cluster, conn, getCmd)
-	if reply.IsErrReply(result1) {
-		return result1 // 直接返回错误，保留原始错误信息
-	}
-
-	bulkReply, ok := result1.(*reply.BulkReply)
-	if !ok || bulkReply == nil {
-		return reply.MakeErrReply("ERR no such key")
+	srcPeer := cluster.pickNode(string(oldKey))
+	destPeer := cluster.pickNode(string(newKey))
+	if srcPeer == destPeer {
+		return cluster.execOn(srcPeer, conn, []string{string(oldKey), string(newKey)}, cmdArgs)
 	}
-
-	// 2. 设置新key的值
-	setCmd := [][]byte{[]byte("SET"), newKey, bulkReply.Arg}
-	result3 := defaultFunc(cluster, conn, setCmd)
-	if reply.IsErrReply(result3) {
-		return result3
+	if result := cluster.renameAcrossNodes(conn, srcPeer, destPeer, oldKey, newKey, false); result != nil {
+		return result
 	}
-
-	// 3. 删除原key（只有在设置成功后）
-	delCmd := [][]byte{[]byte("DEL"), oldKey}
-	delFunc(cluster, conn, delCmd) // 忽略删除结果，因为原key可能已被其他操作删除
-
 	return reply.MakeOkReply()
 }
 
@@ -97,82 +157,134 @@ func renamenxFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]by
 		return reply.MakeIntReply(0) // Redis 在相同key时返回 0
 	}
 
-	// 1. 检查新key是否已存在
-	existsCmd := [][]byte{[]byte("EXISTS"), newKey}
-	existsResult := defaultFunc(cluster, conn, existsCmd)
-	if reply.IsErrReply(existsResult) {
-		return existsResult
+	srcPeer := cluster.pickNode(string(oldKey))
+	destPeer := cluster.pickNode(string(newKey))
+	if srcPeer == destPeer {
+		return cluster.execOn(srcPeer, conn, []string{string(oldKey), string(newKey)}, cmdArgs)
 	}
-
-	intReply, ok := existsResult.(*reply.IntReply)
-	if !ok {
-		return reply.MakeErrReply("ERR invalid EXISTS response")
+	// 新key已存在时目标结点拒绝准备
+	if result := cluster.renameAcrossNodes(conn, srcPeer, destPeer, oldKey, newKey, true); result != nil {
+		if isPreconditionFailed(result) {
+			return reply.MakeIntReply(0)
+		}
+		return result
 	}
+	return reply.MakeIntReply(1) // 成功返回 1
+}
 
-	// 如果新key已存在，返回 0
-	if intReply.Code > 0 {
-		return reply.MakeIntReply(0)
+// renameAcrossNodes 源结点准备删除 oldKey 并返回其数据，目标结点用 SET 写入 newKey，nx 为 true 时要求 newKey 不存在，成功时返回 nil
+func (cluster *ClusterDatabase) renameAcrossNodes(conn resp.Connection, srcPeer, destPeer string, oldKey, newKey []byte, nx bool) resp.Reply {
+	tx := cluster.beginTx(conn)
+	// 目标结点需要源结点的数据，不能按结点地址的顺序准备，与其它事务互相等待时由 txLockTimeout 打破
+	result := tx.prepare(srcPeer, utils.ToCmdLine2("RENAMEFROM", oldKey))
+	if reply.IsErrReply(result) {
+		return result
 	}
-
-	// 2. 获取原key的值
-	getCmd := [][]byte{[]byte("GET"), oldKey}
-	getResult := defaultFunc(cluster, conn, getCmd)
-	if reply.IsErrReply(getResult) {
-		return getResult
+	dump, ok := result.(*reply.MultiBulkReply)
+	if !ok || len(dump.Args) < 3 {
+		tx.rollback()
+		return reply.MakeErrReply("ERR illegal dump of " + string(oldKey))
 	}
-
-	bulkReply, ok := getResult.(*reply.BulkReply)
-	if !ok || bulkReply == nil {
-		return reply.MakeErrReply("ERR no such key") // 原key不存在
+	// dump 为 SET oldKey value [PXAT unix-time-milliseconds]，newKey 保留过期时间
+	cmdLine := append([][]byte{[]byte("SET"), newKey}, dump.Args[2:]...)
+	if nx {
+		cmdLine = append(cmdLine, []byte("NX"))
 	}
-
-	// 3. 设置新key的值 - 修复了这里的错误
-	setCmd := [][]byte{[]byte("SET"), newKey, bulkReply.Arg} // 使用 Value 而不是 ToBytes()
-	setResult := defaultFunc(cluster, conn, setCmd)
-	if reply.IsErrReply(setResult) {
-		return setResult
+	if result := tx.prepare(destPeer, cmdLine); reply.IsErrReply(result) {
+		return result
+	}
+	if _, errReply := tx.commit(); errReply != nil {
+		return errReply
 	}
+	return nil
+}
 
-	// 4. 删除原key（只有在设置成功后）
-	delCmd := [][]byte{[]byte("DEL"), oldKey}
-	delFunc(cluster, conn, delCmd) // 忽略删除结果
+// msetFunc MSET k1 v1 k2 v2
+func msetFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 3 || len(cmdArgs)%2 != 1 {
+		return reply.MakeArgNumErrReply("mset")
+	}
+	cmdLines := cluster.groupPairs(cmdArgs)
+	if len(cmdLines) == 1 {
+		for peer := range cmdLines {
+			return cluster.execOn(peer, conn, pairKeys(cmdArgs), cmdArgs)
+		}
+	}
+	if _, errReply := cluster.execTx(conn, cmdLines); errReply != nil {
+		return errReply
+	}
+	return reply.MakeOkReply()
+}
 
-	return reply.MakeIntReply(1) // 成功返回 1
+// msetnxFunc MSETNX k1 v1 k2 v2 任意一个结点上有 key 已存在时所有结点都不写入
+func msetnxFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if len(cmdArgs) < 3 || len(cmdArgs)%2 != 1 {
+		return reply.MakeArgNumErrReply("msetnx")
+	}
+	cmdLines := cluster.groupPairs(cmdArgs)
+	if len(cmdLines) == 1 {
+		for peer := range cmdLines {
+			return cluster.execOn(peer, conn, pairKeys(cmdArgs), cmdArgs)
+		}
+	}
+	if _, errReply := cluster.execTx(conn, cmdLines); errReply != nil {
+		if isPreconditionFailed(errReply) {
+			return reply.MakeIntReply(0)
+		}
+		return errReply
+	}
+	return reply.MakeIntReply(1)
 }
 
-func flushdbFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
-	var errReply reply.ErrorReply
-	for _, r := range cluster.broadcast(conn, cmdArgs) {
-		if reply.IsErrReply(r) {
-			errReply = r.(reply.ErrorReply)
-			break
+// groupPairs 按 key 所在的结点拆分 MSET 类命令
+func (cluster *ClusterDatabase) groupPairs(cmdArgs [][]byte) map[string][][]byte {
+	cmdLines := make(map[string][][]byte)
+	for i := 1; i+1 < len(cmdArgs); i += 2 {
+		peer := cluster.pickNode(string(cmdArgs[i]))
+		if _, ok := cmdLines[peer]; !ok {
+			cmdLines[peer] = [][]byte{cmdArgs[0]}
 		}
+		cmdLines[peer] = append(cmdLines[peer], cmdArgs[i], cmdArgs[i+1])
 	}
-	if errReply != nil {
-		return reply.MakeOkReply()
+	return cmdLines
+}
+
+// flushdbFunc 所有主结点都清空成功才返回 OK
+func flushdbFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
+	if errReply := cluster.broadcast(context.Background(), conn, cmdArgs).errReply("flushdb"); errReply != nil {
+		return errReply
 	}
-	return reply.MakeErrReply("ERR flushdb command failed")
+	return reply.MakeOkReply()
 }
 
+// delFunc DEL k1 k2 按 key 所在的结点分组，每个结点一条 DEL，跨结点时在各结点上原子地删除
 func delFunc(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
-	var tot int64
-	var errReply reply.ErrorReply
-	for _, r := range cluster.broadcast(conn, cmdArgs) {
-		if reply.IsErrReply(r) {
-			errReply = r.(reply.ErrorReply)
-			break
+	if len(cmdArgs) < 2 {
+		return reply.MakeArgNumErrReply("del")
+	}
+	cmdLines := make(map[string][][]byte)
+	for _, key := range cmdArgs[1:] {
+		peer := cluster.pickNode(string(key))
+		if _, ok := cmdLines[peer]; !ok {
+			cmdLines[peer] = [][]byte{cmdArgs[0]}
 		}
-
-		intReply, ok := r.(*reply.IntReply)
-		if !ok {
-			errReply = r.(reply.ErrorReply)
-			break
-		} else {
-			tot += intReply.Code
+		cmdLines[peer] = append(cmdLines[peer], key)
+	}
+	if len(cmdLines) == 1 {
+		for peer := range cmdLines {
+			return cluster.execOn(peer, conn, allKeys(cmdArgs), cmdArgs)
 		}
 	}
+
+	results, errReply := cluster.execTx(conn, cmdLines)
 	if errReply != nil {
-		return reply.MakeErrReply("ERR del command failed")
+		return errReply
+	}
+	var tot int64
+	for _, r := range results {
+		if intReply, ok := r.(*reply.IntReply); ok {
+			tot += intReply.Code
+		}
 	}
 	return reply.MakeIntReply(tot)
 }
@@ -0,0 +1,370 @@
+package cluster
+
+import (
+	database2 "go-redis/database"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+	两阶段提交的参与者
+	--PREPARE txID cmd...   锁定 cmd 写入的 key，校验前置条件并记录 undo log，超时未提交时自动回滚
+	--COMMIT txID           执行 cmd，继续持有锁直到协调者做出最终决定
+	--FINISH txID           所有参与者都提交成功，释放锁并丢弃 undo log，之后不能再回滚
+	--ROLLBACK txID         已提交的事务执行 undo log 恢复原值，然后释放锁
+	从 PREPARE 到 FINISH 或 ROLLBACK 一直持有锁，其它命令不会写入这些 key，undo log 恢复的一定是事务之前的值
+	参与者按执行 PREPARE 的连接所选择的 db 执行事务
+*/
+
+const txTimeout = 10 * time.Second
+
+// txLockTimeout PREPARE 等待其它事务释放锁的时间，协调者没有按顺序加锁时 (跨结点 RENAME) 可能互相等待，超时后由协调者回滚
+const txLockTimeout = time.Second
+
+// 前置条件不满足时 PREPARE 的错误回复，协调者据此返回 0 而不是错误
+const errPrecondition = "PRECONDITION key exists"
+
+const (
+	txPrepared = iota
+	txCommitted
+	txFinished
+	txRolledBack
+)
+
+// txCommand 可以在事务中执行的命令
+type txCommand struct {
+	keys func(args [][]byte) []string
+	// validate 在加锁后执行，返回错误时放弃事务，返回其他回复时作为 PREPARE 的结果
+	validate func(cluster *ClusterDatabase, dbIndex int, keys []string, args [][]byte) resp.Reply
+	// toCmdLine 提交时实际执行的命令，为空时执行 cmd 本身
+	toCmdLine func(args [][]byte) [][]byte
+}
+
+var txCommands = map[string]*txCommand{
+	"del":        {keys: allKeys},
+	"set":        {keys: firstKey, validate: validateSet},
+	"setnx":      {keys: firstKey, validate: validateAbsent},
+	"mset":       {keys: pairKeys},
+	"msetnx":     {keys: pairKeys, validate: validateAbsent},
+	"renamefrom": {keys: firstKey, validate: validateDump, toCmdLine: renameFromCmdLine},
+}
+
+func allKeys(args [][]byte) []string {
+	keys := make([]string, len(args)-1)
+	for i, arg := range args[1:] {
+		keys[i] = string(arg)
+	}
+	return keys
+}
+
+func firstKey(args [][]byte) []string {
+	return []string{string(args[1])}
+}
+
+func pairKeys(args [][]byte) []string {
+	keys := make([]string, 0, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		keys = append(keys, string(args[i]))
+	}
+	return keys
+}
+
+// validateAbsent NX 类命令要求所有 key 都不存在
+func validateAbsent(cluster *ClusterDatabase, dbIndex int, keys []string, args [][]byte) resp.Reply {
+	for _, key := range keys {
+		if _, exists := cluster.db.GetEntity(dbIndex, key); exists {
+			return reply.MakeErrReply(errPrecondition)
+		}
+	}
+	return nil
+}
+
+// validateSet SET key value NX 要求 key 不存在，跨结点 RENAMENX 在目标结点上执行
+func validateSet(cluster *ClusterDatabase, dbIndex int, keys []string, args [][]byte) resp.Reply {
+	for _, arg := range args[3:] {
+		if strings.EqualFold(string(arg), "NX") {
+			return validateAbsent(cluster, dbIndex, keys, args)
+		}
+	}
+	return nil
+}
+
+// validateDump 跨结点 RENAME 的源 key 必须存在，返回可以重建它的命令
+func validateDump(cluster *ClusterDatabase, dbIndex int, keys []string, args [][]byte) resp.Reply {
+	cmdLine, exists, err := cluster.dumpKey(dbIndex, keys[0])
+	if err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	if !exists {
+		return reply.MakeErrReply("ERR no such key")
+	}
+	return reply.MakeMultiBulkReply(cmdLine)
+}
+
+// dumpKey 重建 key 的命令，为 SET key value [PXAT unix-time-milliseconds]，保留过期时间
+func (cluster *ClusterDatabase) dumpKey(dbIndex int, key string) ([][]byte, bool, error) {
+	entity, exists := cluster.db.GetEntity(dbIndex, key)
+	if !exists {
+		return nil, false, nil
+	}
+	cmdLine, err := database2.EntityToCmdLine(key, entity)
+	if err != nil {
+		return nil, true, err
+	}
+	if expireAt, ok := cluster.db.GetExpireTime(dbIndex, key); ok {
+		cmdLine = append(cmdLine, []byte("PXAT"), []byte(strconv.FormatInt(expireAt.UnixMilli(), 10)))
+	}
+	return cmdLine, true, nil
+}
+
+func renameFromCmdLine(args [][]byte) [][]byte {
+	return [][]byte{[]byte("DEL"), args[1]}
+}
+
+// Transaction 参与者上的事务
+type Transaction struct {
+	id       string
+	cmdLine  [][]byte
+	dbIndex  int
+	lockKeys []string
+	undoLog  [][][]byte
+
+	mu     sync.Mutex
+	status int8
+	timer  *time.Timer
+}
+
+// toLockKeys 不同 db 中的同名 key 使用不同的锁
+func toLockKeys(dbIndex int, keys []string) []string {
+	lockKeys := make([]string, len(keys))
+	for i, key := range keys {
+		lockKeys[i] = strconv.Itoa(dbIndex) + " " + key
+	}
+	return lockKeys
+}
+
+// execLocked 在本地执行命令，期间持有 keys 的锁，事务锁定的 key 需要等待其提交或回滚
+func (cluster *ClusterDatabase) execLocked(conn resp.Connection, keys []string, cmdLine [][]byte) resp.Reply {
+	lockKeys := toLockKeys(conn.GetDBIndex(), keys)
+	cluster.keyLocks.Locks(lockKeys...)
+	defer cluster.keyLocks.UnLocks(lockKeys...)
+	return cluster.db.Exec(conn, cmdLine)
+}
+
+// execTxCommand executes PREPARE|COMMIT|ROLLBACK on this node
+func execTxCommand(cluster *ClusterDatabase, conn resp.Connection, cmdArgs [][]byte) resp.Reply {
+	cmdName := strings.ToLower(string(cmdArgs[0]))
+	if (cmdName == "prepare" && len(cmdArgs) < 3) || (cmdName != "prepare" && len(cmdArgs) != 2) {
+		return reply.MakeArgNumErrReply(cmdName)
+	}
+	txID := string(cmdArgs[1])
+	switch cmdName {
+	case "prepare":
+		return cluster.prepareTx(txID, conn.GetDBIndex(), cmdArgs[2:])
+	case "commit":
+		return cluster.commitTx(txID)
+	case "finish":
+		return cluster.finishTx(txID)
+	}
+	return cluster.rollbackTx(txID)
+}
+
+func (cluster *ClusterDatabase) prepareTx(txID string, dbIndex int, cmdLine [][]byte) resp.Reply {
+	cmdName := strings.ToLower(string(cmdLine[0]))
+	cmd, ok := txCommands[cmdName]
+	if !ok {
+		return reply.MakeErrReply("ERR command '" + cmdName + "' cannot be used in transaction")
+	}
+	if len(cmdLine) < 2 {
+		return reply.MakeArgNumErrReply(cmdName)
+	}
+
+	keys := cmd.keys(cmdLine)
+	tx := &Transaction{
+		id:       txID,
+		cmdLine:  cmdLine,
+		dbIndex:  dbIndex,
+		lockKeys: toLockKeys(dbIndex, keys),
+	}
+	// 等待其它事务结束，等待超时说明可能与其它事务在不同结点上互相等待，失败后由协调者回滚
+	if !cluster.keyLocks.LocksWithTimeout(txLockTimeout, tx.lockKeys...) {
+		return reply.MakeErrReply("TRYAGAIN keys are locked by another transaction")
+	}
+
+	var result resp.Reply = reply.MakeOkReply()
+	if cmd.validate != nil {
+		if r := cmd.validate(cluster, dbIndex, keys, cmdLine); r != nil {
+			if reply.IsErrReply(r) {
+				cluster.keyLocks.UnLocks(tx.lockKeys...)
+				return r
+			}
+			result = r
+		}
+	}
+	for _, key := range keys {
+		undo, err := cluster.undoCmdLine(dbIndex, key)
+		if err != nil {
+			cluster.keyLocks.UnLocks(tx.lockKeys...)
+			return reply.MakeErrReply("ERR " + err.Error())
+		}
+		tx.undoLog = append(tx.undoLog, undo)
+	}
+
+	tx.timer = time.AfterFunc(txTimeout, func() {
+		cluster.expireTx(tx)
+	})
+	cluster.txMu.Lock()
+	if _, exists := cluster.transactions[txID]; exists {
+		cluster.txMu.Unlock()
+		tx.timer.Stop()
+		cluster.keyLocks.UnLocks(tx.lockKeys...)
+		return reply.MakeErrReply("ERR transaction " + txID + " already exists")
+	}
+	cluster.transactions[txID] = tx
+	cluster.txMu.Unlock()
+	return result
+}
+
+// undoCmdLine 恢复 key 当前值和过期时间的命令，无法恢复的 key 不能参与事务
+func (cluster *ClusterDatabase) undoCmdLine(dbIndex int, key string) ([][]byte, error) {
+	cmdLine, exists, err := cluster.dumpKey(dbIndex, key)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return [][]byte{[]byte("DEL"), []byte(key)}, nil
+	}
+	return cmdLine, nil
+}
+
+func (cluster *ClusterDatabase) getTx(txID string) (*Transaction, bool) {
+	cluster.txMu.Lock()
+	defer cluster.txMu.Unlock()
+	tx, ok := cluster.transactions[txID]
+	return tx, ok
+}
+
+func (cluster *ClusterDatabase) commitTx(txID string) resp.Reply {
+	tx, ok := cluster.getTx(txID)
+	if !ok {
+		return reply.MakeErrReply("ERR transaction " + txID + " not found")
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.status != txPrepared {
+		return reply.MakeErrReply("ERR transaction " + txID + " is not prepared")
+	}
+
+	cmdLine := tx.cmdLine
+	if toCmdLine := txCommands[strings.ToLower(string(cmdLine[0]))].toCmdLine; toCmdLine != nil {
+		cmdLine = toCmdLine(cmdLine)
+	}
+	result := cluster.db.Exec(txConnection(tx.dbIndex), cmdLine)
+	if reply.IsErrReply(result) {
+		// 提交失败时保持锁，等待协调者回滚
+		return result
+	}
+	// 其它参与者可能提交失败，继续持有锁直到协调者发送 FINISH 或 ROLLBACK
+	tx.status = txCommitted
+	tx.timer.Reset(txTimeout)
+	return result
+}
+
+func (cluster *ClusterDatabase) finishTx(txID string) resp.Reply {
+	tx, ok := cluster.getTx(txID)
+	if !ok {
+		return reply.MakeErrReply("ERR transaction " + txID + " not found")
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.status != txCommitted {
+		return reply.MakeErrReply("ERR transaction " + txID + " is not committed")
+	}
+	cluster.finishLocked(tx)
+	return reply.MakeOkReply()
+}
+
+// finishLocked caller must hold tx.mu
+func (cluster *ClusterDatabase) finishLocked(tx *Transaction) {
+	cluster.keyLocks.UnLocks(tx.lockKeys...)
+	tx.status = txFinished
+	tx.undoLog = nil
+	tx.timer.Stop()
+	cluster.removeTx(tx.id)
+}
+
+func (cluster *ClusterDatabase) rollbackTx(txID string) resp.Reply {
+	cluster.txMu.Lock()
+	tx, ok := cluster.transactions[txID]
+	if !ok {
+		// PREPARE 可能还在路上 (协调者等待超时)，记录已回滚的事务，之后到达的 PREPARE 会因为 ID 重复而失败
+		tx = &Transaction{id: txID, status: txRolledBack}
+		tx.timer = time.AfterFunc(txTimeout, func() {
+			cluster.removeTx(txID)
+		})
+		cluster.transactions[txID] = tx
+		cluster.txMu.Unlock()
+		return reply.MakeIntReply(0)
+	}
+	cluster.txMu.Unlock()
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	switch tx.status {
+	case txRolledBack:
+		return reply.MakeIntReply(0)
+	case txFinished:
+		return reply.MakeErrReply("ERR transaction " + txID + " is already finished")
+	}
+	cluster.rollbackLocked(tx)
+	return reply.MakeIntReply(1)
+}
+
+// rollbackLocked caller must hold tx.mu
+// 从 PREPARE 开始一直持有锁，undo log 恢复的是事务之前的值，不会覆盖其它命令的写入
+func (cluster *ClusterDatabase) rollbackLocked(tx *Transaction) {
+	if tx.status == txCommitted {
+		conn := txConnection(tx.dbIndex)
+		for _, cmdLine := range tx.undoLog {
+			cluster.db.Exec(conn, cmdLine)
+		}
+	}
+	cluster.keyLocks.UnLocks(tx.lockKeys...)
+	tx.status = txRolledBack
+	tx.undoLog = nil
+	tx.timer.Stop()
+	cluster.removeTx(tx.id)
+}
+
+// expireTx 超时未提交的事务自动回滚
+// 已提交的事务说明协调者已经决定提交，没有等到 FINISH 时保留提交的结果并释放锁
+func (cluster *ClusterDatabase) expireTx(tx *Transaction) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	switch tx.status {
+	case txPrepared:
+		logger.Warn("cluster: transaction ", tx.id, " timeout, roll back")
+		cluster.rollbackLocked(tx)
+	case txCommitted:
+		logger.Warn("cluster: transaction ", tx.id, " is not finished by the coordinator, keep the commit")
+		cluster.finishLocked(tx)
+	}
+}
+
+func (cluster *ClusterDatabase) removeTx(txID string) {
+	cluster.txMu.Lock()
+	delete(cluster.transactions, txID)
+	cluster.txMu.Unlock()
+}
+
+// txConnection 用于在事务的 db 上执行命令的伪连接
+func txConnection(dbIndex int) resp.Connection {
+	conn := &connection.Connection{}
+	conn.SelectDB(dbIndex)
+	return conn
+}
@@ -0,0 +1,228 @@
+package cluster
+
+import (
+	"context"
+	"go-redis/interface/resp"
+	"go-redis/lib/utils"
+	"go-redis/resp/connection"
+	"go-redis/resp/parser"
+	"go-redis/resp/reply"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeParticipant 模拟另一个结点，按命令名回复 replies 中的结果，没有配置的命令回复 OK
+type fakeParticipant struct {
+	addr    string
+	replies map[string]resp.Reply
+
+	mu   sync.Mutex
+	cmds []string
+}
+
+func startFakeParticipant(t *testing.T, replies map[string]resp.Reply) *fakeParticipant {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeParticipant{addr: listener.Addr().String(), replies: replies}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return p
+}
+
+func (p *fakeParticipant) serve(conn net.Conn) {
+	defer conn.Close()
+	for payload := range parser.ParseStream(conn) {
+		if payload.Err != nil {
+			return
+		}
+		args := payload.Data.(*reply.MultiBulkReply).Args
+		cmdName := strings.ToUpper(string(args[0]))
+		p.mu.Lock()
+		p.cmds = append(p.cmds, cmdName)
+		p.mu.Unlock()
+		result, ok := p.replies[cmdName]
+		if !ok {
+			result = reply.MakeOkReply()
+		}
+		if _, err := conn.Write(result.ToBytes()); err != nil {
+			return
+		}
+	}
+}
+
+// received 收到的命令，不包括建立连接时的 CLUSTER PEER
+func (p *fakeParticipant) received() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cmds := make([]string, 0, len(p.cmds))
+	for _, cmd := range p.cmds {
+		if cmd != "CLUSTER" {
+			cmds = append(cmds, cmd)
+		}
+	}
+	return strings.Join(cmds, ",")
+}
+
+// makeTxCluster self 的地址排在 127.0.0.1 之前，事务先在本地准备
+func makeTxCluster(t *testing.T) *ClusterDatabase {
+	cluster := makeTestCluster("127.0.0.0:1")
+	t.Cleanup(func() {
+		for _, p := range cluster.peerConnectionPool {
+			p.Close(context.Background())
+		}
+	})
+	return cluster
+}
+
+func execString(cluster *ClusterDatabase, args ...string) string {
+	return string(cluster.db.Exec(txConnection(0), utils.ToCmdLine(args...)).ToBytes())
+}
+
+// assertUnlocked 事务结束后 key 的锁已经释放，也没有残留的事务
+func assertUnlocked(t *testing.T, cluster *ClusterDatabase, keys ...string) {
+	t.Helper()
+	lockKeys := toLockKeys(0, keys)
+	if !cluster.keyLocks.LocksWithTimeout(100*time.Millisecond, lockKeys...) {
+		t.Fatalf("keys %v are still locked", keys)
+	}
+	cluster.keyLocks.UnLocks(lockKeys...)
+	cluster.txMu.Lock()
+	defer cluster.txMu.Unlock()
+	for id, tx := range cluster.transactions {
+		if tx.status != txRolledBack {
+			t.Fatalf("transaction %s left with status %d", id, tx.status)
+		}
+	}
+}
+
+func TestTxCommit(t *testing.T) {
+	cluster := makeTxCluster(t)
+	remote := startFakeParticipant(t, map[string]resp.Reply{
+		"COMMIT": reply.MakeIntReply(1),
+	})
+	replies, errReply := cluster.execTx(txConnection(0), map[string][][]byte{
+		cluster.self: utils.ToCmdLine("SET", "k", "new"),
+		remote.addr:  utils.ToCmdLine("DEL", "r"),
+	})
+	if errReply != nil {
+		t.Fatalf("execTx: %q", errReply.ToBytes())
+	}
+	if got := string(replies[remote.addr].ToBytes()); got != ":1\r\n" {
+		t.Fatalf("remote commit reply = %q", got)
+	}
+	if got := execString(cluster, "GET", "k"); got != "$3\r\nnew\r\n" {
+		t.Fatalf("GET k = %q", got)
+	}
+	if got := remote.received(); got != "PREPARE,COMMIT,FINISH" {
+		t.Fatalf("remote received %s", got)
+	}
+	assertUnlocked(t, cluster, "k")
+}
+
+func TestTxRollbackWhenPrepareFails(t *testing.T) {
+	cluster := makeTxCluster(t)
+	remote := startFakeParticipant(t, map[string]resp.Reply{
+		"PREPARE": reply.MakeErrReply("ERR injected prepare failure"),
+	})
+	execString(cluster, "SET", "k", "old")
+	_, errReply := cluster.execTx(txConnection(0), map[string][][]byte{
+		cluster.self: utils.ToCmdLine("SET", "k", "new"),
+		remote.addr:  utils.ToCmdLine("SET", "r", "v"),
+	})
+	if errReply == nil || !strings.Contains(string(errReply.ToBytes()), "injected prepare failure") {
+		t.Fatalf("execTx = %v, want the prepare error", errReply)
+	}
+	// 本地已经准备好的事务被回滚，值没有改变，锁已释放
+	if got := execString(cluster, "GET", "k"); got != "$3\r\nold\r\n" {
+		t.Fatalf("GET k = %q", got)
+	}
+	if got := remote.received(); got != "PREPARE,ROLLBACK" {
+		t.Fatalf("remote received %s", got)
+	}
+	assertUnlocked(t, cluster, "k")
+}
+
+func TestTxUndoLogWhenCommitFails(t *testing.T) {
+	cluster := makeTxCluster(t)
+	remote := startFakeParticipant(t, map[string]resp.Reply{
+		"COMMIT": reply.MakeErrReply("ERR injected commit failure"),
+	})
+	execString(cluster, "SET", "k", "old", "EX", "100")
+	execString(cluster, "DEL", "absent")
+	_, errReply := cluster.execTx(txConnection(0), map[string][][]byte{
+		cluster.self: utils.ToCmdLine("MSET", "k", "new", "absent", "v"),
+		remote.addr:  utils.ToCmdLine("SET", "r", "v"),
+	})
+	if errReply == nil || !strings.Contains(string(errReply.ToBytes()), "injected commit failure") {
+		t.Fatalf("execTx = %v, want the commit error", errReply)
+	}
+	// 本地已经提交，undo log 恢复原值和过期时间，原来不存在的 key 被删除
+	if got := execString(cluster, "GET", "k"); got != "$3\r\nold\r\n" {
+		t.Fatalf("GET k = %q", got)
+	}
+	if got := execString(cluster, "TTL", "k"); got != ":100\r\n" && got != ":99\r\n" {
+		t.Fatalf("TTL k = %q", got)
+	}
+	if got := execString(cluster, "EXISTS", "absent"); got != ":0\r\n" {
+		t.Fatalf("EXISTS absent = %q", got)
+	}
+	if got := remote.received(); got != "PREPARE,COMMIT,ROLLBACK" {
+		t.Fatalf("remote received %s", got)
+	}
+	assertUnlocked(t, cluster, "k", "absent")
+}
+
+func TestTxParticipantTimeout(t *testing.T) {
+	cluster := makeTxCluster(t)
+	conn := &connection.Connection{}
+	execString(cluster, "SET", "k", "old")
+
+	// 协调者在 PREPARE 之后失联，超时后回滚并释放锁
+	if result := execTxCommand(cluster, conn, utils.ToCmdLine("PREPARE", "tx1", "SET", "k", "new")); reply.IsErrReply(result) {
+		t.Fatalf("PREPARE = %q", result.ToBytes())
+	}
+	tx, _ := cluster.getTx("tx1")
+	cluster.expireTx(tx)
+	if got := execString(cluster, "GET", "k"); got != "$3\r\nold\r\n" {
+		t.Fatalf("GET k after prepared tx expired = %q", got)
+	}
+	assertUnlocked(t, cluster, "k")
+	if result := execTxCommand(cluster, conn, utils.ToCmdLine("COMMIT", "tx1")); !reply.IsErrReply(result) {
+		t.Fatalf("COMMIT after timeout = %q", result.ToBytes())
+	}
+
+	// 协调者在 COMMIT 之后失联，超时后保留提交的结果并释放锁
+	execTxCommand(cluster, conn, utils.ToCmdLine("PREPARE", "tx2", "SET", "k", "new"))
+	execTxCommand(cluster, conn, utils.ToCmdLine("COMMIT", "tx2"))
+	tx, _ = cluster.getTx("tx2")
+	cluster.expireTx(tx)
+	if got := execString(cluster, "GET", "k"); got != "$3\r\nnew\r\n" {
+		t.Fatalf("GET k after committed tx expired = %q", got)
+	}
+	assertUnlocked(t, cluster, "k")
+
+	// 协调者等待 PREPARE 超时后先发出 ROLLBACK，之后到达的 PREPARE 不能再锁定 key
+	execTxCommand(cluster, conn, utils.ToCmdLine("ROLLBACK", "tx3"))
+	if result := execTxCommand(cluster, conn, utils.ToCmdLine("PREPARE", "tx3", "SET", "k", "late")); !reply.IsErrReply(result) {
+		t.Fatalf("PREPARE after ROLLBACK = %q", result.ToBytes())
+	}
+	if got := execString(cluster, "GET", "k"); got != "$3\r\nnew\r\n" {
+		t.Fatalf("GET k after late PREPARE = %q", got)
+	}
+	assertUnlocked(t, cluster, "k")
+}
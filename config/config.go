@@ -13,15 +13,52 @@ import (
 // ServerProperties defines global config properties
 type ServerProperties struct {
 	Bind           string `cfg:"bind"`
-	Port           int    `cfg:"port"`
+	Port           int    `cfg:"port"` // 为 0 且配置了 tls-port 或 unixsocket 时不监听普通端口
+	UnixSocket     string `cfg:"unixsocket"`
+	UnixSocketPerm string `cfg:"unixsocketperm"` // 八进制，例如 700
 	AppendOnly     bool   `cfg:"appendOnly"`
 	AppendFilename string `cfg:"appendFilename"`
-	MaxClients     int    `cfg:"maxclients"`
+	MaxClients     int    `cfg:"maxclients" default:"10000"`  // 不大于 0 时不限制
+	Timeout        int    `cfg:"timeout"`                     // 秒，连接空闲超过该时间后关闭，0 表示不关闭
+	TCPKeepAlive   int    `cfg:"tcp-keepalive" default:"300"` // 秒，TCP keepalive 的间隔，0 表示关闭
 	RequirePass    string `cfg:"requirepass"`
+	MasterUser     string `cfg:"masteruser"` // 连接其它结点时使用的 ACL 用户，为空时使用 default
+	MasterAuth     string `cfg:"masterauth"` // 连接其它结点时使用的密码，为空且没有配置 aclfile 时使用 requirepass
+	AclFile        string `cfg:"aclfile"`    // 保存 ACL 用户的文件
 	Databases      int    `cfg:"databases" default:"16"`
 
-	Peers []string `cfg:"peers"`
-	Self  string   `cfg:"self"`
+	TLSPort        int    `cfg:"tls-port"`
+	TLSCertFile    string `cfg:"tls-cert-file"`
+	TLSKeyFile     string `cfg:"tls-key-file"`
+	TLSCACertFile  string `cfg:"tls-ca-cert-file"`
+	TLSAuthClients string `cfg:"tls-auth-clients"` // yes (默认) no optional
+	TLSCluster     bool   `cfg:"tls-cluster"`      // 集群结点之间的连接是否使用 TLS
+
+	ProtoMaxBulkLen      int `cfg:"proto-max-bulk-len"`      // 字节，请求中单个参数的最大长度，默认 512MB
+	ProtoMaxMultiBulkLen int `cfg:"proto-max-multibulk-len"` // 请求中参数的最大个数，默认 1024*1024
+
+	ReplyBatchSize          int      `cfg:"reply-batch-size"`           // 字节，流水线请求的回复累积到该大小时立即发送，默认 64KB
+	ClientOutputBufferLimit []string `cfg:"client-output-buffer-limit"` // 可以有多行，每行为 <class> <hard> <soft> <soft seconds>
+
+	ExecMode     string `cfg:"exec-mode"`     // concurrent (默认): 连接的协程并发执行命令; single: 所有命令由一个协程依次执行
+	NetworkModel string `cfg:"network-model"` // goroutine (默认): 每个连接一个协程; epoll: 事件循环，只支持 linux
+	EventLoops   int    `cfg:"event-loops"`   // network-model epoll 时事件循环的个数，默认与 GOMAXPROCS 相同
+
+	Peers        []string `cfg:"peers"`
+	Self         string   `cfg:"self"`
+	VirtualNodes int      `cfg:"virtual-nodes"`
+
+	ClusterNodeTimeout int    `cfg:"cluster-node-timeout"`                     // 毫秒
+	ClusterSecret      string `cfg:"cluster-secret"`                           // 结点之间共享的密钥，连接其它结点时通过 CLUSTER PEER 出示
+	ClusterConfigFile  string `cfg:"cluster-config-file" default:"nodes.conf"` // raft 的任期、投票和日志
+	ReplicaOf          string `cfg:"replicaof"`                                // 作为副本时所属分片的主结点
+	ReplicaReadPolicy  string `cfg:"replica-read-policy"`                      // READONLY 连接的读命令如何选择结点
+
+	ClusterPoolMaxTotal     int `cfg:"cluster-pool-max-total"`    // 每个兄弟结点的最大连接数
+	ClusterPoolMaxIdle      int `cfg:"cluster-pool-max-idle"`     // 每个兄弟结点的最大空闲连接数
+	ClusterPoolIdleTimeout  int `cfg:"cluster-pool-idle-timeout"` // 秒，空闲超过该时间的连接被关闭
+	ClusterBreakerThreshold int `cfg:"cluster-breaker-threshold"` // 连续失败多少次后熔断
+	ClusterBreakerCooldown  int `cfg:"cluster-breaker-cooldown"`  // 毫秒，熔断后多久放行探测请求
 }
 
 // Properties holds global config properties
@@ -40,7 +77,8 @@ func parse(src io.Reader) *ServerProperties {
 	config := &ServerProperties{}
 
 	// read config file
-	rawMap := make(map[string]string)
+	// 同一个配置项出现多次时，普通的配置使用最后一次的值，[]string 类型的配置合并所有的值
+	rawMap := make(map[string][]string)
 	scanner := bufio.NewScanner(src)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -49,9 +87,9 @@ func parse(src io.Reader) *ServerProperties {
 		}
 		pivot := strings.IndexAny(line, " ")
 		if pivot > 0 && pivot < len(line)-1 { // separator found
-			key := line[0:pivot]
+			key := strings.ToLower(line[0:pivot])
 			value := strings.Trim(line[pivot+1:], " ")
-			rawMap[strings.ToLower(key)] = value
+			rawMap[key] = append(rawMap[key], value)
 		}
 	}
 	if err := scanner.Err(); err != nil {
@@ -69,8 +107,15 @@ func parse(src io.Reader) *ServerProperties {
 		if !ok {
 			key = field.Name
 		}
-		value, ok := rawMap[strings.ToLower(key)]
+		values, ok := rawMap[strings.ToLower(key)]
+		if !ok {
+			// 没有配置时使用 default 标签中的默认值
+			if defaultValue, hasDefault := field.Tag.Lookup("default"); hasDefault {
+				values, ok = []string{defaultValue}, true
+			}
+		}
 		if ok {
+			value := values[len(values)-1]
 			// fill config
 			switch field.Type.Kind() {
 			case reflect.String:
@@ -85,7 +130,10 @@ func parse(src io.Reader) *ServerProperties {
 				fieldVal.SetBool(boolValue)
 			case reflect.Slice:
 				if field.Type.Elem().Kind() == reflect.String {
-					slice := strings.Split(value, ",")
+					slice := make([]string, 0)
+					for _, v := range values {
+						slice = append(slice, strings.Split(v, ",")...)
+					}
 					fieldVal.Set(reflect.ValueOf(slice))
 				}
 			}
@@ -102,4 +150,5 @@ func SetupConfig(configFilename string) {
 	}
 	defer file.Close()
 	Properties = parse(file)
+	validateOutputBufferLimits(Properties.ClientOutputBufferLimit)
 }
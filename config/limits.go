@@ -0,0 +1,102 @@
+package config
+
+import (
+	"errors"
+	"go-redis/lib/logger"
+	"strconv"
+	"strings"
+)
+
+// 连接的类别，不同类别使用不同的 client-output-buffer-limit
+const (
+	ClientClassNormal  = "normal"
+	ClientClassReplica = "replica"
+	ClientClassPubSub  = "pubsub"
+)
+
+// OutputBufferLimit 输出缓冲区超过 Hard 时立即断开，持续超过 Soft 达到 SoftSeconds 秒时断开，0 表示不限制
+type OutputBufferLimit struct {
+	Hard        int64
+	Soft        int64
+	SoftSeconds int
+}
+
+// 与 redis 相同的默认值
+var defaultOutputBufferLimits = map[string]OutputBufferLimit{
+	ClientClassNormal:  {},
+	ClientClassReplica: {Hard: 256 << 20, Soft: 64 << 20, SoftSeconds: 60},
+	ClientClassPubSub:  {Hard: 32 << 20, Soft: 8 << 20, SoftSeconds: 60},
+}
+
+// GetOutputBufferLimit 返回一类连接的输出缓冲区限制，没有配置时使用默认值
+func (p *ServerProperties) GetOutputBufferLimit(class string) OutputBufferLimit {
+	limit := defaultOutputBufferLimits[class]
+	for _, line := range p.ClientOutputBufferLimit {
+		lineClass, parsed, err := parseOutputBufferLimit(line)
+		if err == nil && lineClass == class {
+			limit = parsed
+		}
+	}
+	return limit
+}
+
+// parseOutputBufferLimit normal 0 0 0 / replica 256mb 64mb 60，slave 是 replica 的别名
+func parseOutputBufferLimit(line string) (string, OutputBufferLimit, error) {
+	var limit OutputBufferLimit
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return "", limit, errors.New("wrong number of arguments")
+	}
+	class := strings.ToLower(fields[0])
+	if class == "slave" {
+		class = ClientClassReplica
+	}
+	if _, ok := defaultOutputBufferLimits[class]; !ok {
+		return "", limit, errors.New("invalid client class " + fields[0])
+	}
+	var err error
+	if limit.Hard, err = ParseMemory(fields[1]); err != nil {
+		return "", limit, err
+	}
+	if limit.Soft, err = ParseMemory(fields[2]); err != nil {
+		return "", limit, err
+	}
+	if limit.SoftSeconds, err = strconv.Atoi(fields[3]); err != nil || limit.SoftSeconds < 0 {
+		return "", limit, errors.New("invalid soft seconds " + fields[3])
+	}
+	return class, limit, nil
+}
+
+func validateOutputBufferLimits(lines []string) {
+	for _, line := range lines {
+		if _, _, err := parseOutputBufferLimit(line); err != nil {
+			logger.Warn("config: ignore client-output-buffer-limit '" + line + "': " + err.Error())
+		}
+	}
+}
+
+// ParseMemory 解析 64mb 1gb 100k 形式的大小，k m g 为 1000 的倍数，kb mb gb 为 1024 的倍数
+func ParseMemory(s string) (int64, error) {
+	lower := strings.ToLower(s)
+	units := []struct {
+		suffix string
+		unit   int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	unit := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(lower, u.suffix) {
+			lower = strings.TrimSuffix(lower, u.suffix)
+			unit = u.unit
+			break
+		}
+	}
+	n, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid memory size " + s)
+	}
+	return n * unit, nil
+}
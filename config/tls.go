@@ -0,0 +1,93 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+/*
+	TLS
+	--tls-port 不为 0 时在该端口上监听 TLS 连接，与 port 上的普通连接使用同一个处理器，port 为 0 时只监听 TLS
+	--tls-cert-file tls-key-file 服务端证书，tls-cluster yes 时也作为连接其它结点的客户端证书
+	--tls-ca-cert-file 验证客户端证书以及其它结点的服务端证书
+	--tls-auth-clients yes (默认) 要求客户端提供证书，optional 客户端提供证书时验证，no 不要求
+	--tls-cluster yes 时连接池和复制流通过 TLS 连接其它结点，peers 中应当填写 tls-port
+*/
+
+// tls-auth-clients 的取值
+const (
+	TLSAuthClientsYes      = "yes"
+	TLSAuthClientsNo       = "no"
+	TLSAuthClientsOptional = "optional"
+)
+
+// ServerTLSConfig 监听 tls-port 使用的配置
+func (p *ServerProperties) ServerTLSConfig() (*tls.Config, error) {
+	if p.TLSCertFile == "" || p.TLSKeyFile == "" {
+		return nil, errors.New("tls-port requires tls-cert-file and tls-key-file")
+	}
+	cert, err := tls.LoadX509KeyPair(p.TLSCertFile, p.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch p.TLSAuthClients {
+	case "", TLSAuthClientsYes:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case TLSAuthClientsOptional:
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case TLSAuthClientsNo:
+		cfg.ClientAuth = tls.NoClientCert
+	default:
+		return nil, errors.New("invalid tls-auth-clients " + p.TLSAuthClients + ", must be yes, no or optional")
+	}
+	if cfg.ClientAuth != tls.NoClientCert {
+		if p.TLSCACertFile == "" {
+			return nil, errors.New("tls-auth-clients requires tls-ca-cert-file")
+		}
+		if cfg.ClientCAs, err = loadCertPool(p.TLSCACertFile); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// ClientTLSConfig 连接其它结点使用的配置，带上服务端证书以便对方验证，tls-cluster 为 no 时返回 nil
+func (p *ServerProperties) ClientTLSConfig() (*tls.Config, error) {
+	if !p.TLSCluster {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if p.TLSCertFile != "" && p.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(p.TLSCertFile, p.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if p.TLSCACertFile != "" {
+		pool, err := loadCertPool(p.TLSCACertFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate found in " + filename)
+	}
+	return pool, nil
+}
@@ -0,0 +1,197 @@
+package database
+
+import (
+	"go-redis/acl"
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CheckPermission 检查连接的用户能否执行命令，允许时返回 nil
+func CheckPermission(conn resp.Connection, args [][]byte) resp.Reply {
+	if err := acl.Check(conn.GetUser(), args, clientInfo(conn)); err != nil {
+		return reply.MakeErrReply(err.Error())
+	}
+	return nil
+}
+
+// clientInfo 用于 ACL LOG 的客户端地址
+func clientInfo(conn resp.Connection) string {
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok && c.RemoteAddr() != nil {
+		return "addr=" + c.RemoteAddr().String()
+	}
+	return ""
+}
+
+// execACL ACL SETUSER|GETUSER|DELUSER|LIST|USERS|WHOAMI|CAT|LOG|LOAD|SAVE
+func execACL(conn resp.Connection, args [][]byte) resp.Reply {
+	if len(args) < 2 {
+		return reply.MakeArgNumErrReply("acl")
+	}
+	subCmd := strings.ToLower(string(args[1]))
+	switch subCmd {
+	case "setuser":
+		if len(args) < 3 {
+			return reply.MakeArgNumErrReply("acl|setuser")
+		}
+		rules := make([]string, 0, len(args)-3)
+		for _, rule := range args[3:] {
+			rules = append(rules, string(rule))
+		}
+		if err := acl.SetUser(string(args[2]), rules); err != nil {
+			return reply.MakeErrReply("ERR " + err.Error())
+		}
+		return reply.MakeOkReply()
+	case "getuser":
+		if len(args) != 3 {
+			return reply.MakeArgNumErrReply("acl|getuser")
+		}
+		return makeUserReply(acl.GetUser(string(args[2])))
+	case "deluser":
+		if len(args) < 3 {
+			return reply.MakeArgNumErrReply("acl|deluser")
+		}
+		names := make([]string, 0, len(args)-2)
+		for _, name := range args[2:] {
+			names = append(names, string(name))
+		}
+		deleted, err := acl.DelUser(names)
+		if err != nil {
+			return reply.MakeErrReply("ERR " + err.Error())
+		}
+		return reply.MakeIntReply(int64(deleted))
+	case "list", "users":
+		if len(args) != 2 {
+			return reply.MakeArgNumErrReply("acl|" + subCmd)
+		}
+		users := acl.Users()
+		result := make([][]byte, len(users))
+		for i, u := range users {
+			if subCmd == "list" {
+				result[i] = []byte(u.Describe())
+			} else {
+				result[i] = []byte(u.Name)
+			}
+		}
+		return reply.MakeMultiBulkReply(result)
+	case "whoami":
+		if len(args) != 2 {
+			return reply.MakeArgNumErrReply("acl|whoami")
+		}
+		return reply.MakeBulkReply([]byte(conn.GetUser()))
+	case "cat":
+		return execACLCat(args)
+	case "log":
+		return execACLLog(args)
+	case "load", "save":
+		if len(args) != 2 {
+			return reply.MakeArgNumErrReply("acl|" + subCmd)
+		}
+		var err error
+		if subCmd == "load" {
+			err = acl.Load()
+		} else {
+			err = acl.Save()
+		}
+		if err != nil {
+			return reply.MakeErrReply("ERR " + err.Error())
+		}
+		return reply.MakeOkReply()
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + string(args[1]) + "'. Try ACL HELP.")
+}
+
+// makeUserReply flags passwords commands keys channels 组成的 map，用户不存在时为 nil
+func makeUserReply(u *acl.User) resp.Reply {
+	if u == nil {
+		return reply.MakeNullBulkReply()
+	}
+	return reply.MakeMapReply([]resp.Reply{
+		reply.MakeBulkReply([]byte("flags")),
+		reply.MakeMultiBulkReply(toBytesList(u.Flags())),
+		reply.MakeBulkReply([]byte("passwords")),
+		reply.MakeMultiBulkReply(toBytesList(u.PasswordHashes())),
+		reply.MakeBulkReply([]byte("commands")),
+		reply.MakeBulkReply([]byte(u.CommandRules())),
+		reply.MakeBulkReply([]byte("keys")),
+		reply.MakeBulkReply([]byte(u.Keys())),
+		reply.MakeBulkReply([]byte("channels")),
+		reply.MakeBulkReply([]byte(u.Channels())),
+	})
+}
+
+// execACLCat ACL CAT [category]
+func execACLCat(args [][]byte) resp.Reply {
+	switch len(args) {
+	case 2:
+		return reply.MakeMultiBulkReply(toBytesList(acl.Categories()))
+	case 3:
+		category := strings.ToLower(string(args[2]))
+		if !acl.IsCategory(category) {
+			return reply.MakeErrReply("ERR Unknown category '" + string(args[2]) + "'")
+		}
+		return reply.MakeMultiBulkReply(toBytesList(acl.CommandsInCategory(category)))
+	}
+	return reply.MakeArgNumErrReply("acl|cat")
+}
+
+// execACLLog ACL LOG [count | RESET]
+func execACLLog(args [][]byte) resp.Reply {
+	count := 10
+	switch len(args) {
+	case 2:
+	case 3:
+		if strings.ToLower(string(args[2])) == "reset" {
+			acl.ResetLog()
+			return reply.MakeOkReply()
+		}
+		n, err := strconv.Atoi(string(args[2]))
+		if err != nil || n < 0 {
+			return reply.MakeErrReply("ERR value is out of range, must be positive")
+		}
+		count = n
+	default:
+		return reply.MakeArgNumErrReply("acl|log")
+	}
+	now := time.Now()
+	entries := acl.Log(count)
+	result := make([]resp.Reply, len(entries))
+	for i, entry := range entries {
+		age := now.Sub(entry.Created).Seconds()
+		result[i] = reply.MakeMapReply([]resp.Reply{
+			reply.MakeBulkReply([]byte("count")),
+			reply.MakeIntReply(entry.Count),
+			reply.MakeBulkReply([]byte("reason")),
+			reply.MakeBulkReply([]byte(entry.Reason)),
+			reply.MakeBulkReply([]byte("context")),
+			reply.MakeBulkReply([]byte("toplevel")),
+			reply.MakeBulkReply([]byte("object")),
+			reply.MakeBulkReply([]byte(entry.Object)),
+			reply.MakeBulkReply([]byte("username")),
+			reply.MakeBulkReply([]byte(entry.Username)),
+			reply.MakeBulkReply([]byte("age-seconds")),
+			reply.MakeDoubleReply(math.Round(age*1000) / 1000),
+			reply.MakeBulkReply([]byte("client-info")),
+			reply.MakeBulkReply([]byte(entry.ClientInfo)),
+			reply.MakeBulkReply([]byte("entry-id")),
+			reply.MakeIntReply(entry.EntryID),
+			reply.MakeBulkReply([]byte("timestamp-created")),
+			reply.MakeIntReply(entry.Created.UnixMilli()),
+			reply.MakeBulkReply([]byte("timestamp-last-updated")),
+			reply.MakeIntReply(entry.Updated.UnixMilli()),
+		})
+	}
+	return reply.MakeMultiRawReply(result)
+}
+
+func toBytesList(list []string) [][]byte {
+	result := make([][]byte, len(list))
+	for i, s := range list {
+		result[i] = []byte(s)
+	}
+	return result
+}
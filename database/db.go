@@ -1,17 +1,20 @@
 package database
 
 import (
+	"fmt"
 	"go-redis/datastruct/dict"
 	"go-redis/interface/database"
 	"go-redis/interface/resp"
 	"go-redis/resp/reply"
 	"reflect"
 	"strings"
+	"time"
 )
 
 type DB struct {
 	index  int
 	data   dict.Dict
+	ttlMap dict.Dict // key -> 过期时间
 	AddAof func(cmdLine CmdLine)
 }
 
@@ -19,9 +22,13 @@ type ExecFunc func(db *DB, args [][]byte) resp.Reply
 
 type CmdLine [][]byte
 
+// dataDictShards key 所在字典的分段数，SCAN 每次至少遍历一个分段
+const dataDictShards = 1 << 10
+
 func makeDB() *DB {
 	return &DB{
-		data:   dict.MakeSyncDict(),
+		data:   dict.MakeConcurrent(dataDictShards),
+		ttlMap: dict.MakeSyncDict(),
 		AddAof: func(cmdLine CmdLine) {},
 	}
 }
@@ -52,6 +59,9 @@ func validateArity(arity int, cmdArgs [][]byte) bool {
 }
 
 func (db *DB) GetEntity(key string) (*database.DataEntity, bool) {
+	if db.expireIfNeeded(key) {
+		return nil, false
+	}
 	value, exists := db.data.Get(key)
 	if !exists || reflect.TypeOf(value) != reflect.TypeOf(&database.DataEntity{}) {
 		return nil, exists
@@ -64,22 +74,25 @@ func (db *DB) PutEntity(key string, entity *database.DataEntity) int {
 }
 
 func (db *DB) PutIfExists(key string, entity *database.DataEntity) int {
+	db.expireIfNeeded(key)
 	return db.data.PutIfExists(key, entity)
 }
 
 func (db *DB) PutIfAbsent(key string, entity *database.DataEntity) int {
+	db.expireIfNeeded(key)
 	return db.data.PutIfAbsent(key, entity)
 }
 
 func (db *DB) Remove(key string) {
 	db.data.Remove(key)
+	db.ttlMap.Remove(key)
 }
 
 func (db *DB) Removes(keys ...string) (deleted int) {
 	deleted = 0
 	for _, key := range keys {
-		if _, exists := db.data.Get(key); exists {
-			db.data.Remove(key)
+		if _, exists := db.GetEntity(key); exists {
+			db.Remove(key)
 			deleted++
 		}
 	}
@@ -88,8 +101,39 @@ func (db *DB) Removes(keys ...string) (deleted int) {
 
 func (db *DB) Flush() {
 	db.data.Clear()
+	db.ttlMap.Clear()
 }
 
 func (db *DB) Keys() []string {
 	return db.data.Keys()
 }
+
+// ForEach 遍历所有未过期的 key，expiration 为 nil 表示没有过期时间
+func (db *DB) ForEach(cb func(key string, entity *database.DataEntity, expiration *time.Time) bool) {
+	db.data.ForEach(func(key string, val interface{}) bool {
+		entity, ok := val.(*database.DataEntity)
+		if !ok {
+			return true
+		}
+		var expiration *time.Time
+		if expireAt, ok := db.ExpireTime(key); ok {
+			if !time.Now().Before(expireAt) {
+				return true
+			}
+			expiration = &expireAt
+		}
+		return cb(key, entity, expiration)
+	})
+}
+
+// EntityToCmdLine 将数据转换为可以重建它的命令，不支持的数据类型返回错误
+// 过期时间需要另外用 MakeExpireCmd 重建
+func EntityToCmdLine(key string, entity *database.DataEntity) (CmdLine, error) {
+	switch val := entity.Data.(type) {
+	case []byte:
+		return CmdLine{[]byte("SET"), []byte(key), val}, nil
+	case string:
+		return CmdLine{[]byte("SET"), []byte(key), []byte(val)}, nil
+	}
+	return nil, fmt.Errorf("cannot dump key %s: unsupported value type %T", key, entity.Data)
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/lib/sync/queue"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	单线程执行器，exec-mode single 时使用
+	--所有连接解析出的命令通过无锁队列交给同一个协程依次执行，读写连接仍然在各自的协程中并行
+	--任意两条命令不会交叉执行，RENAME、INCR 之类读后写的命令与 redis 一样是原子的
+	--提交命令的协程阻塞到命令执行完成，同一个连接上的命令按顺序执行
+	--执行器中执行的命令不能再调用 StandaloneDatabase.Exec，否则会等待自己
+	--集群直接读取数据 (GetEntity ForEach) 时不经过执行器
+*/
+
+// exec-mode 的取值，默认的 concurrent 由连接的协程直接执行命令
+const (
+	ExecModeConcurrent = "concurrent"
+	ExecModeSingle     = "single"
+)
+
+type execTask struct {
+	client resp.Connection
+	args   [][]byte
+	result chan resp.Reply
+}
+
+var taskPool = sync.Pool{
+	New: func() interface{} {
+		return &execTask{result: make(chan resp.Reply, 1)}
+	},
+}
+
+type executor struct {
+	queue    *queue.MPSC[*execTask]
+	exec     func(client resp.Connection, args [][]byte) resp.Reply
+	sleeping atomic.Bool   // 执行器的协程是否在等待 wake
+	wake     chan struct{} // 容量为 1，执行器睡眠时由提交命令的协程唤醒
+}
+
+func makeExecutor(exec func(client resp.Connection, args [][]byte) resp.Reply) *executor {
+	e := &executor{
+		queue: queue.MakeMPSC[*execTask](),
+		exec:  exec,
+		wake:  make(chan struct{}, 1),
+	}
+	go e.run()
+	return e
+}
+
+// submit 提交命令并等待执行结果
+func (e *executor) submit(client resp.Connection, args [][]byte) resp.Reply {
+	task := taskPool.Get().(*execTask)
+	task.client = client
+	task.args = args
+	e.queue.Push(task)
+	if e.sleeping.CompareAndSwap(true, false) {
+		select {
+		case e.wake <- struct{}{}:
+		default: // 已经有未处理的唤醒
+		}
+	}
+	result := <-task.result
+	task.client = nil
+	task.args = nil
+	taskPool.Put(task)
+	return result
+}
+
+func (e *executor) run() {
+	for {
+		task, ok := e.queue.Pop()
+		if !ok {
+			// 先声明要睡眠再检查一次队列，检查之后加入的命令一定会看到 sleeping 并唤醒执行器
+			e.sleeping.Store(true)
+			if task, ok = e.queue.Pop(); !ok {
+				<-e.wake
+				continue
+			}
+			e.sleeping.Store(false)
+		}
+		task.result <- e.exec(task.client, task.args)
+	}
+}
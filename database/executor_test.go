@@ -0,0 +1,99 @@
+package database
+
+import (
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/lib/utils"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestExecutorOrder(t *testing.T) {
+	const producers, perProducer = 8, 2000
+	var running int
+	var mu sync.Mutex
+	executed := make(map[string][]int) // 每个生产者的命令按执行的顺序排列
+	e := makeExecutor(func(client resp.Connection, args [][]byte) resp.Reply {
+		// 执行器只有一个协程，这里不需要锁，mu 只是为了让 race detector 检查交叉执行
+		mu.Lock()
+		running++
+		if running != 1 {
+			t.Errorf("%d commands running at the same time", running)
+		}
+		producer := string(args[0])
+		seq, _ := strconv.Atoi(string(args[1]))
+		executed[producer] = append(executed[producer], seq)
+		running--
+		mu.Unlock()
+		return reply.MakeIntReply(int64(seq))
+	})
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(producer string) {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				result := e.submit(nil, utils.ToCmdLine(producer, strconv.Itoa(i)))
+				// 每个生产者收到的是自己的命令的结果
+				if code := result.(*reply.IntReply).Code; code != int64(i) {
+					t.Errorf("%s: command %d got the result of %d", producer, i, code)
+					return
+				}
+			}
+		}("p" + strconv.Itoa(p))
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(executed) != producers {
+		t.Fatalf("%d producers executed, want %d", len(executed), producers)
+	}
+	for producer, seqs := range executed {
+		if len(seqs) != perProducer {
+			t.Fatalf("%s: %d commands executed, want %d", producer, len(seqs), perProducer)
+		}
+		for i, seq := range seqs {
+			if seq != i {
+				t.Fatalf("%s: command %d executed at position %d", producer, seq, i)
+			}
+		}
+	}
+}
+
+func TestSingleExecMode(t *testing.T) {
+	config.Properties.Databases = 16
+	config.Properties.ExecMode = ExecModeSingle
+	defer func() {
+		config.Properties.ExecMode = ""
+	}()
+	database := NewStandaloneDatabase()
+	if database.executor == nil {
+		t.Fatal("exec-mode single did not start the executor")
+	}
+
+	// 每个连接读到的是自己刚刚写入的值
+	const producers, perProducer = 8, 500
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			client := &connection.Connection{}
+			for i := 0; i < perProducer; i++ {
+				value := strconv.Itoa(i)
+				database.Exec(client, utils.ToCmdLine("SET", key, value))
+				result := database.Exec(client, utils.ToCmdLine("GET", key))
+				if bulk, ok := result.(*reply.BulkReply); !ok || string(bulk.Arg) != value {
+					t.Errorf("GET %s = %q, want %s", key, result.ToBytes(), value)
+					return
+				}
+			}
+		}("k" + strconv.Itoa(p))
+	}
+	wg.Wait()
+}
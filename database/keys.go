@@ -1,10 +1,15 @@
 package database
 
 import (
+	"go-redis/interface/database"
 	"go-redis/interface/resp"
 	"go-redis/lib/utils"
 	"go-redis/lib/wildcard"
 	"go-redis/resp/reply"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // DEL
@@ -37,7 +42,7 @@ func execKeys(db *DB, args [][]byte) resp.Reply {
 	pattern := wildcard.CompilePattern(string(args[0]))
 	result := make([][]byte, 0)
 	db.data.ForEach(func(key string, val interface{}) bool {
-		if pattern.IsMatch(key) {
+		if pattern.IsMatch(key) && !db.isExpired(key) {
 			result = append(result, []byte(key))
 		}
 		return true
@@ -46,6 +51,82 @@ func execKeys(db *DB, args [][]byte) resp.Reply {
 	return reply.MakeMultiBulkReply(result)
 }
 
+// DBSIZE 不计入已经过期但还没有删除的 key，与 KEYS 的结果一致
+func execDBSize(db *DB, args [][]byte) resp.Reply {
+	size := db.data.Len()
+	now := time.Now()
+	db.ttlMap.ForEach(func(key string, val interface{}) bool {
+		if expireAt, ok := val.(time.Time); ok && !now.Before(expireAt) {
+			size--
+		}
+		return true
+	})
+	return reply.MakeIntReply(int64(size))
+}
+
+// RANDOMKEY
+func execRandomKey(db *DB, args [][]byte) resp.Reply {
+	size := db.data.Len()
+	if size == 0 {
+		return reply.MakeNullBulkReply()
+	}
+	var result string
+	found := false
+	i, target := 0, rand.Intn(size)
+	db.data.ForEach(func(key string, val interface{}) bool {
+		// 跳过已经过期但还没有删除的 key
+		if db.isExpired(key) {
+			return true
+		}
+		result, found = key, true
+		i++
+		return i <= target
+	})
+	if !found {
+		return reply.MakeNullBulkReply()
+	}
+	return reply.MakeBulkReply([]byte(result))
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count]
+func execScan(db *DB, args [][]byte) resp.Reply {
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		return reply.MakeErrReply("ERR invalid cursor")
+	}
+	count := 10
+	var pattern *wildcard.Pattern
+	for i := 1; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return reply.MakeSyntaxErrReply("scan")
+		}
+		switch strings.ToLower(string(args[i])) {
+		case "match":
+			pattern = wildcard.CompilePattern(string(args[i+1]))
+		case "count":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count <= 0 {
+				return reply.MakeSyntaxErrReply("scan")
+			}
+		default:
+			return reply.MakeSyntaxErrReply("scan")
+		}
+	}
+
+	// 游标为字典分段的下标，每次遍历完整的分段，遍历期间一直存在的 key 至少会被返回一次
+	keys := make([][]byte, 0, count)
+	next := db.data.Scan(int(cursor), count, func(key string, val interface{}) bool {
+		if (pattern == nil || pattern.IsMatch(key)) && !db.isExpired(key) {
+			keys = append(keys, []byte(key))
+		}
+		return true
+	})
+	return reply.MakeMultiRawReply([]resp.Reply{
+		reply.MakeBulkReply([]byte(strconv.Itoa(next))),
+		reply.MakeMultiBulkReply(keys),
+	})
+}
+
 // FLUSHDB
 func execFlushDB(db *DB, args [][]byte) resp.Reply {
 	db.Flush()
@@ -69,6 +150,17 @@ func execType(db *DB, args [][]byte) resp.Reply {
 	return reply.MakeUnKnowErrReply()
 }
 
+// renameEntity 把 key1 的数据和过期时间移动到 key2
+func (db *DB) renameEntity(key1, key2 string, entity *database.DataEntity) {
+	expireAt, hasTTL := db.ExpireTime(key1)
+	db.Remove(key1)
+	db.PutEntity(key2, entity)
+	db.Persist(key2)
+	if hasTTL {
+		db.Expire(key2, expireAt)
+	}
+}
+
 // RENAME k1 k2
 func execRename(db *DB, args [][]byte) resp.Reply {
 	key1 := string(args[0])
@@ -77,8 +169,7 @@ func execRename(db *DB, args [][]byte) resp.Reply {
 	if !exists {
 		return reply.MakeErrReply("no such key")
 	}
-	db.Remove(key1)
-	db.PutEntity(key2, entity)
+	db.renameEntity(key1, key2, entity)
 
 	db.AddAof(utils.ToCmdLine2("rename", args...))
 
@@ -98,11 +189,10 @@ func execRenameNX(db *DB, args [][]byte) resp.Reply {
 	if !exists {
 		return reply.MakeErrReply("no such key")
 	}
-	db.Remove(key1)
-	db.PutEntity(key2, entity)
+	db.renameEntity(key1, key2, entity)
 
 	db.AddAof(utils.ToCmdLine2("renamenx", args...))
-	
+
 	return reply.MakeIntReply(1)
 }
 
@@ -111,6 +201,9 @@ func init() {
 	RegisterCommand("exists", execExists, -2)
 	RegisterCommand("keys", execKeys, 2)
 	RegisterCommand("flushdb", execFlushDB, -1)
+	RegisterCommand("dbsize", execDBSize, 1)
+	RegisterCommand("randomkey", execRandomKey, 1)
+	RegisterCommand("scan", execScan, -2)
 	RegisterCommand("type", execType, 2)
 	RegisterCommand("rename", execRename, 3)
 	RegisterCommand("renameNX", execRenameNX, 3)
@@ -9,13 +9,19 @@ import (
 	"go-redis/resp/reply"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type StandaloneDatabase struct {
-	dbSet      []*DB
-	aofHandler *aof.AofHandler
+	dbSet          []*DB
+	aofHandler     *aof.AofHandler
+	writeListeners []WriteListener
+	executor       *executor // exec-mode single 时所有命令由执行器依次执行
 }
 
+// WriteListener receives every write command executed on the database, e.g. to replicate it
+type WriteListener func(dbIndex int, cmdLine CmdLine)
+
 func NewStandaloneDatabase() *StandaloneDatabase {
 	database := &StandaloneDatabase{}
 	database.dbSet = make([]*DB, config.Properties.Databases)
@@ -24,36 +30,98 @@ func NewStandaloneDatabase() *StandaloneDatabase {
 		db.index = i
 		database.dbSet[i] = db
 	}
+	switch config.Properties.ExecMode {
+	case "", ExecModeConcurrent:
+	case ExecModeSingle:
+		database.executor = makeExecutor(database.exec)
+	default:
+		logger.Warn("unknown exec-mode " + config.Properties.ExecMode + ", use " + ExecModeConcurrent)
+	}
 	if config.Properties.AppendOnly {
 		aofHandler, err := aof.NewAofHandler(database)
 		if err != nil {
 			panic(err)
 		}
 		database.aofHandler = aofHandler
-		for _, db := range database.dbSet {
-			sdb := db
-			sdb.AddAof = func(cmdLine CmdLine) {
+	}
+	for _, db := range database.dbSet {
+		sdb := db
+		sdb.AddAof = func(cmdLine CmdLine) {
+			if database.aofHandler != nil {
 				database.aofHandler.AddAof(sdb.index, cmdLine)
 			}
+			for _, listener := range database.writeListeners {
+				listener(sdb.index, cmdLine)
+			}
 		}
 	}
 	return database
 }
 
+// AddWriteListener registers a listener of write commands, it must be called before serving
+func (d *StandaloneDatabase) AddWriteListener(listener WriteListener) {
+	d.writeListeners = append(d.writeListeners, listener)
+}
+
+// DBCount returns the number of logical databases
+func (d *StandaloneDatabase) DBCount() int {
+	return len(d.dbSet)
+}
+
+// ForEach traverses all unexpired entities in the given logical database, expiration is nil for keys without TTL
+func (d *StandaloneDatabase) ForEach(dbIndex int, cb func(key string, entity *database.DataEntity, expiration *time.Time) bool) {
+	if dbIndex < 0 || dbIndex >= len(d.dbSet) {
+		return
+	}
+	d.dbSet[dbIndex].ForEach(cb)
+}
+
+// GetEntity returns the entity of key in the given logical database
+func (d *StandaloneDatabase) GetEntity(dbIndex int, key string) (*database.DataEntity, bool) {
+	if dbIndex < 0 || dbIndex >= len(d.dbSet) {
+		return nil, false
+	}
+	return d.dbSet[dbIndex].GetEntity(key)
+}
+
+// GetExpireTime returns the expiration of key in the given logical database, ok is false if it has no TTL
+func (d *StandaloneDatabase) GetExpireTime(dbIndex int, key string) (expireAt time.Time, ok bool) {
+	if dbIndex < 0 || dbIndex >= len(d.dbSet) {
+		return time.Time{}, false
+	}
+	return d.dbSet[dbIndex].ExpireTime(key)
+}
+
 func (d *StandaloneDatabase) Exec(client resp.Connection, args database.CmdLine) resp.Reply {
+	if d.executor != nil {
+		return d.executor.submit(client, args)
+	}
+	return d.exec(client, args)
+}
+
+func (d *StandaloneDatabase) exec(client resp.Connection, args database.CmdLine) resp.Reply {
 	defer func() {
 		if err := recover(); err != nil {
 			logger.Error(err)
 		}
 	}()
 
+	if errReply := CheckPermission(client, args); errReply != nil {
+		return errReply
+	}
 	cmdName := strings.ToLower(string(args[0]))
+	if cmdName == "acl" {
+		return execACL(client, args)
+	}
 	if cmdName == "select" {
 		if len(args) != 2 {
 			return reply.MakeArgNumErrReply("select")
 		}
 		return execSelect(client, d, args[1:])
 	}
+	if cmdName == "flushall" {
+		return execFlushAll(d)
+	}
 
 	index := client.GetDBIndex()
 	if index < 0 || index >= len(d.dbSet) {
@@ -71,6 +139,14 @@ func (d *StandaloneDatabase) AfterClientClose(client resp.Connection) {
 
 }
 
+// FLUSHALL 清空所有的 db
+func execFlushAll(database *StandaloneDatabase) resp.Reply {
+	for _, db := range database.dbSet {
+		execFlushDB(db, nil)
+	}
+	return reply.MakeOkReply()
+}
+
 // select 4
 func execSelect(conn resp.Connection, database *StandaloneDatabase, args [][]byte) resp.Reply {
 	dbIndex, err := strconv.Atoi(string(args[0]))
@@ -5,6 +5,8 @@ import (
 	"go-redis/interface/resp"
 	"go-redis/lib/utils"
 	"go-redis/resp/reply"
+	"strings"
+	"time"
 )
 
 // GET
@@ -17,21 +19,94 @@ func execGet(db *DB, args [][]byte) resp.Reply {
 	return reply.MakeBulkReply(entity.Data.([]byte))
 }
 
-// SET
+const (
+	upsertPolicy = iota // 默认总是写入
+	insertPolicy        // NX
+	updatePolicy        // XX
+)
+
+// SET key value [NX|XX] [EX seconds|PX milliseconds|EXAT unix-time-seconds|PXAT unix-time-milliseconds|KEEPTTL]
 func execSet(db *DB, args [][]byte) resp.Reply {
 	key := string(args[0])
 	value := args[1]
-	db.PutEntity(key, &database.DataEntity{Data: value})
+	policy := upsertPolicy
+	keepTTL := false
+	var expireAt time.Time
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i]))
+		switch opt {
+		case "NX", "XX":
+			if policy != upsertPolicy {
+				return reply.MakeSyntaxErrReply("set")
+			}
+			policy = insertPolicy
+			if opt == "XX" {
+				policy = updatePolicy
+			}
+		case "KEEPTTL":
+			if !expireAt.IsZero() {
+				return reply.MakeSyntaxErrReply("set")
+			}
+			keepTTL = true
+		case "EX", "PX", "EXAT", "PXAT":
+			if keepTTL || !expireAt.IsZero() || i+1 >= len(args) {
+				return reply.MakeSyntaxErrReply("set")
+			}
+			i++
+			n, ok := parseInt(args[i])
+			if !ok {
+				return reply.MakeErrReply("ERR value is not an integer or out of range")
+			}
+			if n <= 0 {
+				return reply.MakeErrReply("ERR invalid expire time in 'set' command")
+			}
+			switch opt {
+			case "EX":
+				expireAt = time.Now().Add(time.Duration(n) * time.Second)
+			case "PX":
+				expireAt = time.Now().Add(time.Duration(n) * time.Millisecond)
+			case "EXAT":
+				expireAt = time.Unix(n, 0)
+			default:
+				expireAt = time.UnixMilli(n)
+			}
+		default:
+			return reply.MakeSyntaxErrReply("set")
+		}
+	}
 
-	db.AddAof(utils.ToCmdLine2("set", args...))
+	entity := &database.DataEntity{Data: value}
+	var result int
+	switch policy {
+	case insertPolicy:
+		result = db.PutIfAbsent(key, entity)
+	case updatePolicy:
+		result = db.PutIfExists(key, entity)
+	default:
+		db.PutEntity(key, entity)
+		result = 1
+	}
+	if result == 0 {
+		return reply.MakeNullBulkReply()
+	}
 
+	if keepTTL {
+		db.AddAof(utils.ToCmdLine2("set", args[0], args[1], []byte("KEEPTTL")))
+		return reply.MakeOkReply()
+	}
+	db.Persist(key)
+	db.AddAof(utils.ToCmdLine2("set", args[0], args[1]))
+	if !expireAt.IsZero() {
+		db.Expire(key, expireAt)
+		db.AddAof(MakeExpireCmd(key, expireAt))
+	}
 	return reply.MakeOkReply()
 }
 
 // SETNX
 func execSetNX(db *DB, args [][]byte) resp.Reply {
 	key := string(args[0])
-	value := string(args[1])
+	value := args[1]
 	result := db.PutIfAbsent(key, &database.DataEntity{Data: value})
 
 	db.AddAof(utils.ToCmdLine2("setnx", args...))
@@ -42,9 +117,10 @@ func execSetNX(db *DB, args [][]byte) resp.Reply {
 // GETSET k1 v1
 func execGetSet(db *DB, args [][]byte) resp.Reply {
 	key := string(args[0])
-	value := string(args[1])
+	value := args[1]
 	entity, exists := db.GetEntity(key)
 	db.PutEntity(key, &database.DataEntity{Data: value})
+	db.Persist(key)
 
 	db.AddAof(utils.ToCmdLine2("getset", args...))
 
@@ -54,6 +130,41 @@ func execGetSet(db *DB, args [][]byte) resp.Reply {
 	return reply.MakeBulkReply(entity.Data.([]byte))
 }
 
+// MSET k1 v1 k2 v2
+func execMSet(db *DB, args [][]byte) resp.Reply {
+	if len(args)%2 != 0 {
+		return reply.MakeArgNumErrReply("mset")
+	}
+	for i := 0; i < len(args); i += 2 {
+		db.PutEntity(string(args[i]), &database.DataEntity{Data: args[i+1]})
+		db.Persist(string(args[i]))
+	}
+
+	db.AddAof(utils.ToCmdLine2("mset", args...))
+
+	return reply.MakeOkReply()
+}
+
+// MSETNX k1 v1 k2 v2 任意一个 key 已存在时不做任何修改
+func execMSetNX(db *DB, args [][]byte) resp.Reply {
+	if len(args)%2 != 0 {
+		return reply.MakeArgNumErrReply("msetnx")
+	}
+	for i := 0; i < len(args); i += 2 {
+		if _, exists := db.GetEntity(string(args[i])); exists {
+			return reply.MakeIntReply(0)
+		}
+	}
+	for i := 0; i < len(args); i += 2 {
+		db.PutEntity(string(args[i]), &database.DataEntity{Data: args[i+1]})
+		db.Persist(string(args[i]))
+	}
+
+	db.AddAof(utils.ToCmdLine2("msetnx", args...))
+
+	return reply.MakeIntReply(1)
+}
+
 // STRLEN
 func execStrlen(db *DB, args [][]byte) resp.Reply {
 	key := string(args[0])
@@ -66,8 +177,10 @@ func execStrlen(db *DB, args [][]byte) resp.Reply {
 
 func init() {
 	RegisterCommand("get", execGet, 2)
-	RegisterCommand("set", execSet, 3)
+	RegisterCommand("set", execSet, -3)
 	RegisterCommand("setnx", execSetNX, 3)
 	RegisterCommand("getset", execGetSet, 3)
 	RegisterCommand("strlen", execStrlen, 2)
+	RegisterCommand("mset", execMSet, -3)
+	RegisterCommand("msetnx", execMSetNX, -3)
 }
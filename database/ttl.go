@@ -0,0 +1,159 @@
+package database
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"strconv"
+	"time"
+)
+
+/*
+	key 的过期时间
+	--过期时间保存在 DB.ttlMap 中，读取 key 时检查是否过期，过期的 key 在读取时删除
+	--AOF 和复制流中统一记录为 PEXPIREAT 绝对时间，重放时已经过期的 key 直接删除
+	--SET GETSET MSET 等覆盖 key 的命令清除过期时间，RENAME 保留过期时间
+*/
+
+// Expire 设置 key 的过期时间
+func (db *DB) Expire(key string, expireAt time.Time) {
+	db.ttlMap.Put(key, expireAt)
+}
+
+// Persist 清除 key 的过期时间
+func (db *DB) Persist(key string) {
+	db.ttlMap.Remove(key)
+}
+
+// ExpireTime 返回 key 的过期时间，没有设置过期时间时 ok 为 false
+func (db *DB) ExpireTime(key string) (expireAt time.Time, ok bool) {
+	val, exists := db.ttlMap.Get(key)
+	if !exists {
+		return time.Time{}, false
+	}
+	return val.(time.Time), true
+}
+
+// isExpired 检查 key 是否已经过期
+func (db *DB) isExpired(key string) bool {
+	expireAt, ok := db.ExpireTime(key)
+	return ok && !time.Now().Before(expireAt)
+}
+
+// expireIfNeeded key 已经过期时删除，返回是否删除
+func (db *DB) expireIfNeeded(key string) bool {
+	if !db.isExpired(key) {
+		return false
+	}
+	db.Remove(key)
+	return true
+}
+
+// MakeExpireCmd 设置过期时间的 PEXPIREAT 命令
+func MakeExpireCmd(key string, expireAt time.Time) CmdLine {
+	return utils.ToCmdLine("PEXPIREAT", key, strconv.FormatInt(expireAt.UnixMilli(), 10))
+}
+
+// expireAt 设置过期时间并记录 AOF，过期时间已过时直接删除 key
+func (db *DB) expireAt(key string, expireAt time.Time) resp.Reply {
+	if _, exists := db.GetEntity(key); !exists {
+		return reply.MakeIntReply(0)
+	}
+	if !time.Now().Before(expireAt) {
+		db.Remove(key)
+		db.AddAof(utils.ToCmdLine("del", key))
+		return reply.MakeIntReply(1)
+	}
+	db.Expire(key, expireAt)
+	db.AddAof(MakeExpireCmd(key, expireAt))
+	return reply.MakeIntReply(1)
+}
+
+func parseInt(arg []byte) (int64, bool) {
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	return n, err == nil
+}
+
+// EXPIRE key seconds
+func execExpire(db *DB, args [][]byte) resp.Reply {
+	seconds, ok := parseInt(args[1])
+	if !ok {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	return db.expireAt(string(args[0]), time.Now().Add(time.Duration(seconds)*time.Second))
+}
+
+// PEXPIRE key milliseconds
+func execPExpire(db *DB, args [][]byte) resp.Reply {
+	ms, ok := parseInt(args[1])
+	if !ok {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	return db.expireAt(string(args[0]), time.Now().Add(time.Duration(ms)*time.Millisecond))
+}
+
+// EXPIREAT key unix-time-seconds
+func execExpireAt(db *DB, args [][]byte) resp.Reply {
+	seconds, ok := parseInt(args[1])
+	if !ok {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	return db.expireAt(string(args[0]), time.Unix(seconds, 0))
+}
+
+// PEXPIREAT key unix-time-milliseconds
+func execPExpireAt(db *DB, args [][]byte) resp.Reply {
+	ms, ok := parseInt(args[1])
+	if !ok {
+		return reply.MakeErrReply("ERR value is not an integer or out of range")
+	}
+	return db.expireAt(string(args[0]), time.UnixMilli(ms))
+}
+
+// ttl key 不存在时返回 -2，没有过期时间时返回 -1
+func ttl(db *DB, key string, unit time.Duration) resp.Reply {
+	if _, exists := db.GetEntity(key); !exists {
+		return reply.MakeIntReply(-2)
+	}
+	expireAt, ok := db.ExpireTime(key)
+	if !ok {
+		return reply.MakeIntReply(-1)
+	}
+	remaining := time.Until(expireAt)
+	// 与 redis 一样向上取整，剩余不到一秒的 key 返回 1 而不是 0
+	return reply.MakeIntReply(int64((remaining + unit - 1) / unit))
+}
+
+// TTL key
+func execTTL(db *DB, args [][]byte) resp.Reply {
+	return ttl(db, string(args[0]), time.Second)
+}
+
+// PTTL key
+func execPTTL(db *DB, args [][]byte) resp.Reply {
+	return ttl(db, string(args[0]), time.Millisecond)
+}
+
+// PERSIST key
+func execPersist(db *DB, args [][]byte) resp.Reply {
+	key := string(args[0])
+	if _, exists := db.GetEntity(key); !exists {
+		return reply.MakeIntReply(0)
+	}
+	if _, ok := db.ExpireTime(key); !ok {
+		return reply.MakeIntReply(0)
+	}
+	db.Persist(key)
+	db.AddAof(utils.ToCmdLine2("persist", args...))
+	return reply.MakeIntReply(1)
+}
+
+func init() {
+	RegisterCommand("expire", execExpire, 3)
+	RegisterCommand("pexpire", execPExpire, 3)
+	RegisterCommand("expireat", execExpireAt, 3)
+	RegisterCommand("pexpireat", execPExpireAt, 3)
+	RegisterCommand("ttl", execTTL, 2)
+	RegisterCommand("pttl", execPTTL, 2)
+	RegisterCommand("persist", execPersist, 2)
+}
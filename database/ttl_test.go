@@ -0,0 +1,125 @@
+package database
+
+import (
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// exec 执行一条命令，返回编码后的回复
+func exec(db *DB, args ...string) string {
+	return string(db.Exec(nil, utils.ToCmdLine(args...)).ToBytes())
+}
+
+func assertReply(t *testing.T, got string, want string) {
+	t.Helper()
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestExpireAndTTL(t *testing.T) {
+	db := makeDB()
+	assertReply(t, exec(db, "TTL", "k"), ":-2\r\n")
+	assertReply(t, exec(db, "EXPIRE", "k", "10"), ":0\r\n")
+
+	exec(db, "SET", "k", "v")
+	assertReply(t, exec(db, "TTL", "k"), ":-1\r\n")
+	assertReply(t, exec(db, "EXPIRE", "k", "10"), ":1\r\n")
+	assertReply(t, exec(db, "TTL", "k"), ":10\r\n")
+	pttl := db.Exec(nil, utils.ToCmdLine("PTTL", "k")).(*reply.IntReply).Code
+	if pttl <= 9000 || pttl > 10000 {
+		t.Fatalf("PTTL = %d, want about 10000", pttl)
+	}
+	assertReply(t, exec(db, "EXPIRE", "k", "abc"), "-ERR value is not an integer or out of range\r\n")
+
+	assertReply(t, exec(db, "PERSIST", "k"), ":1\r\n")
+	assertReply(t, exec(db, "PERSIST", "k"), ":0\r\n")
+	assertReply(t, exec(db, "TTL", "k"), ":-1\r\n")
+
+	// 过期时间已过时直接删除
+	assertReply(t, exec(db, "EXPIRE", "k", "-1"), ":1\r\n")
+	assertReply(t, exec(db, "GET", "k"), "$-1\r\n")
+}
+
+func TestExpireAtHidesKey(t *testing.T) {
+	db := makeDB()
+	exec(db, "SET", "k", "v")
+	exec(db, "SET", "other", "v")
+	at := time.Now().Add(30 * time.Millisecond).UnixMilli()
+	assertReply(t, exec(db, "PEXPIREAT", "k", strconv.FormatInt(at, 10)), ":1\r\n")
+	assertReply(t, exec(db, "GET", "k"), "$1\r\nv\r\n")
+
+	time.Sleep(50 * time.Millisecond)
+	assertReply(t, exec(db, "KEYS", "*"), "*1\r\n$5\r\nother\r\n")
+	// 过期的 key 还没有被删除，DBSIZE 与 KEYS 一致
+	assertReply(t, exec(db, "DBSIZE"), ":1\r\n")
+	assertReply(t, exec(db, "GET", "k"), "$-1\r\n")
+	assertReply(t, exec(db, "TTL", "k"), ":-2\r\n")
+	assertReply(t, exec(db, "EXISTS", "k"), ":0\r\n")
+}
+
+func TestSetOptions(t *testing.T) {
+	db := makeDB()
+	cases := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", "k", "v1", "XX"}, "$-1\r\n"},
+		{[]string{"SET", "k", "v1", "NX", "EX", "100"}, "+OK\r\n"},
+		{[]string{"SET", "k", "v2", "NX"}, "$-1\r\n"},
+		{[]string{"TTL", "k"}, ":100\r\n"},
+		{[]string{"SET", "k", "v2", "XX", "KEEPTTL"}, "+OK\r\n"},
+		{[]string{"TTL", "k"}, ":100\r\n"},
+		{[]string{"GET", "k"}, "$2\r\nv2\r\n"},
+		// 不带过期时间的 SET 清除过期时间
+		{[]string{"SET", "k", "v3"}, "+OK\r\n"},
+		{[]string{"TTL", "k"}, ":-1\r\n"},
+		{[]string{"SET", "k", "v4", "PX", "5000"}, "+OK\r\n"},
+		{[]string{"TTL", "k"}, ":5\r\n"},
+		{[]string{"SET", "k", "v", "NX", "XX"}, "-Err syntax error\r\n"},
+		{[]string{"SET", "k", "v", "EX", "10", "KEEPTTL"}, "-Err syntax error\r\n"},
+		{[]string{"SET", "k", "v", "EX"}, "-Err syntax error\r\n"},
+		{[]string{"SET", "k", "v", "EX", "0"}, "-ERR invalid expire time in 'set' command\r\n"},
+		{[]string{"SET", "k", "v", "PX", "x"}, "-ERR value is not an integer or out of range\r\n"},
+	}
+	for _, c := range cases {
+		if got := exec(db, c.args...); got != c.want {
+			t.Errorf("%v: got %q, want %q", c.args, got, c.want)
+		}
+	}
+}
+
+func TestRenameKeepsTTL(t *testing.T) {
+	db := makeDB()
+	exec(db, "SET", "a", "v", "EX", "100")
+	exec(db, "SET", "b", "old", "EX", "5")
+	assertReply(t, exec(db, "RENAME", "a", "b"), "+OK\r\n")
+	assertReply(t, exec(db, "TTL", "b"), ":100\r\n")
+	assertReply(t, exec(db, "TTL", "a"), ":-2\r\n")
+
+	exec(db, "SET", "c", "v")
+	assertReply(t, exec(db, "RENAME", "c", "b"), "+OK\r\n")
+	assertReply(t, exec(db, "TTL", "b"), ":-1\r\n")
+}
+
+func TestExpireWritesAbsoluteAof(t *testing.T) {
+	db := makeDB()
+	var logged []string
+	db.AddAof = func(cmdLine CmdLine) {
+		logged = append(logged, string(reply.MakeMultiBulkReply(cmdLine).ToBytes()))
+	}
+	exec(db, "SET", "k", "v")
+	exec(db, "EXPIRE", "k", "100")
+	if len(logged) != 2 {
+		t.Fatalf("logged %d commands, want 2", len(logged))
+	}
+	// 相对时间转换为 PEXPIREAT，重放时不会延长过期时间
+	expireAt, _ := db.ExpireTime("k")
+	want := string(reply.MakeMultiBulkReply(MakeExpireCmd("k", expireAt)).ToBytes())
+	if logged[1] != want {
+		t.Fatalf("aof = %q, want %q", logged[1], want)
+	}
+}
@@ -0,0 +1,234 @@
+package dict
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	ConcurrentDict 分段加锁的哈希表
+	--key 按哈希值分布在固定数量的分段中，每个分段由一个 map 和读写锁组成
+	--分段的数量创建后不再变化，SCAN 的游标为分段的下标，遍历期间一直存在的 key 一定会被返回
+	--遍历时先复制分段中的数据再回调，回调中可以修改字典
+*/
+
+const defaultShardCount = 1 << 10
+
+type shard struct {
+	m  map[string]interface{}
+	mu sync.RWMutex
+}
+
+type ConcurrentDict struct {
+	table []*shard
+	count int64
+}
+
+// computeCapacity 不小于 param 的 2 的幂
+func computeCapacity(param int) int {
+	n := 1
+	for n < param {
+		n <<= 1
+	}
+	return n
+}
+
+// MakeConcurrent creates ConcurrentDict with shardCount shards, rounded up to a power of 2
+func MakeConcurrent(shardCount int) *ConcurrentDict {
+	if shardCount <= 0 {
+		shardCount = defaultShardCount
+	}
+	shardCount = computeCapacity(shardCount)
+	table := make([]*shard, shardCount)
+	for i := range table {
+		table[i] = &shard{m: make(map[string]interface{})}
+	}
+	return &ConcurrentDict{table: table}
+}
+
+func (dict *ConcurrentDict) spread(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() & uint32(len(dict.table)-1))
+}
+
+func (dict *ConcurrentDict) getShard(key string) *shard {
+	return dict.table[dict.spread(key)]
+}
+
+func (dict *ConcurrentDict) Get(key string) (value interface{}, exists bool) {
+	s := dict.getShard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, exists = s.m[key]
+	return
+}
+
+func (dict *ConcurrentDict) Len() int {
+	return int(atomic.LoadInt64(&dict.count))
+}
+
+func (dict *ConcurrentDict) Put(key string, value interface{}) (result int) {
+	s := dict.getShard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[key]; ok {
+		s.m[key] = value
+		return 0
+	}
+	s.m[key] = value
+	atomic.AddInt64(&dict.count, 1)
+	return 1
+}
+
+func (dict *ConcurrentDict) PutIfAbsent(key string, value interface{}) (result int) {
+	s := dict.getShard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[key]; ok {
+		return 0
+	}
+	s.m[key] = value
+	atomic.AddInt64(&dict.count, 1)
+	return 1
+}
+
+func (dict *ConcurrentDict) PutIfExists(key string, value interface{}) (result int) {
+	s := dict.getShard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[key]; !ok {
+		return 0
+	}
+	s.m[key] = value
+	return 1
+}
+
+func (dict *ConcurrentDict) Remove(key string) {
+	s := dict.getShard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[key]; ok {
+		delete(s.m, key)
+		atomic.AddInt64(&dict.count, -1)
+	}
+}
+
+// snapshot 复制分段中的数据，回调时不持有锁
+func (s *shard) snapshot() ([]string, []interface{}) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.m))
+	values := make([]interface{}, 0, len(s.m))
+	for key, value := range s.m {
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	return keys, values
+}
+
+func (dict *ConcurrentDict) ForEach(consumer Consumer) {
+	for _, s := range dict.table {
+		keys, values := s.snapshot()
+		for i, key := range keys {
+			if !consumer(key, values[i]) {
+				return
+			}
+		}
+	}
+}
+
+// Scan 从下标为 cursor 的分段开始遍历，遍历完整的分段直到至少遍历了 count 个 key，返回下一次的游标，0 表示遍历结束
+func (dict *ConcurrentDict) Scan(cursor int, count int, consumer Consumer) int {
+	scanned := 0
+	for i := cursor; i >= 0 && i < len(dict.table); i++ {
+		keys, values := dict.table[i].snapshot()
+		for j, key := range keys {
+			if !consumer(key, values[j]) {
+				return 0
+			}
+		}
+		scanned += len(keys)
+		if scanned >= count && i+1 < len(dict.table) {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (dict *ConcurrentDict) Keys() []string {
+	keys := make([]string, 0, dict.Len())
+	dict.ForEach(func(key string, value interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// randomKey 从随机的分段开始找到第一个非空的分段，返回其中任意一个 key
+func (dict *ConcurrentDict) randomKey() (string, bool) {
+	start := rand.Intn(len(dict.table))
+	for i := 0; i < len(dict.table); i++ {
+		s := dict.table[(start+i)&(len(dict.table)-1)]
+		s.mu.RLock()
+		for key := range s.m {
+			s.mu.RUnlock()
+			return key, true
+		}
+		s.mu.RUnlock()
+	}
+	return "", false
+}
+
+func (dict *ConcurrentDict) RandomKeys(limit int) []string {
+	result := make([]string, 0, limit)
+	for i := 0; i < limit; i++ {
+		key, ok := dict.randomKey()
+		if !ok {
+			break
+		}
+		result = append(result, key)
+	}
+	return result
+}
+
+func (dict *ConcurrentDict) RandomDistinctKeys(limit int) []string {
+	size := dict.Len()
+	if limit > size {
+		limit = size
+	}
+	seen := make(map[string]struct{}, limit)
+	result := make([]string, 0, limit)
+	// 随机取样重复太多时改为按顺序补齐
+	for tries := 0; len(result) < limit && tries < limit*4; tries++ {
+		key, ok := dict.randomKey()
+		if !ok {
+			break
+		}
+		if _, exists := seen[key]; !exists {
+			seen[key] = struct{}{}
+			result = append(result, key)
+		}
+	}
+	if len(result) < limit {
+		dict.ForEach(func(key string, value interface{}) bool {
+			if _, exists := seen[key]; !exists {
+				seen[key] = struct{}{}
+				result = append(result, key)
+			}
+			return len(result) < limit
+		})
+	}
+	return result
+}
+
+func (dict *ConcurrentDict) Clear() {
+	for _, s := range dict.table {
+		s.mu.Lock()
+		atomic.AddInt64(&dict.count, -int64(len(s.m)))
+		s.m = make(map[string]interface{})
+		s.mu.Unlock()
+	}
+}
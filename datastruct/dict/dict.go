@@ -10,6 +10,8 @@ type Dict interface {
 	PutIfExists(key string, value interface{}) (result int)
 	Remove(key string)
 	ForEach(consumer Consumer)
+	// Scan 从 cursor 开始遍历至少 count 个 key，返回下一次的游标，0 表示遍历结束
+	Scan(cursor int, count int, consumer Consumer) int
 	Keys() []string
 	RandomKeys(limit int) []string
 	RandomDistinctKeys(limit int) []string
@@ -65,6 +65,14 @@ func (dict *SyncDict) ForEach(consumer Consumer) {
 	})
 }
 
+// Scan sync.Map 没有稳定的遍历顺序，一次遍历所有的 key
+func (dict *SyncDict) Scan(cursor int, count int, consumer Consumer) int {
+	dict.m.Range(func(key, value interface{}) bool {
+		return consumer(key.(string), value)
+	})
+	return 0
+}
+
 func (dict *SyncDict) Keys() []string {
 	result := make([]string, dict.Len())
 	i := 0
@@ -0,0 +1,79 @@
+package lock
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Locks 按 key 的哈希值分段的读写锁，多个 key 总是按段的顺序加锁，避免死锁
+type Locks struct {
+	table []*sync.RWMutex
+}
+
+// Make creates Locks with tableSize segments
+func Make(tableSize int) *Locks {
+	table := make([]*sync.RWMutex, tableSize)
+	for i := range table {
+		table[i] = &sync.RWMutex{}
+	}
+	return &Locks{table: table}
+}
+
+func (locks *Locks) spread(key string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(locks.table)))
+}
+
+// toLockIndices returns the sorted and distinct segments of keys
+func (locks *Locks) toLockIndices(keys []string) []int {
+	set := make(map[int]struct{}, len(keys))
+	for _, key := range keys {
+		set[locks.spread(key)] = struct{}{}
+	}
+	indices := make([]int, 0, len(set))
+	for index := range set {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	return indices
+}
+
+// Locks acquires the write locks of keys
+func (locks *Locks) Locks(keys ...string) {
+	for _, index := range locks.toLockIndices(keys) {
+		locks.table[index].Lock()
+	}
+}
+
+// UnLocks releases the write locks of keys
+func (locks *Locks) UnLocks(keys ...string) {
+	indices := locks.toLockIndices(keys)
+	for i := len(indices) - 1; i >= 0; i-- {
+		locks.table[indices[i]].Unlock()
+	}
+}
+
+// LocksWithTimeout acquires the write locks of keys, waits at most timeout, nothing is held if it fails
+func (locks *Locks) LocksWithTimeout(timeout time.Duration, keys ...string) bool {
+	acquired := make(chan struct{})
+	go func() {
+		locks.Locks(keys...)
+		close(acquired)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-acquired:
+		return true
+	case <-timer.C:
+		// 放弃等待，拿到锁之后立即释放
+		go func() {
+			<-acquired
+			locks.UnLocks(keys...)
+		}()
+		return false
+	}
+}
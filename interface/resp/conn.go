@@ -4,4 +4,16 @@ type Connection interface {
 	Write([]byte) error
 	GetDBIndex() int
 	SelectDB(int)
+	// SetReadOnly READONLY/READWRITE，只读模式下集群可以从副本读取
+	SetReadOnly(bool)
+	IsReadOnly() bool
+	// SetUser 连接以哪个 ACL 用户的身份执行命令，集群内部的连接为空
+	SetUser(string)
+	GetUser() string
+	// SetPeer 连接来自集群中的其它结点 (连接池和复制流)，只有这样的连接可以执行结点之间的内部命令
+	SetPeer(bool)
+	IsPeer() bool
+	// SetProtocol HELLO 协商的协议版本，2 或 3，命令可以据此返回 RESP3 的类型
+	SetProtocol(int)
+	GetProtocol() int
 }
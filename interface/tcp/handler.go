@@ -9,3 +9,20 @@ type Handler interface {
 	Handle(ctx context.Context, conn net.Conn)
 	Close() error
 }
+
+// EventHandler 由事件循环驱动的处理器，连接上的数据由事件循环读取，空闲的连接不占用协程
+type EventHandler interface {
+	// Open 接受新连接时调用，返回 nil 时关闭连接
+	Open(conn net.Conn) Session
+	Close() error
+}
+
+// Session 一个连接上的请求处理，Feed 和 Serve 不会并发调用
+type Session interface {
+	// Feed 在事件循环中调用，解析 data 中完整的请求，返回消费的字节数以及是否有需要执行的请求
+	Feed(data []byte) (consumed int, ready bool)
+	// Serve 在单独的协程中执行 Feed 解析出的请求并发送回复，返回错误时关闭连接
+	Serve() error
+	// Close 连接断开或者出错时调用
+	Close()
+}
@@ -3,41 +3,123 @@ package consistenthash
 import (
 	"hash/crc32"
 	"sort"
+	"strconv"
 )
 
 type HashFuc func(data []byte) uint32
 
+// DefaultReplicas 每个结点在环上默认放置的虚拟结点数量
+const DefaultReplicas = 160
+
+// ringSize 哈希环的大小 (uint32 的取值范围)
+const ringSize = float64(1 << 32)
+
+// point 环上的一个虚拟结点
+type point struct {
+	hash int
+	node string
+}
+
 type NodeMap struct {
-	hashFunc    HashFuc
-	nodeHashs   []int
-	nodeHashMap map[int]string
+	hashFunc HashFuc
+	replicas int            // 权重为 1 的结点放置的虚拟结点数量
+	points   []point        // 按 (hash, node) 排序
+	weights  map[string]int // 真实结点 -> 权重
 }
 
 func NewNodeMap(fn HashFuc) *NodeMap {
+	return NewNodeMapWithReplicas(DefaultReplicas, fn)
+}
+
+// NewNodeMapWithReplicas creates a NodeMap which places replicas virtual nodes per unit of weight
+func NewNodeMapWithReplicas(replicas int, fn HashFuc) *NodeMap {
 	m := &NodeMap{
-		hashFunc:    fn,
-		nodeHashMap: make(map[int]string),
+		hashFunc: fn,
+		replicas: replicas,
+		weights:  make(map[string]int),
 	}
 	if fn == nil {
 		m.hashFunc = crc32.ChecksumIEEE
 	}
+	if replicas <= 0 {
+		m.replicas = 1
+	}
 	return m
 }
 
 func (m *NodeMap) IsEmpty() bool {
-	return len(m.nodeHashs) == 0
+	return len(m.points) == 0
 }
 
+// AddNode adds nodes with weight 1
 func (m *NodeMap) AddNode(keys ...string) {
 	for _, key := range keys {
-		if key == "" {
-			continue
+		m.addNode(key, 1)
+	}
+	m.sortPoints()
+}
+
+// AddWeightedNode adds a node whose share of the ring is proportional to weight,
+// an existing node will be re-placed with the new weight
+func (m *NodeMap) AddWeightedNode(key string, weight int) {
+	if _, ok := m.weights[key]; ok {
+		m.removeNode(key)
+	}
+	m.addNode(key, weight)
+	m.sortPoints()
+}
+
+// RemoveNode removes the node and all of its virtual nodes from the ring
+func (m *NodeMap) RemoveNode(key string) {
+	if _, ok := m.weights[key]; !ok {
+		return
+	}
+	m.removeNode(key)
+}
+
+func (m *NodeMap) addNode(key string, weight int) {
+	if key == "" || weight <= 0 {
+		return
+	}
+	if _, ok := m.weights[key]; ok {
+		return
+	}
+	m.weights[key] = weight
+	for i := 0; i < m.replicas*weight; i++ {
+		hash := int(m.hashFunc([]byte(strconv.Itoa(i) + "-" + key)))
+		m.points = append(m.points, point{hash: hash, node: key})
+	}
+}
+
+func (m *NodeMap) removeNode(key string) {
+	delete(m.weights, key)
+	points := m.points[:0]
+	for _, p := range m.points {
+		if p.node != key {
+			points = append(points, p)
 		}
-		hash := int(m.hashFunc([]byte(key)))
-		m.nodeHashs = append(m.nodeHashs, hash)
-		m.nodeHashMap[hash] = key
 	}
-	sort.Ints(m.nodeHashs)
+	m.points = points
+}
+
+// sortPoints 哈希冲突时按结点名排序，保证不同的加入顺序得到相同的环
+func (m *NodeMap) sortPoints() {
+	sort.Slice(m.points, func(i, j int) bool {
+		if m.points[i].hash != m.points[j].hash {
+			return m.points[i].hash < m.points[j].hash
+		}
+		return m.points[i].node < m.points[j].node
+	})
+}
+
+// Nodes returns all real nodes on the ring
+func (m *NodeMap) Nodes() []string {
+	nodes := make([]string, 0, len(m.weights))
+	for node := range m.weights {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
 }
 
 func (m *NodeMap) PickNode(key string) string {
@@ -45,11 +127,30 @@ func (m *NodeMap) PickNode(key string) string {
 		return ""
 	}
 	hash := int(m.hashFunc([]byte(key)))
-	index := sort.Search(len(m.nodeHashs), func(i int) bool {
-		return m.nodeHashs[i] >= hash
+	index := sort.Search(len(m.points), func(i int) bool {
+		return m.points[i].hash >= hash
 	})
-	if index == len(m.nodeHashs) {
+	if index == len(m.points) {
 		index = 0
 	}
-	return m.nodeHashMap[m.nodeHashs[index]]
+	return m.points[index].node
+}
+
+// Distribution returns the fraction of the hash ring owned by each node,
+// it can be used to verify the balance of a topology before deploying
+func (m *NodeMap) Distribution() map[string]float64 {
+	result := make(map[string]float64, len(m.weights))
+	for node := range m.weights {
+		result[node] = 0
+	}
+	if m.IsEmpty() {
+		return result
+	}
+	// 每个虚拟结点负责 (上一个结点, 当前结点] 区间，第一个结点还负责环尾部的区间
+	prev := m.points[len(m.points)-1].hash - int(ringSize)
+	for _, p := range m.points {
+		result[p.node] += float64(p.hash-prev) / ringSize
+		prev = p.hash
+	}
+	return result
 }
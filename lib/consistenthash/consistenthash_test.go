@@ -0,0 +1,95 @@
+package consistenthash
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestWeightedDistribution(t *testing.T) {
+	m := NewNodeMap(nil)
+	m.AddNode("a", "b")
+	m.AddWeightedNode("c", 2)
+
+	dist := m.Distribution()
+	total := 0.0
+	for _, share := range dist {
+		total += share
+	}
+	if math.Abs(total-1) > 1e-9 {
+		t.Fatalf("shares sum to %f, want 1", total)
+	}
+	// 权重 1:1:2，每个结点的份额与期望值相差不超过 5%
+	expected := map[string]float64{"a": 0.25, "b": 0.25, "c": 0.5}
+	for node, want := range expected {
+		if got := dist[node]; math.Abs(got-want) > 0.05 {
+			t.Errorf("node %s owns %.3f of the ring, want about %.2f", node, got, want)
+		}
+	}
+
+	// 按 key 统计的分布与环上的份额一致
+	counts := make(map[string]int)
+	const n = 100000
+	for i := 0; i < n; i++ {
+		counts[m.PickNode("key"+strconv.Itoa(i))]++
+	}
+	for node, want := range expected {
+		if got := float64(counts[node]) / n; math.Abs(got-want) > 0.05 {
+			t.Errorf("node %s got %.3f of the keys, want about %.2f", node, got, want)
+		}
+	}
+}
+
+func TestReweightNode(t *testing.T) {
+	m := NewNodeMapWithReplicas(10, nil)
+	m.AddNode("a", "b")
+	m.AddWeightedNode("a", 3)
+	if got := len(m.points); got != 40 {
+		t.Fatalf("ring has %d points, want 40", got)
+	}
+	if dist := m.Distribution(); dist["a"] <= dist["b"] {
+		t.Errorf("node a with weight 3 owns %.3f, node b owns %.3f", dist["a"], dist["b"])
+	}
+}
+
+func TestRemoveNode(t *testing.T) {
+	m := NewNodeMap(nil)
+	m.AddNode("a", "b", "c")
+
+	before := make(map[string]string)
+	for i := 0; i < 10000; i++ {
+		key := "key" + strconv.Itoa(i)
+		before[key] = m.PickNode(key)
+	}
+
+	m.RemoveNode("b")
+	if nodes := m.Nodes(); len(nodes) != 2 || nodes[0] != "a" || nodes[1] != "c" {
+		t.Fatalf("nodes after removal: %v", nodes)
+	}
+	if _, ok := m.Distribution()["b"]; ok {
+		t.Fatal("removed node still owns part of the ring")
+	}
+	for key, node := range before {
+		got := m.PickNode(key)
+		if got == "b" {
+			t.Fatalf("key %s is still routed to the removed node", key)
+		}
+		// 只有原来属于 b 的 key 会迁移
+		if node != "b" && got != node {
+			t.Fatalf("key %s moved from %s to %s", key, node, got)
+		}
+	}
+
+	// 删除不存在的结点没有影响
+	points := len(m.points)
+	m.RemoveNode("missing")
+	if len(m.points) != points {
+		t.Fatalf("removing a missing node changed the ring from %d to %d points", points, len(m.points))
+	}
+
+	m.RemoveNode("a")
+	m.RemoveNode("c")
+	if !m.IsEmpty() || m.PickNode("key") != "" {
+		t.Fatal("ring is not empty after removing every node")
+	}
+}
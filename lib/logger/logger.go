@@ -64,6 +64,11 @@ func Setup(settings *Settings) {
 	logger = log.New(mw, defaultPrefix, flags)
 }
 
+// SetOutput 替换日志的输出，例如基准测试中丢弃日志
+func SetOutput(w io.Writer) {
+	logger.SetOutput(w)
+}
+
 func setPrefix(level logLevel) {
 	_, file, line, ok := runtime.Caller(defaultCallerDepth)
 	if ok {
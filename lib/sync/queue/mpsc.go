@@ -0,0 +1,49 @@
+package queue
+
+import "sync/atomic"
+
+/*
+	MPSC 无锁的多生产者单消费者队列 (Vyukov)
+	--Push 只有一次原子交换，任意多个协程可以同时调用
+	--Pop 只能由一个协程调用，队列为空时返回 false
+	--生产者交换 head 之后、链接 next 之前，消费者会暂时看不到这个元素，
+	  所以 Pop 返回 false 不代表 Push 还没有开始，需要等待的消费者应该由生产者在 Push 返回之后唤醒
+*/
+
+type node[T any] struct {
+	next  atomic.Pointer[node[T]]
+	value T
+}
+
+type MPSC[T any] struct {
+	head atomic.Pointer[node[T]] // 最后加入的元素，生产者修改
+	tail *node[T]                // 已经取出的最后一个元素，只有消费者访问
+}
+
+func MakeMPSC[T any]() *MPSC[T] {
+	stub := &node[T]{}
+	q := &MPSC[T]{tail: stub}
+	q.head.Store(stub)
+	return q
+}
+
+// Push 加入一个元素，可以并发调用
+func (q *MPSC[T]) Push(value T) {
+	n := &node[T]{value: value}
+	prev := q.head.Swap(n)
+	prev.next.Store(n)
+}
+
+// Pop 取出最早加入的元素，只能由一个协程调用
+func (q *MPSC[T]) Pop() (T, bool) {
+	next := q.tail.next.Load()
+	if next == nil {
+		var zero T
+		return zero, false
+	}
+	q.tail = next
+	value := next.value
+	var zero T
+	next.value = zero // next 成为新的哨兵，不再引用元素
+	return value, true
+}
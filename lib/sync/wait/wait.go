@@ -1,6 +1,7 @@
 package wait
 
 import (
+	"context"
 	"sync"
 	"time"
 )
@@ -41,3 +42,19 @@ func (w *Wait) WaitWithTimeout(timeout time.Duration) bool {
 		return true // timed out
 	}
 }
+
+// WaitWithContext blocks until the WaitGroup counter is zero or ctx is done
+// returns true if ctx is done first
+func (w *Wait) WaitWithContext(ctx context.Context) bool {
+	c := make(chan struct{})
+	go func() {
+		defer close(c)
+		w.wg.Wait()
+	}()
+	select {
+	case <-c:
+		return false // completed normally
+	case <-ctx.Done():
+		return true
+	}
+}
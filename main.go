@@ -7,13 +7,18 @@ import (
 	"go-redis/resp/handler"
 	"go-redis/tcp"
 	"os"
+	"strconv"
+	"time"
 )
 
 const configFile = "redis.conf"
 
 var defaultProperties = &config.ServerProperties{
-	Bind: "0.0.0.0",
-	Port: 6379,
+	Bind:              "0.0.0.0",
+	Port:              6379,
+	MaxClients:        10000,
+	TCPKeepAlive:      300,
+	ClusterConfigFile: "nodes.conf",
 }
 
 func fileExists(filename string) bool {
@@ -35,11 +40,42 @@ func main() {
 		config.Properties = defaultProperties
 	}
 
-	err := tcp.ListenAndServeWithSignal(
-		&tcp.Config{
-			Address: fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port),
-		},
-		handler.MakeHandler())
+	cfg := &tcp.Config{
+		Address:    fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.Port),
+		EventLoops: config.Properties.EventLoops,
+		KeepAlive:  time.Duration(config.Properties.TCPKeepAlive) * time.Second,
+	}
+	if config.Properties.TLSPort > 0 {
+		tlsConfig, err := config.Properties.ServerTLSConfig()
+		if err != nil {
+			logger.Fatal(err)
+		}
+		cfg.TLSAddress = fmt.Sprintf("%s:%d", config.Properties.Bind, config.Properties.TLSPort)
+		cfg.TLSConfig = tlsConfig
+	}
+	if config.Properties.UnixSocket != "" {
+		cfg.UnixSocket = config.Properties.UnixSocket
+		if config.Properties.UnixSocketPerm != "" {
+			perm, err := strconv.ParseUint(config.Properties.UnixSocketPerm, 8, 32)
+			if err != nil {
+				logger.Fatal("invalid unixsocketperm " + config.Properties.UnixSocketPerm)
+			}
+			cfg.UnixSocketPerm = os.FileMode(perm)
+		}
+	}
+	// 与 redis 相同，port 为 0 时只监听 TLS 端口和 unix socket
+	if config.Properties.Port == 0 && (cfg.TLSAddress != "" || cfg.UnixSocket != "") {
+		cfg.Address = ""
+	}
+	var err error
+	switch config.Properties.NetworkModel {
+	case "", "goroutine":
+		err = tcp.ListenAndServeWithSignal(cfg, handler.MakeHandler())
+	case "epoll":
+		err = tcp.ListenAndServeWithEpoll(cfg, handler.MakeHandler())
+	default:
+		err = fmt.Errorf("unknown network-model %s", config.Properties.NetworkModel)
+	}
 	if err != nil {
 		logger.Fatal(err)
 	}
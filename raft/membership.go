@@ -0,0 +1,157 @@
+package raft
+
+import (
+	"errors"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"sort"
+	"strings"
+)
+
+/*
+	成员变更
+	--投票者保存在日志中，RAFT.VOTERS addr... 为配置日志，追加到日志后立即生效，不需要等待提交
+	--快照保存压缩位置生效的投票者，日志中没有配置日志时使用快照中的投票者
+	--每次只增加或删除一个投票者，上一次变更提交之前拒绝新的变更，新旧配置的多数派一定相交
+	--AddVoter RemoveVoter 的提案由领导者转换为配置日志，状态机不会收到配置日志
+	--Join 用于新结点加入已有的集群，只有日志为空或者集群中只有自己的结点可以加入
+*/
+
+const (
+	cmdVoters   = "RAFT.VOTERS"
+	cmdAddVoter = "RAFT.ADDVOTER"
+	cmdDelVoter = "RAFT.DELVOTER"
+)
+
+var ErrConfigChange = errors.New("raft: another membership change is in progress")
+
+func isConfigEntry(entry Entry) bool {
+	return len(entry.Cmd) > 0 && string(entry.Cmd[0]) == cmdVoters
+}
+
+// AddVoter adds addr to the voters, returns after the change is applied locally
+func (r *Raft) AddVoter(addr string) error {
+	return r.Propose(utils.ToCmdLine(cmdAddVoter, addr))
+}
+
+// RemoveVoter removes addr from the voters, the leader can not remove itself
+func (r *Raft) RemoveVoter(addr string) error {
+	return r.Propose(utils.ToCmdLine(cmdDelVoter, addr))
+}
+
+// IsVoter returns whether addr is a voter in the latest configuration
+func (r *Raft) IsVoter(addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.isVoter(addr)
+}
+
+// Join makes this node follow an existing cluster of voters.
+// Only a node with an empty log or without other members can join, its own log and snapshot are discarded.
+func (r *Raft) Join(voters []string) error {
+	voters = sortedCopy(voters)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if strings.Join(voters, ",") == strings.Join(sortedCopy(r.voters), ",") {
+		return nil
+	}
+	// 日志为空说明从来没有和其它结点组成过集群，例如 peers 中是已有集群的结点但还没有被 MEET 的结点
+	if r.lastIndex() > 0 {
+		members := append(append([]string(nil), r.voters...), r.learners()...)
+		for _, member := range members {
+			if member != r.self {
+				return errors.New("raft: already a member of the cluster with voters " + strings.Join(r.voters, ","))
+			}
+		}
+	}
+
+	// 本结点独自组成的集群被丢弃，新集群的任期与它无关，从头开始跟随新的领导者
+	logger.Info("raft: join the cluster with voters ", strings.Join(voters, ","))
+	r.role = follower
+	r.leader = ""
+	r.term = 0
+	r.votedFor = ""
+	r.log = nil
+	r.snapshotIndex = 0
+	r.snapshotTerm = 0
+	r.snapshot = nil
+	r.snapshotVoters = voters
+	r.voters = voters
+	r.commitIndex = 0
+	r.lastApplied = 0
+	r.pendingRestore = []byte{}
+	r.dirty = true
+	if err := r.persistLocked(); err != nil {
+		return err
+	}
+	r.resetElectionTimer()
+	r.notifyApply()
+	return nil
+}
+
+// votersAtLocked returns the voters in effect at index
+func (r *Raft) votersAtLocked(index uint64) []string {
+	for i := index; i > r.snapshotIndex; i-- {
+		if entry := r.log[i-r.snapshotIndex-1]; isConfigEntry(entry) {
+			return toStrings(entry.Cmd[1:])
+		}
+	}
+	return r.snapshotVoters
+}
+
+// refreshVotersLocked 日志变化后使用最新的配置
+func (r *Raft) refreshVotersLocked() {
+	voters := r.votersAtLocked(r.lastIndex())
+	if strings.Join(voters, ",") != strings.Join(r.voters, ",") {
+		logger.Info("raft: voters change to ", strings.Join(voters, ","))
+	}
+	r.voters = voters
+}
+
+// pendingConfigLocked 是否有未提交的配置日志
+func (r *Raft) pendingConfigLocked() bool {
+	for i := r.lastIndex(); i > r.commitIndex && i > r.snapshotIndex; i-- {
+		if isConfigEntry(r.log[i-r.snapshotIndex-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// toConfigCmdLocked 把 ADDVOTER DELVOTER 提案转换为配置日志的命令，投票者不变时返回 nil
+func (r *Raft) toConfigCmdLocked(cmd [][]byte) ([][]byte, error) {
+	if len(cmd) != 2 {
+		return nil, errors.New("raft: illegal membership change")
+	}
+	addr := string(cmd[1])
+	voters := make([]string, 0, len(r.voters)+1)
+	if string(cmd[0]) == cmdAddVoter {
+		if r.isVoter(addr) {
+			return nil, nil
+		}
+		voters = append(append(voters, r.voters...), addr)
+	} else {
+		if !r.isVoter(addr) {
+			return nil, nil
+		}
+		if addr == r.self {
+			return nil, errors.New("raft: the leader can not remove itself")
+		}
+		for _, voter := range r.voters {
+			if voter != addr {
+				voters = append(voters, voter)
+			}
+		}
+	}
+	if r.pendingConfigLocked() {
+		return nil, ErrConfigChange
+	}
+	sort.Strings(voters)
+	return utils.ToCmdLine(append([]string{cmdVoters}, voters...)...), nil
+}
+
+func sortedCopy(s []string) []string {
+	result := append([]string(nil), s...)
+	sort.Strings(result)
+	return result
+}
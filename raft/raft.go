@@ -0,0 +1,815 @@
+package raft
+
+import (
+	"errors"
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+	最小化的 Raft 实现，用于在结点之间复制少量的元数据
+	--领导者选举: 跟随者超时后成为候选人，获得多数投票者 (voters) 的选票后成为领导者
+	--日志复制: 领导者通过 APPEND 将日志复制给投票者和学习者 (learners)，多数投票者复制后提交
+	--快照: 已应用的日志超过阈值后由状态机生成快照并压缩日志，落后太多的结点通过 SNAPSHOT 追赶
+	--学习者接收日志但不参与投票，也不会成为领导者
+	--任期、投票、日志和快照保存在 StateFile 中 (见 storage.go)，投票者的变更见 membership.go
+	RPC 以 RESP 命令的形式发送: RAFT VOTE|APPEND|SNAPSHOT|PROPOSE ...
+*/
+
+// FSM is the replicated state machine, all methods are called from a single goroutine
+type FSM interface {
+	Apply(cmd [][]byte)
+	Snapshot() []byte
+	Restore(data []byte)
+}
+
+// Transport sends a RAFT command to peer and returns its reply
+type Transport interface {
+	Send(peer string, args [][]byte) resp.Reply
+}
+
+// Config of a raft node
+type Config struct {
+	Self              string
+	Voters            []string        // 初始的投票者，StateFile 中有状态时以其中的为准
+	StateFile         string          // 为空时状态只保存在内存中
+	Learners          func() []string // 需要接收日志但不参与投票的结点
+	FSM               FSM
+	Transport         Transport
+	SnapshotThreshold int // 已应用但未压缩的日志条数达到该值时生成快照
+}
+
+type role uint8
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+func (r role) String() string {
+	switch r {
+	case candidate:
+		return "candidate"
+	case leader:
+		return "leader"
+	}
+	return "follower"
+}
+
+const (
+	heartbeatInterval  = 200 * time.Millisecond
+	minElectionTimeout = time.Second
+	tickInterval       = 50 * time.Millisecond
+	proposeTimeout     = 3 * time.Second
+	maxAppendEntries   = 256
+	defaultThreshold   = 1024
+)
+
+var (
+	ErrNoLeader = errors.New("no raft leader")
+	ErrTimeout  = errors.New("raft propose timeout")
+	ErrLost     = errors.New("raft entry lost due to leader change")
+	ErrStopped  = errors.New("raft stopped")
+)
+
+// Entry is a log entry, Cmd is nil for the no-op entry appended by a new leader
+type Entry struct {
+	Term uint64
+	Cmd  [][]byte
+}
+
+type Raft struct {
+	mu        sync.Mutex
+	self      string
+	voters    []string
+	learners  func() []string
+	fsm       FSM
+	transport Transport
+	threshold int
+	stateFile string
+	dirty     bool // 有没有写入 stateFile 的修改
+
+	role     role
+	term     uint64
+	votedFor string
+	leader   string
+
+	// log[i] 是第 snapshotIndex+1+i 条日志
+	log           []Entry
+	snapshotIndex uint64
+	snapshotTerm  uint64
+	snapshot      []byte
+	// snapshotVoters 快照位置生效的投票者
+	snapshotVoters []string
+	commitIndex    uint64
+	lastApplied    uint64
+
+	// pendingRestore 等待应用到状态机的快照
+	pendingRestore []byte
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	inflight   map[string]bool
+
+	lastContact     time.Time
+	electionTimeout time.Duration
+	lastHeartbeat   time.Time
+
+	applyCh  chan struct{}
+	applied  *sync.Cond
+	stopChan chan struct{}
+	stopped  bool
+}
+
+// MakeRaft creates a raft node and restores its state from cfg.StateFile, call Start to run it
+func MakeRaft(cfg *Config) (*Raft, error) {
+	r := &Raft{
+		self:       cfg.Self,
+		learners:   cfg.Learners,
+		fsm:        cfg.FSM,
+		transport:  cfg.Transport,
+		threshold:  cfg.SnapshotThreshold,
+		stateFile:  cfg.StateFile,
+		nextIndex:  make(map[string]uint64),
+		matchIndex: make(map[string]uint64),
+		inflight:   make(map[string]bool),
+		applyCh:    make(chan struct{}, 1),
+		stopChan:   make(chan struct{}),
+	}
+	if r.threshold <= 0 {
+		r.threshold = defaultThreshold
+	}
+	if r.learners == nil {
+		r.learners = func() []string { return nil }
+	}
+	r.applied = sync.NewCond(&r.mu)
+	r.resetElectionTimer()
+
+	restored := false
+	if r.stateFile != "" {
+		var err error
+		if restored, err = r.loadState(); err != nil {
+			return nil, err
+		}
+	}
+	if !restored {
+		r.snapshotVoters = sortedCopy(cfg.Voters)
+		r.dirty = true
+	} else {
+		logger.Info("raft: restore state at term ", r.term, ", last index ", r.lastIndex())
+	}
+	r.voters = r.votersAtLocked(r.lastIndex())
+	// 已提交的日志在领导者的心跳中重新确认，快照一定是已提交的
+	r.commitIndex = r.snapshotIndex
+	if r.snapshotIndex > 0 {
+		r.pendingRestore = append([]byte{}, r.snapshot...)
+	}
+	return r, nil
+}
+
+// Start starts the background goroutines
+func (r *Raft) Start() {
+	go r.run()
+	go r.applyLoop()
+	r.mu.Lock()
+	if r.pendingRestore != nil {
+		r.notifyApply()
+	}
+	r.mu.Unlock()
+}
+
+// Stop stops the background goroutines
+func (r *Raft) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return
+	}
+	r.stopped = true
+	close(r.stopChan)
+	r.applied.Broadcast()
+}
+
+// Voters returns the voters
+func (r *Raft) Voters() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.voters...)
+}
+
+// Status returns role, term, leader, commit index and applied index
+func (r *Raft) Status() (string, uint64, string, uint64, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.role.String(), r.term, r.leader, r.commitIndex, r.lastApplied
+}
+
+func (r *Raft) isVoter(addr string) bool {
+	for _, voter := range r.voters {
+		if voter == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Raft) resetElectionTimer() {
+	r.lastContact = time.Now()
+	r.electionTimeout = minElectionTimeout + time.Duration(rand.Int63n(int64(minElectionTimeout)))
+}
+
+func (r *Raft) lastIndex() uint64 {
+	return r.snapshotIndex + uint64(len(r.log))
+}
+
+func (r *Raft) lastTerm() uint64 {
+	if len(r.log) == 0 {
+		return r.snapshotTerm
+	}
+	return r.log[len(r.log)-1].Term
+}
+
+// termAt returns the term of the entry at index, ok is false if it is compacted or beyond the log
+func (r *Raft) termAt(index uint64) (uint64, bool) {
+	if index == r.snapshotIndex {
+		return r.snapshotTerm, true
+	}
+	if index < r.snapshotIndex || index > r.lastIndex() {
+		return 0, false
+	}
+	return r.log[index-r.snapshotIndex-1].Term, true
+}
+
+// entriesFrom returns at most limit entries starting at index
+func (r *Raft) entriesFrom(index uint64, limit int) []Entry {
+	if index <= r.snapshotIndex || index > r.lastIndex() {
+		return nil
+	}
+	entries := r.log[index-r.snapshotIndex-1:]
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return append([]Entry(nil), entries...)
+}
+
+// becomeFollower 任期变化需要在回复 RPC 之前落盘，由调用方调用 persistLocked
+func (r *Raft) becomeFollower(term uint64) {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		r.dirty = true
+	}
+	if r.role != follower {
+		logger.Info("raft: become follower at term ", r.term)
+	}
+	r.role = follower
+}
+
+func (r *Raft) run() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stopChan:
+			return
+		case <-ticker.C:
+			r.tick()
+		}
+	}
+}
+
+func (r *Raft) tick() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.role {
+	case leader:
+		if time.Since(r.lastHeartbeat) >= heartbeatInterval {
+			r.lastHeartbeat = time.Now()
+			r.broadcastAppendLocked()
+		}
+	default:
+		if r.isVoter(r.self) && time.Since(r.lastContact) > r.electionTimeout {
+			r.startElectionLocked()
+		}
+	}
+}
+
+func (r *Raft) startElectionLocked() {
+	r.role = candidate
+	r.term++
+	r.votedFor = r.self
+	r.leader = ""
+	r.resetElectionTimer()
+	r.dirty = true
+	if err := r.persistLocked(); err != nil {
+		r.role = follower
+		return
+	}
+	term := r.term
+	lastIndex, lastTerm := r.lastIndex(), r.lastTerm()
+	logger.Info("raft: start election at term ", term)
+
+	votes := 1
+	quorum := len(r.voters)/2 + 1
+	if votes >= quorum {
+		r.becomeLeaderLocked()
+		return
+	}
+	for _, voter := range r.voters {
+		if voter == r.self {
+			continue
+		}
+		go func(voter string) {
+			voteTerm, granted, err := r.sendVote(voter, term, lastIndex, lastTerm)
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			if voteTerm > r.term {
+				r.becomeFollower(voteTerm)
+				_ = r.persistLocked()
+				return
+			}
+			if r.role != candidate || r.term != term || !granted {
+				return
+			}
+			votes++
+			if votes >= quorum {
+				r.becomeLeaderLocked()
+			}
+		}(voter)
+	}
+}
+
+func (r *Raft) becomeLeaderLocked() {
+	logger.Info("raft: become leader at term ", r.term)
+	r.role = leader
+	r.leader = r.self
+	r.nextIndex = make(map[string]uint64)
+	r.matchIndex = make(map[string]uint64)
+	// 新领导者追加一条空日志，以便提交之前任期的日志
+	r.log = append(r.log, Entry{Term: r.term})
+	r.dirty = true
+	if err := r.persistLocked(); err != nil {
+		r.stepDownLocked()
+		return
+	}
+	r.advanceCommitLocked()
+	r.lastHeartbeat = time.Now()
+	r.broadcastAppendLocked()
+}
+
+// peersLocked returns voters and learners except self
+func (r *Raft) peersLocked() []string {
+	seen := map[string]bool{r.self: true}
+	peers := make([]string, 0, len(r.voters))
+	for _, peer := range append(append([]string(nil), r.voters...), r.learners()...) {
+		if !seen[peer] {
+			seen[peer] = true
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+func (r *Raft) broadcastAppendLocked() {
+	for _, peer := range r.peersLocked() {
+		if r.inflight[peer] {
+			continue
+		}
+		r.inflight[peer] = true
+		go r.replicateTo(peer)
+	}
+}
+
+// replicateTo sends one round of APPEND or SNAPSHOT to peer
+func (r *Raft) replicateTo(peer string) {
+	defer func() {
+		r.mu.Lock()
+		r.inflight[peer] = false
+		r.mu.Unlock()
+	}()
+
+	r.mu.Lock()
+	if r.role != leader {
+		r.mu.Unlock()
+		return
+	}
+	term := r.term
+	next, ok := r.nextIndex[peer]
+	if !ok {
+		next = r.lastIndex() + 1
+	}
+	if next <= r.snapshotIndex {
+		snapIndex, snapTerm, data, voters := r.snapshotIndex, r.snapshotTerm, r.snapshot, r.snapshotVoters
+		r.mu.Unlock()
+		replyTerm, err := r.sendSnapshot(peer, term, snapIndex, snapTerm, data, voters)
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if replyTerm > r.term {
+			r.becomeFollower(replyTerm)
+			_ = r.persistLocked()
+			return
+		}
+		if r.role == leader && r.term == term {
+			r.matchIndex[peer] = snapIndex
+			r.nextIndex[peer] = snapIndex + 1
+		}
+		return
+	}
+	prevIndex := next - 1
+	prevTerm, _ := r.termAt(prevIndex)
+	entries := r.entriesFrom(next, maxAppendEntries)
+	commit := r.commitIndex
+	r.mu.Unlock()
+
+	replyTerm, success, hint, err := r.sendAppend(peer, term, prevIndex, prevTerm, commit, entries)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if replyTerm > r.term {
+		r.becomeFollower(replyTerm)
+		_ = r.persistLocked()
+		return
+	}
+	if r.role != leader || r.term != term {
+		return
+	}
+	if success {
+		match := prevIndex + uint64(len(entries))
+		if match > r.matchIndex[peer] {
+			r.matchIndex[peer] = match
+		}
+		r.nextIndex[peer] = match + 1
+		r.advanceCommitLocked()
+		return
+	}
+	// 跟随者返回的 hint 是它已提交的位置，之前的日志一定一致
+	if hint+1 < next {
+		next = hint + 1
+	} else {
+		next--
+	}
+	if next < 1 {
+		next = 1
+	}
+	r.nextIndex[peer] = next
+}
+
+func (r *Raft) advanceCommitLocked() {
+	quorum := len(r.voters)/2 + 1
+	for n := r.lastIndex(); n > r.commitIndex; n-- {
+		if term, _ := r.termAt(n); term != r.term {
+			break
+		}
+		count := 0
+		for _, voter := range r.voters {
+			if voter == r.self || r.matchIndex[voter] >= n {
+				count++
+			}
+		}
+		if count >= quorum {
+			r.commitIndex = n
+			r.notifyApply()
+			return
+		}
+	}
+}
+
+func (r *Raft) notifyApply() {
+	select {
+	case r.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Raft) applyLoop() {
+	for {
+		select {
+		case <-r.stopChan:
+			return
+		case <-r.applyCh:
+		}
+
+		r.mu.Lock()
+		if r.pendingRestore != nil {
+			data, index := r.pendingRestore, r.snapshotIndex
+			r.pendingRestore = nil
+			r.mu.Unlock()
+			r.fsm.Restore(data)
+			r.mu.Lock()
+			r.lastApplied = index
+		}
+		start := r.lastApplied + 1
+		var entries []Entry
+		if r.commitIndex >= start {
+			entries = r.entriesFrom(start, int(r.commitIndex-start+1))
+		}
+		r.mu.Unlock()
+
+		for _, entry := range entries {
+			if entry.Cmd != nil && !isConfigEntry(entry) {
+				r.fsm.Apply(entry.Cmd)
+			}
+		}
+
+		r.mu.Lock()
+		if len(entries) > 0 && r.lastApplied+1 == start {
+			r.lastApplied = start + uint64(len(entries)) - 1
+		}
+		r.applied.Broadcast()
+		needSnapshot := r.lastApplied-r.snapshotIndex >= uint64(r.threshold) && r.pendingRestore == nil
+		snapIndex := r.lastApplied
+		r.mu.Unlock()
+
+		if needSnapshot {
+			data := r.fsm.Snapshot()
+			r.mu.Lock()
+			r.compactLocked(snapIndex, data)
+			r.mu.Unlock()
+		}
+		r.mu.Lock()
+		if r.commitIndex > r.lastApplied {
+			r.notifyApply()
+		}
+		r.mu.Unlock()
+	}
+}
+
+// compactLocked discards the entries up to index which is covered by the snapshot
+func (r *Raft) compactLocked(index uint64, data []byte) {
+	if index <= r.snapshotIndex || index > r.lastIndex() {
+		return
+	}
+	term, _ := r.termAt(index)
+	r.snapshotVoters = r.votersAtLocked(index)
+	r.log = append([]Entry(nil), r.log[index-r.snapshotIndex:]...)
+	r.snapshotIndex = index
+	r.snapshotTerm = term
+	r.snapshot = data
+	r.dirty = true
+	_ = r.persistLocked()
+	logger.Info("raft: snapshot at index ", index)
+}
+
+// Propose replicates cmd and returns after it is applied to the local state machine
+func (r *Raft) Propose(cmd [][]byte) error {
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return ErrStopped
+	}
+	if r.role != leader {
+		leaderAddr := r.leader
+		voters := append([]string(nil), r.voters...)
+		r.mu.Unlock()
+		return r.forward(leaderAddr, voters, cmd)
+	}
+	index, term, err := r.appendLocked(cmd)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return r.waitApplied(index, term)
+}
+
+// proposeAsLeader is called for PROPOSE forwarded by followers, returns the index of the entry
+func (r *Raft) proposeAsLeader(cmd [][]byte) (uint64, error) {
+	r.mu.Lock()
+	if r.role != leader {
+		r.mu.Unlock()
+		return 0, ErrNoLeader
+	}
+	index, term, err := r.appendLocked(cmd)
+	r.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return index, r.waitApplied(index, term)
+}
+
+// appendLocked 领导者追加一条日志并在落盘后复制，成员变更的提案转换为配置日志
+// 返回日志的位置和任期，投票者没有变化时不追加日志，返回的任期为 0
+func (r *Raft) appendLocked(cmd [][]byte) (uint64, uint64, error) {
+	if len(cmd) > 0 {
+		switch string(cmd[0]) {
+		case cmdAddVoter, cmdDelVoter:
+			configCmd, err := r.toConfigCmdLocked(cmd)
+			if err != nil {
+				return 0, 0, err
+			}
+			if configCmd == nil {
+				return r.commitIndex, 0, nil
+			}
+			cmd = configCmd
+		case cmdVoters:
+			return 0, 0, errors.New("raft: illegal proposal " + cmdVoters)
+		}
+	}
+	entry := Entry{Term: r.term, Cmd: cmd}
+	r.log = append(r.log, entry)
+	if isConfigEntry(entry) {
+		r.refreshVotersLocked()
+	}
+	r.dirty = true
+	if err := r.persistLocked(); err != nil {
+		// 没有落盘的日志不能计入多数派，退位后由新的领导者覆盖
+		r.stepDownLocked()
+		return 0, 0, err
+	}
+	index := r.lastIndex()
+	r.advanceCommitLocked()
+	r.broadcastAppendLocked()
+	return index, r.term, nil
+}
+
+// stepDownLocked 领导者无法落盘时放弃领导权
+func (r *Raft) stepDownLocked() {
+	logger.Error("raft: step down at term ", r.term, " since the state can not be persisted")
+	r.role = follower
+	r.leader = ""
+	r.resetElectionTimer()
+}
+
+// forward sends the proposal to the leader, or to voters if the leader is unknown
+func (r *Raft) forward(leaderAddr string, voters []string, cmd [][]byte) error {
+	targets := voters
+	if leaderAddr != "" {
+		targets = []string{leaderAddr}
+	}
+	err := ErrNoLeader
+	for _, target := range targets {
+		if target == r.self {
+			continue
+		}
+		var index uint64
+		index, err = r.sendPropose(target, cmd)
+		if err == nil {
+			// 等待本地状态机应用后再返回，保证之后读到的是新的配置
+			return r.waitApplied(index, 0)
+		}
+	}
+	return err
+}
+
+// waitApplied waits until index is applied, and checks the entry is still of term if term > 0
+func (r *Raft) waitApplied(index, term uint64) error {
+	deadline := time.Now().Add(proposeTimeout)
+	timer := time.AfterFunc(proposeTimeout, func() {
+		r.mu.Lock()
+		r.applied.Broadcast()
+		r.mu.Unlock()
+	})
+	defer timer.Stop()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.lastApplied < index {
+		if r.stopped {
+			return ErrStopped
+		}
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		r.applied.Wait()
+	}
+	if term > 0 {
+		if t, ok := r.termAt(index); ok && t != term {
+			return ErrLost
+		}
+	}
+	return nil
+}
+
+// handleVote handles RAFT VOTE
+func (r *Raft) handleVote(term uint64, candidateId string, lastIndex, lastTerm uint64) (uint64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if term < r.term || !r.isVoter(candidateId) {
+		return r.term, false
+	}
+	if term > r.term {
+		r.becomeFollower(term)
+	}
+	upToDate := lastTerm > r.lastTerm() || (lastTerm == r.lastTerm() && lastIndex >= r.lastIndex())
+	granted := false
+	if (r.votedFor == "" || r.votedFor == candidateId) && upToDate {
+		if r.votedFor != candidateId {
+			r.votedFor = candidateId
+			r.dirty = true
+		}
+		r.resetElectionTimer()
+		granted = true
+	}
+	// 投票必须在回复之前落盘，否则重启后可能在同一任期再投给别人
+	if err := r.persistLocked(); err != nil {
+		return r.term, false
+	}
+	return r.term, granted
+}
+
+// handleAppend handles RAFT APPEND, returns term, success and a hint of the next index to try
+func (r *Raft) handleAppend(term uint64, leaderId string, prevIndex, prevTerm, leaderCommit uint64, entries []Entry) (uint64, bool, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if term < r.term {
+		return r.term, false, r.commitIndex
+	}
+	r.becomeFollower(term)
+	r.leader = leaderId
+	r.resetElectionTimer()
+	if err := r.persistLocked(); err != nil {
+		return r.term, false, r.commitIndex
+	}
+
+	if prevIndex > r.lastIndex() {
+		return r.term, false, r.commitIndex
+	}
+	// prevIndex 之前的日志已经在快照中，跳过已压缩的部分
+	if prevIndex < r.snapshotIndex {
+		skip := r.snapshotIndex - prevIndex
+		if skip >= uint64(len(entries)) {
+			return r.term, true, r.snapshotIndex
+		}
+		entries = entries[skip:]
+		prevIndex = r.snapshotIndex
+		prevTerm = r.snapshotTerm
+	}
+	if t, _ := r.termAt(prevIndex); t != prevTerm {
+		return r.term, false, r.commitIndex
+	}
+	for i, entry := range entries {
+		index := prevIndex + 1 + uint64(i)
+		if index <= r.lastIndex() {
+			if t, _ := r.termAt(index); t == entry.Term {
+				continue
+			}
+			// 冲突: 删除该位置及之后的日志
+			r.log = r.log[:index-r.snapshotIndex-1]
+		}
+		r.log = append(r.log, entry)
+		r.dirty = true
+	}
+	if r.dirty {
+		r.refreshVotersLocked()
+		// 日志落盘之后才能向领导者确认
+		if err := r.persistLocked(); err != nil {
+			return r.term, false, r.commitIndex
+		}
+	}
+	if leaderCommit > r.commitIndex {
+		last := prevIndex + uint64(len(entries))
+		if leaderCommit < last {
+			last = leaderCommit
+		}
+		if last > r.commitIndex {
+			r.commitIndex = last
+			r.notifyApply()
+		}
+	}
+	return r.term, true, r.commitIndex
+}
+
+// handleSnapshot handles RAFT SNAPSHOT, voters are in effect at snapIndex
+func (r *Raft) handleSnapshot(term uint64, leaderId string, snapIndex, snapTerm uint64, data []byte, voters []string) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if term < r.term {
+		return r.term, nil
+	}
+	r.becomeFollower(term)
+	r.leader = leaderId
+	r.resetElectionTimer()
+	if snapIndex <= r.commitIndex {
+		return r.term, r.persistLocked()
+	}
+	if t, ok := r.termAt(snapIndex); ok && t == snapTerm {
+		r.log = append([]Entry(nil), r.log[snapIndex-r.snapshotIndex:]...)
+	} else {
+		r.log = nil
+	}
+	r.snapshotIndex = snapIndex
+	r.snapshotTerm = snapTerm
+	r.snapshot = data
+	r.snapshotVoters = voters
+	r.refreshVotersLocked()
+	r.dirty = true
+	if err := r.persistLocked(); err != nil {
+		return r.term, err
+	}
+	r.commitIndex = snapIndex
+	r.pendingRestore = data
+	r.notifyApply()
+	logger.Info("raft: install snapshot at index ", snapIndex)
+	return r.term, nil
+}
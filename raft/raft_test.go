@@ -0,0 +1,327 @@
+package raft
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logger.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// memNetwork 在内存中转发 RAFT 命令，down 中的结点既不能发送也不能接收
+type memNetwork struct {
+	mu    sync.Mutex
+	nodes map[string]*Raft
+	down  map[string]bool
+}
+
+func (n *memNetwork) setDown(addr string, down bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[addr] = down
+}
+
+// memTransport 是结点 self 使用的 Transport
+type memTransport struct {
+	network *memNetwork
+	self    string
+}
+
+func (t *memTransport) Send(peer string, args [][]byte) resp.Reply {
+	t.network.mu.Lock()
+	node, ok := t.network.nodes[peer]
+	unreachable := t.network.down[t.self] || t.network.down[peer]
+	t.network.mu.Unlock()
+	if !ok || unreachable {
+		return reply.MakeErrReply("ERR " + peer + " is unreachable")
+	}
+	return node.HandleCommand(args)
+}
+
+// memFSM 按顺序记录应用的命令，快照为换行分隔的命令
+type memFSM struct {
+	mu       sync.Mutex
+	cmds     []string
+	restores int
+}
+
+func (f *memFSM) Apply(cmd [][]byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.cmds = append(f.cmds, string(cmd[0]))
+}
+
+func (f *memFSM) Snapshot() []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return []byte(strings.Join(f.cmds, "\n"))
+}
+
+func (f *memFSM) Restore(data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.restores++
+	f.cmds = nil
+	if len(data) > 0 {
+		f.cmds = strings.Split(string(data), "\n")
+	}
+}
+
+func (f *memFSM) state() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return strings.Join(f.cmds, ",")
+}
+
+type testCluster struct {
+	network *memNetwork
+	nodes   map[string]*Raft
+	fsms    map[string]*memFSM
+}
+
+// makeTestCluster 启动 voters 和 learners 组成的集群，测试结束时停止
+func makeTestCluster(t *testing.T, voters []string, learners []string, threshold int) *testCluster {
+	c := &testCluster{
+		network: &memNetwork{nodes: make(map[string]*Raft), down: make(map[string]bool)},
+		nodes:   make(map[string]*Raft),
+		fsms:    make(map[string]*memFSM),
+	}
+	for _, addr := range append(append([]string(nil), voters...), learners...) {
+		fsm := &memFSM{}
+		r, err := MakeRaft(&Config{
+			Self:              addr,
+			Voters:            voters,
+			Learners:          func() []string { return learners },
+			FSM:               fsm,
+			Transport:         &memTransport{network: c.network, self: addr},
+			SnapshotThreshold: threshold,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.nodes[addr] = r
+		c.fsms[addr] = fsm
+	}
+	c.network.mu.Lock()
+	for addr, r := range c.nodes {
+		c.network.nodes[addr] = r
+	}
+	c.network.mu.Unlock()
+	for _, r := range c.nodes {
+		r.Start()
+	}
+	t.Cleanup(func() {
+		for _, r := range c.nodes {
+			r.Stop()
+		}
+	})
+	return c
+}
+
+// waitFor 轮询 cond 直到成立
+func waitFor(t *testing.T, timeout time.Duration, msg string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for " + msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitLeader 等待没有断开的结点中选出领导者，返回领导者的地址和任期
+func (c *testCluster) waitLeader(t *testing.T) (string, uint64) {
+	t.Helper()
+	var leaderAddr string
+	var leaderTerm uint64
+	waitFor(t, 10*time.Second, "leader", func() bool {
+		c.network.mu.Lock()
+		defer c.network.mu.Unlock()
+		for addr, r := range c.nodes {
+			role, term, _, _, _ := r.Status()
+			if role == leader.String() && !c.network.down[addr] {
+				leaderAddr, leaderTerm = addr, term
+				return true
+			}
+		}
+		return false
+	})
+	return leaderAddr, leaderTerm
+}
+
+func (c *testCluster) propose(t *testing.T, addr string, cmd string) {
+	t.Helper()
+	if err := c.nodes[addr].Propose(utils.ToCmdLine(cmd)); err != nil {
+		t.Fatalf("propose %s on %s: %v", cmd, addr, err)
+	}
+}
+
+func (c *testCluster) waitState(t *testing.T, addr string, want string) {
+	t.Helper()
+	waitFor(t, 10*time.Second, addr+" to apply "+want, func() bool {
+		return c.fsms[addr].state() == want
+	})
+}
+
+func TestElectionAfterLeaderLoss(t *testing.T) {
+	voters := []string{"n1", "n2", "n3"}
+	c := makeTestCluster(t, voters, nil, 0)
+	oldLeader, oldTerm := c.waitLeader(t)
+	c.propose(t, oldLeader, "a")
+
+	c.network.setDown(oldLeader, true)
+	newLeader, newTerm := c.waitLeader(t)
+	if newLeader == oldLeader || newTerm <= oldTerm {
+		t.Fatalf("leader %s at term %d after %s at term %d lost", newLeader, newTerm, oldLeader, oldTerm)
+	}
+	c.propose(t, newLeader, "b")
+
+	// 旧的领导者恢复后成为跟随者，并追上新领导者的日志
+	c.network.setDown(oldLeader, false)
+	waitFor(t, 5*time.Second, oldLeader+" to follow "+newLeader, func() bool {
+		role, _, leaderAddr, _, _ := c.nodes[oldLeader].Status()
+		return role == follower.String() && leaderAddr == newLeader
+	})
+	for _, addr := range voters {
+		c.waitState(t, addr, "a,b")
+	}
+}
+
+func TestCommitOnMajority(t *testing.T) {
+	voters := []string{"n1", "n2", "n3"}
+	c := makeTestCluster(t, voters, nil, 0)
+	leaderAddr, _ := c.waitLeader(t)
+	var followers []string
+	for _, addr := range voters {
+		if addr != leaderAddr {
+			followers = append(followers, addr)
+		}
+	}
+
+	// 一个跟随者断开时仍然是多数派，日志可以提交
+	c.network.setDown(followers[0], true)
+	c.propose(t, leaderAddr, "a")
+	c.waitState(t, followers[1], "a")
+	if state := c.fsms[followers[0]].state(); state != "" {
+		t.Fatalf("disconnected follower applied %q", state)
+	}
+
+	// 两个跟随者都断开时不能提交
+	c.network.setDown(followers[1], true)
+	_, _, _, commitBefore, _ := c.nodes[leaderAddr].Status()
+	if err := c.nodes[leaderAddr].Propose(utils.ToCmdLine("b")); err != ErrTimeout {
+		t.Fatalf("propose without majority: got %v, want %v", err, ErrTimeout)
+	}
+	if _, _, _, commit, _ := c.nodes[leaderAddr].Status(); commit != commitBefore {
+		t.Fatalf("commit index moved from %d to %d without majority", commitBefore, commit)
+	}
+	if state := c.fsms[leaderAddr].state(); state != "a" {
+		t.Fatalf("leader applied %q without majority", state)
+	}
+
+	// 恢复后未提交的日志由多数派提交，所有结点追上
+	c.network.setDown(followers[0], false)
+	c.network.setDown(followers[1], false)
+	for _, addr := range voters {
+		c.waitState(t, addr, "a,b")
+	}
+}
+
+func TestSnapshotCatchUp(t *testing.T) {
+	voters := []string{"n1", "n2", "n3"}
+	c := makeTestCluster(t, voters, nil, 4)
+	leaderAddr, _ := c.waitLeader(t)
+	lagging := voters[0]
+	if lagging == leaderAddr {
+		lagging = voters[1]
+	}
+
+	c.network.setDown(lagging, true)
+	var want []string
+	for i := 0; i < 12; i++ {
+		cmd := "c" + strconv.Itoa(i)
+		c.propose(t, leaderAddr, cmd)
+		want = append(want, cmd)
+	}
+	leaderNode := c.nodes[leaderAddr]
+	waitFor(t, 5*time.Second, "leader snapshot", func() bool {
+		leaderNode.mu.Lock()
+		defer leaderNode.mu.Unlock()
+		return leaderNode.snapshotIndex > 0
+	})
+	if got := string(leaderNode.fsm.Snapshot()); got != strings.Join(want, "\n") {
+		t.Fatalf("snapshot = %q", got)
+	}
+
+	// 落后的结点需要的日志已经被压缩，只能通过快照追赶
+	c.network.setDown(lagging, false)
+	c.waitState(t, lagging, strings.Join(want, ","))
+	fsm := c.fsms[lagging]
+	fsm.mu.Lock()
+	restores := fsm.restores
+	fsm.mu.Unlock()
+	if restores == 0 {
+		t.Fatal("lagging follower caught up without installing a snapshot")
+	}
+
+	c.propose(t, leaderAddr, "after")
+	c.waitState(t, lagging, strings.Join(append(want, "after"), ","))
+}
+
+func TestAddVoterPromotesLearner(t *testing.T) {
+	voters := []string{"n1", "n2", "n3"}
+	c := makeTestCluster(t, voters, []string{"n4"}, 0)
+	leaderAddr, _ := c.waitLeader(t)
+	c.propose(t, leaderAddr, "a")
+
+	// 学习者接收日志但不是投票者
+	c.waitState(t, "n4", "a")
+	if c.nodes["n4"].IsVoter("n4") {
+		t.Fatal("learner is a voter before AddVoter")
+	}
+	if role, _, _, _, _ := c.nodes["n4"].Status(); role != follower.String() {
+		t.Fatalf("learner role = %s", role)
+	}
+
+	// 从跟随者发起的提案转发给领导者
+	var other string
+	for _, addr := range voters {
+		if addr != leaderAddr {
+			other = addr
+			break
+		}
+	}
+	if err := c.nodes[other].AddVoter("n4"); err != nil {
+		t.Fatal(err)
+	}
+	for addr, r := range c.nodes {
+		waitFor(t, 5*time.Second, addr+" to see n4 as a voter", func() bool {
+			return r.IsVoter("n4")
+		})
+	}
+	// 已经是投票者时不追加配置日志
+	if err := c.nodes[leaderAddr].AddVoter("n4"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 四个投票者的多数派是 3，断开一个结点后仍然可以提交
+	c.network.setDown(other, true)
+	c.propose(t, leaderAddr, "b")
+	c.waitState(t, "n4", "a,b")
+	// 配置日志不交给状态机
+	if state := c.fsms[leaderAddr].state(); state != "a,b" {
+		t.Fatalf("leader state = %q", state)
+	}
+}
@@ -0,0 +1,222 @@
+package raft
+
+import (
+	"errors"
+	"go-redis/interface/resp"
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+)
+
+/*
+	RPC 格式
+	RAFT VOTE term candidate lastIndex lastTerm -> *2 term granted
+	RAFT APPEND term leader prevIndex prevTerm leaderCommit [entryTerm argc arg...]... -> *3 term success hint
+	RAFT SNAPSHOT term leader snapshotIndex snapshotTerm data [voter...] -> *1 term
+	RAFT PROPOSE cmd... -> :index 或 -NOTLEADER leader
+*/
+
+const notLeaderPrefix = "NOTLEADER "
+
+func formatUint(v uint64) []byte {
+	return []byte(strconv.FormatUint(v, 10))
+}
+
+func parseUint(b []byte) (uint64, error) {
+	return strconv.ParseUint(string(b), 10, 64)
+}
+
+// parseUints parses a multi bulk reply of unsigned integers
+func parseUints(r resp.Reply, n int) ([]uint64, error) {
+	if errReply, ok := r.(reply.ErrorReply); ok {
+		return nil, errors.New(errReply.Error())
+	}
+	multiBulk, ok := r.(*reply.MultiBulkReply)
+	if !ok || len(multiBulk.Args) != n {
+		return nil, errors.New("raft: illegal reply")
+	}
+	result := make([]uint64, n)
+	for i, arg := range multiBulk.Args {
+		v, err := parseUint(arg)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = v
+	}
+	return result, nil
+}
+
+func (r *Raft) sendVote(peer string, term, lastIndex, lastTerm uint64) (uint64, bool, error) {
+	args := [][]byte{[]byte("RAFT"), []byte("VOTE"), formatUint(term), []byte(r.self), formatUint(lastIndex), formatUint(lastTerm)}
+	result, err := parseUints(r.transport.Send(peer, args), 2)
+	if err != nil {
+		return 0, false, err
+	}
+	return result[0], result[1] == 1, nil
+}
+
+func (r *Raft) sendAppend(peer string, term, prevIndex, prevTerm, commit uint64, entries []Entry) (uint64, bool, uint64, error) {
+	args := [][]byte{[]byte("RAFT"), []byte("APPEND"), formatUint(term), []byte(r.self),
+		formatUint(prevIndex), formatUint(prevTerm), formatUint(commit)}
+	for _, entry := range entries {
+		args = append(args, formatUint(entry.Term), []byte(strconv.Itoa(len(entry.Cmd))))
+		args = append(args, entry.Cmd...)
+	}
+	result, err := parseUints(r.transport.Send(peer, args), 3)
+	if err != nil {
+		return 0, false, 0, err
+	}
+	return result[0], result[1] == 1, result[2], nil
+}
+
+func (r *Raft) sendSnapshot(peer string, term, snapIndex, snapTerm uint64, data []byte, voters []string) (uint64, error) {
+	args := [][]byte{[]byte("RAFT"), []byte("SNAPSHOT"), formatUint(term), []byte(r.self),
+		formatUint(snapIndex), formatUint(snapTerm), data}
+	for _, voter := range voters {
+		args = append(args, []byte(voter))
+	}
+	result, err := parseUints(r.transport.Send(peer, args), 1)
+	if err != nil {
+		return 0, err
+	}
+	return result[0], nil
+}
+
+// sendPropose forwards cmd to peer, follows one NOTLEADER redirection
+func (r *Raft) sendPropose(peer string, cmd [][]byte) (uint64, error) {
+	args := utils.ToCmdLine2("RAFT", append([][]byte{[]byte("PROPOSE")}, cmd...)...)
+	for i := 0; i < 2; i++ {
+		result := r.transport.Send(peer, args)
+		if errReply, ok := result.(reply.ErrorReply); ok {
+			msg := errReply.Error()
+			if strings.HasPrefix(msg, notLeaderPrefix) && i == 0 {
+				peer = strings.TrimPrefix(msg, notLeaderPrefix)
+				continue
+			}
+			return 0, errors.New(msg)
+		}
+		intReply, ok := result.(*reply.IntReply)
+		if !ok {
+			return 0, errors.New("raft: illegal reply")
+		}
+		return uint64(intReply.Code), nil
+	}
+	return 0, ErrNoLeader
+}
+
+// HandleCommand executes RAFT VOTE|APPEND|SNAPSHOT|PROPOSE received from other nodes
+func (r *Raft) HandleCommand(args [][]byte) resp.Reply {
+	if len(args) < 2 {
+		return reply.MakeArgNumErrReply("raft")
+	}
+	subCmd := strings.ToLower(string(args[1]))
+	args = args[2:]
+	switch subCmd {
+	case "vote":
+		return r.execVote(args)
+	case "append":
+		return r.execAppend(args)
+	case "snapshot":
+		return r.execSnapshot(args)
+	case "propose":
+		return r.execPropose(args)
+	}
+	return reply.MakeErrReply("ERR unknown subcommand '" + subCmd + "'")
+}
+
+func (r *Raft) execVote(args [][]byte) resp.Reply {
+	if len(args) != 4 {
+		return reply.MakeArgNumErrReply("raft vote")
+	}
+	term, err1 := parseUint(args[0])
+	lastIndex, err2 := parseUint(args[2])
+	lastTerm, err3 := parseUint(args[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return reply.MakeErrReply("ERR illegal raft vote")
+	}
+	replyTerm, granted := r.handleVote(term, string(args[1]), lastIndex, lastTerm)
+	result := [][]byte{formatUint(replyTerm), []byte("0")}
+	if granted {
+		result[1] = []byte("1")
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+func (r *Raft) execAppend(args [][]byte) resp.Reply {
+	if len(args) < 5 {
+		return reply.MakeArgNumErrReply("raft append")
+	}
+	var header [4]uint64
+	for i, idx := range []int{0, 2, 3, 4} {
+		v, err := parseUint(args[idx])
+		if err != nil {
+			return reply.MakeErrReply("ERR illegal raft append")
+		}
+		header[i] = v
+	}
+	term, prevIndex, prevTerm, commit := header[0], header[1], header[2], header[3]
+
+	entries := make([]Entry, 0)
+	rest := args[5:]
+	for len(rest) > 0 {
+		if len(rest) < 2 {
+			return reply.MakeErrReply("ERR illegal raft append")
+		}
+		entryTerm, err1 := parseUint(rest[0])
+		argc, err2 := strconv.Atoi(string(rest[1]))
+		if err1 != nil || err2 != nil || argc < 0 || len(rest) < 2+argc {
+			return reply.MakeErrReply("ERR illegal raft append")
+		}
+		entry := Entry{Term: entryTerm}
+		if argc > 0 {
+			entry.Cmd = rest[2 : 2+argc]
+		}
+		entries = append(entries, entry)
+		rest = rest[2+argc:]
+	}
+
+	replyTerm, success, hint := r.handleAppend(term, string(args[1]), prevIndex, prevTerm, commit, entries)
+	result := [][]byte{formatUint(replyTerm), []byte("0"), formatUint(hint)}
+	if success {
+		result[1] = []byte("1")
+	}
+	return reply.MakeMultiBulkReply(result)
+}
+
+func (r *Raft) execSnapshot(args [][]byte) resp.Reply {
+	if len(args) < 5 {
+		return reply.MakeArgNumErrReply("raft snapshot")
+	}
+	term, err1 := parseUint(args[0])
+	snapIndex, err2 := parseUint(args[2])
+	snapTerm, err3 := parseUint(args[3])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return reply.MakeErrReply("ERR illegal raft snapshot")
+	}
+	replyTerm, err := r.handleSnapshot(term, string(args[1]), snapIndex, snapTerm, args[4], toStrings(args[5:]))
+	if err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	return reply.MakeMultiBulkReply([][]byte{formatUint(replyTerm)})
+}
+
+func (r *Raft) execPropose(args [][]byte) resp.Reply {
+	if len(args) == 0 {
+		return reply.MakeArgNumErrReply("raft propose")
+	}
+	r.mu.Lock()
+	isLeader, leaderAddr := r.role == leader, r.leader
+	r.mu.Unlock()
+	if !isLeader {
+		if leaderAddr == "" || leaderAddr == r.self {
+			return reply.MakeErrReply("ERR " + ErrNoLeader.Error())
+		}
+		return reply.MakeErrReply(notLeaderPrefix + leaderAddr)
+	}
+	index, err := r.proposeAsLeader(args)
+	if err != nil {
+		return reply.MakeErrReply("ERR " + err.Error())
+	}
+	return reply.MakeIntReply(int64(index))
+}
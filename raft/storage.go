@@ -0,0 +1,135 @@
+package raft
+
+import (
+	"bytes"
+	"errors"
+	"go-redis/lib/logger"
+	"go-redis/resp/parser"
+	"go-redis/resp/reply"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	持久化的状态: 任期、投票、快照和日志，每次修改后整体写入临时文件再替换 stateFile
+	--回复 RPC、发起选举和领导者计入自己的日志之前都先落盘，结点重启后不会在同一任期投两次票，也不会丢失已确认的日志
+	--元数据的日志很少，超过 SnapshotThreshold 后会压缩，整体重写的代价可以接受
+	文件由以下命令组成:
+	--STATE term votedFor
+	--SNAPSHOT index term data voter...
+	--ENTRY term [cmd...]
+*/
+
+// persistLocked 把修改过的状态写入 stateFile，stateFile 为空时只保存在内存中
+func (r *Raft) persistLocked() error {
+	if !r.dirty || r.stateFile == "" {
+		r.dirty = false
+		return nil
+	}
+	var buf bytes.Buffer
+	writeLine := func(args ...[]byte) {
+		buf.Write(reply.MakeMultiBulkReply(args).ToBytes())
+	}
+	writeLine([]byte("STATE"), formatUint(r.term), []byte(r.votedFor))
+	// nil 会被编码为 null bulk，快照为空时写入空字符串
+	snapshot := [][]byte{[]byte("SNAPSHOT"), formatUint(r.snapshotIndex), formatUint(r.snapshotTerm), append([]byte{}, r.snapshot...)}
+	for _, voter := range r.snapshotVoters {
+		snapshot = append(snapshot, []byte(voter))
+	}
+	writeLine(snapshot...)
+	for _, entry := range r.log {
+		writeLine(append([][]byte{[]byte("ENTRY"), formatUint(entry.Term)}, entry.Cmd...)...)
+	}
+
+	if err := writeFileSync(r.stateFile, buf.Bytes()); err != nil {
+		logger.Error("raft: persist state failed: " + err.Error())
+		return err
+	}
+	r.dirty = false
+	return nil
+}
+
+// writeFileSync 写入临时文件并 fsync 后替换 path，避免写到一半时崩溃破坏原来的状态
+func writeFileSync(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// loadState 读取 stateFile，文件不存在时返回 false
+func (r *Raft) loadState() (bool, error) {
+	data, err := os.ReadFile(r.stateFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for payload := range parser.ParseStream(bytes.NewReader(data)) {
+		if payload.Err == io.EOF {
+			break
+		}
+		if payload.Err != nil {
+			return false, errors.New("raft: corrupted state file " + r.stateFile + ": " + payload.Err.Error())
+		}
+		line, ok := payload.Data.(*reply.MultiBulkReply)
+		if !ok || len(line.Args) < 2 {
+			return false, errors.New("raft: corrupted state file " + r.stateFile)
+		}
+		args := line.Args
+		switch strings.ToUpper(string(args[0])) {
+		case "STATE":
+			if len(args) != 3 {
+				return false, errors.New("raft: illegal STATE in " + r.stateFile)
+			}
+			if r.term, err = parseUint(args[1]); err != nil {
+				return false, err
+			}
+			r.votedFor = string(args[2])
+		case "SNAPSHOT":
+			if len(args) < 4 {
+				return false, errors.New("raft: illegal SNAPSHOT in " + r.stateFile)
+			}
+			if r.snapshotIndex, err = parseUint(args[1]); err != nil {
+				return false, err
+			}
+			if r.snapshotTerm, err = parseUint(args[2]); err != nil {
+				return false, err
+			}
+			r.snapshot = args[3]
+			r.snapshotVoters = toStrings(args[4:])
+		case "ENTRY":
+			entry := Entry{}
+			if entry.Term, err = parseUint(args[1]); err != nil {
+				return false, err
+			}
+			if len(args) > 2 {
+				entry.Cmd = args[2:]
+			}
+			r.log = append(r.log, entry)
+		}
+	}
+	return true, nil
+}
+
+func toStrings(args [][]byte) []string {
+	result := make([]string, len(args))
+	for i, arg := range args {
+		result[i] = string(arg)
+	}
+	return result
+}
@@ -1,36 +1,67 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"go-redis/interface/resp"
-	"go-redis/lib/logger"
 	"go-redis/lib/sync/wait"
 	"go-redis/resp/parser"
 	"go-redis/resp/reply"
 	"net"
-	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Client is a pipeline mode redis client
 type Client struct {
-	conn        net.Conn
-	pendingReqs chan *request // wait to send
-	waitingReqs chan *request // waiting response
-	ticker      *time.Ticker
 	addr        string
+	user        string // 为空时以 default 用户认证
+	password    string
+	protocol    int         // 2 或 3，为 3 时连接建立后通过 HELLO 切换到 RESP3
+	tlsConfig   *tls.Config // 不为 nil 时通过 TLS 连接
+	peer        bool        // 集群结点之间的连接，认证之后执行 CLUSTER PEER
+	peerSecret  string
+	pendingReqs chan []*request // wait to send, 同一批请求在一次写入中发出
+	ticker      *time.Ticker
+	closeChan   chan struct{}
+
+	// mu 保护连接状态机: state, conn, gen, waitingReqs, replayReqs, failedSelect
+	mu          sync.Mutex
+	state       int
+	closing     bool // 不再接受新的请求
+	conn        net.Conn
+	replies     <-chan *parser.Payload // 初始连接的回复流
+	gen         uint64                 // 连接的代数，每次重连加一，旧连接上迟到的回复据此丢弃
+	waitingReqs []*request             // 已经写入当前连接、等待回复的请求，按发出顺序排列
+	replayReqs  []*request             // 连接断开时需要在新连接上重新发送的幂等请求
+	// failedSelect 失败的自动插入的 SELECT，reply 为它的错误，之后依赖它的请求返回该错误，直到下一个 SELECT
+	failedSelect *request
+
+	// selectedDB 连接当前选择的数据库，由写协程在发出 SELECT 后更新，SELECT 失败时由读协程置为 -1 (未知)
+	selectedDB int64
+	// db 用户通过 SELECT 选择的数据库，重连后重新选择
+	db int64
 
 	working *sync.WaitGroup // its counter presents unfinished requests(pending and waiting)
 }
 
 // request is a message sends to redis server
 type request struct {
-	id        uint64
 	args      [][]byte
 	reply     resp.Reply
 	heartbeat bool
 	waiting   *wait.Wait
 	err       error
+	ctx       context.Context // 发出前 ctx 已经结束的请求不再发送
+	replayed  bool            // 已经在新连接上重新发送过一次
+
+	selectDB bool // 执行前需要确保连接选择了 dbIndex
+	dbIndex  int
+	isSelect bool // 由客户端自动插入的 SELECT
 }
 
 const (
@@ -38,31 +69,110 @@ const (
 	maxWait  = 3 * time.Second
 )
 
+// Send 在连接出错、超时或被取消时返回的错误信息
+const (
+	errTimeout        = "server time out"
+	errRequestFailed  = "request failed"
+	errCanceled       = "request canceled"
+	errConnectionLost = "connection lost"
+	errNotConnected   = "not connected"
+	errClientClosed   = "client closed"
+)
+
+// IsConnectionError 回复是否因为连接出错或超时而产生，而不是服务端返回的错误
+func IsConnectionError(r resp.Reply) bool {
+	errReply, ok := r.(reply.ErrorReply)
+	if !ok {
+		return false
+	}
+	switch errReply.Error() {
+	case errTimeout, errRequestFailed, errConnectionLost, errNotConnected, errClientClosed:
+		return true
+	}
+	return false
+}
+
+// isUnsent 请求在写入连接之前就失败了，服务端一定没有执行，重新发送是安全的
+func isUnsent(r resp.Reply) bool {
+	errReply, ok := r.(reply.ErrorReply)
+	if !ok {
+		return false
+	}
+	switch errReply.Error() {
+	case errRequestFailed, errNotConnected:
+		return true
+	}
+	return false
+}
+
 // MakeClient creates a new client
 func MakeClient(addr string) (*Client, error) {
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return nil, err
+	return MakeClientWithPassword(addr, "")
+}
+
+// MakeClientWithPassword creates a new client which sends AUTH password on every (re)connection
+func MakeClientWithPassword(addr string, password string) (*Client, error) {
+	return MakeClientWithProtocol(addr, password, reply.Protocol2)
+}
+
+// MakeClientWithProtocol creates a new client speaking RESP2 or RESP3, RESP3 is negotiated by HELLO on every (re)connection
+func MakeClientWithProtocol(addr string, password string, protocol int) (*Client, error) {
+	return MakeClientWithOptions(addr, Options{Password: password, Protocol: protocol})
+}
+
+// Options 创建客户端的参数
+type Options struct {
+	// User 认证使用的 ACL 用户，为空时使用 default
+	User     string
+	Password string
+	Protocol int // 2 或 3，为 0 时使用 2
+	// TLSConfig 不为 nil 时通过 TLS 连接，需要双向认证时在 Certificates 中设置客户端证书
+	TLSConfig *tls.Config
+	// Peer 集群结点之间的连接，认证之后执行 CLUSTER PEER
+	Peer bool
+	// PeerSecret CLUSTER PEER 出示的 cluster-secret，以 masteruser 认证时可以为空
+	PeerSecret string
+	// DB 连接建立后选择的数据库
+	DB int
+}
+
+// MakeClientWithOptions creates a new client with the given options
+func MakeClientWithOptions(addr string, opts Options) (*Client, error) {
+	protocol := opts.Protocol
+	if protocol == 0 {
+		protocol = reply.Protocol2
 	}
-	return &Client{
+	if protocol != reply.Protocol2 && protocol != reply.Protocol3 {
+		return nil, errors.New("unsupported protocol version " + strconv.Itoa(protocol))
+	}
+	client := &Client{
 		addr:        addr,
-		conn:        conn,
-		pendingReqs: make(chan *request, chanSize),
-		waitingReqs: make(chan *request, chanSize),
+		user:        opts.User,
+		password:    opts.Password,
+		protocol:    protocol,
+		tlsConfig:   opts.TLSConfig,
+		peer:        opts.Peer,
+		peerSecret:  opts.PeerSecret,
+		pendingReqs: make(chan []*request, chanSize),
+		closeChan:   make(chan struct{}),
 		working:     &sync.WaitGroup{},
-	}, nil
+		selectedDB:  int64(opts.DB),
+		db:          int64(opts.DB),
+	}
+	conn, replies, err := client.dial()
+	if err != nil {
+		return nil, err
+	}
+	client.conn = conn
+	client.replies = replies
+	return client, nil
 }
 
 // Start starts asynchronous goroutines
 func (client *Client) Start() {
 	client.ticker = time.NewTicker(10 * time.Second)
 	go client.handleWrite()
-	go func() {
-		err := client.handleRead()
-		if err != nil {
-			logger.Error(err)
-		}
-	}()
+	go client.handleRead(client.gen, client.replies)
 	go client.heartbeat()
 }
 
@@ -70,133 +180,350 @@ func (client *Client) Start() {
 func (client *Client) Close() {
 	client.ticker.Stop()
 	// stop new request
-	close(client.pendingReqs)
+	client.mu.Lock()
+	client.closing = true
+	client.mu.Unlock()
 
 	// wait stop process
 	client.working.Wait()
 
 	// clean
+	client.mu.Lock()
+	client.state = stateClosed
 	_ = client.conn.Close()
-	close(client.waitingReqs)
+	leftover := append(client.waitingReqs, client.replayReqs...)
+	client.waitingReqs = nil
+	client.replayReqs = nil
+	client.mu.Unlock()
+	close(client.closeChan)
+	failRequests(leftover, errors.New(errClientClosed))
+	close(client.pendingReqs)
 }
 
-func (client *Client) handleConnectionError(err error) error {
-	err1 := client.conn.Close()
-	if err1 != nil {
-		if opErr, ok := err1.(*net.OpError); ok {
-			if opErr.Err.Error() != "use of closed network connection" {
-				return err1
-			}
-		} else {
-			return err1
+func (client *Client) heartbeat() {
+	for {
+		select {
+		case <-client.ticker.C:
+			client.doHeartbeat()
+		case <-client.closeChan:
+			return
 		}
 	}
-	conn, err1 := net.Dial("tcp", client.addr)
-	if err1 != nil {
-		logger.Error(err1)
-		return err1
-	}
-	client.conn = conn
-	go func() {
-		_ = client.handleRead()
-	}()
-	return nil
 }
 
-func (client *Client) heartbeat() {
-	for range client.ticker.C {
-		client.doHeartbeat()
+func (client *Client) handleWrite() {
+	for reqs := range client.pendingReqs {
+		client.doRequest(reqs)
 	}
 }
 
-func (client *Client) handleWrite() {
-	for req := range client.pendingReqs {
-		client.doRequest(req)
+// acquire 登记一个进行中的请求，客户端正在关闭时返回 false，成功时调用方必须调用 client.working.Done
+func (client *Client) acquire() bool {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.closing {
+		return false
 	}
+	client.working.Add(1)
+	return true
 }
 
 // Send sends a request to redis server
 func (client *Client) Send(args [][]byte) resp.Reply {
-	request := &request{
-		args:      args,
-		heartbeat: false,
-		waiting:   &wait.Wait{},
+	return client.SendContext(context.Background(), args)
+}
+
+// SendContext 等待回复直到 ctx 结束，ctx 没有截止时间时最多等待 maxWait，发出前被取消的请求不会发送
+func (client *Client) SendContext(ctx context.Context, args [][]byte) resp.Reply {
+	return client.send(ctx, &request{args: args})
+}
+
+// SendWithDB 在 dbIndex 数据库上执行命令，连接当前选择的数据库不同时 SELECT 和命令在一次写入中发出，
+// SELECT 失败时 (例如服务端没有这个数据库) 返回 SELECT 的错误
+func (client *Client) SendWithDB(dbIndex int, args [][]byte) resp.Reply {
+	return client.send(context.Background(), &request{args: args, selectDB: true, dbIndex: dbIndex})
+}
+
+func (client *Client) send(ctx context.Context, req *request) resp.Reply {
+	if !client.acquire() {
+		return reply.MakeErrReply(errClientClosed)
 	}
-	request.waiting.Add(1)
-	client.working.Add(1)
 	defer client.working.Done()
-	client.pendingReqs <- request
-	timeout := request.waiting.WaitWithTimeout(maxWait)
-	if timeout {
-		return reply.MakeErrReply("server time out")
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	req.ctx = ctx
+	client.submit([]*request{req})
+	return req.result(ctx)
+}
+
+// SendAsync 发出请求后立即返回，通过 Future 获取回复
+func (client *Client) SendAsync(args [][]byte) *Future {
+	req := &request{args: args}
+	if !client.acquire() {
+		req.waiting = &wait.Wait{}
+		req.err = errors.New(errClientClosed)
+		return &Future{req: req}
+	}
+	defer client.working.Done()
+	client.submit([]*request{req})
+	return &Future{req: req}
+}
+
+// Future 异步请求的回复
+type Future struct {
+	req *request
+}
+
+// Get 等待回复，最多等待 maxWait
+func (f *Future) Get() resp.Reply {
+	return f.GetContext(context.Background())
+}
+
+// GetContext 等待回复直到 ctx 结束，ctx 没有截止时间时最多等待 maxWait
+func (f *Future) GetContext(ctx context.Context) resp.Reply {
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	return f.req.result(ctx)
+}
+
+// Pipeline 收集多条命令，Exec 时在一次写入中全部发出，按顺序返回回复
+type Pipeline struct {
+	client *Client
+	reqs   []*request
+}
+
+// Pipeline 创建一个新的 Pipeline
+func (client *Client) Pipeline() *Pipeline {
+	return &Pipeline{client: client}
+}
+
+// Add 追加一条命令
+func (p *Pipeline) Add(args [][]byte) *Pipeline {
+	p.reqs = append(p.reqs, &request{args: args})
+	return p
+}
+
+// AddWithDB 追加一条在 dbIndex 数据库上执行的命令
+func (p *Pipeline) AddWithDB(dbIndex int, args [][]byte) *Pipeline {
+	p.reqs = append(p.reqs, &request{args: args, selectDB: true, dbIndex: dbIndex})
+	return p
+}
+
+// Len 已经追加的命令数量
+func (p *Pipeline) Len() int {
+	return len(p.reqs)
+}
+
+// Exec 发出所有命令，最多等待 maxWait
+func (p *Pipeline) Exec() []resp.Reply {
+	return p.ExecContext(context.Background())
+}
+
+// ExecContext 发出所有命令并等待回复直到 ctx 结束，未及时回复的命令得到超时错误，之后 Pipeline 可以继续使用
+func (p *Pipeline) ExecContext(ctx context.Context) []resp.Reply {
+	reqs := p.reqs
+	p.reqs = nil
+	if len(reqs) == 0 {
+		return nil
 	}
-	if request.err != nil {
-		return reply.MakeErrReply("request failed")
+	results := make([]resp.Reply, len(reqs))
+	if !p.client.acquire() {
+		for i := range results {
+			results[i] = reply.MakeErrReply(errClientClosed)
+		}
+		return results
+	}
+	defer p.client.working.Done()
+	ctx, cancel := withDefaultTimeout(ctx)
+	defer cancel()
+	for _, req := range reqs {
+		req.ctx = ctx
+	}
+	p.client.submit(reqs)
+	for i, req := range reqs {
+		results[i] = req.result(ctx)
+	}
+	return results
+}
+
+// submit 将一批请求交给写协程，caller must hold client.working
+func (client *Client) submit(reqs []*request) {
+	for _, req := range reqs {
+		req.waiting = &wait.Wait{}
+		req.waiting.Add(1)
+	}
+	client.pendingReqs <- reqs
+}
+
+// withDefaultTimeout 为没有截止时间的 ctx 加上 maxWait 的超时
+func withDefaultTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, maxWait)
+}
+
+// result 等待请求完成直到 ctx 结束
+func (req *request) result(ctx context.Context) resp.Reply {
+	if req.waiting.WaitWithContext(ctx) {
+		if ctx.Err() == context.DeadlineExceeded {
+			return reply.MakeErrReply(errTimeout)
+		}
+		return reply.MakeErrReply(errCanceled)
+	}
+	if req.err != nil {
+		return reply.MakeErrReply(req.err.Error())
+	}
+	return req.reply
+}
+
+// canceled 请求在发出前已经被放弃
+func (req *request) canceled() bool {
+	return req.ctx != nil && req.ctx.Err() != nil
+}
+
+// finish 设置请求的结果并唤醒等待者，每个请求只能调用一次
+func (req *request) finish(result resp.Reply, err error) {
+	req.reply = result
+	req.err = err
+	if req.waiting != nil {
+		req.waiting.Done()
+	}
+}
+
+func failRequests(reqs []*request, err error) {
+	for _, req := range reqs {
+		if !req.isSelect {
+			req.finish(nil, err)
+		}
 	}
-	return request.reply
 }
 
 func (client *Client) doHeartbeat() {
-	request := &request{
+	if !client.acquire() {
+		return
+	}
+	defer client.working.Done()
+	req := &request{
 		args:      [][]byte{[]byte("PING")},
 		heartbeat: true,
-		waiting:   &wait.Wait{},
 	}
-	request.waiting.Add(1)
-	client.working.Add(1)
-	defer client.working.Done()
-	client.pendingReqs <- request
-	request.waiting.WaitWithTimeout(maxWait)
+	client.submit([]*request{req})
+	req.waiting.WaitWithTimeout(maxWait)
 }
 
-func (client *Client) doRequest(req *request) {
-	if req == nil || len(req.args) == 0 {
+func (client *Client) doRequest(reqs []*request) {
+	client.mu.Lock()
+	if client.state != stateConnected {
+		// 重连期间快速失败，不让调用方等到超时
+		msg := errNotConnected
+		if client.state == stateClosed {
+			msg = errClientClosed
+		}
+		client.mu.Unlock()
+		failRequests(reqs, errors.New(msg))
 		return
 	}
-	re := reply.MakeMultiBulkReply(req.args)
-	bytes := re.ToBytes()
-	_, err := client.conn.Write(bytes)
-	i := 0
-	for err != nil && i < 3 {
-		err = client.handleConnectionError(err)
-		if err == nil {
-			_, err = client.conn.Write(bytes)
+	// 之前断开时需要重放的请求排在最前面
+	reqs = append(client.replayReqs, reqs...)
+	client.replayReqs = nil
+	// 空命令和已经放弃的请求不发送
+	valid := make([]*request, 0, len(reqs))
+	dropped := make([]*request, 0)
+	for _, req := range reqs {
+		if len(req.args) == 0 || req.canceled() {
+			dropped = append(dropped, req)
+		} else {
+			valid = append(valid, req)
 		}
-		i++
 	}
-	if err == nil {
-		client.waitingReqs <- req
-	} else {
-		req.err = err
-		req.waiting.Done()
+	var buf []byte
+	if len(valid) > 0 {
+		var sent []*request
+		var dbIndex int64
+		buf, sent, dbIndex = client.encode(valid)
+		atomic.StoreInt64(&client.selectedDB, dbIndex)
+		// 先登记再写入，读协程收到回复时请求一定已经在队列中
+		client.waitingReqs = append(client.waitingReqs, sent...)
+	}
+	conn, gen := client.conn, client.gen
+	client.mu.Unlock()
+
+	failRequests(dropped, errors.New(errRequestFailed))
+	if len(buf) == 0 {
+		return
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(maxWait))
+	if _, err := conn.Write(buf); err != nil {
+		client.handleDisconnect(gen, err)
 	}
 }
 
-func (client *Client) finishRequest(reply resp.Reply) {
-	defer func() {
-		if err := recover(); err != nil {
-			debug.PrintStack()
-			logger.Error(err)
+// encode 将一批请求编码到同一个缓冲区中，请求的数据库与连接当时选择的不同时在它之前插入 SELECT
+// 返回 (缓冲区，需要等待回复的请求，发出后连接选择的数据库)，caller must hold client.mu
+func (client *Client) encode(reqs []*request) ([]byte, []*request, int64) {
+	dbIndex := atomic.LoadInt64(&client.selectedDB)
+	buf := make([]byte, 0)
+	sent := make([]*request, 0, len(reqs))
+	for _, req := range reqs {
+		if req.selectDB && int64(req.dbIndex) != dbIndex {
+			selectReq := &request{
+				args:     [][]byte{[]byte("SELECT"), []byte(strconv.Itoa(req.dbIndex))},
+				dbIndex:  req.dbIndex,
+				isSelect: true,
+			}
+			buf = append(buf, reply.MakeMultiBulkReply(selectReq.args).ToBytes()...)
+			sent = append(sent, selectReq)
+			dbIndex = int64(req.dbIndex)
+		}
+		if !req.selectDB && isSelectCommand(req.args) {
+			dbIndex, _ = strconv.ParseInt(string(req.args[1]), 10, 64)
 		}
-	}()
-	request := <-client.waitingReqs
-	if request == nil {
+		buf = append(buf, reply.MakeMultiBulkReply(req.args).ToBytes()...)
+		sent = append(sent, req)
+	}
+	return buf, sent, dbIndex
+}
+
+// finishRequest 把回复交给 gen 代连接上最早发出的请求，旧连接上迟到的回复被丢弃
+func (client *Client) finishRequest(gen uint64, result resp.Reply) {
+	client.mu.Lock()
+	if gen != client.gen || len(client.waitingReqs) == 0 {
+		client.mu.Unlock()
 		return
 	}
-	request.reply = reply
-	if request.waiting != nil {
-		request.waiting.Done()
+	req := client.waitingReqs[0]
+	client.waitingReqs[0] = nil
+	client.waitingReqs = client.waitingReqs[1:]
+	_, isErr := result.(reply.ErrorReply)
+	if isSelectCommand(req.args) {
+		client.failedSelect = nil
+		if isErr {
+			// 写协程假设 SELECT 会成功，失败后连接选择的数据库未知
+			atomic.StoreInt64(&client.selectedDB, -1)
+			if req.isSelect {
+				req.reply = result
+				client.failedSelect = req
+			}
+		} else if !req.isSelect {
+			// 用户执行的 SELECT，重连后需要重新选择
+			dbIndex, _ := strconv.ParseInt(string(req.args[1]), 10, 64)
+			atomic.StoreInt64(&client.db, dbIndex)
+		}
+	} else if failed := client.failedSelect; failed != nil && req.selectDB && req.dbIndex == failed.dbIndex {
+		// 与 SELECT 一起发出的命令在原来的数据库上执行了，调用方得到 SELECT 的错误而不是它的回复
+		result = failed.reply
+	}
+	client.mu.Unlock()
+	if !req.isSelect {
+		req.finish(result, nil)
 	}
 }
 
-func (client *Client) handleRead() error {
-	ch := parser.ParseStream(client.conn)
-	for payload := range ch {
-		if payload.Err != nil {
-			client.finishRequest(reply.MakeErrReply(payload.Err.Error()))
-			continue
-		}
-		client.finishRequest(payload.Data)
+func isSelectCommand(args [][]byte) bool {
+	if len(args) != 2 || strings.ToLower(string(args[0])) != "select" {
+		return false
 	}
-	return nil
+	_, err := strconv.ParseInt(string(args[1]), 10, 64)
+	return err == nil
 }
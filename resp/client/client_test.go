@@ -0,0 +1,70 @@
+package client
+
+import (
+	"bytes"
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSendWithDBSelectFails(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	written := make(chan []byte, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// 第一次读取就收到 SELECT 和 GET，说明它们在一次写入中发出
+		buf := make([]byte, 1024)
+		n, _ := conn.Read(buf)
+		written <- append([]byte(nil), buf[:n]...)
+		_, _ = conn.Write([]byte("-ERR DB index is out of range\r\n$3\r\nold\r\n"))
+		n, _ = conn.Read(buf)
+		written <- append([]byte(nil), buf[:n]...)
+		_, _ = conn.Write([]byte("+OK\r\n$3\r\nnew\r\n"))
+		_, _ = conn.Read(buf)
+	}()
+
+	c, err := MakeClient(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	defer c.Close()
+
+	result := c.SendWithDB(99, utils.ToCmdLine("GET", "k"))
+	want := reply.MakeMultiBulkReply(utils.ToCmdLine("SELECT", "99"))
+	got := <-written
+	if !bytes.Equal(got, append(want.ToBytes(), reply.MakeMultiBulkReply(utils.ToCmdLine("GET", "k")).ToBytes()...)) {
+		t.Fatalf("first write = %q, want SELECT and GET together", got)
+	}
+	// GET 在原来的数据库上执行了，调用方得到 SELECT 的错误
+	if !reply.IsErrReply(result) || string(result.ToBytes()) != "-ERR DB index is out of range\r\n" {
+		t.Fatalf("SendWithDB = %q, want the SELECT error", result.ToBytes())
+	}
+
+	// 连接选择的数据库未知，下一次请求重新 SELECT
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		result = c.SendWithDB(99, utils.ToCmdLine("GET", "k"))
+	}()
+	select {
+	case got = <-written:
+	case <-time.After(3 * time.Second):
+		t.Fatal("retry was not written")
+	}
+	if !bytes.HasPrefix(got, want.ToBytes()) {
+		t.Fatalf("second write = %q, want a new SELECT", got)
+	}
+	<-done
+	assertBulk(t, result, "new")
+}
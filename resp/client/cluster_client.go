@@ -0,0 +1,572 @@
+package client
+
+import (
+	"errors"
+	"go-redis/interface/resp"
+	"go-redis/lib/consistenthash"
+	"go-redis/lib/logger"
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	ClusterClient 集群客户端
+	--从种子结点获取拓扑: 优先使用 CLUSTER SLOTS (redis cluster)，不支持时使用 CLUSTER SHARDS 和 cluster_virtual_nodes
+	  在本地构建与服务端相同的一致性哈希环
+	--按 key 把命令直接发给所在的主结点，每个结点一个 Client (Client 是 pipeline 模式的，可以并发使用)
+	--收到 MOVED 时改发到新结点并刷新拓扑，收到 ASK 时在新结点的临时连接上把 ASKING 和命令一起发出，只对这一次请求生效
+	--连接失败或 CLUSTERDOWN 时刷新拓扑后重试，超时或连接断开时命令可能已经执行，只有幂等命令和没有发出的命令才重试
+	--SELECT 在所有结点上执行，之后新建的连接也选择同一个数据库
+*/
+
+const (
+	maxRedirects       = 5
+	refreshInterval    = 10 * time.Second
+	minRefreshInterval = 100 * time.Millisecond
+)
+
+// keylessCommands 不含 key 的命令，发给任意一个结点，服务端负责汇总整个集群的结果
+var keylessCommands = map[string]bool{
+	"ping": true, "info": true, "cluster": true, "dbsize": true, "keys": true, "scan": true,
+	"randomkey": true, "flushdb": true, "flushall": true, "echo": true,
+}
+
+// clusterRouter 根据 key 选择结点
+type clusterRouter interface {
+	pick(key string) string
+	nodes() []string
+}
+
+// slotRouter redis cluster 的槽 -> 主结点
+type slotRouter struct {
+	slots   [slotCount]string
+	masters []string
+}
+
+func (r *slotRouter) pick(key string) string {
+	return r.slots[keySlot(key)]
+}
+
+func (r *slotRouter) nodes() []string {
+	return r.masters
+}
+
+// ringRouter 一致性哈希环上的分片 -> 主结点
+type ringRouter struct {
+	ring    *consistenthash.NodeMap
+	masters map[string]string
+}
+
+func (r *ringRouter) pick(key string) string {
+	return r.masters[r.ring.PickNode(key)]
+}
+
+func (r *ringRouter) nodes() []string {
+	addrs := make([]string, 0, len(r.masters))
+	for _, master := range r.masters {
+		if master != "" {
+			addrs = append(addrs, master)
+		}
+	}
+	return addrs
+}
+
+// ClusterClient routes commands to the node owning the key
+type ClusterClient struct {
+	seeds []string
+	// opts 连接每个结点的参数，DB 由 db 决定
+	opts Options
+	// db SELECT 选择的数据库，新建的连接也使用它
+	db int64
+
+	mu      sync.RWMutex
+	router  clusterRouter
+	clients map[string]*Client
+
+	refreshMu   sync.Mutex
+	lastRefresh time.Time
+
+	stopChan  chan struct{}
+	closeOnce sync.Once
+}
+
+// MakeClusterClient creates a ClusterClient and loads the topology from seeds
+func MakeClusterClient(seeds []string) (*ClusterClient, error) {
+	return MakeClusterClientWithPassword(seeds, "")
+}
+
+// MakeClusterClientWithPassword creates a ClusterClient which authenticates to every node with password
+func MakeClusterClientWithPassword(seeds []string, password string) (*ClusterClient, error) {
+	return MakeClusterClientWithOptions(seeds, Options{Password: password})
+}
+
+// MakeClusterClientWithOptions creates a ClusterClient which connects to every node with opts, opts.DB is the initial database
+func MakeClusterClientWithOptions(seeds []string, opts Options) (*ClusterClient, error) {
+	if len(seeds) == 0 {
+		return nil, errors.New("no seed node")
+	}
+	c := &ClusterClient{
+		seeds:    seeds,
+		opts:     opts,
+		db:       int64(opts.DB),
+		clients:  make(map[string]*Client),
+		stopChan: make(chan struct{}),
+	}
+	if err := c.refresh(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	go c.refreshLoop()
+	return c, nil
+}
+
+func (c *ClusterClient) refreshLoop() {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopChan:
+			return
+		case <-ticker.C:
+			if err := c.refresh(); err != nil {
+				logger.Warn("cluster client: refresh topology failed: ", err)
+			}
+		}
+	}
+}
+
+// Close closes clients of all nodes
+func (c *ClusterClient) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stopChan)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for addr, client := range c.clients {
+			client.Close()
+			delete(c.clients, addr)
+		}
+	})
+}
+
+// getClient returns the client of addr, creates it if needed
+// 在锁外建立连接，一个结点无响应时不会阻塞其它结点的请求，并发创建时只保留先放入的连接
+func (c *ClusterClient) getClient(addr string) (*Client, error) {
+	c.mu.RLock()
+	client, ok := c.clients[addr]
+	c.mu.RUnlock()
+	if ok {
+		return client, nil
+	}
+
+	client, err := c.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	client.Start()
+
+	c.mu.Lock()
+	select {
+	case <-c.stopChan:
+		c.mu.Unlock()
+		client.Close()
+		return nil, errors.New(errClientClosed)
+	default:
+	}
+	if existing, ok := c.clients[addr]; ok {
+		c.mu.Unlock()
+		client.Close()
+		return existing, nil
+	}
+	c.clients[addr] = client
+	c.mu.Unlock()
+	return client, nil
+}
+
+// dial 使用创建时的参数连接结点，选择 SELECT 指定的数据库
+func (c *ClusterClient) dial(addr string) (*Client, error) {
+	opts := c.opts
+	opts.DB = int(atomic.LoadInt64(&c.db))
+	return MakeClientWithOptions(addr, opts)
+}
+
+// isBroken 连接已经断开，与其等待客户端自己重连不如换一个结点
+func isBroken(result resp.Reply) bool {
+	errReply, ok := result.(reply.ErrorReply)
+	if !ok {
+		return false
+	}
+	switch errReply.Error() {
+	case errRequestFailed, errConnectionLost, errNotConnected, errClientClosed:
+		return true
+	}
+	return false
+}
+
+// canRetry 连接出错的命令能否重新发送，超时或在途时连接断开的命令可能已经执行，非幂等的命令重试会执行两次
+func canRetry(args [][]byte, result resp.Reply) bool {
+	return isUnsent(result) || isIdempotent(args)
+}
+
+// dropClient closes the client of a broken node, it will be recreated on next use
+func (c *ClusterClient) dropClient(addr string) {
+	c.mu.Lock()
+	client, ok := c.clients[addr]
+	delete(c.clients, addr)
+	c.mu.Unlock()
+	if ok {
+		go client.Close()
+	}
+}
+
+// pick returns the node for the command
+func (c *ClusterClient) pick(args [][]byte) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.router == nil {
+		return c.seeds[0]
+	}
+	if len(args) < 2 || keylessCommands[strings.ToLower(string(args[0]))] {
+		if nodes := c.router.nodes(); len(nodes) > 0 {
+			return nodes[0]
+		}
+		return c.seeds[0]
+	}
+	return c.router.pick(string(args[1]))
+}
+
+// Send sends the command to the node owning its key and follows redirections
+func (c *ClusterClient) Send(args [][]byte) resp.Reply {
+	if isSelectCommand(args) {
+		return c.selectDB(args)
+	}
+	addr := c.pick(args)
+	asking := false
+	for i := 0; i <= maxRedirects; i++ {
+		result := c.sendTo(addr, args, asking)
+		asking = false
+		errReply, ok := result.(reply.ErrorReply)
+		if !ok {
+			return result
+		}
+		msg := errReply.Error()
+		switch {
+		case strings.HasPrefix(msg, "MOVED "):
+			// MOVED slot addr: 槽已经迁移，之后的请求都应当发到新结点
+			addr = redirectAddr(msg)
+			go c.refreshQuietly()
+		case strings.HasPrefix(msg, "ASK "):
+			// ASK slot addr: 槽正在迁移，只有这一次请求发到新结点
+			addr = redirectAddr(msg)
+			asking = true
+		case strings.HasPrefix(msg, "CLUSTERDOWN") || (IsConnectionError(result) && canRetry(args, result)):
+			c.refreshQuietly()
+			addr = c.pick(args)
+		default:
+			return result
+		}
+		if addr == "" {
+			return result
+		}
+	}
+	return reply.MakeErrReply("ERR too many cluster redirections")
+}
+
+func (c *ClusterClient) sendTo(addr string, args [][]byte, asking bool) resp.Reply {
+	if addr == "" {
+		return reply.MakeErrReply("CLUSTERDOWN no node serves the key")
+	}
+	if asking {
+		return c.sendAsking(addr, args)
+	}
+	client, err := c.getClient(addr)
+	if err != nil {
+		return reply.MakeErrReply(errRequestFailed)
+	}
+	result := client.Send(args)
+	if isBroken(result) {
+		c.dropClient(addr)
+	}
+	return result
+}
+
+// sendAsking ASKING 只对同一个连接上的下一条命令生效，共享的连接上其它请求可能插在中间，
+// 因此使用临时连接，ASKING 和命令在一次写入中发出
+func (c *ClusterClient) sendAsking(addr string, args [][]byte) resp.Reply {
+	client, err := c.dial(addr)
+	if err != nil {
+		return reply.MakeErrReply(errRequestFailed)
+	}
+	client.Start()
+	defer client.Close()
+	// ASKING 失败时命令会得到 MOVED 或 ASK，由调用方继续重定向
+	return client.Pipeline().Add(utils.ToCmdLine("ASKING")).Add(args).Exec()[1]
+}
+
+// selectDB 在所有主结点上执行 SELECT，全部成功后记录下来，之后新建的连接也选择这个数据库
+func (c *ClusterClient) selectDB(args [][]byte) resp.Reply {
+	dbIndex, _ := strconv.ParseInt(string(args[1]), 10, 64)
+	// 先记录，执行期间新建的连接也会选择这个数据库
+	atomic.StoreInt64(&c.db, dbIndex)
+	c.mu.RLock()
+	nodes := c.seeds[:1]
+	if c.router != nil {
+		nodes = c.router.nodes()
+	}
+	c.mu.RUnlock()
+	for _, addr := range nodes {
+		client, err := c.getClient(addr)
+		if err != nil {
+			return reply.MakeErrReply(errRequestFailed)
+		}
+		if result := client.Send(args); reply.IsErrReply(result) {
+			if isBroken(result) {
+				c.dropClient(addr)
+			}
+			return result
+		}
+	}
+	return reply.MakeOkReply()
+}
+
+// Pipeline 把命令按结点分组，每个结点上的命令在一次写入中发出，结点之间并发，结果按命令的顺序返回
+// 需要重定向或连接出错的命令之后再逐条通过 Send 重试，SELECT 把命令分成前后两段，保证前后的命令在各自的数据库上执行
+func (c *ClusterClient) Pipeline(cmds [][][]byte) []resp.Reply {
+	results := make([]resp.Reply, len(cmds))
+	start := 0
+	for i, args := range cmds {
+		if isSelectCommand(args) {
+			c.pipelineBatch(cmds, start, i, results)
+			results[i] = c.selectDB(args)
+			start = i + 1
+		}
+	}
+	c.pipelineBatch(cmds, start, len(cmds), results)
+	return results
+}
+
+// pipelineBatch 并发地执行 cmds[start:end]
+func (c *ClusterClient) pipelineBatch(cmds [][][]byte, start, end int, results []resp.Reply) {
+	groups := make(map[string][]int)
+	for i := start; i < end; i++ {
+		addr := c.pick(cmds[i])
+		groups[addr] = append(groups[addr], i)
+	}
+	var wg sync.WaitGroup
+	for addr, indices := range groups {
+		wg.Add(1)
+		go func(addr string, indices []int) {
+			defer wg.Done()
+			c.pipelineTo(addr, cmds, indices, results)
+		}(addr, indices)
+	}
+	wg.Wait()
+}
+
+func (c *ClusterClient) pipelineTo(addr string, cmds [][][]byte, indices []int, results []resp.Reply) {
+	var client *Client
+	var err error
+	if addr != "" {
+		client, err = c.getClient(addr)
+	}
+	if client == nil || err != nil {
+		for _, i := range indices {
+			results[i] = c.Send(cmds[i])
+		}
+		return
+	}
+	pipeline := client.Pipeline()
+	for _, i := range indices {
+		pipeline.Add(cmds[i])
+	}
+	replies := pipeline.Exec()
+	for _, result := range replies {
+		if isBroken(result) {
+			c.dropClient(addr)
+			break
+		}
+	}
+	for j, result := range replies {
+		i := indices[j]
+		if needRetry(cmds[i], result) {
+			result = c.Send(cmds[i])
+		}
+		results[i] = result
+	}
+}
+
+// needRetry 回复是否为重定向、集群不可用或者可以重试的连接错误
+func needRetry(args [][]byte, result resp.Reply) bool {
+	errReply, ok := result.(reply.ErrorReply)
+	if !ok {
+		return false
+	}
+	msg := errReply.Error()
+	return strings.HasPrefix(msg, "MOVED ") || strings.HasPrefix(msg, "ASK ") ||
+		strings.HasPrefix(msg, "CLUSTERDOWN") || (IsConnectionError(result) && canRetry(args, result))
+}
+
+// redirectAddr returns the address of MOVED slot addr / ASK slot addr
+func redirectAddr(msg string) string {
+	fields := strings.Fields(msg)
+	if len(fields) != 3 {
+		return ""
+	}
+	return fields[2]
+}
+
+func (c *ClusterClient) refreshQuietly() {
+	if err := c.refresh(); err != nil {
+		logger.Warn("cluster client: refresh topology failed: ", err)
+	}
+}
+
+// refresh 依次向已知结点和种子结点获取拓扑，并发的刷新只执行一次
+func (c *ClusterClient) refresh() error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+	if time.Since(c.lastRefresh) < minRefreshInterval {
+		return nil
+	}
+
+	candidates := make([]string, 0)
+	c.mu.RLock()
+	if c.router != nil {
+		candidates = append(candidates, c.router.nodes()...)
+	}
+	c.mu.RUnlock()
+	candidates = append(candidates, c.seeds...)
+
+	var lastErr error
+	for _, addr := range candidates {
+		router, err := c.fetchTopology(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.setRouter(router)
+		c.lastRefresh = time.Now()
+		return nil
+	}
+	return lastErr
+}
+
+// setRouter replaces the router and closes clients of nodes which are no longer masters
+func (c *ClusterClient) setRouter(router clusterRouter) {
+	masters := make(map[string]bool)
+	for _, addr := range router.nodes() {
+		masters[addr] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.router = router
+	for addr, client := range c.clients {
+		if !masters[addr] {
+			delete(c.clients, addr)
+			go client.Close()
+		}
+	}
+}
+
+func (c *ClusterClient) fetchTopology(addr string) (clusterRouter, error) {
+	client, err := c.getClient(addr)
+	if err != nil {
+		return nil, err
+	}
+	slots := client.Send(utils.ToCmdLine("CLUSTER", "SLOTS"))
+	if !reply.IsErrReply(slots) {
+		return parseSlots(slots)
+	}
+	if isBroken(slots) {
+		c.dropClient(addr)
+		return nil, errors.New(addr + ": " + errRequestFailed)
+	}
+
+	info := client.Send(utils.ToCmdLine("CLUSTER", "INFO"))
+	infoBulk, ok := info.(*reply.BulkReply)
+	if !ok {
+		return nil, errors.New(addr + ": illegal cluster info reply")
+	}
+	virtualNodes := consistenthash.DefaultReplicas
+	for _, line := range strings.Split(string(infoBulk.Arg), reply.CRLF) {
+		if v := strings.TrimPrefix(line, "cluster_virtual_nodes:"); v != line {
+			if n, err := strconv.Atoi(v); err == nil {
+				virtualNodes = n
+			}
+		}
+	}
+	return parseShards(client.Send(utils.ToCmdLine("CLUSTER", "SHARDS")), virtualNodes)
+}
+
+// parseShards 解析 CLUSTER SHARDS: 每项为 shard master replica...
+func parseShards(r resp.Reply, virtualNodes int) (clusterRouter, error) {
+	router := &ringRouter{
+		ring:    consistenthash.NewNodeMapWithReplicas(virtualNodes, nil),
+		masters: make(map[string]string),
+	}
+	var entries []resp.Reply
+	switch r := r.(type) {
+	case *reply.MultiRawReply:
+		entries = r.Replies
+	case *reply.EmptyMultiBulkReply:
+	default:
+		return nil, errors.New("illegal cluster shards reply")
+	}
+	shards := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		fields, ok := entry.(*reply.MultiBulkReply)
+		if !ok || len(fields.Args) < 2 {
+			return nil, errors.New("illegal cluster shards reply")
+		}
+		shard := string(fields.Args[0])
+		router.masters[shard] = string(fields.Args[1])
+		shards = append(shards, shard)
+	}
+	if len(shards) == 0 {
+		return nil, errors.New("cluster has no shard")
+	}
+	router.ring.AddNode(shards...)
+	return router, nil
+}
+
+// parseSlots 解析 CLUSTER SLOTS: 每项为 start end [ip port id] [replica]...
+func parseSlots(r resp.Reply) (clusterRouter, error) {
+	entries, ok := r.(*reply.MultiRawReply)
+	if !ok {
+		return nil, errors.New("illegal cluster slots reply")
+	}
+	router := &slotRouter{}
+	seen := make(map[string]bool)
+	for _, entry := range entries.Replies {
+		fields, ok := entry.(*reply.MultiRawReply)
+		if !ok || len(fields.Replies) < 3 {
+			return nil, errors.New("illegal cluster slots reply")
+		}
+		start, ok1 := fields.Replies[0].(*reply.IntReply)
+		end, ok2 := fields.Replies[1].(*reply.IntReply)
+		master, ok3 := fields.Replies[2].(*reply.MultiRawReply)
+		if !ok1 || !ok2 || !ok3 || len(master.Replies) < 2 ||
+			start.Code < 0 || end.Code >= slotCount || start.Code > end.Code {
+			return nil, errors.New("illegal cluster slots reply")
+		}
+		host, ok4 := master.Replies[0].(*reply.BulkReply)
+		port, ok5 := master.Replies[1].(*reply.IntReply)
+		if !ok4 || !ok5 {
+			return nil, errors.New("illegal cluster slots reply")
+		}
+		addr := net.JoinHostPort(string(host.Arg), strconv.FormatInt(port.Code, 10))
+		for slot := start.Code; slot <= end.Code; slot++ {
+			router.slots[slot] = addr
+		}
+		if !seen[addr] {
+			seen[addr] = true
+			router.masters = append(router.masters, addr)
+		}
+	}
+	return router, nil
+}
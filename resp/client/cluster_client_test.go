@@ -0,0 +1,317 @@
+package client
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/lib/utils"
+	"go-redis/resp/parser"
+	"go-redis/resp/reply"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNode 测试用的 RESP 服务端，handle 返回 nil 时不回复，模拟卡住的请求
+type fakeNode struct {
+	addr     string
+	listener net.Listener
+	handle   func(args []string) resp.Reply
+
+	mu       sync.Mutex
+	received []string // 每条命令的参数以空格连接
+	conns    []net.Conn
+}
+
+// newFakeNode 只监听不处理请求，调用 serve 之后开始处理，handle 可以引用其它结点的地址
+func newFakeNode(t *testing.T) *fakeNode {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &fakeNode{addr: listener.Addr().String(), listener: listener}
+	t.Cleanup(func() {
+		_ = listener.Close()
+		n.dropConns()
+	})
+	return n
+}
+
+func (n *fakeNode) serve(handle func(args []string) resp.Reply) {
+	n.handle = handle
+	go func() {
+		for {
+			conn, err := n.listener.Accept()
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			n.conns = append(n.conns, conn)
+			n.mu.Unlock()
+			go n.serveConn(conn)
+		}
+	}()
+}
+
+func (n *fakeNode) serveConn(conn net.Conn) {
+	defer conn.Close()
+	for payload := range parser.ParseStream(conn) {
+		if payload.Err != nil {
+			return
+		}
+		mb, ok := payload.Data.(*reply.MultiBulkReply)
+		if !ok {
+			return
+		}
+		args := make([]string, len(mb.Args))
+		for i, arg := range mb.Args {
+			args[i] = string(arg)
+		}
+		n.mu.Lock()
+		n.received = append(n.received, strings.Join(args, " "))
+		n.mu.Unlock()
+		result := n.handle(args)
+		if result == nil {
+			continue
+		}
+		if _, err := conn.Write(result.ToBytes()); err != nil {
+			return
+		}
+	}
+}
+
+func (n *fakeNode) commands() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.received...)
+}
+
+// dropConns 关闭所有已建立的连接，模拟服务端断开
+func (n *fakeNode) dropConns() {
+	n.mu.Lock()
+	conns := n.conns
+	n.conns = nil
+	n.mu.Unlock()
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+func hasCommand(cmds []string, cmd string) bool {
+	for _, c := range cmds {
+		if c == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// slotsReply CLUSTER SLOTS 的回复，第一个结点负责前一半的槽，第二个结点负责后一半
+func slotsReply(first, second string) resp.Reply {
+	entry := func(start, end int64, addr string) resp.Reply {
+		host, portStr, _ := net.SplitHostPort(addr)
+		port, _ := strconv.ParseInt(portStr, 10, 64)
+		return reply.MakeMultiRawReply([]resp.Reply{
+			reply.MakeIntReply(start),
+			reply.MakeIntReply(end),
+			reply.MakeMultiRawReply([]resp.Reply{reply.MakeBulkReply([]byte(host)), reply.MakeIntReply(port)}),
+		})
+	}
+	return reply.MakeMultiRawReply([]resp.Reply{
+		entry(0, slotCount/2-1, first),
+		entry(slotCount/2, slotCount-1, second),
+	})
+}
+
+// keyInHalf 返回槽在前一半 (first 为 true) 或后一半的 key
+func keyInHalf(prefix string, first bool) string {
+	for i := 0; ; i++ {
+		key := prefix + strconv.Itoa(i)
+		if (keySlot(key) < slotCount/2) == first {
+			return key
+		}
+	}
+}
+
+// startTwoNodes 启动两个结点，GET 返回结点名，other 处理其余的命令
+func startTwoNodes(t *testing.T, other func(name string, args []string) resp.Reply) (*fakeNode, *fakeNode) {
+	a, b := newFakeNode(t), newFakeNode(t)
+	handler := func(name string) func(args []string) resp.Reply {
+		return func(args []string) resp.Reply {
+			if other != nil {
+				if result := other(name, args); result != nil {
+					return result
+				}
+			}
+			switch strings.ToUpper(args[0]) {
+			case "CLUSTER":
+				return slotsReply(a.addr, b.addr)
+			case "GET":
+				return reply.MakeBulkReply([]byte(name))
+			}
+			return reply.MakeOkReply()
+		}
+	}
+	a.serve(handler("a"))
+	b.serve(handler("b"))
+	return a, b
+}
+
+func assertBulk(t *testing.T, result resp.Reply, want string) {
+	t.Helper()
+	bulk, ok := result.(*reply.BulkReply)
+	if !ok || string(bulk.Arg) != want {
+		t.Fatalf("got %q, want %q", result.ToBytes(), want)
+	}
+}
+
+func TestClusterClientRouting(t *testing.T) {
+	a, b := startTwoNodes(t, nil)
+	c, err := MakeClusterClientWithOptions([]string{a.addr}, Options{User: "app", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	assertBulk(t, c.Send(utils.ToCmdLine("GET", keyInHalf("k", true))), "a")
+	assertBulk(t, c.Send(utils.ToCmdLine("GET", keyInHalf("k", false))), "b")
+	// 到每个结点的连接都使用创建时的用户和密码
+	for _, n := range []*fakeNode{a, b} {
+		if !hasCommand(n.commands(), "AUTH app secret") {
+			t.Fatalf("%s did not receive AUTH with the user: %v", n.addr, n.commands())
+		}
+	}
+
+	results := c.Pipeline([][][]byte{
+		utils.ToCmdLine("GET", keyInHalf("p", false)),
+		utils.ToCmdLine("GET", keyInHalf("p", true)),
+	})
+	assertBulk(t, results[0], "b")
+	assertBulk(t, results[1], "a")
+}
+
+func TestClusterClientMoved(t *testing.T) {
+	movedKey := keyInHalf("moved", true)
+	var a, b *fakeNode
+	a, b = startTwoNodes(t, func(name string, args []string) resp.Reply {
+		if name == "a" && len(args) == 2 && args[1] == movedKey {
+			return reply.MakeErrReply("MOVED " + strconv.Itoa(keySlot(movedKey)) + " " + b.addr)
+		}
+		return nil
+	})
+	c, err := MakeClusterClient([]string{a.addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	assertBulk(t, c.Send(utils.ToCmdLine("GET", movedKey)), "b")
+	if !hasCommand(a.commands(), "GET "+movedKey) || !hasCommand(b.commands(), "GET "+movedKey) {
+		t.Fatalf("GET was not redirected: a %v, b %v", a.commands(), b.commands())
+	}
+}
+
+func TestClusterClientAsk(t *testing.T) {
+	askKey := keyInHalf("ask", true)
+	var a, b *fakeNode
+	a, b = startTwoNodes(t, func(name string, args []string) resp.Reply {
+		if name == "a" && len(args) == 2 && args[1] == askKey {
+			return reply.MakeErrReply("ASK " + strconv.Itoa(keySlot(askKey)) + " " + b.addr)
+		}
+		return nil
+	})
+	c, err := MakeClusterClient([]string{a.addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	assertBulk(t, c.Send(utils.ToCmdLine("GET", askKey)), "b")
+	// ASKING 和命令在同一个连接上紧挨着发出
+	cmds := b.commands()
+	found := false
+	for i := 0; i+1 < len(cmds); i++ {
+		if cmds[i] == "ASKING" && cmds[i+1] == "GET "+askKey {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("b received %v, want ASKING followed by GET", cmds)
+	}
+	// ASK 只对一次请求生效，不改变路由
+	if got := c.pick(utils.ToCmdLine("GET", askKey)); got != a.addr {
+		t.Fatalf("key routed to %s after ASK, want %s", got, a.addr)
+	}
+}
+
+func TestClusterClientDialsOutsideLock(t *testing.T) {
+	// stuck 接受连接但从不回复，连接它的握手一直等到超时
+	stuck := newFakeNode(t)
+	stuck.serve(func(args []string) resp.Reply { return nil })
+	a := newFakeNode(t)
+	a.serve(func(args []string) resp.Reply {
+		switch strings.ToUpper(args[0]) {
+		case "CLUSTER":
+			return slotsReply(a.addr, stuck.addr)
+		case "GET":
+			return reply.MakeBulkReply([]byte("a"))
+		}
+		return reply.MakeOkReply()
+	})
+	c, err := MakeClusterClientWithPassword([]string{a.addr}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	done := make(chan struct{})
+	go func() {
+		c.Send(utils.ToCmdLine("GET", keyInHalf("k", false)))
+		close(done)
+	}()
+	// 等待开始连接 stuck
+	deadline := time.Now().Add(time.Second)
+	for !hasCommand(stuck.commands(), "AUTH secret") {
+		if time.Now().After(deadline) {
+			t.Fatal("client did not dial the stuck node")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	start := time.Now()
+	assertBulk(t, c.Send(utils.ToCmdLine("GET", keyInHalf("k", true))), "a")
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("request to a healthy node waited %v for the stuck node", elapsed)
+	}
+	// 之后的重试连接失败，不再等待握手超时
+	_ = stuck.listener.Close()
+	stuck.dropConns()
+	<-done
+}
+
+func TestClusterClientConcurrentGetClient(t *testing.T) {
+	a, b := startTwoNodes(t, nil)
+	c, err := MakeClusterClient([]string{a.addr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	const n = 8
+	clients := make([]*Client, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clients[i], _ = c.getClient(b.addr)
+		}(i)
+	}
+	wg.Wait()
+	for _, client := range clients {
+		if client == nil || client != clients[0] {
+			t.Fatal("concurrent getClient returned different clients")
+		}
+	}
+	assertBulk(t, clients[0].Send(utils.ToCmdLine("GET", "k")), "b")
+}
@@ -0,0 +1,257 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"go-redis/lib/logger"
+	"go-redis/resp/parser"
+	"go-redis/resp/reply"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	连接状态机
+	connected    --连接出错--> reconnecting: 关闭连接，在途请求中的幂等命令留待重放，其余以 connection lost 失败
+	reconnecting --拨号成功--> connected:    重新 AUTH 和 SELECT，新连接上先发送需要重放的请求
+	reconnecting 期间的新请求直接以 not connected 失败，拨号按指数退避并加上随机抖动
+	任意状态     --Close-->    closed
+*/
+
+const (
+	stateConnected = iota
+	stateReconnecting
+	stateClosed
+)
+
+const (
+	minBackoff = 100 * time.Millisecond
+	maxBackoff = 5 * time.Second
+)
+
+// idempotentCommands 连接断开后可以安全地重新发送的命令
+var idempotentCommands = map[string]bool{
+	"ping":      true,
+	"echo":      true,
+	"get":       true,
+	"mget":      true,
+	"exists":    true,
+	"type":      true,
+	"strlen":    true,
+	"ttl":       true,
+	"pttl":      true,
+	"keys":      true,
+	"scan":      true,
+	"dbsize":    true,
+	"randomkey": true,
+	"select":    true,
+	"info":      true,
+}
+
+// idempotentClusterCommands 只读的 CLUSTER 子命令
+var idempotentClusterCommands = map[string]bool{
+	"info":   true,
+	"nodes":  true,
+	"slots":  true,
+	"shards": true,
+}
+
+func isIdempotent(args [][]byte) bool {
+	if len(args) == 0 {
+		return false
+	}
+	cmdName := strings.ToLower(string(args[0]))
+	if cmdName == "cluster" {
+		return len(args) >= 2 && idempotentClusterCommands[strings.ToLower(string(args[1]))]
+	}
+	return idempotentCommands[cmdName]
+}
+
+// dial 建立连接 (配置了 TLS 时完成握手)，使用 RESP3 时执行 HELLO，设置了密码时认证，集群结点之间的连接执行 CLUSTER PEER，用户选择过数据库时执行 SELECT
+func (client *Client) dial() (net.Conn, <-chan *parser.Payload, error) {
+	dialer := &net.Dialer{Timeout: maxWait}
+	var conn net.Conn
+	var err error
+	if client.tlsConfig != nil {
+		// 握手也受 maxWait 限制，ServerName 为空时使用 addr 中的主机名
+		conn, err = tls.DialWithDialer(dialer, "tcp", client.addr, client.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", client.addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	ch := parser.ParseStream(conn)
+	cmds := make([][][]byte, 0, 3)
+	if client.protocol == reply.Protocol3 {
+		hello := [][]byte{[]byte("HELLO"), []byte("3")}
+		if client.password != "" {
+			user := client.user
+			if user == "" {
+				user = "default"
+			}
+			hello = append(hello, []byte("AUTH"), []byte(user), []byte(client.password))
+		}
+		cmds = append(cmds, hello)
+	} else if client.password != "" && client.user != "" {
+		cmds = append(cmds, [][]byte{[]byte("AUTH"), []byte(client.user), []byte(client.password)})
+	} else if client.password != "" {
+		cmds = append(cmds, [][]byte{[]byte("AUTH"), []byte(client.password)})
+	}
+	if client.peer {
+		peerCmd := [][]byte{[]byte("CLUSTER"), []byte("PEER")}
+		if client.peerSecret != "" {
+			peerCmd = append(peerCmd, []byte(client.peerSecret))
+		}
+		cmds = append(cmds, peerCmd)
+	}
+	if db := atomic.LoadInt64(&client.db); db != 0 {
+		cmds = append(cmds, [][]byte{[]byte("SELECT"), []byte(strconv.FormatInt(db, 10))})
+	}
+	if err := handshake(conn, ch, cmds); err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	return conn, ch, nil
+}
+
+// handshake 同步地执行连接建立后的命令
+func handshake(conn net.Conn, ch <-chan *parser.Payload, cmds [][][]byte) error {
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	for _, cmd := range cmds {
+		if _, err := conn.Write(reply.MakeMultiBulkReply(cmd).ToBytes()); err != nil {
+			return err
+		}
+		select {
+		case payload, ok := <-ch:
+			if !ok {
+				return io.EOF
+			}
+			if payload.Err != nil {
+				return payload.Err
+			}
+			if errReply, ok := payload.Data.(reply.ErrorReply); ok {
+				return errors.New(string(cmd[0]) + " failed: " + errReply.Error())
+			}
+		case <-timer.C:
+			return errors.New(string(cmd[0]) + " failed: " + errTimeout)
+		}
+	}
+	return nil
+}
+
+// handleRead 读取 gen 代连接上的回复，连接出错时触发重连
+func (client *Client) handleRead(gen uint64, ch <-chan *parser.Payload) {
+	var err error = io.EOF
+	for payload := range ch {
+		if payload.Err != nil {
+			// 协议错误之后回复和请求无法再对应，和 io 错误一样断开重连
+			err = payload.Err
+			break
+		}
+		if _, ok := payload.Data.(*reply.PushReply); ok {
+			// RESP3 的推送消息不对应任何请求，目前还没有订阅功能，直接丢弃
+			continue
+		}
+		client.finishRequest(gen, payload.Data)
+	}
+	client.handleDisconnect(gen, err)
+	// 连接已经关闭，等待解析协程退出
+	for range ch {
+	}
+}
+
+// handleDisconnect 关闭 gen 代连接并开始重连，同一个连接只处理一次
+func (client *Client) handleDisconnect(gen uint64, err error) {
+	client.mu.Lock()
+	if gen != client.gen || client.state != stateConnected {
+		client.mu.Unlock()
+		return
+	}
+	client.state = stateReconnecting
+	_ = client.conn.Close()
+	failed := make([]*request, 0)
+	for _, req := range client.waitingReqs {
+		switch {
+		case req.isSelect:
+		case !req.replayed && !req.heartbeat && isIdempotent(req.args) && !req.canceled():
+			req.replayed = true
+			client.replayReqs = append(client.replayReqs, req)
+		default:
+			failed = append(failed, req)
+		}
+	}
+	client.waitingReqs = nil
+	client.failedSelect = nil
+	client.mu.Unlock()
+
+	logger.Warn("client: connection to " + client.addr + " lost: " + err.Error())
+	failRequests(failed, errors.New(errConnectionLost))
+	go client.reconnect()
+}
+
+// reconnect 按指数退避重新拨号直到成功或客户端关闭
+func (client *Client) reconnect() {
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-client.closeChan:
+			return
+		case <-time.After(backoff(attempt)):
+		}
+		conn, ch, err := client.dial()
+		if err != nil {
+			logger.Warn("client: reconnect to " + client.addr + " failed: " + err.Error())
+			continue
+		}
+
+		client.mu.Lock()
+		if client.state == stateClosed {
+			client.mu.Unlock()
+			_ = conn.Close()
+			return
+		}
+		client.conn = conn
+		client.gen++
+		client.state = stateConnected
+		// dial 已经重新选择了用户的数据库
+		atomic.StoreInt64(&client.selectedDB, atomic.LoadInt64(&client.db))
+		gen := client.gen
+		hasReplay := len(client.replayReqs) > 0
+		client.mu.Unlock()
+
+		logger.Info("client: reconnected to " + client.addr)
+		go client.handleRead(gen, ch)
+		if hasReplay {
+			client.wakeWriter()
+		}
+		return
+	}
+}
+
+// wakeWriter 让空闲的写协程发送需要重放的请求
+func (client *Client) wakeWriter() {
+	if !client.acquire() {
+		return
+	}
+	defer client.working.Done()
+	select {
+	case client.pendingReqs <- nil:
+	default:
+		// 队列不空，写协程很快会处理
+	}
+}
+
+// backoff 第 attempt 次重连前的等待时间，指数增长并加上随机抖动，避免大量客户端同时重连
+func backoff(attempt int) time.Duration {
+	d := maxBackoff
+	if attempt < 16 && minBackoff<<uint(attempt) < maxBackoff {
+		d = minBackoff << uint(attempt)
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"go-redis/interface/resp"
+	"go-redis/lib/utils"
+	"go-redis/resp/reply"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countCommand 统计 cmd 出现的次数
+func countCommand(cmds []string, cmd string) int {
+	n := 0
+	for _, c := range cmds {
+		if c == cmd {
+			n++
+		}
+	}
+	return n
+}
+
+func TestReconnectReplaysIdempotentRequests(t *testing.T) {
+	// stall 为 1 时不回复 GET、SET 和 INCR，请求停在连接上直到连接被断开
+	var stall int32
+	node := newFakeNode(t)
+	node.serve(func(args []string) resp.Reply {
+		switch strings.ToUpper(args[0]) {
+		case "GET", "SET", "INCR":
+			if atomic.LoadInt32(&stall) == 1 {
+				return nil
+			}
+			if strings.ToUpper(args[0]) == "GET" {
+				return reply.MakeBulkReply([]byte("v"))
+			}
+		}
+		return reply.MakeOkReply()
+	})
+	c, err := MakeClientWithPassword(node.addr, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+	defer c.Close()
+	if result := c.Send(utils.ToCmdLine("SELECT", "3")); reply.IsErrReply(result) {
+		t.Fatalf("SELECT = %q", result.ToBytes())
+	}
+
+	atomic.StoreInt32(&stall, 1)
+	get := c.SendAsync(utils.ToCmdLine("GET", "k"))
+	set := c.SendAsync(utils.ToCmdLine("SET", "k", "v"))
+	incr := c.SendAsync(utils.ToCmdLine("INCR", "n"))
+	deadline := time.Now().Add(time.Second)
+	for !hasCommand(node.commands(), "INCR n") {
+		if time.Now().After(deadline) {
+			t.Fatalf("requests did not reach the server: %v", node.commands())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	atomic.StoreInt32(&stall, 0)
+	node.dropConns()
+
+	// 幂等的 GET 在新连接上重新发送，SET 和 INCR 可能已经执行，不能重放
+	assertBulk(t, get.Get(), "v")
+	for _, result := range []resp.Reply{set.Get(), incr.Get()} {
+		if got := string(result.ToBytes()); got != "-"+errConnectionLost+"\r\n" {
+			t.Fatalf("non-idempotent request = %q, want %s", got, errConnectionLost)
+		}
+	}
+
+	cmds := node.commands()
+	if countCommand(cmds, "GET k") != 2 || countCommand(cmds, "SET k v") != 1 || countCommand(cmds, "INCR n") != 1 {
+		t.Fatalf("server received %v", cmds)
+	}
+	// 新连接上先认证并选择用户的数据库，然后重放 GET
+	i := len(cmds) - 3
+	if got := cmds[i:]; got[0] != "AUTH secret" || got[1] != "SELECT 3" || got[2] != "GET k" {
+		t.Fatalf("new connection received %v, want AUTH, SELECT and GET", got)
+	}
+}
@@ -0,0 +1,32 @@
+package client
+
+import "strings"
+
+// slotCount redis cluster 的哈希槽数量
+const slotCount = 16384
+
+// crc16 CRC16-CCITT (XMODEM)，redis cluster 用它计算 key 所在的槽
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// keySlot 计算 key 所在的槽，key 中包含非空的 {tag} 时只对 tag 计算
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16([]byte(key)) % slotCount)
+}
@@ -1,9 +1,14 @@
 package connection
 
 import (
+	"errors"
+	"go-redis/config"
+	"go-redis/interface/resp"
 	"go-redis/lib/sync/wait"
+	"go-redis/resp/reply"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,15 +17,60 @@ type Connection struct {
 	waitingReply wait.Wait
 	mu           sync.Mutex
 	selectedDB   int
+	readOnly     bool
+	// authenticated 是否已经通过 AUTH 认证
+	authenticated bool
+	user          string
+	// protocol HELLO 协商的协议版本，0 表示没有协商过，使用 RESP2
+	protocol int
+	id       int64
+	name     string
+	// outBuf 尚未发送的回复，同一批流水线请求的回复在一次写入中发出
+	outBuf      []byte
+	outputLimit config.OutputBufferLimit
+	overLimit   bool // 输出缓冲区超过了硬限制，连接需要关闭
+	// lastActive 最后一次执行命令的时间 (UnixNano)，用于关闭空闲的连接
+	lastActive atomic.Int64
+	// peer 集群中其它结点的连接，通过 CLUSTER PEER 标记
+	peer atomic.Bool
 }
 
+const maxRetainedOutBuf = 64 * 1024
+
+// ErrOutputBufferLimit 输出缓冲区超过 client-output-buffer-limit，客户端读取得太慢
+var ErrOutputBufferLimit = errors.New("output buffer limit exceeded")
+
+var nextID int64
+
 func NewConnection(conn net.Conn) *Connection {
-	return &Connection{
+	c := &Connection{
 		conn: conn,
+		id:   atomic.AddInt64(&nextID, 1),
 	}
+	c.Touch()
+	return c
+}
+
+// Touch 记录连接刚刚执行过命令
+func (c *Connection) Touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+}
+
+// IdleTime 连接距离上一次执行命令的时间
+func (c *Connection) IdleTime() time.Duration {
+	return time.Duration(time.Now().UnixNano() - c.lastActive.Load())
+}
+
+// ID 连接的唯一编号，HELLO 的回复中返回
+func (c *Connection) ID() int64 {
+	return c.id
 }
 
+// RemoteAddr 集群内部的伪连接没有底层的网络连接，返回 nil
 func (c *Connection) RemoteAddr() net.Addr {
+	if c.conn == nil {
+		return nil
+	}
 	return c.conn.RemoteAddr()
 }
 
@@ -44,6 +94,72 @@ func (c *Connection) Write(bytes []byte) error {
 	return err
 }
 
+// SetOutputLimit 设置输出缓冲区的限制，由连接的类别决定
+func (c *Connection) SetOutputLimit(limit config.OutputBufferLimit) {
+	c.mu.Lock()
+	c.outputLimit = limit
+	c.mu.Unlock()
+}
+
+// AppendReply 将回复按连接的协议版本写入输出缓冲区，调用 Flush 后才会发送
+// 超过硬限制时丢弃缓冲区中的回复，下一次 Flush 返回 ErrOutputBufferLimit
+func (c *Connection) AppendReply(r resp.Reply) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.overLimit {
+		return
+	}
+	c.outBuf = reply.AppendReply(c.outBuf, r, c.GetProtocol())
+	if c.outputLimit.Hard > 0 && int64(len(c.outBuf)) > c.outputLimit.Hard {
+		c.overLimit = true
+		c.outBuf = nil
+	}
+}
+
+// OutputLen 输出缓冲区中尚未发送的字节数
+func (c *Connection) OutputLen() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.outBuf)
+}
+
+// Flush 发送输出缓冲区中的所有回复
+// 缓冲区超过软限制时，客户端需要在 SoftSeconds 秒内读完，否则返回 ErrOutputBufferLimit
+func (c *Connection) Flush() error {
+	c.mu.Lock()
+	c.waitingReply.Add(1)
+	defer func() {
+		c.mu.Unlock()
+		c.waitingReply.Done()
+	}()
+	if c.overLimit {
+		return ErrOutputBufferLimit
+	}
+	if len(c.outBuf) == 0 {
+		return nil
+	}
+	limit := c.outputLimit
+	overSoft := limit.Soft > 0 && limit.SoftSeconds > 0 && int64(len(c.outBuf)) > limit.Soft
+	if overSoft {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(time.Duration(limit.SoftSeconds) * time.Second))
+	}
+	_, err := c.conn.Write(c.outBuf)
+	if overSoft {
+		_ = c.conn.SetWriteDeadline(time.Time{})
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = ErrOutputBufferLimit
+		}
+	}
+	// 大的缓冲区不再保留，避免空闲连接长期占用内存
+	if cap(c.outBuf) > maxRetainedOutBuf {
+		c.outBuf = nil
+	} else {
+		c.outBuf = c.outBuf[:0]
+	}
+	return err
+}
+
 func (c *Connection) GetDBIndex() int {
 	return c.selectedDB
 }
@@ -51,3 +167,55 @@ func (c *Connection) GetDBIndex() int {
 func (c *Connection) SelectDB(i int) {
 	c.selectedDB = i
 }
+
+func (c *Connection) SetReadOnly(readOnly bool) {
+	c.readOnly = readOnly
+}
+
+func (c *Connection) IsReadOnly() bool {
+	return c.readOnly
+}
+
+func (c *Connection) SetAuthenticated(authenticated bool) {
+	c.authenticated = authenticated
+}
+
+func (c *Connection) IsAuthenticated() bool {
+	return c.authenticated
+}
+
+func (c *Connection) SetUser(user string) {
+	c.user = user
+}
+
+func (c *Connection) GetUser() string {
+	return c.user
+}
+
+func (c *Connection) SetPeer(peer bool) {
+	c.peer.Store(peer)
+}
+
+func (c *Connection) IsPeer() bool {
+	return c.peer.Load()
+}
+
+func (c *Connection) SetProtocol(protocol int) {
+	c.protocol = protocol
+}
+
+func (c *Connection) GetProtocol() int {
+	if c.protocol == 0 {
+		return reply.Protocol2
+	}
+	return c.protocol
+}
+
+// SetName CLIENT SETNAME 或 HELLO SETNAME 设置的连接名
+func (c *Connection) SetName(name string) {
+	c.name = name
+}
+
+func (c *Connection) GetName() string {
+	return c.name
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"go-redis/acl"
+	"go-redis/interface/resp"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"strings"
+)
+
+/*
+	认证
+	新连接以 default 用户的身份执行命令，default 用户需要密码 (配置了 requirepass 或 ACL 规则) 时，
+	连接在执行 AUTH 成功之前只能执行 AUTH，其它命令返回 NOAUTH
+	--AUTH password           以 default 用户认证
+	--AUTH username password  以 ACL 用户认证
+	--HELLO protover AUTH username password  切换协议的同时认证
+	集群结点之间的请求 (RAFT、CLUSTER APPLY、PREPARE 等) 同样经过 RespHandler，
+	结点以 masteruser (未配置时为 default) 和 masterauth (未配置且没有 aclfile 时使用 requirepass) 认证，
+	之后执行 CLUSTER PEER，出示 cluster-secret 或者以 masteruser 认证的连接才能成为结点之间的连接
+	只有加载 AOF 和结点在本地执行命令时构造的连接不经过 RespHandler，不需要认证
+*/
+
+// exec 检查认证后执行命令
+func (r *RespHandler) exec(client *connection.Connection, args [][]byte) resp.Reply {
+	if len(args) == 0 {
+		return reply.MakeErrReply("ERR empty command")
+	}
+	switch strings.ToLower(string(args[0])) {
+	case "auth":
+		return auth(client, args)
+	case "hello":
+		return r.hello(client, args)
+	}
+	if !isAuthenticated(client) {
+		return reply.MakeErrReply("NOAUTH Authentication required.")
+	}
+	return r.db.Exec(client, args)
+}
+
+func isAuthenticated(client *connection.Connection) bool {
+	return client.IsAuthenticated() || acl.IsNoPass(acl.DefaultUser)
+}
+
+// auth AUTH [username] password
+func auth(client *connection.Connection, args [][]byte) resp.Reply {
+	var user, password string
+	switch len(args) {
+	case 2:
+		user, password = acl.DefaultUser, string(args[1])
+		if acl.IsNoPass(acl.DefaultUser) {
+			return reply.MakeErrReply("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?")
+		}
+	case 3:
+		user, password = string(args[1]), string(args[2])
+	default:
+		return reply.MakeArgNumErrReply("auth")
+	}
+	if errReply := login(client, user, password); errReply != nil {
+		return errReply
+	}
+	return reply.MakeOkReply()
+}
+
+// login 以 user 的身份认证连接，AUTH 和 HELLO AUTH 共用
+// 重新认证后需要重新执行 CLUSTER PEER，结点之间的连接的身份总是与当前的凭据一致
+func login(client *connection.Connection, user string, password string) resp.Reply {
+	if !acl.Authenticate(user, password, client.RemoteAddr().String()) {
+		return reply.MakeErrReply("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	client.SetUser(user)
+	client.SetAuthenticated(true)
+	client.SetPeer(false)
+	return nil
+}
@@ -3,12 +3,12 @@ package handler
 import (
 	"context"
 	"errors"
+	"go-redis/acl"
 	"go-redis/cluster"
 	"go-redis/config"
 	"go-redis/database"
 	databaseface "go-redis/interface/database"
 	"go-redis/lib/logger"
-	"go-redis/lib/sync/atomic"
 	"go-redis/resp/connection"
 	"go-redis/resp/parser"
 	"go-redis/resp/reply"
@@ -16,86 +16,179 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-var (
-	unknownErrReplyBytes = []byte("-ERR unknown\r\n")
+const (
+	unknownErrReply    = "ERR unknown"
+	maxClientsErrReply = "-ERR max number of clients reached\r\n"
 )
 
 type RespHandler struct {
-	activeConn sync.Map
-	closing    atomic.Boolean
-	db         databaseface.Database
+	activeConn     sync.Map
+	clients        atomic.Int64 // activeConn 中的连接数
+	closing        atomic.Bool
+	closeChan      chan struct{}
+	db             databaseface.Database
+	replyBatchSize int
+	maxClients     int64
 }
 
+// reapInterval 检查空闲连接的间隔
+const reapInterval = time.Second
+
+const defaultReplyBatchSize = 64 * 1024
+
 func MakeHandler() *RespHandler {
+	acl.Setup()
 	var db databaseface.Database
 	if config.Properties.Self != "" && len(config.Properties.Peers) > 0 {
 		db = cluster.MakeClusterDatabase()
 	} else {
 		db = database.NewStandaloneDatabase()
 	}
-	return &RespHandler{
-		db: db,
+	replyBatchSize := config.Properties.ReplyBatchSize
+	if replyBatchSize <= 0 {
+		replyBatchSize = defaultReplyBatchSize
+	}
+	r := &RespHandler{
+		closeChan:      make(chan struct{}),
+		db:             db,
+		replyBatchSize: replyBatchSize,
+		maxClients:     int64(config.Properties.MaxClients),
+	}
+	if config.Properties.Timeout > 0 {
+		go r.reapIdleClients(time.Duration(config.Properties.Timeout) * time.Second)
 	}
+	return r
 }
 
+// closeClient 可以重复调用，只有第一次调用会清理连接的状态
 func (r *RespHandler) closeClient(client *connection.Connection) {
 	client.Close()
-	r.db.AfterClientClose(client)
-	r.activeConn.Delete(client)
+	if _, ok := r.activeConn.LoadAndDelete(client); ok {
+		r.clients.Add(-1)
+		r.db.AfterClientClose(client)
+	}
 }
 
-func (r *RespHandler) Handle(ctx context.Context, conn net.Conn) {
-	if r.closing.Get() {
-		conn.Close()
+// newClient 创建连接并加入 activeConn，连接数超过 maxclients 时回复错误并返回 nil，由调用方关闭连接
+func (r *RespHandler) newClient(conn net.Conn) *connection.Connection {
+	if n := r.clients.Add(1); r.maxClients > 0 && n > r.maxClients {
+		r.clients.Add(-1)
+		_, _ = conn.Write([]byte(maxClientsErrReply))
+		logger.Warn("max number of clients reached, reject " + conn.RemoteAddr().String())
+		return nil
 	}
 	client := connection.NewConnection(conn)
+	client.SetUser(acl.DefaultUser)
+	client.SetOutputLimit(config.Properties.GetOutputBufferLimit(config.ClientClassNormal))
 	r.activeConn.Store(client, struct{}{})
-	ch := parser.ParseStream(conn)
-	for payload := range ch {
-		//error
-		if payload.Err != nil {
-			if errors.Is(payload.Err, io.EOF) || errors.Is(payload.Err, io.ErrUnexpectedEOF) ||
-				strings.Contains(payload.Err.Error(), "use of closed network connection") {
-				r.closeClient(client)
-				logger.Info("connection closed: " + client.RemoteAddr().String())
-				return
-			}
+	return client
+}
+
+// serveRequest 执行一个请求，回复写入连接的输出缓冲区
+func (r *RespHandler) serveRequest(client *connection.Connection, args [][]byte) {
+	client.Touch()
+	result := r.exec(client, args)
+	if result == nil {
+		result = reply.MakeErrReply(unknownErrReply)
+	}
+	client.AppendReply(result)
+}
+
+// flush 发送输出缓冲区中的回复，返回错误时需要关闭连接
+func (r *RespHandler) flush(client *connection.Connection) error {
+	err := client.Flush()
+	if errors.Is(err, connection.ErrOutputBufferLimit) {
+		logger.Warn("client " + client.RemoteAddr().String() + " closed for overcoming of output buffer limits")
+	}
+	return err
+}
 
-			// protocol error
-			errReply := reply.MakeErrReply(payload.Err.Error())
-			err := client.Write(errReply.ToBytes())
-			if err != nil {
-				r.closeClient(client)
-				logger.Info("connection closed: " + client.RemoteAddr().String())
-				return
+func (r *RespHandler) Handle(ctx context.Context, conn net.Conn) {
+	if r.closing.Load() {
+		_ = conn.Close()
+		return
+	}
+	client := r.newClient(conn)
+	if client == nil {
+		_ = conn.Close()
+		return
+	}
+	reader := parser.NewRequestReader(conn, int64(config.Properties.ProtoMaxBulkLen), int64(config.Properties.ProtoMaxMultiBulkLen))
+	for {
+		args, err := reader.ReadRequest()
+		if err != nil {
+			if parser.IsProtocolError(err) {
+				// 协议错误之后无法确定下一个请求从哪里开始，回复错误后关闭连接
+				client.AppendReply(reply.MakeErrReply(err.Error()))
+				_ = client.Flush()
+			} else if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) &&
+				!strings.Contains(err.Error(), "use of closed network connection") {
+				logger.Warn("read request failed: " + err.Error())
 			}
-			continue
+			r.closeClient(client)
+			logger.Info("connection closed: " + client.RemoteAddr().String())
+			return
 		}
-
-		if payload.Data == nil {
-			continue
+		if len(args) > 0 {
+			r.serveRequest(client, args)
 		}
 
-		//exec
-		bulkReply, ok := payload.Data.(*reply.MultiBulkReply)
-		if !ok {
-			logger.Info("request data type is not MultiBulkReply")
+		// 缓冲区中还有流水线中的请求时继续执行，回复在这一批请求执行完或者累积到 replyBatchSize 之后一次发出
+		if reader.Buffered() > 0 && client.OutputLen() < r.replyBatchSize {
 			continue
 		}
-		result := r.db.Exec(client, bulkReply.Args)
-		if result == nil {
-			_ = client.Write(unknownErrReplyBytes)
-		} else {
-			_ = client.Write(result.ToBytes())
+		if err := r.flush(client); err != nil {
+			r.closeClient(client)
+			logger.Info("connection closed: " + client.RemoteAddr().String())
+			return
 		}
 	}
 }
 
+// reapIdleClients 关闭空闲超过 timeout 的连接
+// 事件循环不会再处理已经关闭的连接，由这里直接清理连接的状态
+// 集群结点之间的连接 (连接池和复制流) 由对方管理，不受 timeout 限制
+// 只有出示了 cluster-secret 或者以 masteruser 认证后执行 CLUSTER PEER 的连接才是结点之间的连接，
+// 普通客户端不能借此逃避 timeout
+func (r *RespHandler) reapIdleClients(timeout time.Duration) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.closeChan:
+			return
+		case <-ticker.C:
+		}
+		r.activeConn.Range(func(key, value interface{}) bool {
+			c := key.(*connection.Connection)
+			if c.IsPeer() || c.IdleTime() <= timeout {
+				return true
+			}
+			// 先移出 activeConn，下一轮不会重复关闭
+			// Close 要等待正在发送的回复，最多 10 秒，在单独的协程中执行，不耽误其它连接
+			if _, ok := r.activeConn.LoadAndDelete(c); ok {
+				logger.Info("closing idle client " + c.RemoteAddr().String())
+				go func() {
+					_ = c.Close()
+					r.clients.Add(-1)
+					r.db.AfterClientClose(c)
+				}()
+			}
+			return true
+		})
+	}
+}
+
 func (r *RespHandler) Close() error {
+	if r.closing.Swap(true) {
+		return nil
+	}
 	logger.Info("close resp handler")
-	r.closing.Set(true)
+	close(r.closeChan)
 	r.activeConn.Range(func(key, value interface{}) bool {
 		c := key.(*connection.Connection)
 		c.Close()
@@ -0,0 +1,95 @@
+package handler
+
+import (
+	"go-redis/acl"
+	"go-redis/config"
+	"go-redis/lib/utils"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestMain config 包的默认配置没有设置 databases，测试中的服务使用与配置文件相同的默认值
+func TestMain(m *testing.M) {
+	config.Properties.Databases = 16
+	os.Exit(m.Run())
+}
+
+// isActive 连接是否还在 activeConn 中
+func isActive(r *RespHandler, c *connection.Connection) bool {
+	_, ok := r.activeConn.Load(c)
+	return ok
+}
+
+func TestReapIdleClients(t *testing.T) {
+	r := MakeHandler()
+	defer r.Close()
+	idle := makeTestClient(t, r)
+	peer := makeTestClient(t, r)
+	// 与 CLUSTER PEER 检查凭据之后的效果相同
+	peer.SetPeer(true)
+	time.Sleep(20 * time.Millisecond)
+
+	go r.reapIdleClients(10 * time.Millisecond)
+	deadline := time.Now().Add(3 * reapInterval)
+	// 连接在单独的协程中关闭，之后才减少连接数
+	for isActive(r, idle) || r.clients.Load() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("idle client was not reaped, %d clients counted", r.clients.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !isActive(r, peer) {
+		t.Fatal("peer link was reaped")
+	}
+}
+
+func TestLoginClearsPeer(t *testing.T) {
+	r := MakeHandler()
+	defer r.Close()
+	if err := acl.SetUser("app", []string{"on", ">secret", "~*", "+@all"}); err != nil {
+		t.Fatal(err)
+	}
+	defer acl.Setup()
+	c := makeTestClient(t, r)
+	c.SetPeer(true)
+	// 以其它用户重新认证后不再是结点之间的连接
+	if result := r.exec(c, utils.ToCmdLine("AUTH", "app", "secret")); reply.IsErrReply(result) {
+		t.Fatalf("AUTH = %q", result.ToBytes())
+	}
+	if c.IsPeer() {
+		t.Fatal("connection is still a peer after AUTH")
+	}
+}
+
+func TestMaxClients(t *testing.T) {
+	maxClients := config.Properties.MaxClients
+	config.Properties.MaxClients = 1
+	defer func() {
+		config.Properties.MaxClients = maxClients
+	}()
+	r := MakeHandler()
+	defer r.Close()
+	makeTestClient(t, r)
+
+	server, peer := net.Pipe()
+	defer peer.Close()
+	received := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 128)
+		n, _ := peer.Read(buf)
+		received <- string(buf[:n])
+	}()
+	if c := r.newClient(server); c != nil {
+		t.Fatal("client accepted over maxclients")
+	}
+	if got := <-received; got != maxClientsErrReply {
+		t.Fatalf("got %q, want %q", got, maxClientsErrReply)
+	}
+	if n := r.clients.Load(); n != 1 {
+		t.Fatalf("%d clients counted, want 1", n)
+	}
+}
@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"go-redis/cluster"
+	"go-redis/config"
+	"go-redis/interface/resp"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"strconv"
+	"strings"
+)
+
+// serverVersion HELLO 中返回的版本，客户端据此判断支持的功能
+const serverVersion = "7.0.0"
+
+// hello HELLO [protover [AUTH username password] [SETNAME clientname]]
+// 协商协议版本并返回服务端信息，选项有错误或认证失败时连接的状态不变
+func (r *RespHandler) hello(client *connection.Connection, args [][]byte) resp.Reply {
+	protocol := client.GetProtocol()
+	if len(args) >= 2 {
+		version, err := strconv.Atoi(string(args[1]))
+		if err != nil {
+			return reply.MakeErrReply("ERR Protocol version is not an integer or out of range")
+		}
+		if version != reply.Protocol2 && version != reply.Protocol3 {
+			return reply.MakeErrReply("NOPROTO unsupported protocol version")
+		}
+		protocol = version
+	}
+	var user, password, name string
+	auth, setName := false, false
+	for i := 2; i < len(args); i++ {
+		option := strings.ToLower(string(args[i]))
+		switch {
+		case option == "auth" && i+2 < len(args):
+			auth = true
+			user, password = string(args[i+1]), string(args[i+2])
+			i += 2
+		case option == "setname" && i+1 < len(args):
+			setName = true
+			name = string(args[i+1])
+			i++
+		default:
+			return reply.MakeErrReply("ERR Syntax error in HELLO option '" + string(args[i]) + "'")
+		}
+	}
+	// 先检查所有的选项，认证成功之后不会再失败，连接的用户、名称和协议一起修改
+	if setName && !isValidClientName(name) {
+		return reply.MakeErrReply("ERR Client names cannot contain spaces, newlines or special characters.")
+	}
+	if auth {
+		if errReply := login(client, user, password); errReply != nil {
+			return errReply
+		}
+	}
+	if !isAuthenticated(client) {
+		return reply.MakeErrReply("NOAUTH HELLO must be called with the client already authenticated, " +
+			"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client " +
+			"and select the RESP protocol version at the same time")
+	}
+	if setName {
+		client.SetName(name)
+	}
+	client.SetProtocol(protocol)
+	return r.serverInfo(client)
+}
+
+// isValidClientName 与 redis 相同，名称只能包含 '!' 到 '~' 之间的字符
+func isValidClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// serverInfo HELLO 的回复，RESP2 中为 key value 交替排列的数组
+func (r *RespHandler) serverInfo(client *connection.Connection) resp.Reply {
+	mode, role := "standalone", "master"
+	if _, ok := r.db.(*cluster.ClusterDatabase); ok {
+		mode = "cluster"
+		if config.Properties.ReplicaOf != "" {
+			role = "replica"
+		}
+	}
+	return reply.MakeMapReply([]resp.Reply{
+		reply.MakeBulkReply([]byte("server")),
+		reply.MakeBulkReply([]byte("redis")),
+		reply.MakeBulkReply([]byte("version")),
+		reply.MakeBulkReply([]byte(serverVersion)),
+		reply.MakeBulkReply([]byte("proto")),
+		reply.MakeIntReply(int64(client.GetProtocol())),
+		reply.MakeBulkReply([]byte("id")),
+		reply.MakeIntReply(client.ID()),
+		reply.MakeBulkReply([]byte("mode")),
+		reply.MakeBulkReply([]byte(mode)),
+		reply.MakeBulkReply([]byte("role")),
+		reply.MakeBulkReply([]byte(role)),
+		reply.MakeBulkReply([]byte("modules")),
+		reply.MakeEmptyMultiBulkReply(),
+	})
+}
@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"go-redis/acl"
+	"go-redis/lib/utils"
+	"go-redis/resp/connection"
+	"go-redis/resp/reply"
+	"net"
+	"strings"
+	"testing"
+)
+
+// makeTestClient 创建不经过网络读写的连接，用于直接调用命令的处理函数
+func makeTestClient(t *testing.T, r *RespHandler) *connection.Connection {
+	server, peer := net.Pipe()
+	c := r.newClient(server)
+	t.Cleanup(func() {
+		_ = peer.Close()
+		r.closeClient(c)
+	})
+	return c
+}
+
+func TestHelloValidatesBeforeLogin(t *testing.T) {
+	r := MakeHandler()
+	defer r.Close()
+	// default 用户需要密码，新连接需要认证
+	if err := acl.SetUser(acl.DefaultUser, []string{">default-pass"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := acl.SetUser("app", []string{"on", ">secret", "~*", "+@all"}); err != nil {
+		t.Fatal(err)
+	}
+	defer acl.Setup()
+
+	tests := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{"space in name", []string{"HELLO", "3", "AUTH", "app", "secret", "SETNAME", "bad name"}, "ERR Client names"},
+		{"newline in name", []string{"HELLO", "3", "AUTH", "app", "secret", "SETNAME", "bad\nname"}, "ERR Client names"},
+		{"unknown option", []string{"HELLO", "3", "AUTH", "app", "secret", "SETNAME", "ok", "EXTRA"}, "ERR Syntax error"},
+		{"wrong password", []string{"HELLO", "3", "AUTH", "app", "wrong", "SETNAME", "ok"}, "WRONGPASS"},
+		{"bad protocol", []string{"HELLO", "4", "AUTH", "app", "secret"}, "NOPROTO"},
+		{"not authenticated", []string{"HELLO", "3", "SETNAME", "ok"}, "NOAUTH"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := makeTestClient(t, r)
+			result := r.hello(c, utils.ToCmdLine(tt.args...))
+			if !strings.HasPrefix(string(result.ToBytes()), "-"+tt.err) {
+				t.Fatalf("HELLO = %q, want %s", result.ToBytes(), tt.err)
+			}
+			// 出错时连接的状态不变
+			if c.IsAuthenticated() || c.GetUser() != acl.DefaultUser || c.GetName() != "" || c.GetProtocol() != reply.Protocol2 {
+				t.Fatalf("state changed: authenticated %v, user %q, name %q, protocol %d",
+					c.IsAuthenticated(), c.GetUser(), c.GetName(), c.GetProtocol())
+			}
+		})
+	}
+
+	c := makeTestClient(t, r)
+	if result := r.hello(c, utils.ToCmdLine("HELLO", "3", "AUTH", "app", "secret", "SETNAME", "worker-1")); reply.IsErrReply(result) {
+		t.Fatalf("HELLO = %q", result.ToBytes())
+	}
+	if !c.IsAuthenticated() || c.GetUser() != "app" || c.GetName() != "worker-1" || c.GetProtocol() != reply.Protocol3 {
+		t.Fatalf("state after HELLO: authenticated %v, user %q, name %q, protocol %d",
+			c.IsAuthenticated(), c.GetUser(), c.GetName(), c.GetProtocol())
+	}
+}
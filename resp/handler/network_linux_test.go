@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"bufio"
+	"errors"
+	"go-redis/config"
+	"go-redis/lib/logger"
+	"go-redis/tcp"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+	比较两种网络模型下的请求延迟
+	--goroutine 每个连接一个协程，epoll 由事件循环读取连接，请求在临时的协程中执行
+	--idle 在测量之前建立大量空闲的连接，epoll 模型下它们不占用协程
+*/
+
+const benchIdleConns = 1000
+
+// serveFunc 在 listener 上启动服务直到 closeChan 关闭
+type serveFunc func(listener net.Listener, closeChan <-chan struct{})
+
+func serveGoroutine(listener net.Listener, closeChan <-chan struct{}) {
+	tcp.ListenAndServe(listener, MakeHandler(), closeChan)
+}
+
+func serveEpoll(listener net.Listener, closeChan <-chan struct{}) {
+	_ = tcp.ServeWithEpoll([]net.Listener{listener}, MakeHandler(), 0, closeChan)
+}
+
+func benchmarkNetwork(b *testing.B, serve serveFunc, idle int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	closeChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		serve(listener, closeChan)
+		close(done)
+	}()
+	defer func() {
+		close(closeChan)
+		<-done
+	}()
+	addr := listener.Addr().String()
+
+	for i := 0; i < idle; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+	}
+
+	ping := []byte("*1\r\n$4\r\nPING\r\n")
+	var mu sync.Mutex
+	var failed error
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			defer conn.Close()
+		}
+		br := bufio.NewReader(conn)
+		for pb.Next() {
+			if err == nil {
+				_, err = conn.Write(ping)
+			}
+			var line []byte
+			if err == nil {
+				line, err = br.ReadSlice('\n')
+			}
+			if err == nil && string(line) != "+PONG\r\n" {
+				err = errors.New("unexpected reply " + strconv.Quote(string(line)))
+			}
+			if err != nil {
+				mu.Lock()
+				failed = err
+				mu.Unlock()
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	if failed != nil {
+		b.Fatal(failed)
+	}
+}
+
+func BenchmarkNetworkModel(b *testing.B) {
+	// 每个连接的建立和关闭都会记录日志
+	logger.SetOutput(io.Discard)
+	defer logger.SetOutput(os.Stdout)
+	models := []struct {
+		name  string
+		serve serveFunc
+	}{
+		{"goroutine", serveGoroutine},
+		{"epoll", serveEpoll},
+	}
+	for _, model := range models {
+		b.Run(model.name, func(b *testing.B) {
+			benchmarkNetwork(b, model.serve, 0)
+		})
+		b.Run(model.name+"-idle", func(b *testing.B) {
+			benchmarkNetwork(b, model.serve, benchIdleConns)
+		})
+	}
+}
+
+// startServer 在两种网络模型之一上启动服务，返回地址，测试结束时关闭
+func startServer(t *testing.T, serve serveFunc) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		serve(listener, closeChan)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(closeChan)
+		<-done
+	})
+	return listener.Addr().String()
+}
+
+func TestRequestLimits(t *testing.T) {
+	logger.SetOutput(io.Discard)
+	defer logger.SetOutput(os.Stdout)
+	maxBulkLen, maxMultiBulkLen := config.Properties.ProtoMaxBulkLen, config.Properties.ProtoMaxMultiBulkLen
+	config.Properties.ProtoMaxBulkLen, config.Properties.ProtoMaxMultiBulkLen = 16, 4
+	defer func() {
+		config.Properties.ProtoMaxBulkLen, config.Properties.ProtoMaxMultiBulkLen = maxBulkLen, maxMultiBulkLen
+	}()
+
+	tests := []struct {
+		name    string
+		request string
+		want    string
+	}{
+		{"bulk length", "*2\r\n$3\r\nGET\r\n$17\r\n", "-ERR Protocol error: invalid bulk length\r\n"},
+		{"multibulk count", "*5\r\n", "-ERR Protocol error: invalid multibulk length\r\n"},
+	}
+	for _, model := range []struct {
+		name  string
+		serve serveFunc
+	}{
+		{"goroutine", serveGoroutine},
+		{"epoll", serveEpoll},
+	} {
+		addr := startServer(t, model.serve)
+		for _, tt := range tests {
+			t.Run(model.name+"/"+tt.name, func(t *testing.T) {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+				// 限制之内的请求正常执行，超过限制的请求回复错误后连接被关闭
+				if _, err := conn.Write([]byte("*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$16\r\n" + strings.Repeat("a", 16) + "\r\n" + tt.request)); err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(conn)
+				if err != nil {
+					t.Fatalf("connection not closed: %v, read %q", err, got)
+				}
+				if want := "+OK\r\n" + tt.want; string(got) != want {
+					t.Fatalf("got %q, want %q", got, want)
+				}
+			})
+		}
+	}
+}
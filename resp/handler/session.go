@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"go-redis/config"
+	"go-redis/interface/tcp"
+	"go-redis/lib/logger"
+	"go-redis/resp/connection"
+	"go-redis/resp/parser"
+	"go-redis/resp/reply"
+	"net"
+)
+
+// Open network-model epoll 时由事件循环调用，返回的 Session 解析并执行连接上的请求
+func (r *RespHandler) Open(conn net.Conn) tcp.Session {
+	if r.closing.Load() {
+		return nil
+	}
+	client := r.newClient(conn)
+	if client == nil {
+		return nil
+	}
+	return &respSession{
+		handler: r,
+		client:  client,
+		decoder: parser.NewRequestDecoder(int64(config.Properties.ProtoMaxBulkLen), int64(config.Properties.ProtoMaxMultiBulkLen)),
+	}
+}
+
+// respSession 事件循环中的一个连接，Feed 解析出的请求在下一次 Serve 中按顺序执行
+type respSession struct {
+	handler     *RespHandler
+	client      *connection.Connection
+	decoder     *parser.Decoder
+	requests    [][][]byte
+	protocolErr error
+}
+
+func (s *respSession) Feed(data []byte) (int, bool) {
+	consumed := 0
+	for consumed < len(data) {
+		args, n, err := s.decoder.Decode(data[consumed:])
+		if err != nil {
+			// 协议错误之后的数据无法解析，全部丢弃，执行完之前的请求后回复错误并关闭连接
+			s.protocolErr = err
+			consumed = len(data)
+			break
+		}
+		if n == 0 {
+			break
+		}
+		consumed += n
+		if len(args) > 0 {
+			s.requests = append(s.requests, args)
+		}
+	}
+	return consumed, len(s.requests) > 0 || s.protocolErr != nil
+}
+
+func (s *respSession) Serve() error {
+	r := s.handler
+	for i, args := range s.requests {
+		r.serveRequest(s.client, args)
+		s.requests[i] = nil
+		if s.client.OutputLen() >= r.replyBatchSize {
+			if err := r.flush(s.client); err != nil {
+				return err
+			}
+		}
+	}
+	s.requests = s.requests[:0]
+	if s.protocolErr != nil {
+		s.client.AppendReply(reply.MakeErrReply(s.protocolErr.Error()))
+		_ = s.client.Flush()
+		return s.protocolErr
+	}
+	return r.flush(s.client)
+}
+
+func (s *respSession) Close() {
+	s.handler.closeClient(s.client)
+	logger.Info("connection closed: " + s.client.RemoteAddr().String())
+}
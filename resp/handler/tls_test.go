@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"go-redis/config"
+	"go-redis/resp/client"
+	"go-redis/resp/reply"
+	"go-redis/tcp"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCerts 测试用的 CA 以及由它签发的服务端和客户端证书，都保存为 PEM 文件
+type testCerts struct {
+	caFile, serverCert, serverKey, clientCert, clientKey string
+}
+
+func makeTestCerts(t *testing.T) *testCerts {
+	dir := t.TempDir()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs := &testCerts{caFile: filepath.Join(dir, "ca.crt")}
+	writePEM(t, certs.caFile, "CERTIFICATE", caDER)
+
+	issue := func(name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+		writePEM(t, certFile, "CERTIFICATE", der)
+		writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+		return certFile, keyFile
+	}
+	certs.serverCert, certs.serverKey = issue("server", 2, x509.ExtKeyUsageServerAuth)
+	certs.clientCert, certs.clientKey = issue("client", 3, x509.ExtKeyUsageClientAuth)
+	return certs
+}
+
+func writePEM(t *testing.T, filename string, kind string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der})
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serveTLS 以 tls-auth-clients 为 authClients 的配置启动服务，返回地址，测试结束时关闭
+func serveTLS(t *testing.T, certs *testCerts, authClients string) string {
+	props := &config.ServerProperties{
+		TLSCertFile:    certs.serverCert,
+		TLSKeyFile:     certs.serverKey,
+		TLSCACertFile:  certs.caFile,
+		TLSAuthClients: authClients,
+	}
+	tlsConfig, err := props.ServerTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		tcp.ListenAndServe(tls.NewListener(inner, tlsConfig), MakeHandler(), closeChan)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(closeChan)
+		<-done
+	})
+	return inner.Addr().String()
+}
+
+// clientTLS withCert 为 true 时带上客户端证书
+func clientTLS(t *testing.T, certs *testCerts, withCert bool) *tls.Config {
+	props := &config.ServerProperties{TLSCluster: true, TLSCACertFile: certs.caFile}
+	if withCert {
+		props.TLSCertFile, props.TLSKeyFile = certs.clientCert, certs.clientKey
+	}
+	cfg, err := props.ClientTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// ping 通过 TLS 连接执行 PING，返回是否成功
+func ping(t *testing.T, addr string, tlsConfig *tls.Config) bool {
+	// HELLO 在建立连接时发送，服务端拒绝客户端证书时拨号失败
+	c, err := client.MakeClientWithOptions(addr, client.Options{TLSConfig: tlsConfig, Protocol: reply.Protocol3})
+	if err != nil {
+		return false
+	}
+	c.Start()
+	defer c.Close()
+	result := c.Send([][]byte{[]byte("PING")})
+	status, ok := result.(*reply.StatusReply)
+	return ok && status.Status == "PONG"
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	certs := makeTestCerts(t)
+	cases := []struct {
+		authClients string
+		clientAuth  tls.ClientAuthType
+	}{
+		{"", tls.RequireAndVerifyClientCert},
+		{config.TLSAuthClientsYes, tls.RequireAndVerifyClientCert},
+		{config.TLSAuthClientsOptional, tls.VerifyClientCertIfGiven},
+		{config.TLSAuthClientsNo, tls.NoClientCert},
+	}
+	for _, c := range cases {
+		props := &config.ServerProperties{
+			TLSCertFile:    certs.serverCert,
+			TLSKeyFile:     certs.serverKey,
+			TLSCACertFile:  certs.caFile,
+			TLSAuthClients: c.authClients,
+		}
+		cfg, err := props.ServerTLSConfig()
+		if err != nil {
+			t.Fatalf("tls-auth-clients %q: %v", c.authClients, err)
+		}
+		if cfg.ClientAuth != c.clientAuth {
+			t.Errorf("tls-auth-clients %q: ClientAuth = %v, want %v", c.authClients, cfg.ClientAuth, c.clientAuth)
+		}
+		if (c.clientAuth != tls.NoClientCert) != (cfg.ClientCAs != nil) {
+			t.Errorf("tls-auth-clients %q: ClientCAs loaded = %v", c.authClients, cfg.ClientCAs != nil)
+		}
+	}
+
+	invalid := &config.ServerProperties{
+		TLSCertFile:    certs.serverCert,
+		TLSKeyFile:     certs.serverKey,
+		TLSAuthClients: "maybe",
+	}
+	if _, err := invalid.ServerTLSConfig(); err == nil {
+		t.Error("invalid tls-auth-clients accepted")
+	}
+	noCA := &config.ServerProperties{TLSCertFile: certs.serverCert, TLSKeyFile: certs.serverKey}
+	if _, err := noCA.ServerTLSConfig(); err == nil {
+		t.Error("tls-auth-clients yes without tls-ca-cert-file accepted")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	certs := makeTestCerts(t)
+	cases := []struct {
+		authClients string
+		withCert    bool
+		want        bool
+	}{
+		{config.TLSAuthClientsYes, true, true},
+		{config.TLSAuthClientsYes, false, false},
+		{config.TLSAuthClientsOptional, true, true},
+		{config.TLSAuthClientsOptional, false, true},
+		{config.TLSAuthClientsNo, false, true},
+	}
+	for _, c := range cases {
+		addr := serveTLS(t, certs, c.authClients)
+		if got := ping(t, addr, clientTLS(t, certs, c.withCert)); got != c.want {
+			t.Errorf("tls-auth-clients %s, client certificate %v: ping succeeded = %v, want %v",
+				c.authClients, c.withCert, got, c.want)
+		}
+	}
+}
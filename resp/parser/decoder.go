@@ -0,0 +1,94 @@
+package parser
+
+import "bytes"
+
+/*
+	Decoder 从内存中的数据解析请求，用于事件循环
+	--事件循环每次读到的数据不一定包含完整的请求，数据不完整时 Decode 返回 0，读到更多数据后从头重新解析
+	--请求完整之前只检查头部，不复制参数，声明了很大的参数却迟迟不发送数据的请求只占用读缓冲区
+	--与 NewRequestReader 使用同样的限制，超过限制时返回 ProtocolError
+*/
+
+type Decoder struct {
+	limits
+	spans [][]byte // 解析过程中指向 buf 的参数，复用
+}
+
+// NewRequestDecoder maxBulkLen 和 maxMultiBulkLen 不大于 0 时使用默认值
+func NewRequestDecoder(maxBulkLen int64, maxMultiBulkLen int64) *Decoder {
+	return &Decoder{limits: makeRequestLimits(maxBulkLen, maxMultiBulkLen)}
+}
+
+// Decode 解析 buf 开头的一个请求，返回参数以及请求占用的字节数，请求不完整时返回 0
+// 返回的参数不引用 buf，buf 可以被调用方复用
+func (d *Decoder) Decode(buf []byte) ([][]byte, int, error) {
+	line, pos, err := d.nextLine(buf, 0)
+	if line == nil || err != nil {
+		return nil, 0, err
+	}
+	if line[0] != '*' {
+		args, err := splitArgs(string(trimCRLF(line)))
+		return args, pos, err
+	}
+	argc, err := d.parseMultiBulkHeader(line)
+	if err != nil {
+		return nil, 0, err
+	}
+	spans := d.spans[:0]
+	defer func() {
+		clear(spans)
+		d.spans = spans[:0]
+	}()
+	for i := int64(0); i < argc; i++ {
+		line, pos, err = d.nextLine(buf, pos)
+		if line == nil || err != nil {
+			return nil, 0, err
+		}
+		if line[0] != '$' {
+			return nil, 0, protocolError("expected '$', got '" + string(line[0]) + "'")
+		}
+		bulkLen, err := d.parseBulkHeader(line)
+		if err != nil {
+			return nil, 0, err
+		}
+		if bulkLen < 0 {
+			return nil, 0, protocolError("invalid bulk length")
+		}
+		end := int64(pos) + bulkLen
+		if end+2 > int64(len(buf)) {
+			return nil, 0, nil
+		}
+		if buf[end] != '\r' || buf[end+1] != '\n' {
+			return nil, 0, protocolError("bulk string is not terminated by CRLF")
+		}
+		spans = append(spans, buf[pos:end])
+		pos = int(end) + 2
+	}
+	// 参数会被数据库保存，每个参数单独分配
+	args := make([][]byte, len(spans))
+	for i, span := range spans {
+		args[i] = bytes.Clone(span)
+		if args[i] == nil {
+			args[i] = []byte{}
+		}
+	}
+	return args, pos, nil
+}
+
+// nextLine 从 buf[pos:] 中取出以 \n 结尾的一行，没有完整的一行时返回 nil
+func (d *Decoder) nextLine(buf []byte, pos int) ([]byte, int, error) {
+	i := bytes.IndexByte(buf[pos:], '\n')
+	if i < 0 {
+		// 不完整的行已经超过了限制，不需要等待剩下的数据
+		if len(buf)-pos > d.maxLineLen {
+			_, err := d.checkLineLen(buf[pos:])
+			return nil, 0, err
+		}
+		return nil, 0, nil
+	}
+	line, err := d.checkLineLen(buf[pos : pos+i+1])
+	if err != nil {
+		return nil, 0, err
+	}
+	return line, pos + i + 1, nil
+}
@@ -0,0 +1,60 @@
+package parser
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", []string{}},
+		{"  \t ", []string{}},
+		{"set k v", []string{"set", "k", "v"}},
+		{"  set\tk   v  ", []string{"set", "k", "v"}},
+		{`set k "a b"`, []string{"set", "k", "a b"}},
+		{`set k 'x'`, []string{"set", "k", "x"}},
+		{`set k ""`, []string{"set", "k", ""}},
+		{`set k "\x41\x4a"`, []string{"set", "k", "AJ"}},
+		// 不完整的 \x 转义按普通字符处理
+		{`set k "\x4"`, []string{"set", "k", "x4"}},
+		{`set k "a\n\t\"\\"`, []string{"set", "k", "a\n\t\"\\"}},
+		// 单引号中只有 \' 是转义
+		{`set k 'it\'s \n'`, []string{"set", "k", `it's \n`}},
+		{`set k a"b"`, []string{"set", "k", "ab"}},
+	}
+	for _, tt := range tests {
+		args, err := splitArgs(tt.line)
+		if err != nil {
+			t.Errorf("splitArgs(%q): %v", tt.line, err)
+			continue
+		}
+		if len(args) != len(tt.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", tt.line, args, tt.want)
+			continue
+		}
+		for i := range args {
+			if !bytes.Equal(args[i], []byte(tt.want[i])) {
+				t.Errorf("splitArgs(%q) = %q, want %q", tt.line, args, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestSplitArgsUnbalancedQuotes(t *testing.T) {
+	for _, line := range []string{
+		`set k "a b`,
+		`set k 'x`,
+		`set k "a\"`,
+		// 结束的引号后面必须是空白
+		`set k "a"b`,
+		`set k 'x'y`,
+	} {
+		if _, err := splitArgs(line); err != errUnbalancedQuotes {
+			t.Errorf("splitArgs(%q): got error %v, want %v", line, err, errUnbalancedQuotes)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package parser
+
+import (
+	"bufio"
+	"errors"
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"io"
+	"math"
+	"strconv"
+)
+
+/*
+	Reader 同步的 RESP 解析器
+	--请求和回复的每一行通过 bufio.Reader.ReadSlice 直接在读缓冲区中解析，不为行分配内存
+	--字符串的内容直接读入最终的 []byte，大的字符串由 bufio 绕过缓冲区读取，不会复制两次
+	--参数会被数据库保存 (例如 SET 的值)，所以每个参数单独分配，不复用
+	--超过 bulkChunkSize 的字符串随着数据的到达分块扩容，不会按照头部声明的长度一次分配
+	--NewRequestReader 限制参数的长度、个数以及内联命令的长度，防止恶意的请求耗尽内存
+	--Buffered 返回缓冲区中尚未解析的字节数，大于 0 时说明客户端还有流水线中的请求
+*/
+
+const (
+	readBufferSize = 16 * 1024
+	bulkChunkSize  = 1024 * 1024
+
+	// DefaultMaxBulkLen proto-max-bulk-len 的默认值
+	DefaultMaxBulkLen = 512 * 1024 * 1024
+	// DefaultMaxMultiBulkLen 请求中参数个数的默认上限
+	DefaultMaxMultiBulkLen = 1024 * 1024
+	// maxInlineLen 内联命令以及 * $ 开头的行的最大长度
+	maxInlineLen = 64 * 1024
+	// maxPreallocArgs 按照请求头部声明的参数个数预先分配的上限
+	maxPreallocArgs = 1024
+)
+
+// ProtocolError 请求或回复的格式错误，连接上后续的数据仍然可以继续解析
+type ProtocolError struct {
+	msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "ERR Protocol error: " + e.msg
+}
+
+func protocolError(msg string) error {
+	return &ProtocolError{msg}
+}
+
+// IsProtocolError 是否是格式错误，其它错误都来自底层的连接
+func IsProtocolError(err error) bool {
+	var protocolErr *ProtocolError
+	return errors.As(err, &protocolErr)
+}
+
+type Reader struct {
+	br   *bufio.Reader
+	line []byte // 超过读缓冲区大小的行，复用
+	limits
+}
+
+// limits 请求的大小限制，为 0 表示不限制，Reader 只有 NewRequestReader 设置
+type limits struct {
+	maxBulkLen      int64
+	maxMultiBulkLen int64
+	maxLineLen      int
+}
+
+func makeRequestLimits(maxBulkLen int64, maxMultiBulkLen int64) limits {
+	if maxBulkLen <= 0 {
+		maxBulkLen = DefaultMaxBulkLen
+	}
+	if maxMultiBulkLen <= 0 {
+		maxMultiBulkLen = DefaultMaxMultiBulkLen
+	}
+	return limits{
+		maxBulkLen:      maxBulkLen,
+		maxMultiBulkLen: maxMultiBulkLen,
+		maxLineLen:      maxInlineLen,
+	}
+}
+
+// NewReader 创建一个不限制大小的 Reader，用于读取可信的服务端回复
+func NewReader(rd io.Reader) *Reader {
+	return &Reader{br: bufio.NewReaderSize(rd, readBufferSize)}
+}
+
+// NewRequestReader 创建读取客户端请求的 Reader，maxBulkLen 和 maxMultiBulkLen 不大于 0 时使用默认值
+func NewRequestReader(rd io.Reader, maxBulkLen int64, maxMultiBulkLen int64) *Reader {
+	r := NewReader(rd)
+	r.limits = makeRequestLimits(maxBulkLen, maxMultiBulkLen)
+	return r
+}
+
+// Buffered 已经读入缓冲区但还没有解析的字节数
+func (r *Reader) Buffered() int {
+	return r.br.Buffered()
+}
+
+// ReadRequest 读取一个请求，返回命令的参数
+// 不以 * 开头的行是内联命令，例如 SET a "hello world"，空行返回长度为 0 的参数
+func (r *Reader) ReadRequest() ([][]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if line[0] != '*' {
+		return splitArgs(string(trimCRLF(line)))
+	}
+	argc, err := r.parseMultiBulkHeader(line)
+	if err != nil {
+		return nil, err
+	}
+	// 参数个数由客户端声明，只预分配一部分，其余随着参数的到达扩容
+	args := make([][]byte, 0, min(argc, maxPreallocArgs))
+	for i := int64(0); i < argc; i++ {
+		line, err = r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line[0] != '$' {
+			return nil, protocolError("expected '$', got '" + string(line[0]) + "'")
+		}
+		bulkLen, err := r.parseBulkHeader(line)
+		if err != nil {
+			return nil, err
+		}
+		if bulkLen < 0 {
+			return nil, protocolError("invalid bulk length")
+		}
+		arg, err := r.readBulkBody(bulkLen)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// ReadReply 递归地读取一个完整的回复，数组的元素可以是任意回复
+// *3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n
+// *2\r\n:0\r\n*1\r\n$1\r\na\r\n
+func (r *Reader) ReadReply() (resp.Reply, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, protocolError(string(line))
+	}
+
+	switch line[0] {
+	case '*':
+		argc, err := parseLength(line)
+		if err != nil {
+			return nil, err
+		}
+		// *0\r\n
+		if argc <= 0 {
+			return &reply.EmptyMultiBulkReply{}, nil
+		}
+		replies, err := r.readReplies(argc)
+		if err != nil {
+			return nil, err
+		}
+		allBulk := true
+		for _, rep := range replies {
+			if _, ok := rep.(*reply.BulkReply); !ok {
+				allBulk = false
+			}
+		}
+		// 只包含字符串的数组 (即客户端发送的命令) 仍然解析为 MultiBulkReply
+		if !allBulk {
+			return reply.MakeMultiRawReply(replies), nil
+		}
+		args := make([][]byte, len(replies))
+		for i, rep := range replies {
+			args[i] = rep.(*reply.BulkReply).Arg
+		}
+		return reply.MakeMultiBulkReply(args), nil
+	case '%', '~', '>', '|':
+		// RESP3 的聚合类型: map set push attribute
+		kind := line[0]
+		size, err := parseLength(line)
+		if err != nil || size < 0 {
+			return nil, protocolError(string(line))
+		}
+		n := size
+		if kind == '%' || kind == '|' {
+			n = size * 2
+		}
+		replies, err := r.readReplies(n)
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case '%':
+			return reply.MakeMapReply(replies), nil
+		case '~':
+			return reply.MakeSetReply(replies), nil
+		case '>':
+			return reply.MakePushReply(replies), nil
+		}
+		// 属性之后紧跟着真正的回复
+		rep, err := r.ReadReply()
+		if err != nil {
+			return nil, err
+		}
+		return reply.MakeAttributeReply(reply.MakeMapReply(replies), rep), nil
+	case '$', '=', '!':
+		// $4\r\nPING\r\n
+		kind := line[0]
+		bulkLen, err := r.parseBulkHeader(line)
+		if err != nil {
+			return nil, err
+		}
+		//$-1\r\n
+		if bulkLen < 0 {
+			return &reply.NullBulkReply{}, nil
+		}
+		body, err := r.readBulkBody(bulkLen)
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case '=':
+			// =15\r\ntxt:Some string\r\n
+			if bulkLen < 4 || body[3] != ':' {
+				return nil, protocolError(string(body))
+			}
+			return reply.MakeVerbatimReply(string(body[:3]), body[4:]), nil
+		case '!':
+			return reply.MakeErrReply(string(body)), nil
+		}
+		return reply.MakeBulkReply(body), nil
+	}
+	return parseSingleLineReply(line)
+}
+
+// readReplies 读取聚合类型中的 n 个元素
+func (r *Reader) readReplies(n int64) ([]resp.Reply, error) {
+	replies := make([]resp.Reply, 0, n)
+	for i := int64(0); i < n; i++ {
+		rep, err := r.ReadReply()
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, rep)
+	}
+	return replies, nil
+}
+
+// readLine 读取以 \n 结尾的一行，返回的切片在下一次读取之前有效
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.br.ReadSlice('\n')
+	if err == nil {
+		return r.checkLineLen(line)
+	}
+	if err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	// 行比读缓冲区还长，拼接到 r.line 中
+	r.line = append(r.line[:0], line...)
+	for {
+		if _, err := r.checkLineLen(r.line); err != nil {
+			return nil, err
+		}
+		line, err = r.br.ReadSlice('\n')
+		r.line = append(r.line, line...)
+		if err == nil {
+			return r.checkLineLen(r.line)
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+	}
+}
+
+func (r *limits) checkLineLen(line []byte) ([]byte, error) {
+	if r.maxLineLen <= 0 || len(line) <= r.maxLineLen {
+		return line, nil
+	}
+	switch line[0] {
+	case '*':
+		return nil, protocolError("too big mbulk count string")
+	case '$':
+		return nil, protocolError("too big bulk count string")
+	}
+	return nil, protocolError("too big inline request")
+}
+
+// readBulkBody 读取 n 个字节的字符串以及结尾的 \r\n
+// 超过 bulkChunkSize 的字符串按照实际到达的数据逐步扩容，声明了很大的长度却不发送数据的请求不会占用内存
+func (r *Reader) readBulkBody(n int64) ([]byte, error) {
+	body := make([]byte, 0, min(n, bulkChunkSize))
+	for int64(len(body)) < n {
+		if len(body) == cap(body) {
+			grown := make([]byte, len(body), min(n, int64(cap(body))*2))
+			copy(grown, body)
+			body = grown
+		}
+		chunk := body[len(body):cap(body)]
+		read, err := io.ReadFull(r.br, chunk)
+		body = body[:len(body)+read]
+		if err != nil {
+			return nil, err
+		}
+	}
+	crlf, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(crlf) != 2 || crlf[0] != '\r' {
+		return nil, protocolError("bulk string is not terminated by CRLF")
+	}
+	return body, nil
+}
+
+// parseMultiBulkHeader *3\r\n 中的参数个数
+func (r *limits) parseMultiBulkHeader(line []byte) (int64, error) {
+	argc, err := parseLength(line)
+	if err != nil {
+		return 0, err
+	}
+	if argc < 0 || (r.maxMultiBulkLen > 0 && argc > r.maxMultiBulkLen) {
+		return 0, protocolError("invalid multibulk length")
+	}
+	return argc, nil
+}
+
+// parseBulkHeader $3\r\n 中的字符串长度，-1 表示空值
+func (r *limits) parseBulkHeader(line []byte) (int64, error) {
+	bulkLen, err := parseLength(line)
+	if err != nil {
+		return 0, err
+	}
+	if r.maxBulkLen > 0 && bulkLen > r.maxBulkLen {
+		return 0, protocolError("invalid bulk length")
+	}
+	return bulkLen, nil
+}
+
+// parseLength *3\r\n $3\r\n 中的长度
+func parseLength(line []byte) (int64, error) {
+	length, ok := parseInt(trimCRLF(line)[1:])
+	if !ok || length < -1 {
+		return 0, protocolError("invalid length '" + string(trimCRLF(line)) + "'")
+	}
+	return length, nil
+}
+
+// parseInt 直接解析 []byte 中的十进制整数，避免转换为 string
+func parseInt(b []byte) (int64, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	negative := b[0] == '-'
+	if negative {
+		b = b[1:]
+		if len(b) == 0 {
+			return 0, false
+		}
+	}
+	var n int64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		if n > (math.MaxInt64-int64(c-'0'))/10 {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+	if negative {
+		n = -n
+	}
+	return n, true
+}
+
+func trimCRLF(line []byte) []byte {
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+		if n := len(line); n > 0 && line[n-1] == '\r' {
+			line = line[:n-1]
+		}
+	}
+	return line
+}
+
+// +OK -err :5\r\n 以及 RESP3 的 _ , # (
+func parseSingleLineReply(line []byte) (resp.Reply, error) {
+	str := string(trimCRLF(line))
+	var result resp.Reply
+	switch line[0] {
+	case '+':
+		result = reply.MakeStatusReply(str[1:])
+	case '-':
+		result = reply.MakeErrReply(str[1:])
+	case ':':
+		val, err := strconv.ParseInt(str[1:], 10, 64)
+		if err != nil {
+			return nil, protocolError(str)
+		}
+		result = reply.MakeIntReply(val)
+	case '_':
+		result = reply.MakeNullReply()
+	case ',':
+		val, err := parseDouble(str[1:])
+		if err != nil {
+			return nil, protocolError(str)
+		}
+		result = reply.MakeDoubleReply(val)
+	case '#':
+		switch str[1:] {
+		case "t":
+			result = reply.MakeBooleanReply(true)
+		case "f":
+			result = reply.MakeBooleanReply(false)
+		default:
+			return nil, protocolError(str)
+		}
+	case '(':
+		result = reply.MakeBigNumberReply(str[1:])
+	default:
+		return nil, protocolError("unknown reply type " + strconv.Quote(str))
+	}
+	return result, nil
+}
+
+// parseDouble 除了 strconv 支持的格式外还有 inf -inf nan
+func parseDouble(s string) (float64, error) {
+	switch s {
+	case "inf":
+		return math.Inf(1), nil
+	case "-inf":
+		return math.Inf(-1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
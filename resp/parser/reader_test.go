@@ -0,0 +1,219 @@
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"go-redis/interface/resp"
+	"go-redis/resp/reply"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+/*
+	legacyParseStream 是 Reader 之前的解析器 (git show 786b89e:resp/parser/parser.go)，作为基准测试的对照
+	--每个回复都经过 channel 交给读取方，解析协程和读取方之间需要调度
+	--每一行都由 ReadBytes 新分配，长度经过 string 转换后解析
+	只保留了 RESP2 的部分，RESP3 的类型和内联命令不影响这里的测试数据
+*/
+
+func legacyParseStream(reader io.Reader) <-chan *Payload {
+	ch := make(chan *Payload)
+	go func() {
+		bufReader := bufio.NewReader(reader)
+		for {
+			result, ioErr, err := legacyReadReply(bufReader)
+			if err != nil {
+				ch <- &Payload{nil, err}
+				if ioErr {
+					close(ch)
+					return
+				}
+				continue
+			}
+			ch <- &Payload{Data: result}
+		}
+	}()
+	return ch
+}
+
+// legacyReadReply 返回值 (回复， 是否有io错误， error)
+func legacyReadReply(bufReader *bufio.Reader) (resp.Reply, bool, error) {
+	msg, err := bufReader.ReadBytes('\n')
+	if err != nil {
+		return nil, true, err
+	}
+	if len(msg) < 3 || msg[len(msg)-2] != '\r' {
+		return nil, false, errors.New("protocol error: " + string(msg))
+	}
+	switch msg[0] {
+	case '*':
+		argc, err := legacyParseLength(msg)
+		if err != nil {
+			return nil, false, err
+		}
+		if argc <= 0 {
+			return &reply.EmptyMultiBulkReply{}, false, nil
+		}
+		replies := make([]resp.Reply, 0, argc)
+		for i := int64(0); i < argc; i++ {
+			r, ioErr, err := legacyReadReply(bufReader)
+			if err != nil {
+				return nil, ioErr, err
+			}
+			replies = append(replies, r)
+		}
+		allBulk := true
+		for _, r := range replies {
+			if _, ok := r.(*reply.BulkReply); !ok {
+				allBulk = false
+			}
+		}
+		if !allBulk {
+			return reply.MakeMultiRawReply(replies), false, nil
+		}
+		args := make([][]byte, len(replies))
+		for i, r := range replies {
+			args[i] = r.(*reply.BulkReply).Arg
+		}
+		return reply.MakeMultiBulkReply(args), false, nil
+	case '$':
+		bulkLen, err := legacyParseLength(msg)
+		if err != nil {
+			return nil, false, err
+		}
+		if bulkLen < 0 {
+			return &reply.NullBulkReply{}, false, nil
+		}
+		body := make([]byte, bulkLen+2)
+		if _, err := io.ReadFull(bufReader, body); err != nil {
+			return nil, true, err
+		}
+		if body[bulkLen] != '\r' || body[bulkLen+1] != '\n' {
+			return nil, false, errors.New("protocol error: " + string(body))
+		}
+		return reply.MakeBulkReply(body[:bulkLen]), false, nil
+	}
+	str := strings.TrimSuffix(string(msg), "\r\n")
+	switch msg[0] {
+	case '+':
+		return reply.MakeStatusReply(str[1:]), false, nil
+	case '-':
+		return reply.MakeErrReply(str[1:]), false, nil
+	case ':':
+		val, err := strconv.ParseInt(str[1:], 10, 64)
+		if err != nil {
+			return nil, false, errors.New("protocol error: " + string(msg))
+		}
+		return reply.MakeIntReply(val), false, nil
+	}
+	return nil, false, nil
+}
+
+func legacyParseLength(msg []byte) (int64, error) {
+	length, err := strconv.ParseInt(string(msg[1:len(msg)-2]), 10, 64)
+	if err != nil || length < -1 {
+		return 0, errors.New("protocol error: " + string(msg))
+	}
+	return length, nil
+}
+
+// benchReplies 一批常见的回复: 状态、整数、字符串和数组
+func benchReplies() []byte {
+	args := make([][]byte, 10)
+	for i := range args {
+		args[i] = bytes.Repeat([]byte{'a' + byte(i)}, 16)
+	}
+	buf := make([]byte, 0)
+	buf = append(buf, reply.MakeOkReply().ToBytes()...)
+	buf = append(buf, reply.MakeIntReply(12345).ToBytes()...)
+	buf = append(buf, reply.MakeBulkReply([]byte("hello world")).ToBytes()...)
+	buf = append(buf, reply.MakeMultiBulkReply(args).ToBytes()...)
+	return buf
+}
+
+const benchRepliesCount = 4
+
+func TestReadReplyUnknownType(t *testing.T) {
+	r := NewReader(bytes.NewReader([]byte("?what\r\n+OK\r\n")))
+	if _, err := r.ReadReply(); !IsProtocolError(err) {
+		t.Fatalf("unknown type byte: got error %v, want a protocol error", err)
+	}
+	// 格式错误之后仍然可以继续解析
+	rep, err := r.ReadReply()
+	if err != nil {
+		t.Fatalf("read after protocol error: %v", err)
+	}
+	if got := string(rep.ToBytes()); got != "+OK\r\n" {
+		t.Fatalf("got %q, want +OK", got)
+	}
+}
+
+// BenchmarkParseStream 原来的解析器，BenchmarkReader 与它对比
+func BenchmarkParseStream(b *testing.B) {
+	sample := benchReplies()
+	data := bytes.Repeat(sample, b.N)
+	b.SetBytes(int64(len(sample)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	ch := legacyParseStream(bytes.NewReader(data))
+	for i := 0; i < b.N*benchRepliesCount; i++ {
+		payload := <-ch
+		if payload.Err != nil {
+			b.Fatal(payload.Err)
+		}
+	}
+}
+
+func BenchmarkReader(b *testing.B) {
+	sample := benchReplies()
+	data := bytes.Repeat(sample, b.N)
+	b.SetBytes(int64(len(sample)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	r := NewReader(bytes.NewReader(data))
+	for i := 0; i < b.N*benchRepliesCount; i++ {
+		if _, err := r.ReadReply(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchRequest 一个 SET 请求
+func benchRequest() []byte {
+	return reply.MakeMultiBulkReply([][]byte{
+		[]byte("SET"), []byte("key:000001"), bytes.Repeat([]byte{'v'}, 64),
+	}).ToBytes()
+}
+
+// BenchmarkParseRequestStream 原来的服务端通过 channel 读取请求
+func BenchmarkParseRequestStream(b *testing.B) {
+	sample := benchRequest()
+	data := bytes.Repeat(sample, b.N)
+	b.SetBytes(int64(len(sample)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	ch := legacyParseStream(bytes.NewReader(data))
+	for i := 0; i < b.N; i++ {
+		payload := <-ch
+		if payload.Err != nil {
+			b.Fatal(payload.Err)
+		}
+	}
+}
+
+func BenchmarkReadRequest(b *testing.B) {
+	sample := benchRequest()
+	data := bytes.Repeat(sample, b.N)
+	b.SetBytes(int64(len(sample)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	r := NewRequestReader(bytes.NewReader(data), 0, 0)
+	for i := 0; i < b.N; i++ {
+		if _, err := r.ReadRequest(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
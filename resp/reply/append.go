@@ -0,0 +1,76 @@
+package reply
+
+import (
+	"go-redis/interface/resp"
+	"strconv"
+)
+
+// AppendReply 将回复按协议版本编码后追加到 buf 并返回新的 buf
+// 常用的回复直接编码到 buf 中，不产生中间的字符串，其它回复使用 ToBytes 或 ToResp3Bytes
+func AppendReply(buf []byte, r resp.Reply, protocol int) []byte {
+	switch v := r.(type) {
+	case *BulkReply:
+		if v.Arg == nil {
+			return appendNull(buf, protocol)
+		}
+		return appendBulk(buf, v.Arg)
+	case *MultiBulkReply:
+		buf = appendHeader(buf, '*', len(v.Args))
+		for _, arg := range v.Args {
+			if arg == nil {
+				buf = appendNull(buf, protocol)
+				continue
+			}
+			buf = appendBulk(buf, arg)
+		}
+		return buf
+	case *MultiRawReply:
+		buf = appendHeader(buf, '*', len(v.Replies))
+		for _, child := range v.Replies {
+			buf = AppendReply(buf, child, protocol)
+		}
+		return buf
+	case *IntReply:
+		buf = append(buf, ':')
+		buf = strconv.AppendInt(buf, v.Code, 10)
+		return append(buf, CRLF...)
+	case *StatusReply:
+		buf = append(buf, '+')
+		buf = append(buf, v.Status...)
+		return append(buf, CRLF...)
+	case *StandardErrReply:
+		buf = append(buf, '-')
+		buf = append(buf, v.Status...)
+		return append(buf, CRLF...)
+	}
+	return append(buf, ToProtocolBytes(r, protocol)...)
+}
+
+// appendHeader *3\r\n $5\r\n 等以长度开头的行
+func appendHeader(buf []byte, prefix byte, n int) []byte {
+	buf = append(buf, prefix)
+	buf = strconv.AppendInt(buf, int64(n), 10)
+	return append(buf, CRLF...)
+}
+
+func appendBulk(buf []byte, arg []byte) []byte {
+	buf = appendHeader(buf, '$', len(arg))
+	buf = append(buf, arg...)
+	return append(buf, CRLF...)
+}
+
+func appendNull(buf []byte, protocol int) []byte {
+	if protocol == Protocol3 {
+		return append(buf, nullBytes...)
+	}
+	return append(buf, nullBulkBytes...)
+}
+
+// bulksLen 估算一组字符串编码后的长度，用于一次性分配 ToBytes 的结果
+func bulksLen(args [][]byte) int {
+	n := 16
+	for _, arg := range args {
+		n += len(arg) + 16
+	}
+	return n
+}
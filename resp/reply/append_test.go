@@ -0,0 +1,56 @@
+package reply
+
+import (
+	"bytes"
+	"go-redis/interface/resp"
+	"testing"
+)
+
+func benchReplies() []resp.Reply {
+	args := make([][]byte, 10)
+	for i := range args {
+		args[i] = bytes.Repeat([]byte{'a' + byte(i)}, 16)
+	}
+	return []resp.Reply{
+		MakeOkReply(),
+		MakeIntReply(12345),
+		MakeBulkReply([]byte("hello world")),
+		MakeMultiBulkReply(args),
+	}
+}
+
+func TestAppendReplyMatchesToBytes(t *testing.T) {
+	for _, r := range benchReplies() {
+		if got, want := AppendReply(nil, r, Protocol2), r.ToBytes(); !bytes.Equal(got, want) {
+			t.Errorf("AppendReply = %q, ToBytes = %q", got, want)
+		}
+	}
+}
+
+// BenchmarkToBytes 每个回复单独编码后写入输出缓冲区
+func BenchmarkToBytes(b *testing.B) {
+	replies := benchReplies()
+	buf := make([]byte, 0, 4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf = buf[:0]
+		for _, r := range replies {
+			buf = append(buf, r.ToBytes()...)
+		}
+	}
+}
+
+// BenchmarkAppendReply 回复直接编码到输出缓冲区
+func BenchmarkAppendReply(b *testing.B) {
+	replies := benchReplies()
+	buf := make([]byte, 0, 4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf = buf[:0]
+		for _, r := range replies {
+			buf = AppendReply(buf, r, Protocol2)
+		}
+	}
+}
@@ -1,14 +1,11 @@
 package reply
 
 import (
-	"bytes"
 	"go-redis/interface/resp"
-	"strconv"
 )
 
 var (
-	nullBulkReplyBytes = []byte("$-1")
-	CRLF               = "\r\n"
+	CRLF = "\r\n"
 )
 
 /*
@@ -40,10 +37,7 @@ type BulkReply struct {
 }
 
 func (b *BulkReply) ToBytes() []byte {
-	if len(b.Arg) == 0 {
-		return nullBulkReplyBytes
-	}
-	return []byte("$" + strconv.Itoa(len(b.Arg)) + CRLF + string(b.Arg) + CRLF)
+	return AppendReply(make([]byte, 0, len(b.Arg)+16), b, Protocol2)
 }
 
 func MakeBulkReply(arg []byte) *BulkReply {
@@ -56,30 +50,31 @@ type MultiBulkReply struct {
 }
 
 func (m *MultiBulkReply) ToBytes() []byte {
-	argLen := len(m.Args)
-	if argLen == 0 {
-		return nullBulkReplyBytes
-	}
-	var buf bytes.Buffer
-	buf.WriteString("*" + strconv.Itoa(argLen) + CRLF)
-	for _, arg := range m.Args {
-		if arg == nil {
-			buf.WriteString(string(nullBulkReplyBytes) + CRLF)
-		}
-		buf.WriteString("$" + strconv.Itoa(len(arg)) + CRLF + string(arg) + CRLF)
-	}
-	return buf.Bytes()
+	return AppendReply(make([]byte, 0, bulksLen(m.Args)), m, Protocol2)
 }
 func MakeMultiBulkReply(args [][]byte) *MultiBulkReply {
 	return &MultiBulkReply{args}
 }
 
+// MultiRawReply 元素可以是任意回复的数组，例如 SCAN 的回复
+type MultiRawReply struct {
+	Replies []resp.Reply
+}
+
+func (m *MultiRawReply) ToBytes() []byte {
+	return AppendReply(nil, m, Protocol2)
+}
+
+func MakeMultiRawReply(replies []resp.Reply) *MultiRawReply {
+	return &MultiRawReply{Replies: replies}
+}
+
 type StatusReply struct {
 	Status string
 }
 
 func (s *StatusReply) ToBytes() []byte {
-	return []byte("+" + s.Status + CRLF)
+	return AppendReply(make([]byte, 0, len(s.Status)+3), s, Protocol2)
 }
 func MakeStatusReply(status string) *StatusReply {
 	return &StatusReply{status}
@@ -90,7 +85,7 @@ type IntReply struct {
 }
 
 func (i *IntReply) ToBytes() []byte {
-	return []byte(":" + strconv.FormatInt(i.Code, 64) + CRLF)
+	return AppendReply(make([]byte, 0, 24), i, Protocol2)
 }
 func MakeIntReply(code int64) *IntReply {
 	return &IntReply{code}
@@ -105,7 +100,7 @@ func (s *StandardErrReply) Error() string {
 }
 
 func (s *StandardErrReply) ToBytes() []byte {
-	return []byte("-" + s.Status + CRLF)
+	return AppendReply(make([]byte, 0, len(s.Status)+3), s, Protocol2)
 }
 
 func MakeErrReply(status string) *StandardErrReply {
@@ -0,0 +1,21 @@
+package reply
+
+import "testing"
+
+func TestIntReplyBase10(t *testing.T) {
+	cases := []struct {
+		code int64
+		want string
+	}{
+		{0, ":0\r\n"},
+		{10, ":10\r\n"},
+		{100, ":100\r\n"},
+		{-1, ":-1\r\n"},
+		{1 << 40, ":1099511627776\r\n"},
+	}
+	for _, c := range cases {
+		if got := string(MakeIntReply(c.code).ToBytes()); got != c.want {
+			t.Errorf("MakeIntReply(%d) = %q, want %q", c.code, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package reply
+
+import (
+	"bytes"
+	"go-redis/interface/resp"
+	"math"
+	"strconv"
+)
+
+/*
+	RESP3
+	在 RESP2 的基础上增加的类型，客户端通过 HELLO 3 切换协议
+	--Null        _\r\n
+	--Double      ,1.23\r\n  ,inf\r\n  ,-inf\r\n  ,nan\r\n
+	--Boolean     #t\r\n  #f\r\n
+	--BigNumber   (3492890328409238509324850943850943825024385\r\n
+	--Verbatim    =15\r\ntxt:Some string\r\n  前 3 个字节为格式，例如 txt mkd
+	--Map         %2\r\n 后面跟 2 对 key value
+	--Set         ~3\r\n 后面跟 3 个元素
+	--Attribute   |1\r\n 后面跟 1 对 key value，然后是真正的回复
+	--Push        >3\r\n 服务端主动推送的消息，不对应任何请求
+	--BlobError   !21\r\nSYNTAX invalid syntax\r\n
+	这些回复的 ToBytes 返回 RESP2 中的等价编码，RESP2 的连接不受影响
+*/
+
+// 协议版本
+const (
+	Protocol2 = 2
+	Protocol3 = 3
+)
+
+var nullBytes = []byte("_\r\n")
+
+// Resp3Reply 在 RESP3 中编码不同的回复
+type Resp3Reply interface {
+	resp.Reply
+	ToResp3Bytes() []byte
+}
+
+// ToProtocolBytes 按连接的协议版本编码回复
+func ToProtocolBytes(r resp.Reply, protocol int) []byte {
+	if protocol == Protocol3 {
+		if r3, ok := r.(Resp3Reply); ok {
+			return r3.ToResp3Bytes()
+		}
+	}
+	return r.ToBytes()
+}
+
+func writeReplies(buf *bytes.Buffer, replies []resp.Reply, protocol int) {
+	for _, r := range replies {
+		buf.Write(ToProtocolBytes(r, protocol))
+	}
+}
+
+// RESP2 中已有的回复在 RESP3 中的编码: 空值统一为 _，数组的元素按 RESP3 编码
+
+func (n *NullBulkReply) ToResp3Bytes() []byte {
+	return nullBytes
+}
+
+func (b *BulkReply) ToResp3Bytes() []byte {
+	if b.Arg == nil {
+		return nullBytes
+	}
+	return b.ToBytes()
+}
+
+func (m *MultiBulkReply) ToResp3Bytes() []byte {
+	return AppendReply(make([]byte, 0, bulksLen(m.Args)), m, Protocol3)
+}
+
+func (m *MultiRawReply) ToResp3Bytes() []byte {
+	return AppendReply(nil, m, Protocol3)
+}
+
+// NullReply 空值，RESP2 中为 $-1
+type NullReply struct {
+}
+
+func (n *NullReply) ToBytes() []byte {
+	return nullBulkBytes
+}
+
+func (n *NullReply) ToResp3Bytes() []byte {
+	return nullBytes
+}
+
+var theNullReply = &NullReply{}
+
+func MakeNullReply() *NullReply {
+	return theNullReply
+}
+
+// DoubleReply 浮点数，RESP2 中为字符串
+type DoubleReply struct {
+	Value float64
+}
+
+// FormatDouble 与 redis 相同的浮点数格式: inf -inf nan 以及最短的十进制表示
+func FormatDouble(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "inf"
+	case math.IsInf(value, -1):
+		return "-inf"
+	case math.IsNaN(value):
+		return "nan"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (d *DoubleReply) ToBytes() []byte {
+	s := FormatDouble(d.Value)
+	return []byte("$" + strconv.Itoa(len(s)) + CRLF + s + CRLF)
+}
+
+func (d *DoubleReply) ToResp3Bytes() []byte {
+	return []byte("," + FormatDouble(d.Value) + CRLF)
+}
+
+func MakeDoubleReply(value float64) *DoubleReply {
+	return &DoubleReply{value}
+}
+
+// BooleanReply 布尔值，RESP2 中为整数 1 和 0
+type BooleanReply struct {
+	Value bool
+}
+
+func (b *BooleanReply) ToBytes() []byte {
+	if b.Value {
+		return []byte(":1" + CRLF)
+	}
+	return []byte(":0" + CRLF)
+}
+
+func (b *BooleanReply) ToResp3Bytes() []byte {
+	if b.Value {
+		return []byte("#t" + CRLF)
+	}
+	return []byte("#f" + CRLF)
+}
+
+var (
+	theTrueReply  = &BooleanReply{true}
+	theFalseReply = &BooleanReply{false}
+)
+
+func MakeBooleanReply(value bool) *BooleanReply {
+	if value {
+		return theTrueReply
+	}
+	return theFalseReply
+}
+
+// BigNumberReply 任意精度的整数，RESP2 中为字符串
+type BigNumberReply struct {
+	Value string
+}
+
+func (b *BigNumberReply) ToBytes() []byte {
+	return []byte("$" + strconv.Itoa(len(b.Value)) + CRLF + b.Value + CRLF)
+}
+
+func (b *BigNumberReply) ToResp3Bytes() []byte {
+	return []byte("(" + b.Value + CRLF)
+}
+
+func MakeBigNumberReply(value string) *BigNumberReply {
+	return &BigNumberReply{value}
+}
+
+// VerbatimReply 带格式的字符串，例如 INFO 的 txt，RESP2 中为字符串
+type VerbatimReply struct {
+	Format string // 3 个字节
+	Text   []byte
+}
+
+func (v *VerbatimReply) ToBytes() []byte {
+	return MakeBulkReply(v.Text).ToBytes()
+}
+
+func (v *VerbatimReply) ToResp3Bytes() []byte {
+	return []byte("=" + strconv.Itoa(len(v.Format)+1+len(v.Text)) + CRLF + v.Format + ":" + string(v.Text) + CRLF)
+}
+
+func MakeVerbatimReply(format string, text []byte) *VerbatimReply {
+	return &VerbatimReply{Format: format, Text: text}
+}
+
+// MapReply 键值对，RESP2 中为 key value 交替排列的数组
+type MapReply struct {
+	Pairs []resp.Reply // key value 交替排列
+}
+
+func (m *MapReply) ToBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(m.Pairs)) + CRLF)
+	writeReplies(&buf, m.Pairs, Protocol2)
+	return buf.Bytes()
+}
+
+func (m *MapReply) ToResp3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("%" + strconv.Itoa(len(m.Pairs)/2) + CRLF)
+	writeReplies(&buf, m.Pairs, Protocol3)
+	return buf.Bytes()
+}
+
+// Len 键值对的数量
+func (m *MapReply) Len() int {
+	return len(m.Pairs) / 2
+}
+
+func MakeMapReply(pairs []resp.Reply) *MapReply {
+	return &MapReply{Pairs: pairs}
+}
+
+// SetReply 无序集合，RESP2 中为数组
+type SetReply struct {
+	Members []resp.Reply
+}
+
+func (s *SetReply) ToBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(s.Members)) + CRLF)
+	writeReplies(&buf, s.Members, Protocol2)
+	return buf.Bytes()
+}
+
+func (s *SetReply) ToResp3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("~" + strconv.Itoa(len(s.Members)) + CRLF)
+	writeReplies(&buf, s.Members, Protocol3)
+	return buf.Bytes()
+}
+
+func MakeSetReply(members []resp.Reply) *SetReply {
+	return &SetReply{Members: members}
+}
+
+// AttributeReply 附带属性的回复，RESP2 中只发送回复本身
+type AttributeReply struct {
+	Attributes *MapReply
+	Reply      resp.Reply
+}
+
+func (a *AttributeReply) ToBytes() []byte {
+	return a.Reply.ToBytes()
+}
+
+func (a *AttributeReply) ToResp3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("|" + strconv.Itoa(a.Attributes.Len()) + CRLF)
+	writeReplies(&buf, a.Attributes.Pairs, Protocol3)
+	buf.Write(ToProtocolBytes(a.Reply, Protocol3))
+	return buf.Bytes()
+}
+
+func MakeAttributeReply(attributes *MapReply, r resp.Reply) *AttributeReply {
+	return &AttributeReply{Attributes: attributes, Reply: r}
+}
+
+// PushReply 服务端推送的消息，第一个元素为消息的类型，RESP2 中为数组
+type PushReply struct {
+	Items []resp.Reply
+}
+
+func (p *PushReply) ToBytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(p.Items)) + CRLF)
+	writeReplies(&buf, p.Items, Protocol2)
+	return buf.Bytes()
+}
+
+func (p *PushReply) ToResp3Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(">" + strconv.Itoa(len(p.Items)) + CRLF)
+	writeReplies(&buf, p.Items, Protocol3)
+	return buf.Bytes()
+}
+
+func MakePushReply(items []resp.Reply) *PushReply {
+	return &PushReply{Items: items}
+}
@@ -59,7 +59,6 @@ func (handler *EchoHandler) Handle(ctx context.Context, conn net.Conn) {
 		conn.Write(b)
 		client.Waiting.Done()
 	}
-	handler.activeConn.Delete(client)
 }
 
 func (handler *EchoHandler) Close() error {
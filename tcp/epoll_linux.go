@@ -0,0 +1,515 @@
+package tcp
+
+import (
+	"errors"
+	"go-redis/interface/tcp"
+	"go-redis/lib/logger"
+	"go-redis/lib/sync/atomic"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+/*
+	基于 epoll 的事件循环，network-model epoll 时使用
+	--空闲的连接不占用协程，适合连接很多而每个连接上请求不频繁的场景
+	--每个 listener 一个协程 Accept，新连接的 fd 复制一份脱离 Go 的 netpoller，轮流分配给各个事件循环
+	--事件循环使用 EPOLLONESHOT，连接可读时以非阻塞的方式读一次，交给 Session 解析出完整的请求
+	--连接的读缓冲区只保存不完整的请求，其余的数据直接在事件循环共用的缓冲区中解析
+	--请求在临时的协程中执行并发送回复，执行完之后才重新监听可读事件，同一个连接上的请求按顺序执行，
+	  执行命令时的阻塞 (例如集群中转发请求) 不影响同一个事件循环上的其它连接
+	--写入时遇到 EAGAIN 用 ppoll 等待连接可写，等待的时长由 SetWriteDeadline 决定
+*/
+
+const (
+	loopReadSize = 64 * 1024
+	maxEvents    = 256
+	// epoll_wait 的超时，毫秒，事件循环据此检查是否需要退出
+	pollTimeout = 1000
+
+	connEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+)
+
+// ListenAndServeWithEpoll 普通连接和 unix socket 由事件循环处理，TLS 连接需要 handler 同时实现 tcp.Handler，每个连接一个协程
+func ListenAndServeWithEpoll(cfg *Config, handler tcp.EventHandler) error {
+	var tlsHandler tcp.Handler
+	if cfg.TLSAddress != "" {
+		h, ok := handler.(tcp.Handler)
+		if !ok {
+			return errors.New("handler does not support tls connections")
+		}
+		tlsHandler = h
+		if cfg.Address == "" && cfg.UnixSocket == "" {
+			return ListenAndServeWithSignal(cfg, tlsHandler)
+		}
+	}
+	closeChan := notifyClose()
+	listeners, err := listen(cfg)
+	if err != nil {
+		return err
+	}
+	if len(listeners) == 0 {
+		return errors.New("no address to listen")
+	}
+	logger.Info("serve with epoll")
+	tlsListener, err := listenTLS(cfg)
+	if err != nil {
+		closeListeners(listeners)
+		return err
+	}
+	if tlsListener == nil {
+		return ServeWithEpoll(listeners, handler, cfg.EventLoops, closeChan)
+	}
+	tlsDone := new(sync.WaitGroup)
+	tlsDone.Add(1)
+	go func() {
+		defer tlsDone.Done()
+		acceptLoop(tlsListener, tlsHandler, tlsDone)
+	}()
+	err = ServeWithEpoll(listeners, handler, cfg.EventLoops, closeChan)
+	// ServeWithEpoll 返回时已经关闭了 handler，TLS 连接也随之关闭
+	_ = tlsListener.Close()
+	tlsDone.Wait()
+	return err
+}
+
+// ServeWithEpoll 在所有 listener 上接受连接并交给 loops 个事件循环处理，直到 closeChan 关闭或者任意一个 listener 出错
+func ServeWithEpoll(listeners []net.Listener, handler tcp.EventHandler, loops int, closeChan <-chan struct{}) error {
+	if loops <= 0 {
+		loops = runtime.GOMAXPROCS(0)
+	}
+	p := &poller{
+		handler: handler,
+		loops:   make([]*eventLoop, 0, loops),
+	}
+	for i := 0; i < loops; i++ {
+		l, err := makeEventLoop(p)
+		if err != nil {
+			p.close()
+			closeListeners(listeners)
+			return err
+		}
+		p.loops = append(p.loops, l)
+	}
+	for _, l := range p.loops {
+		p.loopsDone.Add(1)
+		go func(l *eventLoop) {
+			defer p.loopsDone.Done()
+			l.run()
+		}(l)
+	}
+
+	go func() {
+		<-closeChan
+		logger.Info("shutting down")
+		closeListeners(listeners)
+	}()
+
+	acceptDone := new(sync.WaitGroup)
+	for _, listener := range listeners {
+		acceptDone.Add(1)
+		go func(listener net.Listener) {
+			defer acceptDone.Done()
+			p.accept(listener)
+			closeListeners(listeners)
+		}(listener)
+	}
+	acceptDone.Wait()
+	_ = handler.Close()
+	p.close()
+	return nil
+}
+
+type poller struct {
+	handler   tcp.EventHandler
+	loops     []*eventLoop
+	stopped   atomic.Boolean
+	loopsDone sync.WaitGroup
+	serving   sync.WaitGroup // 正在执行请求的协程
+}
+
+// accept 接受连接并轮流分配给各个事件循环，直到 listener 关闭
+func (p *poller) accept(listener net.Listener) {
+	next := 0
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		logger.Info("accepted link ", conn.RemoteAddr())
+		if err := p.loops[next].register(conn); err != nil {
+			logger.Warn("register connection failed: " + err.Error())
+		}
+		next = (next + 1) % len(p.loops)
+	}
+}
+
+// close 停止所有事件循环，等待正在执行的请求结束后关闭剩下的连接
+func (p *poller) close() {
+	p.stopped.Set(true)
+	p.loopsDone.Wait()
+	p.serving.Wait()
+	for _, l := range p.loops {
+		for _, c := range l.connections() {
+			_ = c.Close()
+		}
+		_ = syscall.Close(l.epfd)
+	}
+}
+
+type eventLoop struct {
+	poller *poller
+	epfd   int
+	buf    []byte // 读取数据的共用缓冲区，只在事件循环的协程中使用
+
+	mu    sync.Mutex
+	conns map[int]*pollConn
+}
+
+func makeEventLoop(p *poller) (*eventLoop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("epoll_create1", err)
+	}
+	return &eventLoop{
+		poller: p,
+		epfd:   epfd,
+		buf:    make([]byte, loopReadSize),
+		conns:  make(map[int]*pollConn),
+	}, nil
+}
+
+// register 复制 conn 的 fd 后关闭 conn，之后由事件循环读写复制的 fd
+func (l *eventLoop) register(conn net.Conn) error {
+	defer conn.Close()
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("unsupported connection type")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	fd := -1
+	var dupErr error
+	err = raw.Control(func(s uintptr) {
+		fd, dupErr = syscall.Dup(int(s))
+	})
+	if err == nil {
+		err = dupErr
+	}
+	if err != nil {
+		return os.NewSyscallError("dup", err)
+	}
+	syscall.CloseOnExec(fd)
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return os.NewSyscallError("setnonblock", err)
+	}
+
+	c := &pollConn{
+		fd:         fd,
+		loop:       l,
+		localAddr:  conn.LocalAddr(),
+		remoteAddr: conn.RemoteAddr(),
+	}
+	session := l.poller.handler.Open(c)
+	if session == nil {
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		return syscall.Close(fd)
+	}
+	c.session = session
+	// 加入 conns 之后事件循环才能找到这个连接，session 在此之前赋值
+	l.mu.Lock()
+	l.conns[fd] = c
+	l.mu.Unlock()
+	event := syscall.EpollEvent{Events: connEvents, Fd: int32(fd)}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+		session.Close()
+		return os.NewSyscallError("epoll_ctl", err)
+	}
+	return nil
+}
+
+func (l *eventLoop) run() {
+	events := make([]syscall.EpollEvent, maxEvents)
+	for !l.poller.stopped.Get() {
+		n, err := syscall.EpollWait(l.epfd, events, pollTimeout)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			logger.Error("epoll_wait failed: " + err.Error())
+			return
+		}
+		for i := 0; i < n; i++ {
+			l.mu.Lock()
+			c := l.conns[int(events[i].Fd)]
+			l.mu.Unlock()
+			if c != nil {
+				l.handle(c)
+			}
+		}
+	}
+}
+
+// handle 连接可读时读取数据并解析，有完整的请求时在新的协程中执行
+func (l *eventLoop) handle(c *pollConn) {
+	if !c.acquire() {
+		return
+	}
+	data, eof := l.read(c)
+	consumed, ready := c.session.Feed(data)
+	c.keep(data[consumed:])
+	if ready {
+		// 引用计数交给执行请求的协程释放
+		l.poller.serving.Add(1)
+		go func() {
+			defer l.poller.serving.Done()
+			defer c.release()
+			if err := c.session.Serve(); err != nil || eof {
+				c.session.Close()
+				return
+			}
+			l.rearm(c)
+		}()
+		return
+	}
+	defer c.release()
+	if eof {
+		c.session.Close()
+		return
+	}
+	l.rearm(c)
+}
+
+// read 读取一次连接上的数据，返回连同之前不完整的请求在内的所有待解析的数据
+// 一次只读一次，剩下的数据在重新监听之后再次触发可读事件，避免一个连接独占事件循环
+func (l *eventLoop) read(c *pollConn) ([]byte, bool) {
+	buf := l.buf
+	if len(c.in) > 0 {
+		if cap(c.in)-len(c.in) < loopReadSize {
+			grown := make([]byte, len(c.in), 2*cap(c.in)+loopReadSize)
+			copy(grown, c.in)
+			c.in = grown
+		}
+		buf = c.in[len(c.in):cap(c.in)]
+	}
+	var n int
+	var err error
+	for {
+		n, err = syscall.Read(c.fd, buf)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	eof := false
+	if err != nil {
+		n = 0
+		eof = err != syscall.EAGAIN
+	} else if n == 0 {
+		eof = true
+	}
+	if len(c.in) > 0 {
+		c.in = c.in[:len(c.in)+n]
+		return c.in, eof
+	}
+	return buf[:n], eof
+}
+
+// rearm 重新监听可读事件，持有 c.mu 保证之后的事件中 acquire 能看到 Serve 写入的状态
+func (l *eventLoop) rearm(c *pollConn) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	event := syscall.EpollEvent{Events: connEvents, Fd: int32(c.fd)}
+	err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_MOD, c.fd, &event)
+	c.mu.Unlock()
+	if err != nil {
+		c.session.Close()
+	}
+}
+
+func (l *eventLoop) remove(c *pollConn) {
+	l.mu.Lock()
+	delete(l.conns, c.fd)
+	l.mu.Unlock()
+	_ = syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+}
+
+func (l *eventLoop) connections() []*pollConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	conns := make([]*pollConn, 0, len(l.conns))
+	for _, c := range l.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// pollConn 事件循环中的连接，实现 net.Conn 供 Session 写回复
+// Close 只 shutdown 连接，fd 在没有读写正在使用时才真正关闭，避免 fd 被新连接复用后写错连接
+type pollConn struct {
+	fd         int
+	loop       *eventLoop
+	session    tcp.Session
+	in         []byte // 不完整的请求，只在事件循环的协程中使用
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	mu            sync.Mutex
+	refs          int
+	closed        bool
+	writeDeadline time.Time
+}
+
+// keep 把尚未解析的数据 rest 保存到连接的读缓冲区
+func (c *pollConn) keep(rest []byte) {
+	switch {
+	case len(rest) == 0:
+		// 空闲的连接不保留读缓冲区
+		c.in = nil
+	case len(c.in) == 0:
+		// rest 在事件循环共用的缓冲区中
+		c.in = append(c.in, rest...)
+	default:
+		c.in = c.in[:copy(c.in, rest)]
+	}
+}
+
+func (c *pollConn) acquire() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.refs++
+	return true
+}
+
+func (c *pollConn) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refs--
+	if c.closed && c.refs == 0 {
+		c.destroy()
+	}
+}
+
+func (c *pollConn) destroy() {
+	c.loop.remove(c)
+	_ = syscall.Close(c.fd)
+}
+
+func (c *pollConn) Read(b []byte) (int, error) {
+	return 0, errors.New("read is driven by the event loop")
+}
+
+func (c *pollConn) Write(b []byte) (int, error) {
+	if !c.acquire() {
+		return 0, net.ErrClosed
+	}
+	defer c.release()
+	written := 0
+	for written < len(b) {
+		n, err := syscall.Write(c.fd, b[written:])
+		if n > 0 {
+			written += n
+		}
+		switch err {
+		case nil, syscall.EINTR:
+		case syscall.EAGAIN:
+			if err := c.waitWritable(); err != nil {
+				return written, err
+			}
+		default:
+			return written, os.NewSyscallError("write", err)
+		}
+	}
+	return written, nil
+}
+
+// waitWritable 等待连接可写，超过写超时返回 os.ErrDeadlineExceeded
+func (c *pollConn) waitWritable() error {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	for {
+		var ts *syscall.Timespec
+		if !deadline.IsZero() {
+			timeout := time.Until(deadline)
+			if timeout <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			t := syscall.NsecToTimespec(int64(timeout))
+			ts = &t
+		}
+		pfd := pollFd{fd: int32(c.fd), events: pollOut}
+		n, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1, uintptr(unsafe.Pointer(ts)), 0, 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return os.NewSyscallError("ppoll", errno)
+		}
+		if n > 0 {
+			return nil
+		}
+	}
+}
+
+// pollFd ppoll 的参数 struct pollfd
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+const pollOut = 0x4
+
+func (c *pollConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	// shutdown 唤醒正在等待可写的协程，fd 在最后一个引用释放时关闭
+	_ = syscall.Shutdown(c.fd, syscall.SHUT_RDWR)
+	if c.refs == 0 {
+		c.destroy()
+	}
+	return nil
+}
+
+func (c *pollConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *pollConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *pollConn) SetDeadline(t time.Time) error {
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline 读取由事件循环完成，没有读超时
+func (c *pollConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *pollConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package tcp
+
+import (
+	"errors"
+	"go-redis/interface/tcp"
+)
+
+func ListenAndServeWithEpoll(cfg *Config, handler tcp.EventHandler) error {
+	return errors.New("network-model epoll is only supported on linux")
+}
@@ -2,6 +2,8 @@ package tcp
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"go-redis/interface/tcp"
 	"go-redis/lib/logger"
 	"net"
@@ -9,60 +11,191 @@ import (
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 )
 
 type Config struct {
-	Address string
+	Address    string        // 为空时不监听普通连接
+	TLSAddress string        // 为空时不监听 TLS 连接
+	TLSConfig  *tls.Config   // 监听 TLSAddress 使用的证书
+	EventLoops int           // 使用 epoll 时事件循环的个数，不大于 0 时与 GOMAXPROCS 相同
+	KeepAlive  time.Duration // 接受的 TCP 连接的 keepalive 间隔，为 0 时关闭
+
+	UnixSocket     string      // 为空时不监听 unix socket
+	UnixSocketPerm os.FileMode // socket 文件的权限，为 0 时不修改
 }
 
-func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
+// tlsHandshakeTimeout TLS 握手的最长时间，超时的连接直接关闭，不交给 handler
+const tlsHandshakeTimeout = 10 * time.Second
+
+// notifyClose 收到退出信号时关闭返回的 channel
+func notifyClose() <-chan struct{} {
 	closeChan := make(chan struct{})
-	sigChan := make(chan os.Signal)
+	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	go func() {
-		sig := <-sigChan
-		switch sig {
-		case syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT:
-			closeChan <- struct{}{}
-		}
+		<-sigChan
+		close(closeChan)
 	}()
+	return closeChan
+}
 
-	listener, err := net.Listen("tcp", cfg.Address)
+// listenTLS 监听 cfg.TLSAddress，没有配置时返回 nil
+func listenTLS(cfg *Config) (net.Listener, error) {
+	if cfg.TLSAddress == "" {
+		return nil, nil
+	}
+	inner, err := listenTCP(cfg, cfg.TLSAddress)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	listener := tls.NewListener(inner, cfg.TLSConfig)
+	logger.Info("start tls listen at ", listener.Addr())
+	return listener, nil
+}
+
+// listenTCP 监听 address，接受的连接按 cfg.KeepAlive 设置 keepalive
+func listenTCP(cfg *Config, address string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: cfg.KeepAlive}
+	if cfg.KeepAlive <= 0 {
+		lc.KeepAlive = -1 // ListenConfig 中 0 表示使用默认的 15 秒，负数才是关闭
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// listen 监听普通端口和 unix socket，TLS 端口由 listenTLS 单独监听
+func listen(cfg *Config) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, 2)
+	if cfg.Address != "" {
+		listener, err := listenTCP(cfg, cfg.Address)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("start listen at ", listener.Addr())
+		listeners = append(listeners, listener)
 	}
-	logger.Info("start listen at ", listener.Addr())
-	ListenAndServe(listener, handler, closeChan)
+	if cfg.UnixSocket != "" {
+		listener, err := listenUnix(cfg.UnixSocket, cfg.UnixSocketPerm)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
 
+// listenUnix 监听 unix socket，listener 关闭时删除 socket 文件
+func listenUnix(path string, perm os.FileMode) (net.Listener, error) {
+	// 上次没有正常退出时会留下 socket 文件，只删除 socket，避免配置错误时删掉其它文件
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, errors.New(path + " exists and is not a unix socket")
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if perm != 0 {
+		if err := os.Chmod(path, perm); err != nil {
+			_ = listener.Close()
+			return nil, err
+		}
+	}
+	logger.Info("start listen at unix socket ", path)
+	return listener, nil
+}
+
+func ListenAndServeWithSignal(cfg *Config, handler tcp.Handler) error {
+	closeChan := notifyClose()
+	listeners, err := listen(cfg)
+	if err != nil {
+		return err
+	}
+	tlsListener, err := listenTLS(cfg)
+	if err != nil {
+		closeListeners(listeners)
+		return err
+	}
+	if tlsListener != nil {
+		listeners = append(listeners, tlsListener)
+	}
+	if len(listeners) == 0 {
+		return errors.New("no address to listen")
+	}
+	serve(listeners, handler, closeChan)
 	return nil
 }
 
 func ListenAndServe(listener net.Listener, handler tcp.Handler, closeChan <-chan struct{}) {
+	serve([]net.Listener{listener}, handler, closeChan)
+}
+
+// serve 在所有 listener 上接受连接，任意一个 listener 出错时全部关闭
+func serve(listeners []net.Listener, handler tcp.Handler, closeChan <-chan struct{}) {
 	go func() {
 		<-closeChan
 		logger.Info("shutting down")
-		listener.Close()
+		closeListeners(listeners)
 		handler.Close()
 	}()
 
 	defer func() {
-		listener.Close()
+		closeListeners(listeners)
 		handler.Close()
 	}()
 
-	ctx := context.Background()
 	waitDone := new(sync.WaitGroup)
+	acceptDone := new(sync.WaitGroup)
+	for _, listener := range listeners {
+		acceptDone.Add(1)
+		go func(listener net.Listener) {
+			defer acceptDone.Done()
+			acceptLoop(listener, handler, waitDone)
+			closeListeners(listeners)
+		}(listener)
+	}
+	acceptDone.Wait()
+	waitDone.Wait()
+}
+
+// acceptLoop 为每个连接启动一个协程，直到 listener 关闭
+func acceptLoop(listener net.Listener, handler tcp.Handler, waitDone *sync.WaitGroup) {
+	ctx := context.Background()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			break
+			return
 		}
 		logger.Info("accepted link ", conn.RemoteAddr())
 		waitDone.Add(1)
 		go func() {
 			defer waitDone.Done()
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				if err := handshake(ctx, tlsConn); err != nil {
+					logger.Warn("tls handshake with " + conn.RemoteAddr().String() + " failed: " + err.Error())
+					_ = conn.Close()
+					return
+				}
+			}
 			handler.Handle(ctx, conn)
 		}()
 	}
-	waitDone.Wait()
+}
+
+// handshake 在 tlsHandshakeTimeout 内完成握手，tls.NewListener 接受的连接默认在第一次读写时握手且没有超时
+func handshake(ctx context.Context, conn *tls.Conn) error {
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	return conn.HandshakeContext(ctx)
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
 }
@@ -0,0 +1,67 @@
+package tcp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnixRemovesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.sock")
+	// 上次没有正常退出时留下的 socket 文件
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatalf("stale socket not left behind: %v", err)
+	}
+
+	listener, err := listenUnix(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	_ = listener.Close()
+	// 关闭 listener 时删除 socket 文件
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file left after close: %v", err)
+	}
+}
+
+func TestListenUnixRefusesNonSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.conf")
+	if err := os.WriteFile(path, []byte("port 6379\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if listener, err := listenUnix(path, 0); err == nil {
+		_ = listener.Close()
+		t.Fatal("listenUnix replaced a regular file")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != "port 6379\n" {
+		t.Fatalf("regular file changed: %q, %v", data, err)
+	}
+}
+
+func TestListenUnixPerm(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "redis.sock")
+	listener, err := listenUnix(path, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Fatalf("socket permission = %o, want 700", perm)
+	}
+}